@@ -0,0 +1,95 @@
+// verify.go - Embedded asset verification.
+// Copyright (C) 2017  Yawning Angel.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package data
+
+import (
+	"fmt"
+	"runtime"
+	"strings"
+)
+
+// MissingAssetError is the error returned when an embedded asset can not be
+// loaded, which is almost always due to an incomplete build (Eg: the static
+// assets were not regenerated).
+type MissingAssetError struct {
+	// Name is the name of the asset.
+	Name string
+}
+
+// Error returns the string representation of a MissingAssetError.
+func (e *MissingAssetError) Error() string {
+	return fmt.Sprintf("data: embedded data asset %q missing, build incomplete", e.Name)
+}
+
+// Load loads and returns the embedded asset by name, like Asset, with a
+// MissingAssetError on failure.
+func Load(name string) ([]byte, error) {
+	b, err := Asset(name)
+	if err != nil {
+		return nil, &MissingAssetError{Name: name}
+	}
+	return b, nil
+}
+
+// requiredAssets returns the names of the assets that a complete build
+// embeds for the current architecture.
+func requiredAssets() []string {
+	assets := []string{
+		"bridges.json",
+		"extralibs.json",
+		"gtkrc-2.0",
+		"gtkrc-2.0-fallback",
+		"installer/0x4E2C6E8793298290.asc",
+		"installer/autoconfig.js",
+		"installer/hpkp.json",
+		"installer/mozilla.cfg",
+		"installer/release_primary.der",
+		"installer/release_primary_6.5.der",
+		"installer/release_secondary.der",
+		"installer/urls.json",
+		"loaders.cache",
+		"revision",
+		"tbb_stub.so",
+		"torrc",
+		"torrc-bridges",
+		"ui/channels.json",
+		"ui/default48.png",
+		"ui/gtkui.ui",
+		"ui/locales.json",
+		"ui/tbb-logo.png",
+		"version",
+	}
+	for _, v := range []string{"blacklist", "tor", "tor-common", "tor-obfs4", "torbrowser"} {
+		assets = append(assets, v+"-"+runtime.GOARCH+".seccomp")
+	}
+	return assets
+}
+
+// Verify checks that all of the embedded assets that are required at runtime
+// are present, and returns an error listing the ones that are missing.
+func Verify() error {
+	var missing []string
+	for _, name := range requiredAssets() {
+		if _, err := Asset(name); err != nil {
+			missing = append(missing, name)
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("data: embedded data assets missing, build incomplete: %v", strings.Join(missing, ", "))
+	}
+	return nil
+}
@@ -0,0 +1,116 @@
+// auxv.go - Auxiliary vector hwcap support.
+// Copyright (C) 2017  Yawning Angel.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package dynlib
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"runtime"
+
+	. "cmd/sandboxed-tor-browser/internal/utils"
+)
+
+const (
+	atNull   = 0
+	atHwcap  = 16
+	atHwcap2 = 26
+
+	// cacheHwcapIgnoredMask is the bits of a cache entry's hwcap that do not
+	// correspond to AT_HWCAP: the platform bits, the glibc-hwcaps extension
+	// and the TLS bit.
+	cacheHwcapIgnoredMask = 0xffff << 48
+)
+
+// hwcapMask is the host's hardware capabilities, as reported by the kernel
+// in the auxiliary vector.
+type hwcapMask struct {
+	hwcap  uint64
+	hwcap2 uint64
+	known  bool
+}
+
+// satisfies returns true iff the host supports all of the hwcap bits that a
+// cache entry requires.  If the host's hwcaps are unknown, all entries are
+// assumed to be usable.
+//
+// Only AT_HWCAP is considered, as the `ld.so.cache` has no notion of
+// AT_HWCAP2.
+func (m hwcapMask) satisfies(required uint64) bool {
+	required &^= cacheHwcapIgnoredMask
+	return !m.known || required&^m.hwcap == 0
+}
+
+func (m hwcapMask) String() string {
+	if !m.known {
+		return "unknown"
+	}
+	return fmt.Sprintf("%x (hwcap2: %x)", m.hwcap, m.hwcap2)
+}
+
+// hostHwcap is the host's hardware capabilities.
+var hostHwcap hwcapMask
+
+// checkCacheHwcap is true iff the legacy hwcap bits of `ld.so.cache` entries
+// are checked against hostHwcap.  HWCAP is unused on amd64, and glibc's
+// notion of it is synthesized rather than taken from AT_HWCAP, so it can't
+// be checked.  The legacy HWCAP subdirectories are unused on arm64, but
+// ld.so matches any that exist against AT_HWCAP.
+var checkCacheHwcap = runtime.GOARCH == "arm64"
+
+// auxvSource returns the raw auxiliary vector of the running process.
+var auxvSource = func() ([]byte, error) {
+	return ioutil.ReadFile("/proc/self/auxv")
+}
+
+// parseAuxv parses the AT_HWCAP and AT_HWCAP2 values out of a raw (64 bit
+// little endian) auxiliary vector.
+func parseAuxv(b []byte) (hwcapMask, error) {
+	const entrySz = 8 + 8
+
+	var m hwcapMask
+	for ; len(b) >= entrySz; b = b[entrySz:] {
+		k, v := binary.LittleEndian.Uint64(b[0:]), binary.LittleEndian.Uint64(b[8:])
+		switch k {
+		case atNull:
+			m.known = true
+			return m, nil
+		case atHwcap:
+			m.hwcap = v
+		case atHwcap2:
+			m.hwcap2 = v
+		}
+	}
+	return hwcapMask{}, fmt.Errorf("auxiliary vector is truncated")
+}
+
+func getHostHwcap() hwcapMask {
+	b, err := auxvSource()
+	if err != nil {
+		Debugf("dynlib: Failed to read the auxiliary vector: %v", err)
+		return hwcapMask{}
+	}
+	m, err := parseAuxv(b)
+	if err != nil {
+		Debugf("dynlib: Failed to parse the auxiliary vector: %v", err)
+	}
+	return m
+}
+
+func init() {
+	hostHwcap = getHostHwcap()
+}
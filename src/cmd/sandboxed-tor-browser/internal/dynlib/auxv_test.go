@@ -0,0 +1,141 @@
+// auxv_test.go - Auxiliary vector hwcap support tests.
+// Copyright (C) 2017  Yawning Angel.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package dynlib
+
+import (
+	"encoding/binary"
+	"errors"
+	"io/ioutil"
+	"testing"
+)
+
+// newExtCacheFixtureHwcapOffset is the offset of the hwcap field of the
+// `libfixture.so.1` entry in the fixture.
+const newExtCacheFixtureHwcapOffset = 48 + 16
+
+func buildAuxv(kvs ...uint64) []byte {
+	b := make([]byte, 8*len(kvs))
+	for i, v := range kvs {
+		binary.LittleEndian.PutUint64(b[8*i:], v)
+	}
+	return b
+}
+
+// mockAuxv replaces the auxiliary vector source, and recomputes hostHwcap
+// from it for the duration of the test.
+func mockAuxv(t *testing.T, b []byte, err error) {
+	oldSource, oldHwcap := auxvSource, hostHwcap
+	t.Cleanup(func() {
+		auxvSource, hostHwcap = oldSource, oldHwcap
+	})
+	auxvSource = func() ([]byte, error) { return b, err }
+	hostHwcap = getHostHwcap()
+}
+
+func TestParseAuxv(t *testing.T) {
+	for _, v := range []struct {
+		name     string
+		b        []byte
+		expected hwcapMask
+		ok       bool
+	}{
+		{"hwcap", buildAuxv(6, 4096, atHwcap, 0xff, atHwcap2, 0x3, atNull, 0), hwcapMask{0xff, 0x3, true}, true},
+		{"no hwcap", buildAuxv(6, 4096, atNull, 0), hwcapMask{0, 0, true}, true},
+		{"unterminated", buildAuxv(atHwcap, 0xff), hwcapMask{}, false},
+		{"truncated", buildAuxv(atHwcap, 0xff, atNull)[:20], hwcapMask{}, false},
+		{"empty", nil, hwcapMask{}, false},
+	} {
+		m, err := parseAuxv(v.b)
+		if (err == nil) != v.ok {
+			t.Errorf("%v: parseAuxv() = %v", v.name, err)
+		}
+		if m != v.expected {
+			t.Errorf("%v: parseAuxv() = %+v, expected %+v", v.name, m, v.expected)
+		}
+	}
+}
+
+func TestHwcapMaskSatisfies(t *testing.T) {
+	m := hwcapMask{hwcap: 0x5, known: true}
+	for _, v := range []struct {
+		mask     hwcapMask
+		required uint64
+		expected bool
+	}{
+		{m, 0, true},
+		{m, 0x1, true},
+		{m, 0x5, true},
+		{m, 0x2, false},
+		{m, 0x7, false},
+		{m, 0x1 | 1<<63, true}, // glibc-hwcaps extension bit.
+		{m, 0x1 | 1<<48, true}, // Platform bits.
+		{hwcapMask{}, 0x2, true},
+	} {
+		if ok := v.mask.satisfies(v.required); ok != v.expected {
+			t.Errorf("%v: satisfies(%x) = %v, expected %v", v.mask, v.required, ok, v.expected)
+		}
+	}
+}
+
+func TestGetHostHwcap(t *testing.T) {
+	mockAuxv(t, buildAuxv(atHwcap, 0x10, atNull, 0), nil)
+	if expected := (hwcapMask{0x10, 0, true}); hostHwcap != expected {
+		t.Errorf("getHostHwcap() = %+v, expected %+v", hostHwcap, expected)
+	}
+
+	mockAuxv(t, nil, errors.New("no auxv for you"))
+	if hostHwcap.known {
+		t.Errorf("getHostHwcap() = %+v, expected unknown", hostHwcap)
+	}
+}
+
+func TestLoadCacheHwcap(t *testing.T) {
+	if !IsSupported() {
+		t.Skip("dynlib is unsupported on this host")
+	}
+
+	oldCheck := checkCacheHwcap
+	defer func() { checkCacheHwcap = oldCheck }()
+	checkCacheHwcap = true
+
+	b, err := ioutil.ReadFile(newExtCacheFixture)
+	if err != nil {
+		t.Fatalf("failed to read fixture: %v", err)
+	}
+	binary.LittleEndian.PutUint64(b[newExtCacheFixtureHwcapOffset:], 0x8)
+	fn := writeCacheFixture(t, b)
+
+	for _, v := range []struct {
+		name     string
+		auxv     []byte
+		err      error
+		expected string
+	}{
+		{"available", buildAuxv(atHwcap, 0xc, atNull, 0), nil, "/proc/self/exe"},
+		{"unavailable", buildAuxv(atHwcap, 0x4, atNull, 0), nil, ""},
+		{"unknown", nil, errors.New("no auxv for you"), "/proc/self/exe"},
+	} {
+		mockAuxv(t, v.auxv, v.err)
+		c, err := loadCache(fn)
+		if err != nil {
+			t.Fatalf("%v: loadCache() = %v", v.name, err)
+		}
+		if p := c.GetLibraryPath("libfixture.so.1"); p != v.expected {
+			t.Errorf("%v: GetLibraryPath(libfixture.so.1) = '%v', expected '%v'", v.name, p, v.expected)
+		}
+	}
+}
@@ -23,9 +23,11 @@ import (
 	"encoding/binary"
 	"fmt"
 	"io/ioutil"
+	"os"
 	"path/filepath"
 	"runtime"
 	"sort"
+	"strings"
 
 	. "cmd/sandboxed-tor-browser/internal/utils"
 )
@@ -33,11 +35,79 @@ import (
 const (
 	ldSoCache = "/etc/ld.so.cache"
 
-	flagX8664Lib64 = 0x0300
-	flagElf        = 1
-	flagElfLibc6   = 3
+	cacheExtensionMagic          = 0xeaa42174
+	cacheExtensionTagGenerator   = 0
+	cacheExtensionTagGlibcHwcaps = 1
 )
 
+// The `ld.so.cache` entry flags.  The low byte is the library type, and the
+// next byte is the architecture specific requirements.
+const (
+	FlagElf          = 0x0001
+	FlagElfLibc6     = 0x0003
+	FlagX8664Lib64   = 0x0300
+	FlagAArch64Lib64 = 0x0a00
+
+	flagTypeMask     = 0x00ff
+	flagRequiredMask = 0xff00
+)
+
+var flagTypeNames = map[uint32]string{
+	FlagElf:      "elf",
+	FlagElfLibc6: "libc6",
+}
+
+var flagRequiredNames = map[uint32]string{
+	FlagX8664Lib64:   "x86-64",
+	FlagAArch64Lib64: "aarch64",
+}
+
+// FlagString returns a human readable representation of the `ld.so.cache`
+// entry flags (Eg: "libc6,x86-64").  Unknown values are rendered in hex.
+func FlagString(flags uint32) string {
+	var s []string
+	if t := flags & flagTypeMask; flagTypeNames[t] != "" {
+		s = append(s, flagTypeNames[t])
+	} else {
+		s = append(s, fmt.Sprintf("unknown-type:%#x", t))
+	}
+	if r := flags & flagRequiredMask; r == 0 {
+		// No architecture specific requirements.
+	} else if flagRequiredNames[r] != "" {
+		s = append(s, flagRequiredNames[r])
+	} else {
+		s = append(s, fmt.Sprintf("unknown-arch:%#x", r))
+	}
+	if u := flags &^ (flagTypeMask | flagRequiredMask); u != 0 {
+		s = append(s, fmt.Sprintf("unknown:%#x", u))
+	}
+	return strings.Join(s, ",")
+}
+
+// cacheFlagCheck returns a function that returns true iff a cache entry
+// with the flags is a libc6 library for goarch, or nil if goarch is
+// unsupported.  The architecture requirements are an enumeration rather
+// than a bit field, so they are compared exactly, like ld.so does.
+func cacheFlagCheck(goarch string) func(uint32) bool {
+	var wantRequired uint32
+	switch goarch {
+	case "amd64":
+		wantRequired = FlagX8664Lib64
+	case "arm64":
+		wantRequired = FlagAArch64Lib64
+	default:
+		return nil
+	}
+	return func(flags uint32) bool {
+		return flags&flagTypeMask == FlagElfLibc6 && flags&flagRequiredMask == wantRequired
+	}
+}
+
+var cacheMagicNew = []byte{
+	'g', 'l', 'i', 'b', 'c', '-', 'l', 'd', '.', 's', 'o', '.', 'c', 'a', 'c',
+	'h', 'e', '1', '.', '1',
+}
+
 // FilterFunc is a function that implements a filter to allow rejecting
 // dependencies when resolving libraries.
 type FilterFunc func(string) error
@@ -63,15 +133,35 @@ type FilterFunc func(string) error
 //   string 1
 //   string 2
 //   ...
+//
+// glibc 2.32 and later omit the old format entirely, and glibc 2.33 and later
+// append an extension directory to the end of the file, that is located via
+// the new format header.
 
 // Cache is a representation of the `ld.so.cache` file.
 type Cache struct {
-	store map[string]cacheEntries
+	store      map[string]cacheEntries
+	extensions map[uint32][]byte
+	confDirs   []string
+	mtime      int64
+
+	resolveCachePath    string
+	resolveCacheVersion string
+
+	skipMissingBinaries bool
+}
+
+// SetSkipMissingBinaries sets if ResolveLibraries should skip binaries that
+// do not exist with a warning, instead of failing.  Missing libraries are
+// always an error.  The skipped binaries are recorded in the result.
+func (c *Cache) SetSkipMissingBinaries(b bool) {
+	c.skipMissingBinaries = b
 }
 
-// GetLibraryPath returns the path to the given library, if any.  This routine
-// makes no attempt to disambiguate multiple libraries (eg: via hwcap/search
-// path).
+// GetLibraryPath returns the path to the given library, if any.  Libraries
+// that the host can not use (eg: due to hwcap) are excluded when the cache is
+// loaded, but this routine makes no further attempt to disambiguate multiple
+// libraries (eg: via search path).
 func (c *Cache) GetLibraryPath(name string) string {
 	ents, ok := c.store[name]
 	if !ok {
@@ -81,18 +171,66 @@ func (c *Cache) GetLibraryPath(name string) string {
 	return ents[0].value
 }
 
-// ResolveLibraries returns a map of library paths and their aliases for a
-// given set of binaries, based off the ld.so.cache, libraries known to be
-// internal, and a search path.
-func (c *Cache) ResolveLibraries(binaries []string, extraLibs []string, ldLibraryPath, fallbackSearchPath string, filterFn FilterFunc) (map[string][]string, error) {
+// ResolveLibraries returns the libraries and their aliases for a given set of
+// binaries, based off the ld.so.cache, libraries known to be internal, and a
+// search path.  Extra libraries may either be sonames, or absolute paths that
+// are used without searching (See ParseLdPreload for `LD_PRELOAD`).  An
+// *AliasConflictError is returned if an alias resolves to more than one
+// distinct library.
+//
+// Libraries found via ldLibraryPath are returned separately in LdLibraryPath
+// (See Libraries.LdLibraryPathDirs), as the caller is responsible for
+// ensuring that they are present in the sandbox.
+func (c *Cache) ResolveLibraries(binaries []string, extraLibs []string, ldLibraryPath, fallbackSearchPath string, filterFn FilterFunc) (*Libraries, error) {
+	cacheKey := resolveCacheKey(binaries, extraLibs, ldLibraryPath, fallbackSearchPath, c.confDirs)
+	if libs := c.getCachedLibraries(cacheKey, binaries, filterFn); libs != nil {
+		Debugf("dynlib: Using cached libraries for: %v", binaries)
+		return libs, nil
+	}
+
 	searchPaths := filepath.SplitList(ldLibraryPath)
 	fallbackSearchPaths := filepath.SplitList(fallbackSearchPath)
 	libraries := make(map[string]string)
+	ldPathLibs := make(map[string]string)
 
 	// Breadth-first iteration of all the binaries, and their dependencies.
 	checkedFile := make(map[string]bool)
 	checkedLib := make(map[string]bool)
-	toCheck := binaries
+	toCheck := make([]string, 0, len(binaries))
+	var skipped []string
+	for _, fn := range binaries {
+		if c.skipMissingBinaries && !FileExists(fn) {
+			Warnf("dynlib: Skipping missing binary: %v", fn)
+			skipped = append(skipped, fn)
+			continue
+		}
+		toCheck = append(toCheck, fn)
+	}
+
+	// Extra libraries specified by absolute path (Eg: bundle internal
+	// libraries) are used as is, and take precedence over any library with
+	// the same name that would be found by searching.
+	var extraSonames []string
+	for _, lib := range extraLibs {
+		if !filepath.IsAbs(lib) {
+			extraSonames = append(extraSonames, lib)
+			continue
+		}
+		if !FileExists(lib) {
+			return nil, &MissingLibraryError{Library: lib, RequiredBy: "extra libraries"}
+		}
+		dir, alias := filepath.Split(lib)
+		Debugf("dynlib: Found %v (Absolute).", lib)
+		if !isInDirs(filepath.Clean(dir), searchPaths) {
+			libraries[alias] = lib
+		} else {
+			ldPathLibs[alias] = lib
+		}
+		checkedLib[alias] = true
+		toCheck = append(toCheck, lib)
+	}
+	extraLibs = extraSonames
+
 	for {
 		newToCheck := make(map[string]bool)
 		if len(toCheck) == 0 {
@@ -104,26 +242,51 @@ func (c *Cache) ResolveLibraries(binaries []string, extraLibs []string, ldLibrar
 					return nil, err
 				}
 			}
+		}
 
-			impLibs, err := getLibraries(fn)
-			if err != nil {
-				return nil, err
+		// Parsing the ELF headers is the expensive part, so do an entire
+		// layer at a time concurrently.  The results are processed in
+		// order, so nothing else needs to be synchronized.
+		deps := getLayerDependencies(toCheck)
+		for idx, fn := range toCheck {
+			if deps[idx].err != nil {
+				return nil, deps[idx].err
 			}
+			impLibs := deps[idx].libs
 			Debugf("dynlib: %v imports: %v", fn, impLibs)
 			checkedFile[fn] = true
 
+			// The program interpreter is not in the imported libraries,
+			// but is required to run the binary at all.
+			if interp := deps[idx].interp; interp != "" {
+				_, alias := filepath.Split(interp)
+				if !checkedLib[alias] {
+					if !FileExists(interp) {
+						return nil, &MissingLibraryError{Library: interp, RequiredBy: fn}
+					}
+					Debugf("dynlib: Found %v (PT_INTERP).", interp)
+					libraries[alias] = interp
+					checkedLib[alias] = true
+				}
+			}
+
 			// The internal libraries also need recursive resolution,
 			// so just append them to the first binary.
+			nImported := len(impLibs)
 			if extraLibs != nil {
 				Debugf("dynlib: Appending extra libs: %v", extraLibs)
 				impLibs = append(impLibs, extraLibs...)
 				extraLibs = nil
 			}
 
-			for _, lib := range impLibs {
+			for i, lib := range impLibs {
 				if checkedLib[lib] {
 					continue
 				}
+				requiredBy := fn
+				if i >= nImported {
+					requiredBy = "extra libraries"
+				}
 
 				isInPath := func(l string, p []string) string {
 					for _, d := range p {
@@ -137,15 +300,26 @@ func (c *Cache) ResolveLibraries(binaries []string, extraLibs []string, ldLibrar
 
 				// Look for the library in the various places.
 				var libPath string
-				var inLdLibraryPath, inCache, inFallbackPath bool
+				var inLdLibraryPath, inCache, inConfDir, inFallbackPath bool
 				if libPath = isInPath(lib, searchPaths); libPath != "" {
 					inLdLibraryPath = true
 				} else if libPath = c.GetLibraryPath(lib); libPath != "" {
 					inCache = true
+				} else if libPath = c.getConfDirLibraryPath(lib); libPath != "" {
+					// The cache can be stale (Eg: a library was installed,
+					// but ldconfig was not re-run).
+					inConfDir = true
 				} else if libPath = isInPath(lib, fallbackSearchPaths); libPath != "" {
 					inFallbackPath = true
 				} else {
-					return nil, fmt.Errorf("dynlib: Failed to find library: %v", lib)
+					return nil, &MissingLibraryError{Library: lib, RequiredBy: requiredBy}
+				}
+
+				// glibc 2.33 and later prefer an optimized variant of the
+				// library in a glibc-hwcaps subdirectory if the CPU
+				// supports it, and the cache may be stale.
+				if !inLdLibraryPath {
+					libPath = findHwcapsVariant(lib, libPath)
 				}
 
 				var libSrc string
@@ -153,6 +327,8 @@ func (c *Cache) ResolveLibraries(binaries []string, extraLibs []string, ldLibrar
 				case inLdLibraryPath:
 					libSrc = "LD_LIBRARY_PATH"
 				case inCache:
+					libSrc = "ld.so.cache"
+				case inConfDir:
 					libSrc = "ld.so.conf"
 				case inFallbackPath:
 					libSrc = "Filesystem"
@@ -163,6 +339,8 @@ func (c *Cache) ResolveLibraries(binaries []string, extraLibs []string, ldLibrar
 				// presumably be `LD_LIBRARY_PATH` inside the hugbox.
 				if !inLdLibraryPath {
 					libraries[lib] = libPath
+				} else {
+					ldPathLibs[lib] = libPath
 				}
 				checkedLib[lib] = true
 
@@ -175,31 +353,40 @@ func (c *Cache) ResolveLibraries(binaries []string, extraLibs []string, ldLibrar
 		for k, _ := range newToCheck {
 			toCheck = append(toCheck, k)
 		}
+		sort.Strings(toCheck)
 	}
 
 	// De-dup the libraries map by figuring out what can be symlinked.
-	ret := make(map[string][]string)
+	ret := newLibraries()
+	ret.Skipped = skipped
+	if len(ldPathLibs) > 0 {
+		ret.LdLibraryPath = ldPathLibs
+	}
 	for lib, fn := range libraries {
-		f, err := filepath.EvalSymlinks(fn)
-		if err != nil {
+		if err := ret.add(lib, fn); err != nil {
 			return nil, err
 		}
-
-		vec := ret[f]
-		vec = append(vec, lib)
-		ret[f] = vec
 	}
-
-	// XXX: This should sanity check to ensure that aliases are distinct.
+	c.putCachedLibraries(cacheKey, ret)
 
 	return ret, nil
 }
 
+func isInDirs(dir string, dirs []string) bool {
+	for _, d := range dirs {
+		if filepath.Clean(d) == dir {
+			return true
+		}
+	}
+	return false
+}
+
 type cacheEntry struct {
-	key, value string
-	flags      uint32
-	osVersion  uint32
-	hwcap      uint64
+	key, value     string
+	flags          uint32
+	osVersion      uint32
+	hwcap          uint64
+	hwcapsPriority int
 }
 
 type cacheEntries []*cacheEntry
@@ -209,17 +396,18 @@ func (e cacheEntries) Len() int {
 }
 
 func (e cacheEntries) Less(i, j int) bool {
-	// Bigger hwcap should come first.
-	if e[i].hwcap > e[j].hwcap {
-		return true
+	// The best glibc-hwcaps subdirectory should come first.
+	if e[i].hwcapsPriority != e[j].hwcapsPriority {
+		return e[i].hwcapsPriority > e[j].hwcapsPriority
 	}
-	// Bigger osVersion should come first.
-	if e[i].osVersion > e[j].osVersion {
-		return true
+
+	// Bigger hwcap should come first.
+	if e[i].hwcap != e[j].hwcap {
+		return e[i].hwcap > e[j].hwcap
 	}
 
-	// Preserve the ordering otherwise.
-	return i < j
+	// Bigger osVersion should come first.
+	return e[i].osVersion > e[j].osVersion
 }
 
 func (e cacheEntries) Swap(i, j int) {
@@ -235,6 +423,11 @@ func getNewLdCache(b []byte) ([]byte, int, error) {
 		'l', 'd', '.', 's', 'o', '-', '1', '.', '7', '.', '0', 0,
 	}
 
+	// glibc >= 2.32 defaults to only writing the new format.
+	if bytes.HasPrefix(b, cacheMagicNew) {
+		return b, 0, nil
+	}
+
 	// old_magic
 	if !bytes.HasPrefix(b, cacheMagic) {
 		return nil, 0, fmt.Errorf("dynlib: ld.so.cache has invalid old_magic")
@@ -266,24 +459,70 @@ func getNewLdCache(b []byte) ([]byte, int, error) {
 	return b[padLen:], nlibs, nil
 }
 
+// loadExtensions parses the extension directory located at offset off of the
+// new format cache b.
+//
+// See `struct cache_extension` in `sysdeps/generic/dl-cache.h`.
+func (c *Cache) loadExtensions(b []byte, off int) error {
+	const sectionSz = 4 + 4 + 4 + 4
+
+	if off < 0 || off+8 > len(b) {
+		return fmt.Errorf("extension offset out of bounds")
+	}
+	ext := b[off:]
+	if binary.LittleEndian.Uint32(ext) != cacheExtensionMagic {
+		return fmt.Errorf("invalid extension magic")
+	}
+	count := int(binary.LittleEndian.Uint32(ext[4:]))
+	ext = ext[8:]
+	if count < 0 || len(ext)/sectionSz < count {
+		return fmt.Errorf("extension directory truncated")
+	}
+
+	c.extensions = make(map[uint32][]byte)
+	for i := 0; i < count; i++ {
+		rawS := ext[sectionSz*i : sectionSz*(i+1)]
+		tag := binary.LittleEndian.Uint32(rawS[0:])
+		sOff := int(binary.LittleEndian.Uint32(rawS[8:]))
+		sSize := int(binary.LittleEndian.Uint32(rawS[12:]))
+		if sOff < 0 || sSize < 0 || sOff+sSize > len(b) || sOff+sSize < sOff {
+			return fmt.Errorf("extension section %d out of bounds", tag)
+		}
+		c.extensions[tag] = b[sOff : sOff+sSize]
+	}
+	return nil
+}
+
 // LoadCache loads and parses the `ld.so.cache` file.
 //
 // See `sysdeps/generic/dl-cache.h` in the glibc source tree for details
 // regarding the format.
 func LoadCache() (*Cache, error) {
-	const entrySz = 4 + 4 + 4 + 4 + 8
-
-	if !IsSupported() {
-		return nil, errUnsupported
+	if ok, reason := SupportInfo(); !ok {
+		return nil, fmt.Errorf("dynlib: %v", reason)
 	}
 
+	return loadCache(ldSoCache)
+}
+
+func loadCache(path string) (*Cache, error) {
+	const entrySz = 4 + 4 + 4 + 4 + 8
+
 	ourOsVersion := getOsVersion()
-	Debugf("dynlib: osVersion: %08x", ourOsVersion)
+	Debugf("dynlib: osVersion: %08x (%v)", ourOsVersion, formatOsVersion(ourOsVersion))
+	Debugf("dynlib: glibc-hwcaps: %v", supportedHwcaps)
+	Debugf("dynlib: hwcap: %v", hostHwcap)
 
 	c := new(Cache)
 	c.store = make(map[string]cacheEntries)
 
-	b, err := ioutil.ReadFile(ldSoCache)
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	c.mtime = fi.ModTime().UnixNano()
+
+	b, err := ioutil.ReadFile(path)
 	if err != nil {
 		return nil, err
 	}
@@ -297,50 +536,59 @@ func LoadCache() (*Cache, error) {
 	stringTable := b
 
 	// new_magic.
-	cacheMagicNew := []byte{
-		'g', 'l', 'i', 'b', 'c', '-', 'l', 'd', '.', 's', 'o', '.', 'c', 'a', 'c',
-		'h', 'e', '1', '.', '1',
-	}
 	if !bytes.HasPrefix(b, cacheMagicNew) {
 		return nil, fmt.Errorf("dynlib: ld.so.cache has invalid new_magic")
 	}
 	b = b[len(cacheMagicNew):]
 
-	// nlibs, len_strings, unused[].
+	// nlibs, len_strings, flags, padding[3], extension_offset, unused[3].
 	if len(b) < 2*4+5*4 {
 		return nil, fmt.Errorf("dynlib: ld.so.cache truncated (new header)")
 	}
 	nlibs := int(binary.LittleEndian.Uint32(b))
 	b = b[4:]
 	lenStrings := int(binary.LittleEndian.Uint32(b))
-	b = b[4+20:] // Also skip unused[].
+	b = b[4:]
+	extOffset := int(binary.LittleEndian.Uint32(b[4:]))
+	b = b[20:] // Also skip flags, padding[], and unused[].
+	if len(b) < nlibs*entrySz {
+		return nil, fmt.Errorf("dynlib: ld.so.cache truncated (libs[])")
+	}
 	rawLibs := b[:nlibs*entrySz]
 	b = b[len(rawLibs):]
-	if len(b) != lenStrings {
+	if len(b) < lenStrings {
 		return nil, fmt.Errorf("dynlib: lenStrings appears invalid")
 	}
 
+	// The extension directory is purely informational for now, so failing
+	// to parse it is not fatal.
+	if extOffset != 0 {
+		if err = c.loadExtensions(stringTable, extOffset); err != nil {
+			Warnf("dynlib: ignoring ld.so.cache extensions: %v", err)
+		} else if gen, ok := c.extensions[cacheExtensionTagGenerator]; ok {
+			Debugf("dynlib: ld.so.cache generator: %v", string(gen))
+		}
+	}
+
+	c.confDirs = loadLdSoConf(ldSoConf)
+	Debugf("dynlib: ld.so.conf directories: %v", c.confDirs)
+
 	getString := func(idx int) (string, error) {
 		if idx < 0 || idx > len(stringTable) {
 			return "", fmt.Errorf("dynlib: string table index out of bounds")
 		}
 		l := bytes.IndexByte(stringTable[idx:], 0)
-		if l == 0 {
+		if l < 0 {
+			return "", fmt.Errorf("dynlib: string table entry is unterminated")
+		} else if l == 0 {
 			return "", nil
 		}
 		return string(stringTable[idx : idx+l]), nil
 	}
 
 	// libs[]
-	var flagCheckFn func(uint32) bool
-	switch runtime.GOARCH {
-	case "amd64":
-		flagCheckFn = func(flags uint32) bool {
-			const wantFlags = flagX8664Lib64 | flagElfLibc6
-			return flags&wantFlags == wantFlags
-		}
-		// HWCAP is unused on amd64.
-	default:
+	flagCheckFn := cacheFlagCheck(runtime.GOARCH)
+	if flagCheckFn == nil {
 		panic(errUnsupported)
 	}
 
@@ -363,10 +611,25 @@ func LoadCache() (*Cache, error) {
 			return nil, fmt.Errorf("dynlib: failed to query value: %v", err)
 		}
 
+		// Libraries in glibc-hwcaps subdirectories are only usable if the
+		// CPU supports the subdirectory's feature level, and libraries in
+		// legacy hwcap subdirectories if the CPU has all of the hwcap bits.
+		if name, ok := c.getHwcapsName(e.hwcap, stringTable); ok {
+			if e.hwcapsPriority = hwcapsPriority(name); e.hwcapsPriority == 0 {
+				Debugf("dynlib: ignoring library: %v (unsupported glibc-hwcaps: '%v')", e.value, name)
+				continue
+			}
+		} else if checkCacheHwcap && !hostHwcap.satisfies(e.hwcap) {
+			Debugf("dynlib: ignoring library: %v (unsupported hwcap: %x)", e.value, e.hwcap)
+			continue
+		}
+
 		// Discard libraries we have no hope of using, either due to
 		// osVersion, or hwcap.
 		if ourOsVersion < e.osVersion {
-			Debugf("dynlib: ignoring library: %v (osVersion: %x)", e.key, e.osVersion)
+			// ld.so will skip these as well, so picking one would result in
+			// a library the running kernel can't support.
+			Warnf("dynlib: ignoring library: %v (requires kernel %v, running %v)", e.value, formatOsVersion(e.osVersion), formatOsVersion(ourOsVersion))
 		} else if err = ValidateLibraryClass(e.value); err != nil {
 			Debugf("dynlib: ignoring library %v (%v)", e.key, err)
 		} else if flagCheckFn(e.flags) {
@@ -374,7 +637,7 @@ func LoadCache() (*Cache, error) {
 			vec = append(vec, e)
 			c.store[e.key] = vec
 		} else {
-			Debugf("dynlib: ignoring library: %v (flags: %x, hwcap: %x)", e.key, e.flags, e.hwcap)
+			Debugf("dynlib: ignoring library: %v (flags: %v, hwcap: %x)", e.key, FlagString(e.flags), e.hwcap)
 		}
 	}
 
@@ -384,13 +647,13 @@ func LoadCache() (*Cache, error) {
 		}
 
 		// Sort the entires in order of prefernce similar to what ld-linux.so
-		// will do.
-		sort.Sort(entries)
+		// will do, preserving the cache ordering otherwise.
+		sort.Stable(entries)
 		c.store[lib] = entries
 
 		paths := []string{}
 		for _, e := range entries {
-			paths = append(paths, e.value)
+			paths = append(paths, fmt.Sprintf("%v (%v)", e.value, FlagString(e.flags)))
 		}
 
 		Debugf("dynlib: debug: Multiple entry: %v: %v", lib, paths)
@@ -0,0 +1,236 @@
+// cache_test.go - Dynamic linker cache tests.
+// Copyright (C) 2016  Yawning Angel.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package dynlib
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+// newExtCacheFixture is a new format only `ld.so.cache` (glibc >= 2.32)
+// with an extension directory (glibc >= 2.33), containing a generator
+// section.  It has two entries, `libfixture.so.1` which resolves to the
+// running test binary (so that the ELF class check passes), and
+// `libmissing.so.2` which does not exist.
+const newExtCacheFixture = "testdata/ld.so.cache-new-ext"
+
+// newExtCacheFixtureExtOffset is the offset of the extension directory in
+// the fixture.
+const newExtCacheFixtureExtOffset = 176
+
+func writeCacheFixture(t *testing.T, b []byte) string {
+	fn := filepath.Join(t.TempDir(), "ld.so.cache")
+	if err := ioutil.WriteFile(fn, b, 0600); err != nil {
+		t.Fatalf("failed to write cache: %v", err)
+	}
+	return fn
+}
+
+func TestLoadCacheNewFormatExtensions(t *testing.T) {
+	if !IsSupported() {
+		t.Skip("dynlib is unsupported on this host")
+	}
+
+	c, err := loadCache(newExtCacheFixture)
+	if err != nil {
+		t.Fatalf("loadCache() = %v", err)
+	}
+	if p := c.GetLibraryPath("libfixture.so.1"); p != "/proc/self/exe" {
+		t.Errorf("GetLibraryPath(libfixture.so.1) = '%v'", p)
+	}
+	if p := c.GetLibraryPath("libmissing.so.2"); p != "" {
+		t.Errorf("GetLibraryPath(libmissing.so.2) = '%v', expected it to be ignored", p)
+	}
+	if gen := string(c.extensions[cacheExtensionTagGenerator]); gen != "ldconfig (fixture)" {
+		t.Errorf("generator extension = '%v'", gen)
+	}
+}
+
+func TestLoadCacheBadExtensions(t *testing.T) {
+	if !IsSupported() {
+		t.Skip("dynlib is unsupported on this host")
+	}
+
+	b, err := ioutil.ReadFile(newExtCacheFixture)
+	if err != nil {
+		t.Fatalf("failed to read fixture: %v", err)
+	}
+
+	// A corrupted extension directory is not fatal.
+	corrupt := append([]byte{}, b...)
+	binary.LittleEndian.PutUint32(corrupt[newExtCacheFixtureExtOffset:], 0xdeadbeef)
+	c, err := loadCache(writeCacheFixture(t, corrupt))
+	if err != nil {
+		t.Fatalf("loadCache(bad extension magic) = %v", err)
+	}
+	if c.extensions != nil {
+		t.Errorf("extensions parsed despite the bad magic")
+	}
+	if p := c.GetLibraryPath("libfixture.so.1"); p != "/proc/self/exe" {
+		t.Errorf("GetLibraryPath(libfixture.so.1) = '%v'", p)
+	}
+
+	// Neither is a truncated one.
+	if _, err = loadCache(writeCacheFixture(t, b[:newExtCacheFixtureExtOffset+4])); err != nil {
+		t.Errorf("loadCache(truncated extensions) = %v", err)
+	}
+
+	// But a truncated entry table is.
+	if _, err = loadCache(writeCacheFixture(t, b[:64])); err == nil {
+		t.Errorf("loadCache(truncated libs) succeeded")
+	}
+}
+
+// testCacheEntry is an entry in a synthetic `ld.so.cache`.
+type testCacheEntry struct {
+	flags      uint32
+	key, value string
+	hwcap      uint64
+}
+
+// buildNewCache returns a synthetic new format only `ld.so.cache`, with a
+// glibc-hwcaps extension section listing hwcaps, if any.
+func buildNewCache(entries []testCacheEntry, hwcaps ...string) []byte {
+	const (
+		headerSz  = 20 + 4 + 4 + 4 + 4 + 3*4
+		entrySz   = 4 + 4 + 4 + 4 + 8
+		sectionSz = 4 + 4 + 4 + 4
+	)
+
+	var strs bytes.Buffer
+	strsOff := headerSz + entrySz*len(entries)
+	addString := func(s string) uint32 {
+		off := strsOff + strs.Len()
+		strs.WriteString(s)
+		strs.WriteByte(0)
+		return uint32(off)
+	}
+
+	b := make([]byte, strsOff)
+	copy(b, cacheMagicNew)
+	binary.LittleEndian.PutUint32(b[20:], uint32(len(entries)))
+	for i, e := range entries {
+		rawE := b[headerSz+entrySz*i:]
+		binary.LittleEndian.PutUint32(rawE[0:], e.flags)
+		binary.LittleEndian.PutUint32(rawE[4:], addString(e.key))
+		binary.LittleEndian.PutUint32(rawE[8:], addString(e.value))
+		binary.LittleEndian.PutUint64(rawE[16:], e.hwcap)
+	}
+	var hwcapsOffs []uint32
+	for _, v := range hwcaps {
+		hwcapsOffs = append(hwcapsOffs, addString(v))
+	}
+	binary.LittleEndian.PutUint32(b[24:], uint32(strs.Len()))
+	b = append(b, strs.Bytes()...)
+	if len(hwcaps) == 0 {
+		return b
+	}
+
+	extOff := len(b)
+	binary.LittleEndian.PutUint32(b[32:], uint32(extOff))
+	ext := make([]byte, 8+sectionSz, 8+sectionSz+4*len(hwcaps))
+	binary.LittleEndian.PutUint32(ext[0:], cacheExtensionMagic)
+	binary.LittleEndian.PutUint32(ext[4:], 1)
+	binary.LittleEndian.PutUint32(ext[8:], cacheExtensionTagGlibcHwcaps)
+	binary.LittleEndian.PutUint32(ext[16:], uint32(extOff+len(ext)))
+	binary.LittleEndian.PutUint32(ext[20:], uint32(4*len(hwcaps)))
+	for _, off := range hwcapsOffs {
+		ext = binary.LittleEndian.AppendUint32(ext, off)
+	}
+	return append(b, ext...)
+}
+
+func TestCacheFlagCheck(t *testing.T) {
+	const (
+		flagX8664LibX32     = 0x0800
+		flagMIPS64LibN64Nan = 0x0b00
+	)
+	for _, v := range []struct {
+		goarch   string
+		flags    uint32
+		expected bool
+	}{
+		{"amd64", FlagElfLibc6 | FlagX8664Lib64, true},
+		{"amd64", FlagElfLibc6 | FlagAArch64Lib64, false},
+		{"amd64", FlagElfLibc6 | flagX8664LibX32, false},
+		{"amd64", FlagElfLibc6 | flagMIPS64LibN64Nan, false},
+		{"amd64", FlagElfLibc6, false},
+		{"amd64", FlagElf | FlagX8664Lib64, false},
+		{"arm64", FlagElfLibc6 | FlagAArch64Lib64, true},
+		{"arm64", FlagElfLibc6 | FlagX8664Lib64, false},
+		{"arm64", FlagElfLibc6 | flagMIPS64LibN64Nan, false},
+		{"arm64", FlagElf | FlagAArch64Lib64, false},
+	} {
+		fn := cacheFlagCheck(v.goarch)
+		if ok := fn(v.flags); ok != v.expected {
+			t.Errorf("%v: cacheFlagCheck()(%v) = %v, expected %v", v.goarch, FlagString(v.flags), ok, v.expected)
+		}
+	}
+	if fn := cacheFlagCheck("mips64"); fn != nil {
+		t.Errorf("cacheFlagCheck(mips64) returned a check function")
+	}
+}
+
+func TestLoadCacheSyntheticAArch64(t *testing.T) {
+	if !IsSupported() {
+		t.Skip("dynlib is unsupported on this host")
+	}
+
+	hostFlags, foreignFlags := uint32(FlagX8664Lib64), uint32(FlagAArch64Lib64)
+	if runtime.GOARCH == "arm64" {
+		hostFlags, foreignFlags = foreignFlags, hostFlags
+	}
+
+	// All of the entries point to the running test binary, so that only the
+	// flags determine if an entry is usable.
+	fn := writeCacheFixture(t, buildNewCache([]testCacheEntry{
+		{FlagElfLibc6 | FlagAArch64Lib64, "libaarch64.so.1", "/proc/self/exe", 0},
+		{FlagElfLibc6 | FlagX8664Lib64, "libx86-64.so.1", "/proc/self/exe", 0},
+		{FlagElfLibc6 | foreignFlags, "libboth.so.1", "/proc/self/exe", 0},
+		{FlagElfLibc6 | hostFlags, "libboth.so.1", "/proc/self/exe", 0},
+		{FlagElfLibc6 | 0x0b00, "libmips.so.1", "/proc/self/exe", 0},
+	}))
+	c, err := loadCache(fn)
+	if err != nil {
+		t.Fatalf("loadCache() = %v", err)
+	}
+
+	hostLib, foreignLib := "libx86-64.so.1", "libaarch64.so.1"
+	if runtime.GOARCH == "arm64" {
+		hostLib, foreignLib = foreignLib, hostLib
+	}
+	for _, v := range []struct {
+		lib    string
+		usable bool
+	}{
+		{hostLib, true},
+		{foreignLib, false},
+		{"libboth.so.1", true},
+		{"libmips.so.1", false},
+	} {
+		if p := c.GetLibraryPath(v.lib); (p != "") != v.usable {
+			t.Errorf("GetLibraryPath(%v) = '%v', expected usable: %v", v.lib, p, v.usable)
+		}
+	}
+	if n := len(c.store["libboth.so.1"]); n != 1 {
+		t.Errorf("libboth.so.1 has %v entries, expected only the %v one", n, runtime.GOARCH)
+	}
+}
@@ -26,6 +26,7 @@ import "C"
 
 import (
 	"bytes"
+	"fmt"
 	"syscall"
 )
 
@@ -49,21 +50,30 @@ func getOsVersion() uint32 {
 	// Parse major, minor, pl into bytes, and jam them together.
 	//
 	// glibc as far as I can tell doesn't handle any of versions being larger
-	// than 256 at all.
+	// than 256 at all, so clamp each component to 255 (patch levels on
+	// long term kernels can and do exceed this), so that the comparison
+	// errs on the side of the running kernel being newer.
 	var ret uint32
 	appended := uint(0)
 	for i, v := range bytes.Split(relBuf, []byte{'.'}) {
 		if i > 2 {
 			break
 		}
-		var subVer uint8
+		var subVer uint32
 		for _, b := range v {
-			subVer = subVer * 10
-			subVer = subVer + (b - '0')
+			subVer = subVer*10 + uint32(b-'0')
+			if subVer > 0xff {
+				subVer = 0xff
+			}
 		}
 		ret = ret << 8
-		ret = ret | uint32(subVer)
+		ret = ret | subVer
 		appended++
 	}
 	return ret << (8 * (3 - appended))
 }
+
+// formatOsVersion returns the human readable form of a packed osVersion.
+func formatOsVersion(v uint32) string {
+	return fmt.Sprintf("%d.%d.%d", (v>>16)&0xff, (v>>8)&0xff, v&0xff)
+}
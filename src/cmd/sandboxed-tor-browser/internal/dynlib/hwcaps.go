@@ -0,0 +1,155 @@
+// hwcaps.go - glibc-hwcaps subdirectory support.
+// Copyright (C) 2017  Yawning Angel.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package dynlib
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	. "cmd/sandboxed-tor-browser/internal/utils"
+)
+
+// cacheHwcapExtension is the value of the upper 32 bits of a cache entry's
+// hwcap for libraries in a `glibc-hwcaps` subdirectory, in which case the
+// lower 32 bits are the index into the glibc-hwcaps extension section.
+const cacheHwcapExtension = 1 << 30
+
+// x86-64 microarchitecture levels, in order of preference, along with the
+// `/proc/cpuinfo` flags that each level requires in addition to the levels
+// below it.  See `sysdeps/x86/get-isa-level.h` in the glibc source tree.
+var x8664Levels = []struct {
+	name  string
+	flags []string
+}{
+	{"x86-64-v4", []string{"avx512f", "avx512bw", "avx512cd", "avx512dq", "avx512vl"}},
+	{"x86-64-v3", []string{"avx", "avx2", "bmi1", "bmi2", "f16c", "fma", "abm", "movbe", "xsave"}},
+	{"x86-64-v2", []string{"cx16", "lahf_lm", "popcnt", "pni", "sse4_1", "sse4_2", "ssse3"}},
+}
+
+// supportedHwcaps is the `glibc-hwcaps` subdirectories usable on the host,
+// in order of preference.
+var supportedHwcaps []string
+
+func getSupportedHwcaps() []string {
+	if runtime.GOARCH != "amd64" {
+		// glibc does not define any subdirectories for arm64 (yet).
+		return nil
+	}
+
+	f, err := os.Open("/proc/cpuinfo")
+	if err != nil {
+		Debugf("dynlib: Failed to open /proc/cpuinfo: %v", err)
+		return nil
+	}
+	defer f.Close()
+
+	return parseCpuinfoHwcaps(f)
+}
+
+// parseCpuinfoHwcaps returns the x86-64 `glibc-hwcaps` subdirectories that
+// the first CPU in the `/proc/cpuinfo` formatted r supports, in order of
+// preference.
+func parseCpuinfoHwcaps(r io.Reader) []string {
+	cpuFlags := make(map[string]bool)
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		sp := strings.SplitN(scanner.Text(), ":", 2)
+		if len(sp) == 2 && strings.TrimSpace(sp[0]) == "flags" {
+			for _, v := range strings.Fields(sp[1]) {
+				cpuFlags[v] = true
+			}
+			break
+		}
+	}
+
+	// Each level requires all of the lower levels.
+	var ret []string
+	for i := len(x8664Levels) - 1; i >= 0; i-- {
+		for _, v := range x8664Levels[i].flags {
+			if !cpuFlags[v] {
+				return ret
+			}
+		}
+		ret = append([]string{x8664Levels[i].name}, ret...)
+	}
+	return ret
+}
+
+// hwcapsPriority returns the preference for a `glibc-hwcaps` subdirectory,
+// with higher being more preferred, or 0 if the subdirectory is not usable
+// on the host.
+func hwcapsPriority(name string) int {
+	for i, v := range supportedHwcaps {
+		if v == name {
+			return len(supportedHwcaps) - i
+		}
+	}
+	return 0
+}
+
+// getHwcapsName returns the `glibc-hwcaps` subdirectory name for a cache
+// entry's hwcap, if it is a glibc-hwcaps entry.
+func (c *Cache) getHwcapsName(hwcap uint64, stringTable []byte) (string, bool) {
+	if hwcap>>32 != cacheHwcapExtension {
+		return "", false
+	}
+
+	// The section is an array of string table offsets.
+	sect := c.extensions[cacheExtensionTagGlibcHwcaps]
+	idx := int(uint32(hwcap))
+	if idx < 0 || (idx+1)*4 > len(sect) {
+		return "", true
+	}
+	off := int(binary.LittleEndian.Uint32(sect[idx*4:]))
+	if off < 0 || off >= len(stringTable) {
+		return "", true
+	}
+	s := stringTable[off:]
+	for i, b := range s {
+		if b == 0 {
+			return string(s[:i]), true
+		}
+	}
+	return "", true
+}
+
+// findHwcapsVariant returns the best `glibc-hwcaps` variant of the library
+// name, that is a sibling of the library at libPath, or libPath if there is
+// none.
+func findHwcapsVariant(name, libPath string) string {
+	dir := filepath.Dir(libPath)
+	if filepath.Base(filepath.Dir(dir)) == "glibc-hwcaps" {
+		return libPath // Already a variant.
+	}
+	for _, v := range supportedHwcaps {
+		candidate := filepath.Join(dir, "glibc-hwcaps", v, name)
+		if FileExists(candidate) && ValidateLibraryClass(candidate) == nil {
+			Debugf("dynlib: Using %v variant of %v: %v", v, name, candidate)
+			return candidate
+		}
+	}
+	return libPath
+}
+
+func init() {
+	supportedHwcaps = getSupportedHwcaps()
+}
@@ -0,0 +1,183 @@
+// hwcaps_test.go - glibc-hwcaps routine tests.
+// Copyright (C) 2017  Yawning Angel.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package dynlib
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+const (
+	cpuFlagsV2 = "cx16 lahf_lm popcnt pni sse4_1 sse4_2 ssse3"
+	cpuFlagsV3 = "avx avx2 bmi1 bmi2 f16c fma abm movbe xsave"
+	cpuFlagsV4 = "avx512f avx512bw avx512cd avx512dq avx512vl"
+)
+
+// mockSupportedHwcaps overrides the host's supported glibc-hwcaps for the
+// duration of the test.
+func mockSupportedHwcaps(t *testing.T, hwcaps []string) {
+	old := supportedHwcaps
+	t.Cleanup(func() { supportedHwcaps = old })
+	supportedHwcaps = hwcaps
+}
+
+// writeHwcapsTree creates a library named name in dir, and a variant in the
+// glibc-hwcaps subdirectory for each of the levels.  The libraries are
+// copies of the dynamic linker, as it has no dependencies.
+func writeHwcapsTree(t *testing.T, dir, name string, levels ...string) {
+	ldSo, err := ioutil.ReadFile(hostInterpreter(t))
+	if err != nil {
+		t.Fatalf("failed to read the interpreter: %v", err)
+	}
+	files := map[string]string{name: string(ldSo)}
+	for _, v := range levels {
+		files[filepath.Join("glibc-hwcaps", v, name)] = string(ldSo)
+	}
+	writeConfFiles(t, dir, files)
+}
+
+func TestParseCpuinfoHwcaps(t *testing.T) {
+	for _, v := range []struct {
+		name     string
+		flags    string
+		expected []string
+	}{
+		{"baseline", "fpu sse sse2", nil},
+		{"v2", cpuFlagsV2, []string{"x86-64-v2"}},
+		{"v3", cpuFlagsV2 + " " + cpuFlagsV3, []string{"x86-64-v3", "x86-64-v2"}},
+		{"v4", cpuFlagsV2 + " " + cpuFlagsV3 + " " + cpuFlagsV4, []string{"x86-64-v4", "x86-64-v3", "x86-64-v2"}},
+		{"v3 without v2", cpuFlagsV3 + " " + cpuFlagsV4, nil},
+		{"v2 missing popcnt", strings.Replace(cpuFlagsV2, "popcnt", "", 1), nil},
+	} {
+		cpuinfo := "processor\t: 0\nvendor_id\t: GenuineIntel\nflags\t\t: " + v.flags + "\n\n" +
+			"processor\t: 1\nflags\t\t: " + cpuFlagsV2 + " " + cpuFlagsV3 + " " + cpuFlagsV4 + "\n"
+		if hwcaps := parseCpuinfoHwcaps(strings.NewReader(cpuinfo)); !reflect.DeepEqual(hwcaps, v.expected) {
+			t.Errorf("%v: parseCpuinfoHwcaps() = %v, expected %v", v.name, hwcaps, v.expected)
+		}
+	}
+}
+
+func TestFindHwcapsVariant(t *testing.T) {
+	loadHostCache(t)
+	const name = "libhwcapstest.so.1"
+	dir := t.TempDir()
+	writeHwcapsTree(t, dir, name, "x86-64-v2", "x86-64-v3", "x86-64-v4")
+	baseline := filepath.Join(dir, name)
+	variant := func(level string) string {
+		return filepath.Join(dir, "glibc-hwcaps", level, name)
+	}
+
+	for _, v := range []struct {
+		hwcaps   []string
+		libPath  string
+		expected string
+	}{
+		{nil, baseline, baseline},
+		{[]string{"x86-64-v2"}, baseline, variant("x86-64-v2")},
+		{[]string{"x86-64-v3", "x86-64-v2"}, baseline, variant("x86-64-v3")},
+		{[]string{"x86-64-v4", "x86-64-v3", "x86-64-v2"}, baseline, variant("x86-64-v4")},
+		{[]string{"x86-64-v3", "x86-64-v2"}, variant("x86-64-v2"), variant("x86-64-v2")},
+	} {
+		mockSupportedHwcaps(t, v.hwcaps)
+		if p := findHwcapsVariant(name, v.libPath); p != v.expected {
+			t.Errorf("%v: findHwcapsVariant(%v) = %v, expected %v", v.hwcaps, v.libPath, p, v.expected)
+		}
+	}
+}
+
+func TestResolveLibrariesHwcapsVariant(t *testing.T) {
+	c := loadHostCache(t)
+	c.SetResolveCache("", "")
+	mockSupportedHwcaps(t, []string{"x86-64-v3", "x86-64-v2"})
+
+	const name = "libhwcapstest.so.1"
+	dir := t.TempDir()
+	writeHwcapsTree(t, dir, name, "x86-64-v2", "x86-64-v3", "x86-64-v4")
+	c.confDirs = []string{dir}
+
+	libs, err := c.ResolveLibraries(testBinaries, []string{name}, "", "", nil)
+	if err != nil {
+		t.Fatalf("ResolveLibraries() = %v", err)
+	}
+
+	// The variant is mounted under the library's soname.
+	expected := filepath.Join(dir, "glibc-hwcaps", "x86-64-v3", name)
+	if p := libs.Targets[name]; p != expected {
+		t.Errorf("ResolveLibraries() %v = %v, expected %v", name, p, expected)
+	}
+	if aliases := libs.Aliases[expected]; !reflect.DeepEqual(aliases, []string{name}) {
+		t.Errorf("ResolveLibraries() aliases = %v, expected [%v]", aliases, name)
+	}
+}
+
+func TestLoadCacheHwcaps(t *testing.T) {
+	loadHostCache(t)
+	mockSupportedHwcaps(t, []string{"x86-64-v3", "x86-64-v2"})
+
+	const name = "libhwcapstest.so.1"
+	dir := t.TempDir()
+	writeHwcapsTree(t, dir, name, "x86-64-v2", "x86-64-v3", "x86-64-v4")
+	hostFlags := hostCacheFlags(t)
+	entry := func(level string, idx uint64) testCacheEntry {
+		if level == "" {
+			return testCacheEntry{hostFlags, name, filepath.Join(dir, name), 0}
+		}
+		return testCacheEntry{hostFlags, name, filepath.Join(dir, "glibc-hwcaps", level, name), cacheHwcapExtension<<32 | idx}
+	}
+
+	// ldconfig puts the variants first, but the ordering should not matter.
+	fn := writeCacheFixture(t, buildNewCache([]testCacheEntry{
+		entry("", 0),
+		entry("x86-64-v2", 0),
+		entry("x86-64-v4", 2),
+		entry("x86-64-v3", 1),
+	}, "x86-64-v2", "x86-64-v3", "x86-64-v4"))
+	c, err := loadCache(fn)
+	if err != nil {
+		t.Fatalf("loadCache() = %v", err)
+	}
+
+	// The unsupported v4 variant is discarded, and the rest are ordered
+	// best level first.
+	var got []string
+	for _, e := range c.store[name] {
+		got = append(got, e.value)
+	}
+	expected := []string{entry("x86-64-v3", 1).value, entry("x86-64-v2", 0).value, entry("", 0).value}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("cache entries = %v, expected %v", got, expected)
+	}
+	if p := c.GetLibraryPath(name); p != expected[0] {
+		t.Errorf("GetLibraryPath() = %v, expected %v", p, expected[0])
+	}
+}
+
+// hostCacheFlags returns the `ld.so.cache` flags for a libc6 library
+// on the host.
+func hostCacheFlags(t *testing.T) uint32 {
+	for _, flags := range []uint32{FlagElfLibc6 | FlagX8664Lib64, FlagElfLibc6 | FlagAArch64Lib64} {
+		if fn := cacheFlagCheck(runtime.GOARCH); fn != nil && fn(flags) {
+			return flags
+		}
+	}
+	t.Skip("no cache flags for the host architecture")
+	return 0
+}
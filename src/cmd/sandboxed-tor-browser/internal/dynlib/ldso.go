@@ -17,46 +17,184 @@
 package dynlib
 
 import (
+	"bytes"
 	"debug/elf"
 	"errors"
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
 	"runtime"
+	"strings"
+	"sync"
 )
 
 var errUnsupported = errors.New("dynlib: unsupported os/architecture")
 
-func getLibraries(fn string) ([]string, error) {
-	f, err := elf.Open(fn)
+// maxLayerWorkers is the maximum number of files that will be concurrently
+// parsed by getLayerDependencies.
+const maxLayerWorkers = 8
+
+// NotELFError is the error returned when a file that is expected to be an
+// ELF binary or library is not one (Eg: a shell script or a linker script).
+type NotELFError struct {
+	// Path is the path of the file.
+	Path string
+}
+
+// Error returns the string representation of a NotELFError.
+func (e *NotELFError) Error() string {
+	return fmt.Sprintf("dynlib: not an ELF file: %v", e.Path)
+}
+
+// openELF opens the ELF file fn, returning a *NotELFError if it is not an ELF
+// file at all, rather than an obscure parse failure.  Both ELFCLASS32 and
+// ELFCLASS64 files are supported.
+func openELF(fn string) (*elf.File, error) {
+	r, err := os.Open(fn)
+	if err != nil {
+		return nil, err
+	}
+	var magic [len(elf.ELFMAG)]byte
+	_, err = io.ReadFull(r, magic[:])
+	r.Close()
+	if err != nil || !bytes.Equal(magic[:], []byte(elf.ELFMAG)) {
+		return nil, &NotELFError{Path: fn}
+	}
+
+	return elf.Open(fn)
+}
+
+// GetLibraries returns the libraries that the ELF file fn directly depends on
+// (the `DT_NEEDED` entries in the `.dynamic` section), which is empty for
+// static binaries.
+func GetLibraries(fn string) ([]string, error) {
+	f, err := openELF(fn)
 	if err != nil {
 		return nil, err
 	}
 	defer f.Close()
 
-	return f.ImportedLibraries()
+	libs, err := f.ImportedLibraries()
+	if err != nil {
+		return nil, err
+	}
+	if libs == nil {
+		libs = []string{}
+	}
+	return libs, nil
+}
+
+// elfDependencies is the dependencies of a single ELF file.
+type elfDependencies struct {
+	libs   []string
+	interp string
+	err    error
+}
+
+func getDependencies(fn string) *elfDependencies {
+	d := new(elfDependencies)
+	f, err := openELF(fn)
+	if err != nil {
+		d.err = err
+		return d
+	}
+	defer f.Close()
+
+	if d.libs, d.err = f.ImportedLibraries(); d.err == nil {
+		d.interp, d.err = getInterpreter(f, fn)
+	}
+	return d
+}
+
+// getLayerDependencies returns the dependencies of each of the files, in the
+// same order, parsing the files concurrently.
+func getLayerDependencies(files []string) []*elfDependencies {
+	ret := make([]*elfDependencies, len(files))
+
+	nWorkers := runtime.NumCPU()
+	if nWorkers > maxLayerWorkers {
+		nWorkers = maxLayerWorkers
+	}
+	if nWorkers > len(files) {
+		nWorkers = len(files)
+	}
+
+	var wg sync.WaitGroup
+	idxCh := make(chan int)
+	for i := 0; i < nWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for idx := range idxCh {
+				ret[idx] = getDependencies(files[idx])
+			}
+		}()
+	}
+	for idx := range files {
+		idxCh <- idx
+	}
+	close(idxCh)
+	wg.Wait()
+
+	return ret
+}
+
+// GetInterpreter returns the program interpreter (`PT_INTERP`) of the ELF
+// binary, or "" if the binary does not have one (Eg: libraries and static
+// binaries).
+func GetInterpreter(fn string) (string, error) {
+	f, err := openELF(fn)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	return getInterpreter(f, fn)
+}
+
+func getInterpreter(f *elf.File, fn string) (string, error) {
+	for _, p := range f.Progs {
+		if p.Type != elf.PT_INTERP {
+			continue
+		}
+		b := make([]byte, p.Filesz)
+		if _, err := p.ReadAt(b, 0); err != nil {
+			return "", fmt.Errorf("dynlib: failed to read interpreter: %v: %v", fn, err)
+		}
+		return strings.TrimRight(string(b), "\x00"), nil
+	}
+	return "", nil
 }
 
 // ValidateLibraryClass ensures that the library matches the current
 // architecture.
 func ValidateLibraryClass(fn string) error {
-	f, err := elf.Open(fn)
+	f, err := openELF(fn)
 	if err != nil {
 		return err
 	}
 	defer f.Close()
 
 	var expectedClass elf.Class
+	var expectedMachine elf.Machine
 	switch runtime.GOARCH {
 	case "amd64":
 		expectedClass = elf.ELFCLASS64
+		expectedMachine = elf.EM_X86_64
+	case "arm64":
+		expectedClass = elf.ELFCLASS64
+		expectedMachine = elf.EM_AARCH64
 	default:
-		return errUnsupported
+		return unsupportedError()
 	}
 
 	if f.Class != expectedClass {
 		return fmt.Errorf("unsupported class: %v: %v", fn, f.Class)
 	}
+	if f.Machine != expectedMachine {
+		return fmt.Errorf("unsupported machine: %v: %v", fn, f.Machine)
+	}
 	return nil
 }
 
@@ -64,7 +202,7 @@ func ValidateLibraryClass(fn string) error {
 // architecture, which is usually a symlink
 func FindLdSo(cache *Cache) (string, string, error) {
 	if !IsSupported() {
-		return "", "", errUnsupported
+		return "", "", unsupportedError()
 	}
 
 	name := ""
@@ -73,6 +211,8 @@ func FindLdSo(cache *Cache) (string, string, error) {
 	case "amd64":
 		searchPaths = append(searchPaths, "/lib64")
 		name = "ld-linux-x86-64.so.2"
+	case "arm64":
+		name = "ld-linux-aarch64.so.1"
 	default:
 		panic("dynlib: unsupported architecture: " + runtime.GOARCH)
 	}
@@ -98,7 +238,35 @@ func FindLdSo(cache *Cache) (string, string, error) {
 }
 
 // IsSupported returns true if the architecture/os combination has dynlib
-// sypport.
+// sypport.  See SupportInfo for the reason if it does not.
 func IsSupported() bool {
-	return runtime.GOOS == "linux" && runtime.GOARCH == "amd64"
+	return runtime.GOOS == "linux" && (runtime.GOARCH == "amd64" || runtime.GOARCH == "arm64")
+}
+
+// SupportInfo returns true if dynlib is usable on the host, or false and a
+// human readable reason if it is not.  Unlike IsSupported, this also checks
+// that the `ld.so.cache` file is present.
+func SupportInfo() (bool, string) {
+	if runtime.GOOS != "linux" {
+		return false, fmt.Sprintf("unsupported OS: %v (only linux is supported)", runtime.GOOS)
+	}
+	if runtime.GOARCH != "amd64" && runtime.GOARCH != "arm64" {
+		return false, fmt.Sprintf("unsupported architecture: %v (only amd64 and arm64 are supported)", runtime.GOARCH)
+	}
+	if _, err := os.Stat(ldSoCache); err != nil {
+		if os.IsNotExist(err) {
+			return false, fmt.Sprintf("%v is missing (try running `ldconfig`)", ldSoCache)
+		}
+		return false, fmt.Sprintf("%v is inaccessible: %v", ldSoCache, err)
+	}
+	return true, ""
+}
+
+// unsupportedError returns an error with the reason that dynlib is not
+// supported on the host.
+func unsupportedError() error {
+	if ok, reason := SupportInfo(); !ok {
+		return fmt.Errorf("dynlib: %v", reason)
+	}
+	return errUnsupported
 }
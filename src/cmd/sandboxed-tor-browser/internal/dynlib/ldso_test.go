@@ -0,0 +1,230 @@
+// ldso_test.go - Dynamic linker routine tests.
+// Copyright (C) 2016  Yawning Angel.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package dynlib
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"sort"
+	"sync"
+	"testing"
+)
+
+// hostLayerFiles returns the test binaries, and every library they depend
+// on, which is a decent approximation of a real resolution layer.
+func hostLayerFiles(tb testing.TB) []string {
+	c := loadHostCache(tb)
+	libs, err := c.ResolveLibraries(testBinaries, nil, "", "", nil)
+	if err != nil {
+		tb.Fatalf("ResolveLibraries() = %v", err)
+	}
+
+	files := append([]string{}, testBinaries...)
+	for fn := range libs.Aliases {
+		files = append(files, fn)
+	}
+	sort.Strings(files)
+
+	// Include something that fails to parse, so errors are compared too.
+	return append(files, "/nonexistent/libbogus.so.1")
+}
+
+func TestGetLayerDependencies(t *testing.T) {
+	files := hostLayerFiles(t)
+
+	deps := getLayerDependencies(files)
+	if len(deps) != len(files) {
+		t.Fatalf("getLayerDependencies() returned %v results, expected %v", len(deps), len(files))
+	}
+	for i, fn := range files {
+		expected := getDependencies(fn)
+		if !reflect.DeepEqual(deps[i].libs, expected.libs) || deps[i].interp != expected.interp || (deps[i].err == nil) != (expected.err == nil) {
+			t.Errorf("%v: getLayerDependencies() = %+v, expected %+v", fn, deps[i], expected)
+		}
+	}
+
+	if deps = getLayerDependencies(nil); len(deps) != 0 {
+		t.Errorf("getLayerDependencies(nil) = %v", deps)
+	}
+}
+
+func TestResolveLibrariesConcurrent(t *testing.T) {
+	c := loadHostCache(t)
+	expected, err := c.ResolveLibraries(testBinaries, nil, "", "", nil)
+	if err != nil {
+		t.Fatalf("ResolveLibraries() = %v", err)
+	}
+
+	const nCallers = 8
+	var wg sync.WaitGroup
+	results := make([]*Libraries, nCallers)
+	errs := make([]error, nCallers)
+	for i := 0; i < nCallers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i], errs[i] = c.ResolveLibraries(testBinaries, nil, "", "", nil)
+		}(i)
+	}
+	wg.Wait()
+
+	for i := 0; i < nCallers; i++ {
+		if errs[i] != nil {
+			t.Errorf("caller %v: ResolveLibraries() = %v", i, errs[i])
+		} else if !reflect.DeepEqual(results[i], expected) {
+			t.Errorf("caller %v: ResolveLibraries() = %v, expected %v", i, results[i], expected)
+		}
+	}
+}
+
+// hostInterpreter returns the expected PT_INTERP of the test binaries.
+func hostInterpreter(tb testing.TB) string {
+	switch runtime.GOARCH {
+	case "amd64":
+		return "/lib64/ld-linux-x86-64.so.2"
+	case "arm64":
+		return "/lib/ld-linux-aarch64.so.1"
+	}
+	tb.Skipf("unsupported architecture: %v", runtime.GOARCH)
+	return ""
+}
+
+func TestGetInterpreter(t *testing.T) {
+	loadHostCache(t)
+	expected := hostInterpreter(t)
+
+	for _, fn := range testBinaries {
+		interp, err := GetInterpreter(fn)
+		if err != nil {
+			t.Errorf("%v: GetInterpreter() = %v", fn, err)
+		} else if interp != expected {
+			t.Errorf("%v: GetInterpreter() = '%v', expected '%v'", fn, interp, expected)
+		}
+	}
+
+	// The dynamic linker does not have an interpreter.  (Modern libc is
+	// executable, so has one.)
+	if interp, err := GetInterpreter(expected); err != nil || interp != "" {
+		t.Errorf("%v: GetInterpreter() = '%v', %v, expected none", expected, interp, err)
+	}
+
+	if _, err := GetInterpreter("/nonexistent/bin/ls"); err == nil {
+		t.Errorf("GetInterpreter(missing) succeeded")
+	}
+}
+
+func TestResolveLibrariesInterpreter(t *testing.T) {
+	c := loadHostCache(t)
+	interp := hostInterpreter(t)
+
+	libs, err := c.ResolveLibraries(testBinaries, nil, "", "", nil)
+	if err != nil {
+		t.Fatalf("ResolveLibraries() = %v", err)
+	}
+	realInterp, err := filepath.EvalSymlinks(interp)
+	if err != nil {
+		t.Fatalf("failed to resolve the interpreter: %v", err)
+	}
+	if target := libs.Targets[filepath.Base(interp)]; target != realInterp {
+		t.Errorf("ResolveLibraries() interpreter = '%v', expected '%v'", target, realInterp)
+	}
+}
+
+func TestGetLibraries(t *testing.T) {
+	// The fixtures are minimal ELF files with just enough of a `.dynamic`
+	// section to be parsed, so that the 32-bit case does not depend on a
+	// multilib host.
+	for _, v := range []struct {
+		fn       string
+		expected []string
+	}{
+		{"testdata/elf64-dynamic", []string{"libm.so.6", "libc.so.6"}},
+		{"testdata/elf32-dynamic", []string{"libm.so.6", "libc.so.6"}},
+		{"testdata/elf64-static", []string{}},
+		{"testdata/elf32-static", []string{}},
+	} {
+		libs, err := GetLibraries(v.fn)
+		if err != nil {
+			t.Errorf("%v: GetLibraries() = %v", v.fn, err)
+		} else if !reflect.DeepEqual(libs, v.expected) {
+			t.Errorf("%v: GetLibraries() = %v, expected %v", v.fn, libs, v.expected)
+		}
+	}
+
+	var notELFErr *NotELFError
+	if _, err := GetLibraries("testdata/script.sh"); !errors.As(err, &notELFErr) || notELFErr.Path != "testdata/script.sh" {
+		t.Errorf("GetLibraries(script) = %v, expected a NotELFError", err)
+	}
+	if _, err := GetLibraries("testdata/nonexistent"); !os.IsNotExist(err) {
+		t.Errorf("GetLibraries(missing) = %v, expected ENOENT", err)
+	}
+}
+
+func TestGetLibrariesHost(t *testing.T) {
+	loadHostCache(t)
+	libs, err := GetLibraries(testBinaries[0])
+	if err != nil {
+		t.Fatalf("GetLibraries() = %v", err)
+	}
+	found := false
+	for _, lib := range libs {
+		found = found || lib == "libc.so.6"
+	}
+	if !found {
+		t.Errorf("GetLibraries() = %v, expected libc.so.6", libs)
+	}
+}
+
+func TestValidateLibraryClass(t *testing.T) {
+	if runtime.GOARCH != "amd64" {
+		t.Skipf("fixtures are x86-64, host is %v", runtime.GOARCH)
+	}
+	for _, v := range []struct {
+		fn    string
+		valid bool
+	}{
+		{"testdata/elf64-dynamic", true},
+		{"testdata/elf64-static", true},
+		{"testdata/elf32-dynamic", false},
+		{"testdata/elf32-static", false},
+		{"testdata/script.sh", false},
+	} {
+		if err := ValidateLibraryClass(v.fn); (err == nil) != v.valid {
+			t.Errorf("%v: ValidateLibraryClass() = %v, expected valid: %v", v.fn, err, v.valid)
+		}
+	}
+}
+
+func BenchmarkGetLayerDependencies(b *testing.B) {
+	files := hostLayerFiles(b)
+
+	b.Run("serial", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			for _, fn := range files {
+				getDependencies(fn)
+			}
+		}
+	})
+	b.Run("concurrent", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			getLayerDependencies(files)
+		}
+	})
+}
@@ -0,0 +1,117 @@
+// ldsoconf.go - ld.so.conf parser.
+// Copyright (C) 2017  Yawning Angel.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package dynlib
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"strings"
+
+	. "cmd/sandboxed-tor-browser/internal/utils"
+)
+
+const ldSoConf = "/etc/ld.so.conf"
+
+// loadLdSoConf returns the library directories listed in the `ld.so.conf`
+// file at path, and the files it includes, in order.  Files that can not be
+// read are skipped, as the directories are only a supplement to the cache.
+func loadLdSoConf(path string) []string {
+	var dirs []string
+	seenDir := make(map[string]bool)
+	seenFile := make(map[string]bool)
+
+	var parseFn func(string)
+	parseFn = func(fn string) {
+		if seenFile[fn] {
+			return
+		}
+		seenFile[fn] = true
+
+		f, err := os.Open(fn)
+		if err != nil {
+			Debugf("dynlib: Failed to open %v: %v", fn, err)
+			return
+		}
+		defer f.Close()
+
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			l := scanner.Text()
+			if idx := strings.IndexByte(l, '#'); idx >= 0 {
+				l = l[:idx]
+			}
+			fields := strings.FieldsFunc(l, func(r rune) bool {
+				return r == ' ' || r == '\t' || r == ',' || r == ':'
+			})
+			if len(fields) == 0 {
+				continue
+			}
+
+			switch fields[0] {
+			case "include":
+				// Relative patterns are relative to the including file.
+				for _, pattern := range fields[1:] {
+					if !filepath.IsAbs(pattern) {
+						pattern = filepath.Join(filepath.Dir(fn), pattern)
+					}
+					matches, err := filepath.Glob(pattern)
+					if err != nil {
+						Debugf("dynlib: Invalid include in %v: %v", fn, pattern)
+						continue
+					}
+					for _, m := range matches {
+						parseFn(m)
+					}
+				}
+			case "hwcap":
+				// Obsolete, and ignored by modern ldconfig.
+			default:
+				for _, d := range fields {
+					// libc5 era `dir=type` entries.
+					if idx := strings.IndexByte(d, '='); idx >= 0 {
+						d = d[:idx]
+					}
+					if !filepath.IsAbs(d) {
+						continue
+					}
+					d = filepath.Clean(d)
+					if !seenDir[d] {
+						seenDir[d] = true
+						dirs = append(dirs, d)
+					}
+				}
+			}
+		}
+	}
+	parseFn(path)
+
+	return dirs
+}
+
+// getConfDirLibraryPath returns the path to the given library in one of the
+// `ld.so.conf` directories, if any.  Libraries for other architectures are
+// skipped, as the directories are not necessarily architecture specific.
+func (c *Cache) getConfDirLibraryPath(name string) string {
+	for _, d := range c.confDirs {
+		fn := filepath.Join(d, name)
+		if FileExists(fn) && ValidateLibraryClass(fn) == nil {
+			return fn
+		}
+	}
+	return ""
+}
@@ -0,0 +1,108 @@
+// ldsoconf_test.go - ld.so.conf routine tests.
+// Copyright (C) 2017  Yawning Angel.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package dynlib
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func writeConfFiles(t *testing.T, dir string, files map[string]string) {
+	for name, content := range files {
+		fn := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(fn), 0700); err != nil {
+			t.Fatalf("failed to create directory: %v", err)
+		}
+		if err := ioutil.WriteFile(fn, []byte(content), 0600); err != nil {
+			t.Fatalf("failed to write '%v': %v", name, err)
+		}
+	}
+}
+
+func TestLoadLdSoConf(t *testing.T) {
+	dir := t.TempDir()
+	writeConfFiles(t, dir, map[string]string{
+		"ld.so.conf": "# Comment.\n" +
+			"include ld.so.conf.d/*.conf\n" +
+			"/usr/local/lib # Trailing comment.\n" +
+			"/usr/local/lib/\n",
+		"ld.so.conf.d/a.conf": "/opt/a/lib,/opt/b/lib:relative/lib\n",
+		"ld.so.conf.d/b.conf": "include ../ld.so.conf\n" + // Cycle.
+			"/opt/c/lib=libc6\n" +
+			"hwcap 1 nosegneg\n",
+		"ld.so.conf.d/c.notconf": "/opt/ignored/lib\n",
+		"absolute.conf":          "include " + filepath.Join(dir, "ld.so.conf.d", "a.conf") + "\n/opt/d/lib\n",
+	})
+
+	for _, v := range []struct {
+		conf     string
+		expected []string
+	}{
+		{"ld.so.conf", []string{"/opt/a/lib", "/opt/b/lib", "/opt/c/lib", "/usr/local/lib"}},
+		{"absolute.conf", []string{"/opt/a/lib", "/opt/b/lib", "/opt/d/lib"}},
+		{"nonexistent.conf", nil},
+	} {
+		if dirs := loadLdSoConf(filepath.Join(dir, v.conf)); !reflect.DeepEqual(dirs, v.expected) {
+			t.Errorf("%v: loadLdSoConf() = %v, expected %v", v.conf, dirs, v.expected)
+		}
+	}
+}
+
+func TestResolveLibrariesConfDir(t *testing.T) {
+	c := loadHostCache(t)
+	c.SetResolveCache("", "")
+
+	// Any library of the right architecture will do, as long as it is not in
+	// the cache, and the dynamic linker has no dependencies.
+	const libName = "libconfdirtest.so.1"
+	ldSo, err := ioutil.ReadFile(hostInterpreter(t))
+	if err != nil {
+		t.Fatalf("failed to read the interpreter: %v", err)
+	}
+	dir := t.TempDir()
+	libDir := filepath.Join(dir, "lib")
+	writeConfFiles(t, dir, map[string]string{
+		"ld.so.conf":             "include ld.so.conf.d/*.conf\n",
+		"ld.so.conf.d/test.conf": libDir + "\n",
+		"lib/" + libName:         string(ldSo),
+	})
+	if c.GetLibraryPath(libName) != "" {
+		t.Fatalf("%v is in the host cache", libName)
+	}
+
+	resolve := func() (*Libraries, error) {
+		return c.ResolveLibraries(testBinaries, []string{libName}, "", "", nil)
+	}
+
+	var missingErr *MissingLibraryError
+	if _, err = resolve(); !errors.As(err, &missingErr) || missingErr.Library != libName {
+		t.Fatalf("ResolveLibraries() without the conf dir = %v", err)
+	}
+
+	c.confDirs = loadLdSoConf(filepath.Join(dir, "ld.so.conf"))
+	libs, err := resolve()
+	if err != nil {
+		t.Fatalf("ResolveLibraries() = %v", err)
+	}
+	if p := libs.Targets[libName]; p != filepath.Join(libDir, libName) {
+		t.Errorf("ResolveLibraries() %v = '%v', expected it from the conf dir", libName, p)
+	}
+}
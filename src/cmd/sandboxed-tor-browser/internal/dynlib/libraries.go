@@ -0,0 +1,111 @@
+// libraries.go - Resolved library set.
+// Copyright (C) 2017  Yawning Angel.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package dynlib
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+)
+
+// AliasConflictError is the error returned when a single alias (soname)
+// resolves to more than one distinct library.
+type AliasConflictError struct {
+	// Alias is the conflicting alias.
+	Alias string
+
+	// Targets are the real paths of the libraries that the alias resolved
+	// to.
+	Targets []string
+}
+
+// Error returns the string representation of an AliasConflictError.
+func (e *AliasConflictError) Error() string {
+	return fmt.Sprintf("dynlib: alias '%v' resolves to multiple libraries: %v", e.Alias, e.Targets)
+}
+
+// Libraries is the set of libraries resolved by ResolveLibraries.
+type Libraries struct {
+	// Aliases is the map of real library paths to the aliases the library
+	// should be made available as.
+	Aliases map[string][]string `json:"aliases"`
+
+	// Targets is the map of aliases to real library paths.
+	Targets map[string]string `json:"targets"`
+
+	// Skipped is the list of binaries that were skipped as they do not
+	// exist, if the Cache is configured to skip missing binaries.
+	Skipped []string `json:"skipped,omitempty"`
+
+	// LdLibraryPath is the map of aliases to the paths of the libraries that
+	// were found via the library path.  These are omitted from Aliases and
+	// Targets, as the directories are expected to be mounted as is.
+	LdLibraryPath map[string]string `json:"ldLibraryPath,omitempty"`
+}
+
+func newLibraries() *Libraries {
+	return &Libraries{
+		Aliases: make(map[string][]string),
+		Targets: make(map[string]string),
+	}
+}
+
+// add registers the library at fn under alias, resolving any symlinks so
+// that libraries that are the same file share an entry.
+func (l *Libraries) add(alias, fn string) error {
+	realPath, err := filepath.EvalSymlinks(fn)
+	if err != nil {
+		return err
+	}
+
+	if target, ok := l.Targets[alias]; ok {
+		if target == realPath {
+			return nil
+		}
+		return &AliasConflictError{Alias: alias, Targets: []string{target, realPath}}
+	}
+	l.Targets[alias] = realPath
+	l.Aliases[realPath] = append(l.Aliases[realPath], alias)
+
+	return nil
+}
+
+// LdLibraryPathDirs returns the sorted list of library path directories that
+// the resolution relied upon, and thus must be mounted for the libraries in
+// LdLibraryPath to be found.
+func (l *Libraries) LdLibraryPathDirs() []string {
+	dirMap := make(map[string]bool)
+	for _, fn := range l.LdLibraryPath {
+		dirMap[filepath.Dir(fn)] = true
+	}
+	var dirs []string
+	for k := range dirMap {
+		dirs = append(dirs, k)
+	}
+	sort.Strings(dirs)
+	return dirs
+}
+
+// Paths returns the sorted list of real library paths.
+func (l *Libraries) Paths() []string {
+	var paths []string
+	for k := range l.Aliases {
+		paths = append(paths, k)
+	}
+	sort.Strings(paths)
+	return paths
+}
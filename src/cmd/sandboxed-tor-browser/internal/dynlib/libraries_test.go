@@ -0,0 +1,114 @@
+// libraries_test.go - Resolved library set tests.
+// Copyright (C) 2017  Yawning Angel.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package dynlib
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"testing"
+)
+
+func TestLdLibraryPathDirs(t *testing.T) {
+	for _, v := range []struct {
+		ldPathLibs map[string]string
+		expected   []string
+	}{
+		{nil, nil},
+		{map[string]string{"libfoo.so.1": "/opt/foo/lib/libfoo.so.1"}, []string{"/opt/foo/lib"}},
+		{
+			map[string]string{
+				"libfoo.so.1": "/opt/foo/lib/libfoo.so.1",
+				"libbar.so.2": "/opt/bar/lib/libbar.so.2",
+				"libbaz.so.3": "/opt/foo/lib/libbaz.so.3",
+			},
+			[]string{"/opt/bar/lib", "/opt/foo/lib"},
+		},
+	} {
+		l := &Libraries{LdLibraryPath: v.ldPathLibs}
+		if dirs := l.LdLibraryPathDirs(); !reflect.DeepEqual(dirs, v.expected) {
+			t.Errorf("%v: LdLibraryPathDirs() = %v, expected %v", v.ldPathLibs, dirs, v.expected)
+		}
+	}
+}
+
+func TestResolveLibrariesLdLibraryPath(t *testing.T) {
+	c := loadHostCache(t)
+	if runtime.GOARCH != "amd64" {
+		t.Skipf("fixtures are x86-64, host is %v", runtime.GOARCH)
+	}
+
+	// The library is only in the library path, and depends on libm, which
+	// is not.
+	const name = "libldpathtest.so.1"
+	b, err := ioutil.ReadFile("testdata/elf64-dynamic")
+	if err != nil {
+		t.Fatalf("failed to read the fixture: %v", err)
+	}
+	dir := t.TempDir()
+	writeConfFiles(t, dir, map[string]string{name: string(b)})
+	fn := filepath.Join(dir, name)
+
+	for _, lib := range []string{name, fn} {
+		c.SetResolveCache("", "")
+		libs, err := c.ResolveLibraries(testBinaries, []string{lib}, dir, "", nil)
+		if err != nil {
+			t.Errorf("%v: ResolveLibraries() = %v", lib, err)
+			continue
+		}
+		if p := libs.LdLibraryPath[name]; p != fn {
+			t.Errorf("%v: LdLibraryPath[%v] = '%v', expected '%v'", lib, name, p, fn)
+		}
+		if _, ok := libs.Targets[name]; ok {
+			t.Errorf("%v: ResolveLibraries() %v is in Targets", lib, name)
+		}
+		if _, ok := libs.Aliases[fn]; ok {
+			t.Errorf("%v: ResolveLibraries() %v is in Aliases", lib, fn)
+		}
+		if p := libs.Targets["libm.so.6"]; p == "" {
+			t.Errorf("%v: ResolveLibraries() is missing the transitive dependency libm.so.6", lib)
+		}
+		if dirs := libs.LdLibraryPathDirs(); !reflect.DeepEqual(dirs, []string{dir}) {
+			t.Errorf("%v: LdLibraryPathDirs() = %v, expected %v", lib, dirs, []string{dir})
+		}
+	}
+
+	// Without the library path, nothing is attributed to it.
+	libs, err := c.ResolveLibraries(testBinaries, nil, "", "", nil)
+	if err != nil {
+		t.Fatalf("ResolveLibraries() = %v", err)
+	}
+	if libs.LdLibraryPath != nil {
+		t.Errorf("ResolveLibraries() LdLibraryPath = %v, expected none", libs.LdLibraryPath)
+	}
+
+	// A cached entry is not used once a library path library is gone.
+	c.SetResolveCache(filepath.Join(t.TempDir(), "resolve-cache.json"), "1")
+	if _, err = c.ResolveLibraries(testBinaries, []string{name}, dir, "", nil); err != nil {
+		t.Fatalf("ResolveLibraries() = %v", err)
+	}
+	if err = os.Remove(fn); err != nil {
+		t.Fatalf("failed to remove '%v': %v", fn, err)
+	}
+	var missingErr *MissingLibraryError
+	if _, err = c.ResolveLibraries(testBinaries, []string{name}, dir, "", nil); !errors.As(err, &missingErr) || missingErr.Library != name {
+		t.Errorf("ResolveLibraries() = %v, expected the library to be missing", err)
+	}
+}
@@ -0,0 +1,87 @@
+// missing.go - Missing library error.
+// Copyright (C) 2017  Yawning Angel.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package dynlib
+
+import "fmt"
+
+// packageHint is the likely distribution packages that provide a library.
+type packageHint struct {
+	debian string
+	fedora string
+}
+
+// packageHints is the likely packages that provide the libraries that are
+// commonly missing on minimal installs, keyed by soname.
+var packageHints = map[string]packageHint{
+	"libX11.so.6":            {"libx11-6", "libX11"},
+	"libX11-xcb.so.1":        {"libx11-xcb1", "libX11-xcb"},
+	"libXau.so.6":            {"libxau6", "libXau"},
+	"libXcomposite.so.1":     {"libxcomposite1", "libXcomposite"},
+	"libXdamage.so.1":        {"libxdamage1", "libXdamage"},
+	"libXdmcp.so.6":          {"libxdmcp6", "libXdmcp"},
+	"libXext.so.6":           {"libxext6", "libXext"},
+	"libXfixes.so.3":         {"libxfixes3", "libXfixes"},
+	"libXrender.so.1":        {"libxrender1", "libXrender"},
+	"libXt.so.6":             {"libxt6", "libXt"},
+	"libasound.so.2":         {"libasound2", "alsa-lib"},
+	"libcairo.so.2":          {"libcairo2", "cairo"},
+	"libdbus-1.so.3":         {"libdbus-1-3", "dbus-libs"},
+	"libdbus-glib-1.so.2":    {"libdbus-glib-1-2", "dbus-glib"},
+	"libfontconfig.so.1":     {"libfontconfig1", "fontconfig"},
+	"libfreetype.so.6":       {"libfreetype6", "freetype"},
+	"libgcc_s.so.1":          {"libgcc1", "libgcc"},
+	"libgdk-x11-2.0.so.0":    {"libgtk2.0-0", "gtk2"},
+	"libgdk_pixbuf-2.0.so.0": {"libgdk-pixbuf2.0-0", "gdk-pixbuf2"},
+	"libglib-2.0.so.0":       {"libglib2.0-0", "glib2"},
+	"libgobject-2.0.so.0":    {"libglib2.0-0", "glib2"},
+	"libgtk-x11-2.0.so.0":    {"libgtk2.0-0", "gtk2"},
+	"libpango-1.0.so.0":      {"libpango-1.0-0", "pango"},
+	"libpangocairo-1.0.so.0": {"libpango-1.0-0", "pango"},
+	"libpulse.so.0":          {"libpulse0", "pulseaudio-libs"},
+	"libstdc++.so.6":         {"libstdc++6", "libstdc++"},
+	"libxcb.so.1":            {"libxcb1", "libxcb"},
+}
+
+// MissingLibraryError is the error returned when a library required by a
+// binary can not be found.
+type MissingLibraryError struct {
+	// Library is the soname of the missing library.
+	Library string
+
+	// RequiredBy is the path of the binary or library that requires the
+	// missing library, or "extra libraries" if the library was explicitly
+	// requested.
+	RequiredBy string
+}
+
+// Hint returns a suggestion for the distribution package that likely
+// provides the missing library, if known.
+func (e *MissingLibraryError) Hint() string {
+	if h, ok := packageHints[e.Library]; ok {
+		return fmt.Sprintf("try installing `%s` (Debian/Ubuntu) or `%s` (Fedora)", h.debian, h.fedora)
+	}
+	return ""
+}
+
+// Error returns the string representation of a MissingLibraryError.
+func (e *MissingLibraryError) Error() string {
+	s := fmt.Sprintf("dynlib: Failed to find library: %v (required by %v)", e.Library, e.RequiredBy)
+	if hint := e.Hint(); hint != "" {
+		s = s + ", " + hint
+	}
+	return s
+}
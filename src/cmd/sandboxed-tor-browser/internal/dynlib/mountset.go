@@ -0,0 +1,162 @@
+// mountset.go - Sandbox library mount planning.
+// Copyright (C) 2017  Yawning Angel.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package dynlib
+
+import (
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+
+	. "cmd/sandboxed-tor-browser/internal/utils"
+)
+
+const (
+	// MountLibDir is the directory that libraries are mounted in, in a
+	// MountSet.
+	MountLibDir = "/usr/lib"
+
+	// MountLdSoDir is the directory that the dynamic linker is mounted in,
+	// in a MountSet.
+	MountLdSoDir = "/lib"
+)
+
+var distributionLibSearchPath []string
+
+// Mount is a single bind mount or symlink in a MountSet.
+type Mount struct {
+	// Source is the real path for a bind mount, or the target for a
+	// symlink.
+	Source string
+
+	// Target is the path inside the sandbox.
+	Target string
+}
+
+// MountSet is the set of files that must be visible inside a sandbox for a
+// set of binaries to run.
+type MountSet struct {
+	// Libraries is the resolved library set, including the interpreter.
+	Libraries *Libraries
+
+	// Interpreter is the real path of the dynamic linker.
+	Interpreter string
+
+	// InterpreterTarget is the path that the dynamic linker is mounted at.
+	InterpreterTarget string
+
+	// Binds is the list of read-only bind mounts, each real library exactly
+	// once, in a consistent order.
+	Binds []Mount
+
+	// Symlinks is the list of symlinks for the additional aliases of each
+	// library, all pointing at the bind mounted file.
+	Symlinks []Mount
+}
+
+// DistributionLibSearchPath returns the distribution specific library
+// directories, that are searched if a library is neither in the library path
+// nor the cache.
+func DistributionLibSearchPath() []string {
+	return append([]string{}, distributionLibSearchPath...)
+}
+
+// MountSetFor returns the MountSet for the binaries, with the libraries in
+// extraLibs also included, using the system `ld.so.cache`.
+func MountSetFor(binaries []string, extraLibs []string, ldLibraryPath string) (*MountSet, error) {
+	cache, err := LoadCache()
+	if err != nil {
+		return nil, err
+	}
+	fallbackSearchPath := strings.Join(distributionLibSearchPath, string(filepath.ListSeparator))
+	return cache.MountSet(binaries, extraLibs, ldLibraryPath, fallbackSearchPath, ValidateLibraryClass)
+}
+
+// MountSet returns the MountSet for the binaries.  The arguments are as for
+// ResolveLibraries.  Libraries found via ldLibraryPath are omitted as the
+// directories are expected to be mounted as is, and are available in
+// Libraries.LdLibraryPath for the caller to verify that.
+func (c *Cache) MountSet(binaries []string, extraLibs []string, ldLibraryPath, fallbackSearchPath string, filterFn FilterFunc) (*MountSet, error) {
+	// ld-linux(-x86-64).so needs special handling since it needs to be in
+	// a precise location on the filesystem.
+	ldSoPath, ldSoAlias, err := FindLdSo(c)
+	if err != nil {
+		return nil, err
+	}
+	Debugf("dynlib: ld.so appears to be '%v' -> %v.", ldSoAlias, ldSoPath)
+
+	libs, err := c.ResolveLibraries(binaries, extraLibs, ldLibraryPath, fallbackSearchPath, filterFn)
+	if err != nil {
+		return nil, err
+	}
+	return newMountSet(libs, ldSoPath, ldSoAlias), nil
+}
+
+// newMountSet plans the bind mounts and symlinks for the resolved libraries,
+// with the dynamic linker at ldSoPath made available as ldSoAlias.
+func newMountSet(libs *Libraries, ldSoPath, ldSoAlias string) *MountSet {
+	m := &MountSet{
+		Libraries:         libs,
+		Interpreter:       ldSoPath,
+		InterpreterTarget: filepath.Join(MountLdSoDir, filepath.Base(ldSoAlias)),
+	}
+	for _, realLib := range libs.Paths() {
+		if realLib == ldSoPath { // Special handling.
+			m.Binds = append(m.Binds, Mount{realLib, m.InterpreterTarget})
+			continue
+		}
+
+		aliases := append([]string{}, libs.Aliases[realLib]...)
+		sort.Strings(aliases) // Likewise, ensure symlink ordering.
+
+		// Avoid leaking information about exact library versions to cursory
+		// inspection by bind mounting libraries in as the first alias, and
+		// then symlinking off that.
+		src := filepath.Join(MountLibDir, aliases[0])
+		m.Binds = append(m.Binds, Mount{realLib, src})
+		for i, alias := range aliases[1:] {
+			if alias == aliases[i] {
+				continue // Duplicate alias.
+			}
+			m.Symlinks = append(m.Symlinks, Mount{src, filepath.Join(MountLibDir, alias)})
+		}
+	}
+	return m
+}
+
+func init() {
+	searchPaths := []string{
+		"/usr/lib", // Arch Linux.
+	}
+	switch runtime.GOARCH {
+	case "amd64":
+		searchPaths = append([]string{
+			"/usr/lib64",                // Fedora 25
+			"/usr/lib/x86_64-linux-gnu", // Debian
+		}, searchPaths...)
+	case "arm64":
+		searchPaths = append([]string{
+			"/usr/lib64",                 // Fedora
+			"/usr/lib/aarch64-linux-gnu", // Debian
+		}, searchPaths...)
+	default:
+		// Unsupported, IsSupported() will return false.
+		return
+	}
+
+	distributionLibSearchPath = searchPaths
+}
@@ -0,0 +1,111 @@
+// mountset_test.go - Library mount set tests.
+// Copyright (C) 2017  Yawning Angel.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package dynlib
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestNewMountSet(t *testing.T) {
+	const (
+		ldSoPath  = "/usr/lib/x86_64-linux-gnu/ld-2.24.so"
+		ldSoAlias = "/lib64/ld-linux-x86-64.so.2"
+		libFoo    = "/usr/lib/x86_64-linux-gnu/libfoo.so.1.2.3"
+		libBar    = "/usr/lib/x86_64-linux-gnu/libbar.so.4"
+	)
+	libs := newLibraries()
+	for _, v := range []struct{ alias, fn string }{
+		{"libfoo.so.1", libFoo},
+		{"libfoo.so", libFoo},
+		{"libfoo.so.1.2", libFoo},
+		{"libbar.so.4", libBar},
+		{"ld-linux-x86-64.so.2", ldSoPath},
+	} {
+		libs.Aliases[v.fn] = append(libs.Aliases[v.fn], v.alias)
+		libs.Targets[v.alias] = v.fn
+	}
+
+	m := newMountSet(libs, ldSoPath, ldSoAlias)
+	if m.InterpreterTarget != "/lib/ld-linux-x86-64.so.2" {
+		t.Errorf("InterpreterTarget = %v", m.InterpreterTarget)
+	}
+
+	// Each library is bind mounted exactly once, as it's first alias, and
+	// the remaining aliases are symlinks to that, so that all three of
+	// libfoo's aliases are visible to the dynamic linker.
+	fooTarget := filepath.Join(MountLibDir, "libfoo.so")
+	expectedBinds := []Mount{
+		{ldSoPath, m.InterpreterTarget},
+		{libBar, filepath.Join(MountLibDir, "libbar.so.4")},
+		{libFoo, fooTarget},
+	}
+	expectedSymlinks := []Mount{
+		{fooTarget, filepath.Join(MountLibDir, "libfoo.so.1")},
+		{fooTarget, filepath.Join(MountLibDir, "libfoo.so.1.2")},
+	}
+	if !reflect.DeepEqual(m.Binds, expectedBinds) {
+		t.Errorf("Binds = %v, expected %v", m.Binds, expectedBinds)
+	}
+	if !reflect.DeepEqual(m.Symlinks, expectedSymlinks) {
+		t.Errorf("Symlinks = %v, expected %v", m.Symlinks, expectedSymlinks)
+	}
+
+	// Duplicate aliases do not result in duplicate symlinks.
+	libs.Aliases[libFoo] = append(libs.Aliases[libFoo], "libfoo.so.1")
+	if m = newMountSet(libs, ldSoPath, ldSoAlias); !reflect.DeepEqual(m.Symlinks, expectedSymlinks) {
+		t.Errorf("Symlinks = %v, expected %v", m.Symlinks, expectedSymlinks)
+	}
+}
+
+func TestMountSet(t *testing.T) {
+	c := loadHostCache(t)
+	m, err := c.MountSet(testBinaries, nil, "", "", nil)
+	if err != nil {
+		t.Fatalf("MountSet() = %v", err)
+	}
+
+	bound := make(map[string]bool)
+	visible := make(map[string]bool)
+	for _, v := range m.Binds {
+		if bound[v.Source] {
+			t.Errorf("library bind mounted more than once: %v", v.Source)
+		}
+		bound[v.Source] = true
+		visible[v.Target] = true
+	}
+	for _, v := range m.Symlinks {
+		if !visible[v.Source] {
+			t.Errorf("symlink %v points at %v, which is not bind mounted", v.Target, v.Source)
+		}
+		visible[v.Target] = true
+	}
+	if !bound[m.Interpreter] {
+		t.Errorf("interpreter %v is not bind mounted", m.Interpreter)
+	}
+	for realLib, aliases := range m.Libraries.Aliases {
+		if realLib == m.Interpreter {
+			continue
+		}
+		for _, alias := range aliases {
+			if !visible[filepath.Join(MountLibDir, alias)] {
+				t.Errorf("alias %v of %v is not visible", alias, realLib)
+			}
+		}
+	}
+}
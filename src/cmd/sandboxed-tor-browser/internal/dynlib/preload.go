@@ -0,0 +1,49 @@
+// preload.go - LD_PRELOAD parsing.
+// Copyright (C) 2017  Yawning Angel.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package dynlib
+
+import (
+	"path/filepath"
+	"strings"
+)
+
+// ParseLdPreload splits an `LD_PRELOAD` style list of libraries, separated by
+// spaces and/or colons as with glibc, into entries suitable for the extraLibs
+// argument of ResolveLibraries, so that the preloaded libraries and all of
+// their dependencies are part of the result.  Entries containing a `/` are
+// paths, which are made absolute relative to the current working directory
+// like the loader would, and the rest are sonames that are searched for like
+// any other dependency.  Duplicate entries are omitted.
+func ParseLdPreload(ldPreload string) ([]string, error) {
+	var libs []string
+	seen := make(map[string]bool)
+	for _, lib := range strings.FieldsFunc(ldPreload, func(r rune) bool { return r == ' ' || r == ':' }) {
+		if strings.ContainsRune(lib, '/') && !filepath.IsAbs(lib) {
+			abs, err := filepath.Abs(lib)
+			if err != nil {
+				return nil, err
+			}
+			lib = abs
+		}
+		if seen[lib] {
+			continue
+		}
+		seen[lib] = true
+		libs = append(libs, lib)
+	}
+	return libs, nil
+}
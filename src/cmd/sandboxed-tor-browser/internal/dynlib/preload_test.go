@@ -0,0 +1,102 @@
+// preload_test.go - LD_PRELOAD parsing tests.
+// Copyright (C) 2017  Yawning Angel.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package dynlib
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"testing"
+)
+
+func TestParseLdPreload(t *testing.T) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatalf("failed to get the working directory: %v", err)
+	}
+
+	for _, v := range []struct {
+		ldPreload string
+		expected  []string
+	}{
+		{"", nil},
+		{" : ", nil},
+		{"libfoo.so.1", []string{"libfoo.so.1"}},
+		{"libfoo.so.1 libbar.so.2", []string{"libfoo.so.1", "libbar.so.2"}},
+		{"libfoo.so.1:libbar.so.2", []string{"libfoo.so.1", "libbar.so.2"}},
+		{" libfoo.so.1 :: libbar.so.2: ", []string{"libfoo.so.1", "libbar.so.2"}},
+		{"/usr/lib/libfoo.so.1 libfoo.so.1", []string{"/usr/lib/libfoo.so.1", "libfoo.so.1"}},
+		{"lib/libfoo.so.1", []string{filepath.Join(wd, "lib/libfoo.so.1")}},
+		{"./libfoo.so.1", []string{filepath.Join(wd, "libfoo.so.1")}},
+		{"libfoo.so.1 libbar.so.2 libfoo.so.1", []string{"libfoo.so.1", "libbar.so.2"}},
+		{"./libfoo.so.1 " + filepath.Join(wd, "libfoo.so.1"), []string{filepath.Join(wd, "libfoo.so.1")}},
+	} {
+		libs, err := ParseLdPreload(v.ldPreload)
+		if err != nil {
+			t.Errorf("ParseLdPreload(%q) = %v", v.ldPreload, err)
+		} else if !reflect.DeepEqual(libs, v.expected) {
+			t.Errorf("ParseLdPreload(%q) = %q, expected %q", v.ldPreload, libs, v.expected)
+		}
+	}
+}
+
+func TestResolveLibrariesLdPreload(t *testing.T) {
+	c := loadHostCache(t)
+	c.SetResolveCache("", "")
+	if runtime.GOARCH != "amd64" {
+		t.Skipf("fixtures are x86-64, host is %v", runtime.GOARCH)
+	}
+
+	// The preloaded library is not in the cache, and depends on libm,
+	// which the test binaries do not.
+	const name = "libpreloadtest.so.1"
+	b, err := ioutil.ReadFile("testdata/elf64-dynamic")
+	if err != nil {
+		t.Fatalf("failed to read the fixture: %v", err)
+	}
+	dir := t.TempDir()
+	writeConfFiles(t, dir, map[string]string{name: string(b)})
+	c.confDirs = []string{dir}
+
+	baseline, err := c.ResolveLibraries(testBinaries, nil, "", "", nil)
+	if err != nil {
+		t.Fatalf("ResolveLibraries() = %v", err)
+	}
+	if _, ok := baseline.Targets["libm.so.6"]; ok {
+		t.Skipf("the test binaries depend on libm.so.6")
+	}
+
+	for _, ldPreload := range []string{name, filepath.Join(dir, name)} {
+		extraLibs, err := ParseLdPreload(ldPreload)
+		if err != nil {
+			t.Fatalf("ParseLdPreload(%v) = %v", ldPreload, err)
+		}
+		libs, err := c.ResolveLibraries(testBinaries, extraLibs, "", "", nil)
+		if err != nil {
+			t.Errorf("%v: ResolveLibraries() = %v", ldPreload, err)
+			continue
+		}
+		if _, ok := libs.Aliases[filepath.Join(dir, name)]; !ok {
+			t.Errorf("%v: ResolveLibraries() is missing the preloaded library", ldPreload)
+		}
+		if p := libs.Targets["libm.so.6"]; p == "" {
+			t.Errorf("%v: ResolveLibraries() libm.so.6 = '%v', expected the transitive dependency", ldPreload, p)
+		}
+	}
+}
@@ -0,0 +1,148 @@
+// resolvecache.go - On-disk cache of resolved libraries.
+// Copyright (C) 2017  Yawning Angel.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package dynlib
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+
+	. "cmd/sandboxed-tor-browser/internal/utils"
+)
+
+// resolveCache is the on-disk cache of ResolveLibraries results.  The entire
+// cache is invalidated if either the `ld.so.cache` file or the version
+// changes.
+type resolveCache struct {
+	LdSoCacheMtime int64                 `json:"ldSoCacheMtime"`
+	Version        string                `json:"version"`
+	Entries        map[string]*Libraries `json:"entries"`
+}
+
+// resolveCacheFormat is mixed into the cache keys, and should be bumped
+// whenever the contents of a ResolveLibraries result change.
+const resolveCacheFormat = "5"
+
+// SetResolveCache enables caching ResolveLibraries results in the file at
+// path.  The version should change whenever the binaries being resolved do
+// (Eg: the bundle version).
+func (c *Cache) SetResolveCache(path, version string) {
+	c.resolveCachePath = path
+	c.resolveCacheVersion = version
+}
+
+func resolveCacheKey(binaries []string, extraLibs []string, ldLibraryPath, fallbackSearchPath string, confDirs []string) string {
+	h := sha256.New()
+	write := func(v []string) {
+		v = append([]string{}, v...)
+		sort.Strings(v)
+		for _, s := range v {
+			h.Write([]byte(s))
+			h.Write([]byte{0x00})
+		}
+		h.Write([]byte{0x00})
+	}
+	write([]string{resolveCacheFormat})
+	write(binaries)
+	write(extraLibs)
+	write([]string{ldLibraryPath, fallbackSearchPath})
+	write([]string{strings.Join(confDirs, ":")})
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func (c *Cache) loadResolveCache() *resolveCache {
+	rc := &resolveCache{
+		LdSoCacheMtime: c.mtime,
+		Version:        c.resolveCacheVersion,
+		Entries:        make(map[string]*Libraries),
+	}
+
+	b, err := ioutil.ReadFile(c.resolveCachePath)
+	if err != nil {
+		return rc
+	}
+	var onDisk resolveCache
+	if err = json.Unmarshal(b, &onDisk); err != nil {
+		Debugf("dynlib: Discarding corrupted resolve cache: %v", err)
+		return rc
+	}
+	if onDisk.LdSoCacheMtime != rc.LdSoCacheMtime || onDisk.Version != rc.Version || onDisk.Entries == nil {
+		Debugf("dynlib: Discarding stale resolve cache.")
+		return rc
+	}
+	return &onDisk
+}
+
+func (c *Cache) getCachedLibraries(key string, binaries []string, filterFn FilterFunc) *Libraries {
+	if c.resolveCachePath == "" {
+		return nil
+	}
+
+	libs := c.loadResolveCache().Entries[key]
+	if libs == nil || libs.Aliases == nil || libs.Targets == nil {
+		return nil
+	}
+
+	// A previously skipped binary must still be missing, and skipping must
+	// still be allowed.
+	for _, fn := range libs.Skipped {
+		if !c.skipMissingBinaries || FileExists(fn) {
+			return nil
+		}
+	}
+
+	// The filter and existence checks are cheap compared to parsing all
+	// of the ELF headers, so re-do them.
+	for _, fn := range binaries {
+		if filterFn != nil && filterFn(fn) != nil {
+			return nil
+		}
+	}
+	for _, fn := range libs.LdLibraryPath {
+		if !FileExists(fn) {
+			return nil
+		}
+	}
+	for fn := range libs.Aliases {
+		if !FileExists(fn) {
+			return nil
+		}
+		if filterFn != nil && filterFn(fn) != nil {
+			return nil
+		}
+	}
+	return libs
+}
+
+func (c *Cache) putCachedLibraries(key string, libs *Libraries) {
+	if c.resolveCachePath == "" {
+		return
+	}
+
+	rc := c.loadResolveCache()
+	rc.Entries[key] = libs
+	if b, err := json.Marshal(rc); err != nil {
+		Debugf("dynlib: Failed to serialize resolve cache: %v", err)
+	} else if err = ioutil.WriteFile(c.resolveCachePath, b, FileMode); err != nil {
+		Debugf("dynlib: Failed to write resolve cache: %v", err)
+		os.Remove(c.resolveCachePath)
+	}
+}
@@ -0,0 +1,149 @@
+// resolvecache_test.go - On-disk cache of resolved libraries tests.
+// Copyright (C) 2017  Yawning Angel.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package dynlib
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	. "cmd/sandboxed-tor-browser/internal/utils"
+)
+
+// testBinaries are dynamically linked binaries that are present on any
+// reasonable host.
+var testBinaries = []string{"/bin/ls", "/usr/bin/env"}
+
+// loadHostCache returns the host `ld.so.cache`, skipping the test if dynlib
+// can not be used.
+func loadHostCache(tb testing.TB) *Cache {
+	if !IsSupported() {
+		tb.Skip("dynlib is unsupported on this host")
+	}
+	for _, fn := range testBinaries {
+		if !FileExists(fn) {
+			tb.Skipf("missing test binary: %v", fn)
+		}
+	}
+	c, err := LoadCache()
+	if err != nil {
+		tb.Fatalf("LoadCache() = %v", err)
+	}
+	return c
+}
+
+func TestResolveCache(t *testing.T) {
+	c := loadHostCache(t)
+	path := filepath.Join(t.TempDir(), "resolve-cache.json")
+	c.SetResolveCache(path, "1")
+
+	resolve := func() *Libraries {
+		libs, err := c.ResolveLibraries(testBinaries, nil, "", "", nil)
+		if err != nil {
+			t.Fatalf("ResolveLibraries() = %v", err)
+		}
+		return libs
+	}
+	resolve()
+
+	// Tag the on-disk entry, so that cache hits are identifiable.
+	const marker = "libresolvecachetest.so"
+	rc := c.loadResolveCache()
+	if len(rc.Entries) != 1 {
+		t.Fatalf("resolve cache has %v entries, expected 1", len(rc.Entries))
+	}
+	for _, libs := range rc.Entries {
+		libs.Targets[marker] = testBinaries[0]
+	}
+	b, err := json.Marshal(rc)
+	if err != nil {
+		t.Fatalf("failed to serialize resolve cache: %v", err)
+	}
+	if err = ioutil.WriteFile(path, b, FileMode); err != nil {
+		t.Fatalf("failed to write resolve cache: %v", err)
+	}
+
+	if libs := resolve(); libs.Targets[marker] == "" {
+		t.Errorf("ResolveLibraries() did not use the cached entry")
+	}
+
+	// Changing the version invalidates the entire cache.
+	c.SetResolveCache(path, "2")
+	if libs := resolve(); libs.Targets[marker] != "" {
+		t.Errorf("ResolveLibraries() used a cached entry from another version")
+	}
+
+	// A corrupted cache is discarded, and replaced.
+	if err = ioutil.WriteFile(path, []byte("{\"entries\": "), FileMode); err != nil {
+		t.Fatalf("failed to corrupt resolve cache: %v", err)
+	}
+	if libs := resolve(); len(libs.Targets) == 0 {
+		t.Errorf("ResolveLibraries() returned no libraries with a corrupted cache")
+	}
+	b, err = ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("failed to read resolve cache: %v", err)
+	}
+	if err = json.Unmarshal(b, &resolveCache{}); err != nil {
+		t.Errorf("corrupted resolve cache was not replaced: %v", err)
+	}
+}
+
+func TestResolveCacheKey(t *testing.T) {
+	k := resolveCacheKey([]string{"a", "b"}, nil, "", "", nil)
+	if k != resolveCacheKey([]string{"b", "a"}, nil, "", "", nil) {
+		t.Errorf("resolveCacheKey() depends on the binary order")
+	}
+	for _, other := range []string{
+		resolveCacheKey([]string{"a"}, []string{"b"}, "", "", nil),
+		resolveCacheKey([]string{"a", "b"}, nil, "/lib", "", nil),
+		resolveCacheKey([]string{"a", "b"}, nil, "", "/lib", nil),
+		resolveCacheKey([]string{"a", "b"}, nil, "", "", []string{"/etc/ld.so.conf.d"}),
+	} {
+		if k == other {
+			t.Errorf("resolveCacheKey() collision: %v", k)
+		}
+	}
+}
+
+func BenchmarkResolveLibrariesCold(b *testing.B) {
+	c := loadHostCache(b)
+	c.SetResolveCache("", "")
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := c.ResolveLibraries(testBinaries, nil, "", "", nil); err != nil {
+			b.Fatalf("ResolveLibraries() = %v", err)
+		}
+	}
+}
+
+func BenchmarkResolveLibrariesWarm(b *testing.B) {
+	c := loadHostCache(b)
+	c.SetResolveCache(filepath.Join(b.TempDir(), "resolve-cache.json"), "1")
+	if _, err := c.ResolveLibraries(testBinaries, nil, "", "", nil); err != nil {
+		b.Fatalf("ResolveLibraries() = %v", err)
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := c.ResolveLibraries(testBinaries, nil, "", "", nil); err != nil {
+			b.Fatalf("ResolveLibraries() = %v", err)
+		}
+	}
+}
@@ -32,7 +32,7 @@ func init() {
 	StaticHPKPPins = hpkp.NewMemStorage()
 
 	var parsedPins map[string][]string
-	if d, err := data.Asset("installer/hpkp.json"); err != nil {
+	if d, err := data.Load("installer/hpkp.json"); err != nil {
 		panic(err)
 	} else if err = json.Unmarshal(d, &parsedPins); err != nil {
 		panic(err)
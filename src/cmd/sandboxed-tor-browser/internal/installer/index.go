@@ -0,0 +1,131 @@
+// index.go - Download server index routines.
+// Copyright (C) 2017  Yawning Angel.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package installer
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+
+	"cmd/sandboxed-tor-browser/internal/ui/config"
+)
+
+var (
+	indexDirRe       = regexp.MustCompile(`href="([^"/?]+)/"`)
+	releaseVersionRe = regexp.MustCompile(`^[0-9]+\.[0-9]+(\.[0-9]+)*$`)
+	alphaVersionRe   = regexp.MustCompile(`^[0-9]+\.[0-9]+(\.[0-9]+)*a[0-9]+$`)
+	versionPartRe    = regexp.MustCompile(`[0-9]+`)
+)
+
+// IndexURL returns the URL of the download server's directory index that
+// lists the released versions, or the bundles for a given version if version
+// is not empty.
+func IndexURL(version string) string {
+	u := CanonicalMirror + "torbrowser/"
+	if version != "" {
+		u = u + version + "/"
+	}
+	return u
+}
+
+// AvailableVersions parses the download server's version directory index,
+// and returns the versions offered for the configured channel, oldest first.
+func AvailableVersions(cfg *config.Config, b []byte) ([]string, error) {
+	var re *regexp.Regexp
+	switch cfg.Channel {
+	case "release":
+		re = releaseVersionRe
+	case "alpha":
+		re = alphaVersionRe
+	default:
+		return nil, fmt.Errorf("no version index for channel: %v", cfg.Channel)
+	}
+
+	var versions []string
+	for _, m := range indexDirRe.FindAllSubmatch(b, -1) {
+		if v := string(m[1]); re.MatchString(v) {
+			versions = append(versions, v)
+		}
+	}
+	if len(versions) == 0 {
+		return nil, fmt.Errorf("no versions found for channel: %v", cfg.Channel)
+	}
+	sort.Sort(versionList(versions))
+	return versions, nil
+}
+
+// AvailableLocales parses the download server's directory index for version,
+// and returns the locales that the bundle is offered in for the configured
+// architecture, sorted.
+func AvailableLocales(cfg *config.Config, version string, b []byte) ([]string, error) {
+	re, err := regexp.Compile(`href="tor-browser-` + regexp.QuoteMeta(cfg.Architecture) + `-` + regexp.QuoteMeta(version) + `_([A-Za-z-]+)\.tar\.xz"`)
+	if err != nil {
+		return nil, err
+	}
+
+	seen := make(map[string]bool)
+	var locales []string
+	for _, m := range re.FindAllSubmatch(b, -1) {
+		if l := string(m[1]); !seen[l] {
+			seen[l] = true
+			locales = append(locales, l)
+		}
+	}
+	if len(locales) == 0 {
+		return nil, fmt.Errorf("no %v bundles found for version: %v", cfg.Architecture, version)
+	}
+	sort.Strings(locales)
+	return locales, nil
+}
+
+type versionList []string
+
+func (l versionList) Len() int {
+	return len(l)
+}
+
+func (l versionList) Less(i, j int) bool {
+	return compareVersions(l[i], l[j]) < 0
+}
+
+func (l versionList) Swap(i, j int) {
+	l[i], l[j] = l[j], l[i]
+}
+
+// compareVersions compares two Tor Browser version strings numerically,
+// returning -1, 0, or 1.
+func compareVersions(a, b string) int {
+	aParts, bParts := versionPartRe.FindAllString(a, -1), versionPartRe.FindAllString(b, -1)
+	for i := 0; i < len(aParts) && i < len(bParts); i++ {
+		aN, _ := strconv.Atoi(aParts[i])
+		bN, _ := strconv.Atoi(bParts[i])
+		if aN != bN {
+			if aN < bN {
+				return -1
+			}
+			return 1
+		}
+	}
+	switch {
+	case len(aParts) < len(bParts):
+		return -1
+	case len(aParts) > len(bParts):
+		return 1
+	}
+	return 0
+}
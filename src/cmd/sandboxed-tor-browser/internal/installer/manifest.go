@@ -0,0 +1,40 @@
+// manifest.go - Installed bundle manifest.
+// Copyright (C) 2017  Yawning Angel.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package installer
+
+import (
+	"errors"
+
+	"cmd/sandboxed-tor-browser/internal/ui/config"
+	. "cmd/sandboxed-tor-browser/internal/utils"
+)
+
+// ErrNotInstalled is the error returned when there is no installed bundle.
+var ErrNotInstalled = errors.New("no Tor Browser bundle is installed")
+
+// InstalledManifest returns the manifest of the installed bundle, which is
+// written after each successful install or update.
+func InstalledManifest(cfg *config.Config) (*config.Manifest, error) {
+	m, err := config.LoadManifest(cfg)
+	if err != nil {
+		return nil, err
+	}
+	if m == nil || !DirExists(cfg.BundleInstallDir) {
+		return nil, ErrNotInstalled
+	}
+	return m, nil
+}
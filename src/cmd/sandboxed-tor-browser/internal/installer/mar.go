@@ -141,7 +141,7 @@ func init() {
 	}
 
 	for _, asset := range assets {
-		if der, err := data.Asset(asset); err != nil {
+		if der, err := data.Load(asset); err != nil {
 			panic(err)
 		} else if cert, err := x509.ParseCertificate(der); err != nil {
 			panic("failed to parse TBB MAR signing cert:" + err.Error())
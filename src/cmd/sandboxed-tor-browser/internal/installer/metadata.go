@@ -22,9 +22,11 @@ import (
 	"encoding/json"
 	"encoding/xml"
 	"fmt"
+	"strings"
 
 	"cmd/sandboxed-tor-browser/internal/data"
 	"cmd/sandboxed-tor-browser/internal/ui/config"
+	. "cmd/sandboxed-tor-browser/internal/utils"
 )
 
 type installURLs struct {
@@ -52,28 +54,89 @@ type DownloadsEntry struct {
 	Binary string
 }
 
+// CanonicalMirror is the base URL of the canonical Tor Browser download
+// server.
+const CanonicalMirror = "https://dist.torproject.org/"
+
+// MirrorDownloadsEntry returns a DownloadsEntry with the URLs rewritten to
+// point to the mirror at the base URL mirror.  The mirror is expected to have
+// the same layout as the canonical download server.
+func MirrorDownloadsEntry(e *DownloadsEntry, mirror string) (*DownloadsEntry, error) {
+	if mirror == CanonicalMirror {
+		return e, nil
+	}
+	if !strings.HasSuffix(mirror, "/") {
+		mirror = mirror + "/"
+	}
+
+	m := new(DownloadsEntry)
+	for _, v := range []struct {
+		src string
+		dst *string
+	}{
+		{e.Binary, &m.Binary},
+		{e.Sig, &m.Sig},
+	} {
+		if !strings.HasPrefix(v.src, CanonicalMirror) {
+			return nil, fmt.Errorf("download not on the canonical server: %v", v.src)
+		}
+		*v.dst = mirror + strings.TrimPrefix(v.src, CanonicalMirror)
+	}
+	return m, nil
+}
+
+// PinnedDownloadsEntry returns a DownloadsEntry with the URLs rewritten to
+// point to the bundle for the pinned version instead of the current version.
+func PinnedDownloadsEntry(e *DownloadsEntry, version, pinned string) (*DownloadsEntry, error) {
+	m := new(DownloadsEntry)
+	for _, v := range []struct {
+		src string
+		dst *string
+	}{
+		{e.Binary, &m.Binary},
+		{e.Sig, &m.Sig},
+	} {
+		if !strings.Contains(v.src, version) {
+			return nil, fmt.Errorf("download does not contain the version: %v", v.src)
+		}
+		*v.dst = strings.Replace(v.src, version, pinned, -1)
+	}
+	return m, nil
+}
+
 // DownloadsURL returns the `downloads.json` URL for the configured channel.
+// Channels that are not mirrored to an onion service (eg: `nightly`) use the
+// regular URL even if useOnion is set.
 func DownloadsURL(cfg *config.Config, useOnion bool) string {
-	if useOnion {
-		return urls.DownloadsOnions[cfg.Channel]
+	if u := urls.DownloadsOnions[cfg.Channel]; useOnion && u != "" {
+		return u
 	}
 	return urls.DownloadsURLs[cfg.Channel]
 }
 
-// GetDownloadsEntry parses the json file and returns the Version and
-// appropriate DownloadsEntry for the current configuration.
-func GetDownloadsEntry(cfg *config.Config, b []byte) (string, *DownloadsEntry, error) {
+// GetDownloadsEntry parses the json file and returns the Version, locale and
+// appropriate DownloadsEntry for the current configuration.  If there are no
+// downloads for the configured locale, the locales from
+// `cfg.LocaleFallbacks()` are tried in order.
+func GetDownloadsEntry(cfg *config.Config, b []byte) (string, string, *DownloadsEntry, error) {
 	d := &downloads{}
 	if err := json.Unmarshal(b, &d); err != nil {
-		return "", nil, err
+		return "", "", nil, err
+	}
+	a := d.Downloads[cfg.Architecture]
+	if a == nil {
+		return "", "", nil, fmt.Errorf("no downloads for architecture: %v", cfg.Architecture)
 	}
-	if a := d.Downloads[cfg.Architecture]; a == nil {
-		return "", nil, fmt.Errorf("no downloads for architecture: %v", cfg.Architecture)
-	} else if e := a[cfg.Locale]; e == nil {
-		return "", nil, fmt.Errorf("no downloads for locale: %v", cfg.Locale)
-	} else {
-		return d.Version, e, nil
+	locales := cfg.LocaleFallbacks()
+	for i, l := range locales {
+		if e := a[l]; e != nil {
+			return d.Version, l, e, nil
+		}
+		if i < len(locales)-1 {
+			Infof("installer: No downloads for locale %v, falling back to %v.", l, locales[i+1])
+		}
 	}
+	return "", "", nil, fmt.Errorf("no downloads for locale: %v", cfg.Locale)
 }
 
 type updates struct {
@@ -109,6 +172,9 @@ func UpdateURL(manif *config.Manifest, useOnion bool) (string, error) {
 	if useOnion {
 		base = urls.UpdateOnions[manif.Channel]
 	}
+	if base == "" {
+		return "", fmt.Errorf("no update URL for channel: %v", manif.Channel)
+	}
 
 	arch := ""
 	switch manif.Architecture {
@@ -119,7 +185,7 @@ func UpdateURL(manif *config.Manifest, useOnion bool) (string, error) {
 	default:
 		return "", fmt.Errorf("unsupported architecture for update: %v", manif.Architecture)
 	}
-	return fmt.Sprintf("%s/%s/%s/%s", base, arch, manif.Version, manif.Locale), nil
+	return fmt.Sprintf("%s/%s/%s/%s", base, arch, manif.Version, manif.BundleLocale()), nil
 }
 
 // GetUpdateEntry parses the xml file and returns the UpdateEntry if any.
@@ -140,7 +206,7 @@ func GetUpdateEntry(b []byte) (*UpdateEntry, error) {
 
 func init() {
 	urls = new(installURLs)
-	if b, err := data.Asset("installer/urls.json"); err != nil {
+	if b, err := data.Load("installer/urls.json"); err != nil {
 		panic(err)
 	} else if err = json.Unmarshal(b, &urls); err != nil {
 		panic(err)
@@ -0,0 +1,80 @@
+// metadata_test.go - Tor Browser install/update metadata tests.
+// Copyright (C) 2016  Yawning Angel.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package installer
+
+import (
+	"strings"
+	"testing"
+
+	"cmd/sandboxed-tor-browser/internal/ui/config"
+)
+
+var testDownloadsEntry = &DownloadsEntry{
+	Binary: "https://dist.torproject.org/torbrowser/7.0/tor-browser-linux64-7.0_en-US.tar.xz",
+	Sig:    "https://dist.torproject.org/torbrowser/7.0/tor-browser-linux64-7.0_en-US.tar.xz.asc",
+}
+
+func TestMirrorDownloadsEntry(t *testing.T) {
+	if e, err := MirrorDownloadsEntry(testDownloadsEntry, CanonicalMirror); err != nil || e != testDownloadsEntry {
+		t.Errorf("MirrorDownloadsEntry(canonical) = %v, %v", e, err)
+	}
+
+	for _, mirror := range []string{"https://mirror.example.com/tor", "https://mirror.example.com/tor/"} {
+		e, err := MirrorDownloadsEntry(testDownloadsEntry, mirror)
+		if err != nil {
+			t.Errorf("MirrorDownloadsEntry(%v) = %v", mirror, err)
+			continue
+		}
+		if expected := "https://mirror.example.com/tor/torbrowser/7.0/tor-browser-linux64-7.0_en-US.tar.xz"; e.Binary != expected {
+			t.Errorf("MirrorDownloadsEntry(%v): Binary = %v, expected %v", mirror, e.Binary, expected)
+		}
+		if expected := "https://mirror.example.com/tor/torbrowser/7.0/tor-browser-linux64-7.0_en-US.tar.xz.asc"; e.Sig != expected {
+			t.Errorf("MirrorDownloadsEntry(%v): Sig = %v, expected %v", mirror, e.Sig, expected)
+		}
+	}
+
+	offsite := &DownloadsEntry{
+		Binary: "https://elsewhere.example.com/tor-browser-linux64-7.0_en-US.tar.xz",
+		Sig:    testDownloadsEntry.Sig,
+	}
+	if _, err := MirrorDownloadsEntry(offsite, "https://mirror.example.com/"); err == nil {
+		t.Errorf("MirrorDownloadsEntry() rewrote a download not on the canonical server")
+	}
+}
+
+func TestChannelURLs(t *testing.T) {
+	for _, channel := range config.Channels {
+		if channel == "hardened" {
+			// Discontinued, existing installs are forced to reinstall.
+			continue
+		}
+
+		cfg := &config.Config{Channel: channel}
+		for _, useOnion := range []bool{false, true} {
+			if u := DownloadsURL(cfg, useOnion); !strings.HasSuffix(u, "/downloads.json") {
+				t.Errorf("%v: DownloadsURL(onion: %v) = '%v'", channel, useOnion, u)
+			}
+		}
+
+		manif := &config.Manifest{Version: "7.0", Architecture: "linux64", Channel: channel, Locale: "en-US"}
+		if u, err := UpdateURL(manif, false); err != nil {
+			t.Errorf("%v: UpdateURL() = %v", channel, err)
+		} else if !strings.HasSuffix(u, "/Linux_x86_64-gcc3/7.0/en-US") {
+			t.Errorf("%v: UpdateURL() = '%v'", channel, u)
+		}
+	}
+}
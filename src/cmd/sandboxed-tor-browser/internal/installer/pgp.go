@@ -18,7 +18,9 @@ package installer
 
 import (
 	"bytes"
+	"encoding/hex"
 	"fmt"
+	"strings"
 	"time"
 
 	"golang.org/x/crypto/openpgp"
@@ -29,6 +31,10 @@ import (
 const (
 	tbbSigningKeyID    = 0x4E2C6E8793298290
 	tbbSigningKeyAsset = "installer/0x4E2C6E8793298290.asc"
+
+	// TorBrowserSigningKeyFingerprint is the fingerprint of the Tor Browser
+	// Developers signing key that all bundles must be signed with.
+	TorBrowserSigningKeyFingerprint = "EF6E286DDA85EA2A4BA7DE684E2C6E8793298290"
 )
 
 var tbbKeyRing openpgp.KeyRing
@@ -37,6 +43,9 @@ var tbbPgpKey *openpgp.Entity
 // ValidatePGPSignature validates the bundle and signature pair against the TBB
 // key ring.
 func ValidatePGPSignature(bundle, signature []byte) error {
+	if len(bundle) == 0 || len(signature) == 0 {
+		return fmt.Errorf("missing bundle or signature")
+	}
 	if ent, err := openpgp.CheckArmoredDetachedSignature(tbbKeyRing, bytes.NewReader(bundle), bytes.NewReader(signature)); err != nil {
 		return err
 	} else if ent != tbbPgpKey {
@@ -48,7 +57,7 @@ func ValidatePGPSignature(bundle, signature []byte) error {
 func init() {
 	var err error
 
-	pem, err := data.Asset(tbbSigningKeyAsset)
+	pem, err := data.Load(tbbSigningKeyAsset)
 	if err != nil {
 		panic(err)
 	}
@@ -67,6 +76,12 @@ func init() {
 	}
 	tbbPgpKey = keys[0].Entity
 
+	// Ensure that the key is the one that it is supposed to be.
+	fp := hex.EncodeToString(tbbPgpKey.PrimaryKey.Fingerprint[:])
+	if strings.ToUpper(fp) != TorBrowserSigningKeyFingerprint {
+		panic("tbb PGP key has an unexpected fingerprint: " + fp)
+	}
+
 	// Ensure that at least one subkey hasn't expired.
 	sigValid := false
 	for _, subKey := range tbbPgpKey.Subkeys {
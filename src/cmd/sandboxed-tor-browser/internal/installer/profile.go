@@ -0,0 +1,123 @@
+// profile.go - Browser profile directory routines.
+// Copyright (C) 2017  Yawning Angel.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package installer
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+
+	"cmd/sandboxed-tor-browser/internal/ui/config"
+	. "cmd/sandboxed-tor-browser/internal/utils"
+)
+
+// bundleProfileSubDir is the location of the browser profile relative to
+// the installed bundle.
+const bundleProfileSubDir = "Browser/TorBrowser/Data/Browser/profile.default"
+
+// bundleProfileExcludes are the entries of the bundle's profile that are
+// part of the bundle itself, and are mounted read-only from it at launch.
+var bundleProfileExcludes = map[string]bool{
+	"preferences": true,
+	"extensions":  true,
+}
+
+// InitProfileDir ensures that the mutable browser profile directory, which
+// is kept outside of the bundle so that it survives reinstalls, exists.
+//
+// Installs made by older versions kept the profile inside the bundle, so if
+// the profile directory does not exist yet, and the installed bundle has a
+// profile, it is copied out.  The copy is made into a temporary directory
+// that is only renamed into place once complete, and the copy inside the
+// bundle is left untouched, and discarded with the rest of the bundle on
+// the next reinstall.
+func InitProfileDir(cfg *config.Config) error {
+	if DirExists(cfg.ProfileDir) {
+		return nil
+	}
+
+	oldDir := filepath.Join(cfg.BundleInstallDir, bundleProfileSubDir)
+	if !DirExists(oldDir) {
+		return MkdirAllPrivate(cfg.ProfileDir)
+	}
+
+	Debugf("installer: Migrating profile: %v -> %v", oldDir, cfg.ProfileDir)
+	tmpDir := cfg.ProfileDir + tmpSuffix
+	if err := os.RemoveAll(tmpDir); err != nil {
+		return err
+	}
+	if err := copyProfileDir(tmpDir, oldDir); err != nil {
+		os.RemoveAll(tmpDir)
+		return err
+	}
+	return os.Rename(tmpDir, cfg.ProfileDir)
+}
+
+func copyProfileDir(dst, src string) error {
+	return filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		relPath, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		if bundleProfileExcludes[relPath] {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		dstPath := filepath.Join(dst, relPath)
+
+		switch m := info.Mode(); {
+		case m.IsDir():
+			return os.MkdirAll(dstPath, DirMode)
+		case m.IsRegular():
+			return copyFile(dstPath, path, m.Perm())
+		case m&os.ModeSymlink != 0:
+			target, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			return os.Symlink(target, dstPath)
+		default:
+			// Sockets and the like are runtime state, and not worth keeping.
+			Debugf("installer: Skipping irregular profile entry: %v", path)
+			return nil
+		}
+	})
+}
+
+func copyFile(dst, src string, perm os.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_EXCL|os.O_WRONLY, perm)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
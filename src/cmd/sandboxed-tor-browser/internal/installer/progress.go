@@ -0,0 +1,72 @@
+// progress.go - Install progress reporting.
+// Copyright (C) 2017  Yawning Angel.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package installer
+
+import (
+	"io"
+	"time"
+)
+
+// The install phases reported via Progress.
+const (
+	PhaseCheck    = "check"
+	PhaseDownload = "download"
+	PhaseVerify   = "verify"
+	PhaseExtract  = "extract"
+)
+
+// progressInterval is the minimum interval between progress callbacks for
+// the same phase.
+const progressInterval = 250 * time.Millisecond
+
+// Progress is an install progress report.
+type Progress struct {
+	// Phase is the current install phase (Eg: PhaseDownload).
+	Phase string
+
+	// BytesDone and BytesTotal are the bytes processed so far, and the
+	// expected total (0 if unknown).  When extracting, these refer to the
+	// compressed archive.
+	BytesDone  uint64
+	BytesTotal uint64
+
+	// Filename is the file being processed, if any.
+	Filename string
+}
+
+// ProgressFunc is the install progress callback.
+type ProgressFunc func(Progress)
+
+// progressReader is an io.Reader that counts the bytes read, and reports
+// progress at most every progressInterval.
+type progressReader struct {
+	r    io.Reader
+	fn   ProgressFunc
+	last time.Time
+
+	Progress
+}
+
+func (pr *progressReader) Read(p []byte) (int, error) {
+	n, err := pr.r.Read(p)
+	pr.BytesDone += uint64(n)
+	if now := time.Now(); now.Sub(pr.last) >= progressInterval || err == io.EOF {
+		pr.last = now
+		pr.fn(pr.Progress)
+	}
+	return n, err
+}
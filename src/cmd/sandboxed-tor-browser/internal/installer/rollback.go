@@ -0,0 +1,82 @@
+// rollback.go - Installation rollback routines.
+// Copyright (C) 2017  Yawning Angel.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package installer
+
+import (
+	"errors"
+	"os"
+
+	"cmd/sandboxed-tor-browser/internal/ui/config"
+)
+
+const (
+	tmpSuffix    = ".tmp"
+	backupSuffix = ".bak"
+)
+
+// ErrNoRollback is the error returned when there is no previous installation
+// to roll back to.
+var ErrNoRollback = errors.New("no previous installation to roll back to")
+
+// CanRollback returns true if there is a previous installation to roll back
+// to.
+func CanRollback(cfg *config.Config) bool {
+	fi, err := os.Stat(cfg.BundleInstallDir + backupSuffix)
+	return err == nil && fi.IsDir() && config.HasManifestBackup(cfg)
+}
+
+// Rollback replaces the installed bundle with the previous installation
+// kept by ExtractBundle(), and restores the previous manifest.
+func Rollback(cfg *config.Config) (*config.Manifest, error) {
+	if !CanRollback(cfg) {
+		return nil, ErrNoRollback
+	}
+
+	bakDir := cfg.BundleInstallDir + backupSuffix
+	if err := os.RemoveAll(cfg.BundleInstallDir); err != nil {
+		return nil, err
+	}
+	if err := os.Rename(bakDir, cfg.BundleInstallDir); err != nil {
+		return nil, err
+	}
+	return config.RestoreManifestBackup(cfg)
+}
+
+// DiscardRollback removes the previous installation kept by ExtractBundle(),
+// if any.
+func DiscardRollback(cfg *config.Config) {
+	os.RemoveAll(cfg.BundleInstallDir + backupSuffix)
+	config.RemoveManifestBackup(cfg)
+}
+
+// RemoveBundle removes the installed bundle, and the previous installation
+// kept by ExtractBundle(), if any, and returns the paths that were removed.
+// The browser profile directory is left untouched.
+func RemoveBundle(cfg *config.Config) ([]string, error) {
+	var removed []string
+	for _, d := range []string{cfg.BundleInstallDir, cfg.BundleInstallDir + tmpSuffix, cfg.BundleInstallDir + backupSuffix} {
+		if _, err := os.Lstat(d); err != nil {
+			continue
+		}
+		if err := os.RemoveAll(d); err != nil {
+			return removed, err
+		}
+		removed = append(removed, d)
+	}
+	config.RemoveManifestBackup(cfg)
+	return removed, nil
+}
@@ -0,0 +1,99 @@
+// sums.go - SHA256 sums file routines.
+// Copyright (C) 2017  Yawning Angel.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package installer
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/url"
+	"path"
+	"strings"
+)
+
+const sha256SumsFile = "sha256sums-signed-build.txt"
+
+var (
+	// ErrBundleHashMissing is the error returned when the sums file has no
+	// entry for the bundle.
+	ErrBundleHashMissing = errors.New("bundle missing from the SHA256 sums file")
+
+	// ErrBundleHashMismatch is the error returned when the bundle's SHA256
+	// digest does not match the one in the sums file.
+	ErrBundleHashMismatch = errors.New("bundle SHA256 digest mismatch")
+)
+
+// SHA256SumsURL returns the URL of the SHA256 sums file that covers the
+// bundle at binaryURL.  The sums file lives in the same directory as the
+// bundles.
+func SHA256SumsURL(binaryURL string) (string, error) {
+	u, err := url.Parse(binaryURL)
+	if err != nil {
+		return "", err
+	}
+	u.Path = path.Join(path.Dir(u.Path), sha256SumsFile)
+	return u.String(), nil
+}
+
+// SHA256SumsSigURL returns the URL of the detached PGP signature for the
+// SHA256 sums file at sumsURL.
+func SHA256SumsSigURL(sumsURL string) string {
+	return sumsURL + ".asc"
+}
+
+// ValidateSHA256SumsSignature validates the SHA256 sums file and detached
+// signature pair against the TBB key ring.  The sums file is fetched over
+// the same channel as the bundle, so it is only meaningful if signed.
+func ValidateSHA256SumsSignature(sums, signature []byte) error {
+	if err := ValidatePGPSignature(sums, signature); err != nil {
+		return fmt.Errorf("invalid SHA256 sums file signature: %v", err)
+	}
+	return nil
+}
+
+// ValidateSHA256Sum validates the bundle downloaded from binaryURL against
+// the entry for the bundle in the SHA256 sums file.  The caller is expected
+// to have validated the sums file with ValidateSHA256SumsSignature.
+func ValidateSHA256Sum(sums []byte, binaryURL string, bundle []byte) error {
+	u, err := url.Parse(binaryURL)
+	if err != nil {
+		return err
+	}
+	fn := path.Base(u.Path)
+
+	// Each line is `hex-digest  filename`, as produced by sha256sum(1).
+	for _, l := range strings.Split(string(sums), "\n") {
+		sp := strings.Fields(l)
+		if len(sp) != 2 || strings.TrimPrefix(sp[1], "*") != fn {
+			continue
+		}
+
+		expected, err := hex.DecodeString(sp[0])
+		if err != nil || len(expected) != sha256.Size {
+			return ErrBundleHashMismatch
+		}
+		derived := sha256.Sum256(bundle)
+		if !bytes.Equal(expected, derived[:]) {
+			return ErrBundleHashMismatch
+		}
+		return nil
+	}
+
+	return ErrBundleHashMissing
+}
@@ -0,0 +1,87 @@
+// sums_test.go - SHA256 sums file tests.
+// Copyright (C) 2017  Yawning Angel.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package installer
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"testing"
+
+	"golang.org/x/crypto/openpgp"
+)
+
+const testBinaryURL = "https://dist.torproject.org/torbrowser/7.0/tor-browser-linux64-7.0_en-US.tar.xz"
+
+func TestSHA256SumsURL(t *testing.T) {
+	u, err := SHA256SumsURL(testBinaryURL)
+	if err != nil {
+		t.Fatalf("SHA256SumsURL() = %v", err)
+	}
+	if expected := "https://dist.torproject.org/torbrowser/7.0/sha256sums-signed-build.txt"; u != expected {
+		t.Errorf("SHA256SumsURL() = %v, expected %v", u, expected)
+	}
+	if sigURL := SHA256SumsSigURL(u); sigURL != u+".asc" {
+		t.Errorf("SHA256SumsSigURL() = %v", sigURL)
+	}
+}
+
+func TestValidateSHA256Sum(t *testing.T) {
+	bundle := []byte("not really a tarball")
+	digest := sha256.Sum256(bundle)
+	hexDigest := hex.EncodeToString(digest[:])
+	other := sha256.Sum256([]byte("something else"))
+
+	for _, v := range []struct {
+		name     string
+		sums     string
+		expected error
+	}{
+		{"match", hexDigest + "  tor-browser-linux64-7.0_en-US.tar.xz\n", nil},
+		{"binary mode", hexDigest + " *tor-browser-linux64-7.0_en-US.tar.xz\n", nil},
+		{"among others", hex.EncodeToString(other[:]) + "  tor-browser-linux32-7.0_en-US.tar.xz\n" + hexDigest + "  tor-browser-linux64-7.0_en-US.tar.xz\n", nil},
+		{"mismatch", hex.EncodeToString(other[:]) + "  tor-browser-linux64-7.0_en-US.tar.xz\n", ErrBundleHashMismatch},
+		{"truncated digest", hexDigest[:32] + "  tor-browser-linux64-7.0_en-US.tar.xz\n", ErrBundleHashMismatch},
+		{"other locale", hexDigest + "  tor-browser-linux64-7.0_de.tar.xz\n", ErrBundleHashMissing},
+		{"empty", "", ErrBundleHashMissing},
+	} {
+		if err := ValidateSHA256Sum([]byte(v.sums), testBinaryURL, bundle); err != v.expected {
+			t.Errorf("%v: ValidateSHA256Sum() = %v, expected %v", v.name, err, v.expected)
+		}
+	}
+}
+
+func TestValidateSHA256SumsSignature(t *testing.T) {
+	sums := []byte("0000  tor-browser-linux64-7.0_en-US.tar.xz\n")
+
+	if err := ValidateSHA256SumsSignature(sums, nil); err == nil {
+		t.Errorf("ValidateSHA256SumsSignature() succeeded without a signature")
+	}
+
+	// A valid signature by a key other than the pinned key must be rejected.
+	ent, err := openpgp.NewEntity("test", "", "test@example.com", nil)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	var sig bytes.Buffer
+	if err = openpgp.ArmoredDetachSign(&sig, ent, bytes.NewReader(sums), nil); err != nil {
+		t.Fatalf("failed to sign: %v", err)
+	}
+	if err = ValidateSHA256SumsSignature(sums, sig.Bytes()); err == nil {
+		t.Errorf("ValidateSHA256SumsSignature() accepted a signature from an unknown key")
+	}
+}
@@ -30,25 +30,73 @@ import (
 	"github.com/ulikunitz/xz"
 )
 
+// maxExtractedSize is the limit on the total uncompressed size of the
+// bundle, so that a malicious archive can not fill the disk.  Tor Browser is
+// well under half of this.
+const maxExtractedSize = 1 << 30
+
 // ErrExtractionCanceled is the error returned when the untar operation was
 // canceled.
 var ErrExtractionCanceled = errors.New("tar extraction canceled")
 
+// ErrBundleTooLarge is the error returned when the uncompressed size of the
+// bundle exceeds the limit.
+var ErrBundleTooLarge = errors.New("tar extraction exceeds the maximum size")
+
 // ExtractBundle extracts the supplied tar.xz archive into destDir.  Any writes
 // to cancelCh will abort the extraction.
+//
+// The archive is extracted into a temporary directory, that is only swapped
+// into place if the extraction succeeds, so that a failure leaves the old
+// installation directory untouched.  The old installation directory is
+// kept for the purpose of Rollback().
 func ExtractBundle(destDir string, bundleTarXz []byte, cancelCh chan interface{}) error {
-	// Obliterate the old installation directory.
-	os.RemoveAll(destDir)
+	return ExtractBundleWithProgress(destDir, bundleTarXz, cancelCh, nil)
+}
+
+// ExtractBundleWithProgress extracts the supplied tar.xz archive like
+// ExtractBundle, periodically invoking fn (if non-nil) with the extraction
+// progress and the file being extracted.
+func ExtractBundleWithProgress(destDir string, bundleTarXz []byte, cancelCh chan interface{}, fn ProgressFunc) error {
+	tmpDir := destDir + tmpSuffix
+	bakDir := destDir + backupSuffix
+
+	// Obliterate the remnants of a previous failed extraction.
+	os.RemoveAll(tmpDir)
+
+	var r io.Reader = bytes.NewReader(bundleTarXz)
+	var pr *progressReader
+	if fn != nil {
+		pr = &progressReader{r: r, fn: fn}
+		pr.Phase = PhaseExtract
+		pr.BytesTotal = uint64(len(bundleTarXz))
+		r = pr
+	}
 
-	if xzr, err := xz.NewReader(bytes.NewReader(bundleTarXz)); err != nil {
+	if xzr, err := xz.NewReader(r); err != nil {
+		return err
+	} else if err = untar(xzr, tmpDir, cancelCh, pr); err != nil {
+		os.RemoveAll(tmpDir)
 		return err
-	} else if err = untar(xzr, destDir, cancelCh); err != nil {
+	}
+
+	// Swap the new installation directory into place.
+	os.RemoveAll(bakDir)
+	if _, err := os.Lstat(destDir); err == nil {
+		if err = os.Rename(destDir, bakDir); err != nil {
+			os.RemoveAll(tmpDir)
+			return err
+		}
+	}
+	if err := os.Rename(tmpDir, destDir); err != nil {
+		os.Rename(bakDir, destDir)
+		os.RemoveAll(tmpDir)
 		return err
 	}
 	return nil
 }
 
-func untar(r io.Reader, destDir string, cancelCh chan interface{}) error {
+func untar(r io.Reader, destDir string, cancelCh chan interface{}, pr *progressReader) error {
 	if err := os.MkdirAll(destDir, os.ModeDir|0700); err != nil {
 		return err
 	}
@@ -63,11 +111,47 @@ func untar(r io.Reader, destDir string, cancelCh chan interface{}) error {
 		return ""
 	}
 
+	// Paths in the archive are untrusted, and must resolve to somewhere
+	// under destDir once cleaned.
+	destPath := func(name string) (string, error) {
+		if filepath.IsAbs(name) {
+			return "", fmt.Errorf("absolute path in archive: %v", name)
+		}
+		dest := filepath.Join(destDir, name)
+		if rel, err := filepath.Rel(destDir, dest); err != nil {
+			return "", err
+		} else if rel == ".." || strings.HasPrefix(rel, "../") {
+			return "", fmt.Errorf("path escapes the destination: %v", name)
+		}
+		return dest, nil
+	}
+
+	var extractedSize int64
 	extractFile := func(dest string, hdr *tar.Header, r io.Reader) error {
-		if hdr.Typeflag == tar.TypeSymlink {
+		switch hdr.Typeflag {
+		case tar.TypeReg, tar.TypeRegA:
+		case tar.TypeSymlink:
 			return fmt.Errorf("symlinks not supported: %v", dest)
+		case tar.TypeLink:
+			// Hard links are relative to the archive root, and must
+			// point to somewhere inside the destination.
+			if filepath.IsAbs(hdr.Linkname) {
+				return fmt.Errorf("hard link outside the destination: %v -> %v", dest, hdr.Linkname)
+			}
+			target, err := destPath(stripContainerDir(hdr.Linkname))
+			if err != nil || target == destDir {
+				return fmt.Errorf("hard link outside the destination: %v -> %v", dest, hdr.Linkname)
+			}
+			return os.Link(target, dest)
+		default:
+			return fmt.Errorf("unsupported entry type '%c': %v", hdr.Typeflag, dest)
 		}
 
+		if hdr.Size < 0 || hdr.Size > maxExtractedSize-extractedSize {
+			return ErrBundleTooLarge
+		}
+		extractedSize += hdr.Size
+
 		f, err := os.OpenFile(dest, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, hdr.FileInfo().Mode())
 		if err != nil {
 			return err
@@ -95,6 +179,9 @@ func untar(r io.Reader, destDir string, cancelCh chan interface{}) error {
 			runtime.Gosched()
 		}
 
+		if filepath.IsAbs(hdr.Name) {
+			return fmt.Errorf("absolute path in archive: %v", hdr.Name)
+		}
 		name := stripContainerDir(hdr.Name)
 		if name == "" {
 			// Ensure that this is the container dir being skipped.
@@ -103,7 +190,13 @@ func untar(r io.Reader, destDir string, cancelCh chan interface{}) error {
 			}
 			return fmt.Errorf("expecting container dir, got file: %v", hdr.Name)
 		}
-		destName := filepath.Join(destDir, name)
+		destName, err := destPath(name)
+		if err != nil {
+			return err
+		}
+		if pr != nil {
+			pr.Filename = name
+		}
 
 		if hdr.FileInfo().IsDir() {
 			if err := os.MkdirAll(destName, hdr.FileInfo().Mode()); err != nil {
@@ -0,0 +1,194 @@
+// tar_test.go - Tar extraction tests.
+// Copyright (C) 2016  Yawning Angel.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package installer
+
+import (
+	"archive/tar"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ulikunitz/xz"
+)
+
+// testEntry is an entry in a crafted test archive.  Entries with a nil
+// body have their header written without any file contents.
+type testEntry struct {
+	hdr  tar.Header
+	body []byte
+}
+
+func dirEntry(name string) testEntry {
+	return testEntry{hdr: tar.Header{Name: name, Typeflag: tar.TypeDir, Mode: 0700}}
+}
+
+func fileEntry(name, body string) testEntry {
+	return testEntry{tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0600, Size: int64(len(body))}, []byte(body)}
+}
+
+func linkEntry(name, target string, typ byte) testEntry {
+	return testEntry{hdr: tar.Header{Name: name, Typeflag: typ, Linkname: target, Mode: 0600}}
+}
+
+func buildTar(t *testing.T, entries ...testEntry) []byte {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, e := range entries {
+		hdr := e.hdr
+		if err := tw.WriteHeader(&hdr); err != nil {
+			t.Fatalf("failed to write header '%v': %v", hdr.Name, err)
+		}
+		if e.body == nil && hdr.Size > 0 {
+			// Oversized entries are never read past the header.
+			return buf.Bytes()
+		}
+		if _, err := tw.Write(e.body); err != nil {
+			t.Fatalf("failed to write body '%v': %v", hdr.Name, err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf("failed to close archive: %v", err)
+	}
+	return buf.Bytes()
+}
+
+func TestUntar(t *testing.T) {
+	destDir := filepath.Join(t.TempDir(), "tor-browser")
+	b := buildTar(t,
+		dirEntry("tor-browser/"),
+		dirEntry("tor-browser/Browser/"),
+		fileEntry("tor-browser/Browser/start-tor-browser", "#!/bin/sh\n"),
+		linkEntry("tor-browser/Browser/start-tor-browser.link", "tor-browser/Browser/start-tor-browser", tar.TypeLink),
+	)
+	if err := untar(bytes.NewReader(b), destDir, nil, nil); err != nil {
+		t.Fatalf("untar() = %v", err)
+	}
+	for _, fn := range []string{"Browser/start-tor-browser", "Browser/start-tor-browser.link"} {
+		if body, err := ioutil.ReadFile(filepath.Join(destDir, fn)); err != nil || string(body) != "#!/bin/sh\n" {
+			t.Errorf("%v: extracted contents = '%v' (%v)", fn, string(body), err)
+		}
+	}
+}
+
+func TestUntarMalicious(t *testing.T) {
+	for _, v := range []struct {
+		name    string
+		entries []testEntry
+	}{
+		{"traversal", []testEntry{fileEntry("tor-browser/../../escaped", "pwned")}},
+		{"nested traversal", []testEntry{fileEntry("tor-browser/Browser/../../../escaped", "pwned")}},
+		{"traversal dir", []testEntry{dirEntry("tor-browser/../../escaped/")}},
+		{"absolute path", []testEntry{fileEntry("/tmp/escaped", "pwned")}},
+		{"container file", []testEntry{fileEntry("tor-browser", "pwned")}},
+		{"symlink", []testEntry{linkEntry("tor-browser/escaped", "../../../../etc/passwd", tar.TypeSymlink)}},
+		{"absolute symlink", []testEntry{linkEntry("tor-browser/escaped", "/etc/passwd", tar.TypeSymlink)}},
+		{"hard link traversal", []testEntry{linkEntry("tor-browser/escaped", "tor-browser/../../etc/passwd", tar.TypeLink)}},
+		{"absolute hard link", []testEntry{linkEntry("tor-browser/escaped", "/etc/passwd", tar.TypeLink)}},
+		{"hard link to destination", []testEntry{linkEntry("tor-browser/escaped", "tor-browser/", tar.TypeLink)}},
+		{"device", []testEntry{{hdr: tar.Header{Name: "tor-browser/null", Typeflag: tar.TypeChar, Mode: 0600}}}},
+	} {
+		parent := t.TempDir()
+		destDir := filepath.Join(parent, "a", "b", "tor-browser")
+		b := buildTar(t, append([]testEntry{dirEntry("tor-browser/")}, v.entries...)...)
+		if err := untar(bytes.NewReader(b), destDir, nil, nil); err == nil {
+			t.Errorf("%v: untar() succeeded", v.name)
+		}
+		for _, fn := range []string{filepath.Join(parent, "escaped"), filepath.Join(parent, "a", "escaped")} {
+			if _, err := os.Lstat(fn); err == nil {
+				t.Errorf("%v: untar() wrote outside the destination: %v", v.name, fn)
+			}
+		}
+	}
+}
+
+func TestUntarSizeLimit(t *testing.T) {
+	b := buildTar(t,
+		dirEntry("tor-browser/"),
+		testEntry{hdr: tar.Header{Name: "tor-browser/bomb", Typeflag: tar.TypeReg, Mode: 0600, Size: maxExtractedSize + 1}},
+	)
+	destDir := filepath.Join(t.TempDir(), "tor-browser")
+	if err := untar(bytes.NewReader(b), destDir, nil, nil); err != ErrBundleTooLarge {
+		t.Fatalf("untar() = %v, expected %v", err, ErrBundleTooLarge)
+	}
+	if _, err := os.Lstat(filepath.Join(destDir, "bomb")); err == nil {
+		t.Errorf("untar() created the oversized file")
+	}
+}
+
+func TestUntarCanceled(t *testing.T) {
+	cancelCh := make(chan interface{}, 1)
+	cancelCh <- true
+	b := buildTar(t, dirEntry("tor-browser/"), fileEntry("tor-browser/a", "a"))
+	if err := untar(bytes.NewReader(b), filepath.Join(t.TempDir(), "tor-browser"), cancelCh, nil); err != ErrExtractionCanceled {
+		t.Fatalf("untar() = %v, expected %v", err, ErrExtractionCanceled)
+	}
+}
+
+func buildTarXz(t *testing.T, entries ...testEntry) []byte {
+	var buf bytes.Buffer
+	w, err := xz.NewWriter(&buf)
+	if err != nil {
+		t.Fatalf("failed to create xz writer: %v", err)
+	}
+	if _, err = w.Write(buildTar(t, entries...)); err != nil {
+		t.Fatalf("failed to compress archive: %v", err)
+	}
+	if err = w.Close(); err != nil {
+		t.Fatalf("failed to compress archive: %v", err)
+	}
+	return buf.Bytes()
+}
+
+func TestExtractBundle(t *testing.T) {
+	destDir := filepath.Join(t.TempDir(), "tor-browser")
+	readVersion := func() string {
+		b, _ := ioutil.ReadFile(filepath.Join(destDir, "version"))
+		return string(b)
+	}
+
+	if err := ExtractBundle(destDir, buildTarXz(t, dirEntry("tor-browser/"), fileEntry("tor-browser/version", "1")), nil); err != nil {
+		t.Fatalf("ExtractBundle() = %v", err)
+	}
+	if v := readVersion(); v != "1" {
+		t.Fatalf("ExtractBundle() installed version '%v'", v)
+	}
+
+	// A malicious update leaves the existing installation untouched.
+	bad := buildTarXz(t, dirEntry("tor-browser/"), fileEntry("tor-browser/version", "2"), fileEntry("tor-browser/../../escaped", "pwned"))
+	if err := ExtractBundle(destDir, bad, nil); err == nil {
+		t.Fatalf("ExtractBundle() succeeded with a malicious archive")
+	}
+	if v := readVersion(); v != "1" {
+		t.Errorf("failed ExtractBundle() altered the installation: version '%v'", v)
+	}
+	if _, err := os.Lstat(destDir + tmpSuffix); err == nil {
+		t.Errorf("failed ExtractBundle() left the temporary directory behind")
+	}
+
+	// A good one replaces it, and keeps the old one for rollback.
+	if err := ExtractBundle(destDir, buildTarXz(t, dirEntry("tor-browser/"), fileEntry("tor-browser/version", "3")), nil); err != nil {
+		t.Fatalf("ExtractBundle() = %v", err)
+	}
+	if v := readVersion(); v != "3" {
+		t.Errorf("ExtractBundle() installed version '%v'", v)
+	}
+	if b, err := ioutil.ReadFile(filepath.Join(destDir+backupSuffix, "version")); err != nil || string(b) != "1" {
+		t.Errorf("ExtractBundle() backup version = '%v' (%v)", string(b), err)
+	}
+}
@@ -20,9 +20,10 @@ package sandbox
 
 import (
 	"bytes"
+	"context"
 	"fmt"
+	"io"
 	"io/ioutil"
-	"log"
 	"os"
 	"path/filepath"
 	"runtime"
@@ -38,15 +39,53 @@ import (
 	. "cmd/sandboxed-tor-browser/internal/utils"
 )
 
-const restrictedLibDir = "/usr/lib"
-
-var distributionDependentLibSearchPath []string
+const restrictedLibDir = dynlib.MountLibDir
+
+// RunOptions is the per-launch options for sandboxed Tor Browser, that are
+// not part of the persistent configuration.
+type RunOptions struct {
+	// ExtraArgs are appended to the firefox command line (Eg: a URL to open,
+	// or `--headless`).
+	ExtraArgs []string
+
+	// Env is additional environment variables to set in the sandbox.  These
+	// override the launcher's own values, except for the X11 related ones.
+	Env map[string]string
+
+	// Stdout and Stderr if non-nil receive the browser's output instead of
+	// the console logger.
+	Stdout io.Writer
+	Stderr io.Writer
+
+	// DryRun if non-nil causes the sandbox configuration (bwrap arguments,
+	// libraries, and the seccomp profile summary) to be written to the
+	// writer, instead of launching the browser.  The tor instance may be
+	// nil when doing a dry run.
+	DryRun io.Writer
+
+	// WritableBundle mounts the installed bundle read-write instead of
+	// read-only, allowing the browser to modify its own files.  This should
+	// never be needed except for debugging.
+	WritableBundle bool
+}
 
 // RunTorBrowser launches sandboxed Tor Browser.
 func RunTorBrowser(cfg *config.Config, manif *config.Manifest, tor *tor.Tor) (process *Process, err error) {
+	return RunTorBrowserWithOptions(cfg, manif, tor, nil)
+}
+
+// RunTorBrowserWithOptions launches sandboxed Tor Browser, with the provided
+// per-launch options.
+func RunTorBrowserWithOptions(cfg *config.Config, manif *config.Manifest, tor *tor.Tor, opts *RunOptions) (process *Process, err error) {
+	return RunTorBrowserContext(context.Background(), cfg, manif, tor, opts)
+}
+
+// RunTorBrowserContext launches sandboxed Tor Browser like
+// RunTorBrowserWithOptions.  Cancelling ctx terminates the browser, along
+// with the rest of the sandbox (See Process.Kill).  If ctx is cancelled
+// before the sandbox has started, the launch is aborted.
+func RunTorBrowserContext(ctx context.Context, cfg *config.Config, manif *config.Manifest, tor *tor.Tor, opts *RunOptions) (process *Process, err error) {
 	const (
-		profileSubDir = "TorBrowser/Data/Browser/profile.default"
-		cachesSubDir  = "TorBrowser/Data/Browser/Caches"
 		stubPath      = "/home/amnesia/.tbb_stub.so"
 		controlSocket = "control"
 		socksSocket   = "socks"
@@ -64,10 +103,23 @@ func RunTorBrowser(cfg *config.Config, manif *config.Manifest, tor *tor.Tor) (pr
 		return nil, err
 	}
 
+	if opts == nil {
+		opts = &RunOptions{}
+	}
+
 	logger := newConsoleLogger("firefox")
 	h.stdout = logger
 	h.stderr = logger
-	h.seccompFn = installTorBrowserSeccompProfile
+	if opts.Stdout != nil {
+		h.stdout = opts.Stdout
+	}
+	if opts.Stderr != nil {
+		h.stderr = opts.Stderr
+	}
+	h.seccompFn = func(fd *os.File) (*ProfileStats, error) { return installTorBrowserSeccompProfile(fd, roleBrowser) }
+	h.allowNoSeccomp = cfg.Sandbox.AllowNoSeccomp
+	h.allowHostResolvConf = cfg.Sandbox.AllowHostResolvConf
+	h.dryRun = opts.DryRun
 	h.fakeDbus = true
 	h.mountProc = false
 	h.fakeProc = true
@@ -93,7 +145,7 @@ func RunTorBrowser(cfg *config.Config, manif *config.Manifest, tor *tor.Tor) (pr
 	pulseAudioWorks := false
 	if cfg.Sandbox.EnablePulseAudio {
 		if err = h.enablePulseAudio(); err != nil {
-			log.Printf("sandbox: failed to proxy PulseAudio: %v", err)
+			Warnf("sandbox: failed to proxy PulseAudio: %v", err)
 		} else {
 			pulseAudioWorks = true
 		}
@@ -102,68 +154,11 @@ func RunTorBrowser(cfg *config.Config, manif *config.Manifest, tor *tor.Tor) (pr
 
 	browserHome := filepath.Join(h.homeDir, "sandboxed-tor-browser", "tor-browser", "Browser")
 	realBrowserHome := filepath.Join(cfg.BundleInstallDir, "Browser")
-	realCachesDir := filepath.Join(realBrowserHome, cachesSubDir)
-	realProfileDir := filepath.Join(realBrowserHome, profileSubDir)
-	realDesktopDir := filepath.Join(realBrowserHome, "Desktop")
-	realDownloadsDir := filepath.Join(realBrowserHome, "Downloads")
-	realExtensionsDir := filepath.Join(realProfileDir, "extensions")
-
-	// Ensure that the `Caches`, `Downloads` and `Desktop` mount points exist.
-	if err = os.MkdirAll(realCachesDir, DirMode); err != nil {
+	if err = h.appendBrowserFilesystem(cfg, browserHome, realBrowserHome, opts.WritableBundle); err != nil {
 		return
 	}
-	if err = os.MkdirAll(realDesktopDir, DirMode); err != nil {
-		return
-	}
-	if err = os.MkdirAll(realDownloadsDir, DirMode); err != nil {
-		return
-	}
-
-	// Apply directory overrides.
-	if cfg.Sandbox.DesktopDir != "" {
-		realDesktopDir = cfg.Sandbox.DesktopDir
-	}
-	if cfg.Sandbox.DownloadsDir != "" {
-		realDownloadsDir = cfg.Sandbox.DownloadsDir
-	}
-
-	profileDir := filepath.Join(browserHome, profileSubDir)
-	cachesDir := filepath.Join(browserHome, cachesSubDir)
-	downloadsDir := filepath.Join(browserHome, "Downloads")
 	desktopDir := filepath.Join(browserHome, "Desktop")
-	extensionsDir := filepath.Join(profileDir, "extensions")
-
-	// Filesystem stuff.
-	h.roBind(cfg.BundleInstallDir, filepath.Join(h.homeDir, "sandboxed-tor-browser", "tor-browser"), false)
-	if cfg.Sandbox.EnableAmnesiacProfileDirectory {
-		excludes := []string{
-			filepath.Join(realProfileDir, "preferences"),
-			realExtensionsDir,
-		}
-		h.shadowDir(profileDir, realProfileDir, excludes)
-	} else {
-		h.bind(realProfileDir, profileDir, false)
-	}
-	h.roBind(filepath.Join(realProfileDir, "preferences"), filepath.Join(profileDir, "preferences"), false)
-	h.bind(realDesktopDir, desktopDir, false)
-	h.bind(realDownloadsDir, downloadsDir, false)
-	h.tmpfs(cachesDir)
-	h.chdir = browserHome
-
-	// Explicitly bind mount the expected extensions in.
-	//
-	// If the Tor Browser developers ever decide to do something sensible like
-	// sign their XPI files, then the whitelist could be public key based, till
-	// then this may be somewhat fragile.
-	h.tmpfs(extensionsDir)
-	for _, extName := range []string{
-		"{73a6fe31-595d-460b-a920-fcc0f8843232}.xpi", // NoScript
-		"torbutton@torproject.org.xpi",
-		"https-everywhere-eff@eff.org.xpi",
-		"tor-launcher@torproject.org.xpi",
-	} {
-		h.roBind(filepath.Join(realExtensionsDir, extName), filepath.Join(extensionsDir, extName), false)
-	}
+	downloadsDir := filepath.Join(browserHome, "Downloads")
 
 	// Env vars taken from start-tor-browser.
 	// h.setenv("LD_LIBRARY_PATH", filepath.Join(browserHome, "TorBrowser", "Tor"))
@@ -192,14 +187,7 @@ func RunTorBrowser(cfg *config.Config, manif *config.Manifest, tor *tor.Tor) (pr
 	h.symlink(desktopDir, "/home/amnesia/Desktop")
 	h.symlink(downloadsDir, "/home/amnesia/Downloads")
 
-	// Set the same env vars that Tor Browser would expect when using a system
-	// tor, since the launcher is responsible for managing the Tor process, and
-	// it will be talking to the surrogates anyway.
-	h.setenv("TOR_SOCKS_PORT", "9150")
-	h.setenv("TOR_CONTROL_PORT", "9151")
-	h.setenv("TOR_SKIP_LAUNCH", "1")
-	h.setenv("TOR_NO_DISPLAY_NETWORK_SETTINGS", "1")
-	h.setenv("TOR_HIDE_UPDATE_CHECK_UI", "1")
+	h.setenvs(buildEnv(cfg))
 
 	// Inject the AF_LOCAL compatibility hack stub into the filesystem, and
 	// supply the relevant args required for functionality.
@@ -207,19 +195,20 @@ func RunTorBrowser(cfg *config.Config, manif *config.Manifest, tor *tor.Tor) (pr
 	socksPath := filepath.Join(h.runtimeDir, socksSocket)
 	h.setenv("TOR_STUB_CONTROL_SOCKET", ctrlPath)
 	h.setenv("TOR_STUB_SOCKS_SOCKET", socksPath)
-	h.bind(tor.CtrlSurrogatePath(), ctrlPath, false)
-	h.bind(tor.SocksSurrogatePath(), socksPath, false)
+	if tor != nil {
+		h.bind(tor.CtrlSurrogatePath(), ctrlPath, false)
+		h.bind(tor.SocksSurrogatePath(), socksPath, false)
+	} else if h.dryRun != nil {
+		h.bind(filepath.Join(cfg.RuntimeDir, controlSocket), ctrlPath, false)
+		h.bind(filepath.Join(cfg.RuntimeDir, socksSocket), socksPath, false)
+	} else {
+		return nil, fmt.Errorf("sandbox: no tor instance")
+	}
 	h.assetFile(stubPath, "tbb_stub.so")
 
 	ldPreload := stubPath
 	h.setenv("LD_PRELOAD", ldPreload)
 
-	// Hardware accelerated OpenGL will not work, and never will.
-	h.setenv("LIBGL_ALWAYS_SOFTWARE", "1")
-
-	// Crashdumps regardless of being sanitized or not, not to be trusted.
-	h.setenv("MOZ_CRASHREPORTER_DISABLE", "1")
-
 	// Tor Browser currently is incompatible with PaX MPROTECT, apply the
 	// override if needed.
 	realFirefoxPath := filepath.Join(realBrowserHome, "firefox")
@@ -230,17 +219,21 @@ func RunTorBrowser(cfg *config.Config, manif *config.Manifest, tor *tor.Tor) (pr
 	for _, p := range needsPaXPaths {
 		err := applyPaXAttributes(manif, p)
 		if err != nil {
-			log.Printf("sandbox: Failed to apply PaX attributes to `%v`: %v", p, err)
+			Warnf("sandbox: Failed to apply PaX attributes to `%v`: %v", p, err)
 		}
 	}
 
 	extraLdLibraryPath := ""
 	if dynlib.IsSupported() {
-		cache, err := dynlib.LoadCache()
+		cache, err := loadDynlibCache(cfg, manif)
 		if err != nil {
 			return nil, err
 		}
 
+		// A stale path shouldn't prevent the launch, firefox itself
+		// failing to exec will be obvious enough.
+		cache.SetSkipMissingBinaries(true)
+
 		// XXX: It's probably safe to assume that firefox will always link
 		// against libc and libpthread that are required by `tbb_stub.so`.
 		binaries := []string{realFirefoxPath}
@@ -253,18 +246,15 @@ func RunTorBrowser(cfg *config.Config, manif *config.Manifest, tor *tor.Tor) (pr
 
 		// Extra libraries that firefox dlopen()s.
 		extraLdLibraryPath = extraLdLibraryPath + ":" + restrictedLibDir
-		extraLibs := []string{
-			// These are absolutely required, or libxul.so will crash
-			// the firefox process.  Perhapbs wayland will deliver us
-			// from this evil.
-			"libxcb.so.1",
-			"libXau.so.6",
-			"libXdmcp.so.6",
-
-			// "libXss.so.1", - Not ubiquitous? nsIdleService uses this.
-			// "libc.so", - Uhhhhh.... wtf?
-			// "libcanberra.so.0", - Not ubiquitous.
+		//
+		// The X11 libraries in the manifest are absolutely required, or
+		// libxul.so will crash the firefox process.  Perhapbs wayland
+		// will deliver us from this evil.
+		manifestLibs, err := manifestExtraLibs(cfg, cache)
+		if err != nil {
+			return nil, err
 		}
+		extraLibs := append([]string{}, manifestLibs...)
 
 		glExtraLibs, glLibPaths := h.appendRestrictedOpenGL()
 		extraLibs = append(extraLibs, glExtraLibs...)
@@ -273,7 +263,7 @@ func RunTorBrowser(cfg *config.Config, manif *config.Manifest, tor *tor.Tor) (pr
 		if cfg.Sandbox.EnablePulseAudio && pulseAudioWorks {
 			paLibs, paPath, paExtraPath, err := h.appendRestrictedPulseAudio(cache)
 			if err != nil {
-				log.Printf("sandbox: Failed to find PulseAudio libraries: %v", err)
+				Warnf("sandbox: Failed to find PulseAudio libraries: %v", err)
 			} else {
 				extraLibs = append(extraLibs, paLibs...)
 				ldLibraryPath = ldLibraryPath + paPath
@@ -304,11 +294,26 @@ func RunTorBrowser(cfg *config.Config, manif *config.Manifest, tor *tor.Tor) (pr
 		if err := h.appendLibraries(cache, binaries, extraLibs, ldLibraryPath, filterFn); err != nil {
 			return nil, err
 		}
+		h.logManifestLibs(manifestLibs)
 	}
 	h.setenv("LD_LIBRARY_PATH", filepath.Join(browserHome, "TorBrowser", "Tor")+extraLdLibraryPath)
 
 	h.cmd = filepath.Join(browserHome, "firefox")
-	h.cmdArgs = []string{"--class", "Tor Browser", "-profile", profileDir}
+	h.cmdArgs = []string{"--class", "Tor Browser", "-profile", filepath.Join(browserHome, profileSubDir)}
+	h.cmdArgs = append(h.cmdArgs, opts.ExtraArgs...)
+
+	// Apply the caller provided environment, in a deterministic order.
+	envKeys := make([]string, 0, len(opts.Env))
+	for k := range opts.Env {
+		envKeys = append(envKeys, k)
+	}
+	sort.Strings(envKeys)
+	for _, k := range envKeys {
+		if k == "" || strings.ContainsAny(k, "=\x00") {
+			return nil, fmt.Errorf("sandbox: invalid environment variable: %q", k)
+		}
+		h.setenv(k, opts.Env[k])
+	}
 
 	// Do X11 last, because of the surrogate.
 	x11SurrogatePath := filepath.Join(cfg.RuntimeDir, x11Socket)
@@ -323,6 +328,11 @@ func RunTorBrowser(cfg *config.Config, manif *config.Manifest, tor *tor.Tor) (pr
 			h.setenv("XAUTHORITY", xauthPath)
 			h.file(xauthPath, x.Xauthority)
 		}
+		if h.dryRun != nil {
+			h.bind(x11SurrogatePath, filepath.Join(x11.SockDir, "X0"), false)
+			_, err = h.run()
+			return nil, err
+		}
 		if err = x.LaunchSurrogate(); err != nil {
 			return nil, err
 		}
@@ -335,6 +345,10 @@ func RunTorBrowser(cfg *config.Config, manif *config.Manifest, tor *tor.Tor) (pr
 		}
 	}
 
+	if err = ctx.Err(); err != nil {
+		x11TermHook()
+		return nil, err
+	}
 	proc, err := h.run()
 	if err != nil {
 		x11TermHook()
@@ -342,10 +356,110 @@ func RunTorBrowser(cfg *config.Config, manif *config.Manifest, tor *tor.Tor) (pr
 	} else {
 		proc.AddTermHook(x11TermHook)
 	}
+	if ctx.Done() != nil {
+		go func() {
+			select {
+			case <-ctx.Done():
+				Debugf("sandbox: Context cancelled, terminating firefox: %v", ctx.Err())
+				proc.Kill()
+			case <-proc.Done():
+			}
+		}()
+	}
 
 	return proc, nil
 }
 
+const (
+	profileSubDir = "TorBrowser/Data/Browser/profile.default"
+	cachesSubDir  = "TorBrowser/Data/Browser/Caches"
+)
+
+// appendBrowserFilesystem mounts the bundle, the profile and the other
+// directories that the browser uses at browserHome.  The bundle is read-only
+// unless writableBundle is set, so that a compromised browser can not modify
+// its own binaries, and only the profile, `Desktop` and `Downloads` are
+// writable.
+func (h *hugbox) appendBrowserFilesystem(cfg *config.Config, browserHome, realBrowserHome string, writableBundle bool) error {
+	realCachesDir := filepath.Join(realBrowserHome, cachesSubDir)
+	realProfileDir := cfg.ProfileDir
+	bundleProfileDir := filepath.Join(realBrowserHome, profileSubDir)
+	realDesktopDir := filepath.Join(realBrowserHome, "Desktop")
+	realDownloadsDir := filepath.Join(realBrowserHome, "Downloads")
+	realExtensionsDir := filepath.Join(bundleProfileDir, "extensions")
+
+	// Ensure that the `Caches`, `Downloads` and `Desktop` mount points exist.
+	for _, d := range []string{realCachesDir, realDesktopDir, realDownloadsDir} {
+		if err := os.MkdirAll(d, DirMode); err != nil {
+			return err
+		}
+	}
+
+	// Apply directory overrides.
+	if cfg.Sandbox.DesktopDir != "" {
+		realDesktopDir = cfg.Sandbox.DesktopDir
+	}
+	if cfg.Sandbox.DownloadsDir != "" {
+		realDownloadsDir = cfg.Sandbox.DownloadsDir
+	}
+
+	profileDir := filepath.Join(browserHome, profileSubDir)
+	cachesDir := filepath.Join(browserHome, cachesSubDir)
+	downloadsDir := filepath.Join(browserHome, "Downloads")
+	desktopDir := filepath.Join(browserHome, "Desktop")
+	extensionsDir := filepath.Join(profileDir, "extensions")
+
+	// Filesystem stuff.
+	if writableBundle {
+		Warnf("sandbox: mounting the bundle read-write, as requested")
+		h.bind(cfg.BundleInstallDir, filepath.Join(h.homeDir, "sandboxed-tor-browser", "tor-browser"), false)
+	} else {
+		h.roBind(cfg.BundleInstallDir, filepath.Join(h.homeDir, "sandboxed-tor-browser", "tor-browser"), false)
+	}
+
+	// The mutable profile lives outside of the bundle so that it survives
+	// reinstalls, while the preferences and extensions are part of the
+	// bundle and are mounted from there.
+	if cfg.Sandbox.EnableAmnesiacProfileDirectory {
+		excludes := []string{
+			filepath.Join(realProfileDir, "preferences"),
+			filepath.Join(realProfileDir, "extensions"),
+		}
+		h.shadowDir(profileDir, realProfileDir, excludes)
+	} else {
+		h.bind(realProfileDir, profileDir, false)
+	}
+	h.roBind(filepath.Join(bundleProfileDir, "preferences"), filepath.Join(profileDir, "preferences"), false)
+	h.bind(realDesktopDir, desktopDir, false)
+	h.bind(realDownloadsDir, downloadsDir, false)
+	h.tmpfs(cachesDir)
+	for _, m := range cfg.Sandbox.ExtraBindMounts {
+		if m.ReadOnly {
+			h.roBind(m.Source, m.Dest, false)
+		} else {
+			h.bind(m.Source, m.Dest, false)
+		}
+	}
+	h.chdir = browserHome
+
+	// Explicitly bind mount the expected extensions in.
+	//
+	// If the Tor Browser developers ever decide to do something sensible like
+	// sign their XPI files, then the whitelist could be public key based, till
+	// then this may be somewhat fragile.
+	h.tmpfs(extensionsDir)
+	for _, extName := range []string{
+		"{73a6fe31-595d-460b-a920-fcc0f8843232}.xpi", // NoScript
+		"torbutton@torproject.org.xpi",
+		"https-everywhere-eff@eff.org.xpi",
+		"tor-launcher@torproject.org.xpi",
+	} {
+		h.roBind(filepath.Join(realExtensionsDir, extName), filepath.Join(extensionsDir, extName), false)
+	}
+
+	return nil
+}
+
 func filterCodecs(fn string, allowFfmpeg bool) error {
 	_, fn = filepath.Split(fn)
 	lfn := strings.ToLower(fn)
@@ -406,7 +520,7 @@ func applyPaXAttributes(manif *config.Manifest, f string) error {
 	// Strip off the attribute if this is a non-grsec kernel.
 	if !IsGrsecKernel() {
 		if sz > 0 {
-			log.Printf("sandbox: Removing PaX attributes: %v", n)
+			Infof("sandbox: Removing PaX attributes: %v", n)
 			syscall.Removexattr(f, paxAttr)
 		}
 		return nil
@@ -419,12 +533,12 @@ func applyPaXAttributes(manif *config.Manifest, f string) error {
 			return err
 		}
 		if bytes.Contains(dest, paxOverride) {
-			log.Printf("sandbox: PaX attributes already set: %v", n)
+			Infof("sandbox: PaX attributes already set: %v", n)
 			return nil
 		}
 	}
 
-	log.Printf("sandbox: Applying PaX attributes: %v", n)
+	Infof("sandbox: Applying PaX attributes: %v", n)
 	return syscall.Setxattr(f, paxAttr, paxOverride, 0)
 }
 
@@ -443,7 +557,10 @@ func RunUpdate(cfg *config.Config, mar []byte) (err error) {
 	logger := newConsoleLogger("update")
 	h.stdout = logger
 	h.stderr = logger
-	h.seccompFn = installTorBrowserSeccompProfile
+	h.seccompFn = func(fd *os.File) (*ProfileStats, error) { return installTorBrowserSeccompProfile(fd, roleUpdater) }
+	h.seccompExtraDenied = updaterExtraDenied
+	h.allowNoSeccomp = cfg.Sandbox.AllowNoSeccomp
+	h.allowHostResolvConf = cfg.Sandbox.AllowHostResolvConf
 
 	// https://wiki.mozilla.org/Software_Update:Manually_Installing_a_MAR_file
 	const (
@@ -573,7 +690,9 @@ func RunTor(cfg *config.Config, manif *config.Manifest, torrc []byte) (process *
 	logger := newConsoleLogger("tor")
 	h.stdout = logger
 	h.stderr = logger
-	h.seccompFn = func(fd *os.File) error { return installTorSeccompProfile(fd, cfg.Tor.UseBridges) }
+	h.seccompFn = func(fd *os.File) (*ProfileStats, error) { return installTorSeccompProfile(fd, cfg.Tor.UseBridges) }
+	h.seccompExtraDenied = torExtraDenied
+	h.allowNoSeccomp = cfg.Sandbox.AllowNoSeccomp
 	h.unshare.net = false // Tor needs host network access.
 
 	// Regarding `/proc`...
@@ -592,7 +711,7 @@ func RunTor(cfg *config.Config, manif *config.Manifest, torrc []byte) (process *
 	// See: https://bugs.torproject.org/20773
 	h.mountProc = false
 
-	if err = os.MkdirAll(cfg.TorDataDir, DirMode); err != nil {
+	if err = MkdirAllPrivate(cfg.TorDataDir); err != nil {
 		return
 	}
 
@@ -615,7 +734,7 @@ func RunTor(cfg *config.Config, manif *config.Manifest, torrc []byte) (process *
 	// libraries that matter.
 	extraLdLibraryPath := ""
 	if dynlib.IsSupported() {
-		cache, err := dynlib.LoadCache()
+		cache, err := loadDynlibCache(cfg, manif)
 		if err != nil {
 			return nil, err
 		}
@@ -642,7 +761,7 @@ type consoleLogger struct {
 func (l *consoleLogger) Write(p []byte) (n int, err error) {
 	for _, s := range bytes.Split(p, []byte{'\n'}) {
 		if len(s) != 0 { // Trim empty lines.
-			log.Printf("%s: %s", l.prefix, s)
+			Infof("%s: %s", l.prefix, s)
 		}
 	}
 	return len(p), nil
@@ -654,10 +773,23 @@ func newConsoleLogger(prefix string) *consoleLogger {
 	return l
 }
 
+// loadDynlibCache loads the `ld.so.cache`, with the library resolution
+// results cached across launches of the same bundle.
+func loadDynlibCache(cfg *config.Config, manif *config.Manifest) (*dynlib.Cache, error) {
+	const resolveCacheFile = "dynlib-cache.json"
+
+	cache, err := dynlib.LoadCache()
+	if err != nil {
+		return nil, err
+	}
+	cache.SetResolveCache(filepath.Join(cfg.RuntimeDir, resolveCacheFile), manif.Channel+"-"+manif.Version)
+	return cache, nil
+}
+
 func findDistributionDependentLibs(extraSearch []string, subDir, fn string) string {
 	var searchPaths []string
 	searchPaths = append(searchPaths, extraSearch...)
-	searchPaths = append(searchPaths, distributionDependentLibSearchPath...)
+	searchPaths = append(searchPaths, dynlib.DistributionLibSearchPath()...)
 
 	for _, base := range searchPaths {
 		candidate := filepath.Join(base, subDir, fn)
@@ -671,7 +803,7 @@ func findDistributionDependentLibs(extraSearch []string, subDir, fn string) stri
 func findDistributionDependentDir(extraSearch []string, subDir, fn string) string {
 	var searchPaths []string
 	searchPaths = append(searchPaths, extraSearch...)
-	searchPaths = append(searchPaths, distributionDependentLibSearchPath...)
+	searchPaths = append(searchPaths, dynlib.DistributionLibSearchPath()...)
 
 	for _, base := range searchPaths {
 		candidate := filepath.Join(base, subDir, fn)
@@ -721,7 +853,7 @@ func (h *hugbox) appendGtk2Theme() bool {
 		h.roBind("/usr/share/icons/Adwaita", "/usr/share/icons/Adwaita", false)
 		gtkRc = adwaitaGtkrcAsset
 	} else {
-		log.Printf("sandbox: Failed to find Adwaita gtk-2.0 theme.")
+		Warnf("sandbox: Failed to find Adwaita gtk-2.0 theme.")
 	}
 
 	gtkRcPath := filepath.Join(h.homeDir, ".gtkrc-2.0")
@@ -763,7 +895,7 @@ func (h *hugbox) appendRestrictedGtk2(hasAdwaita bool) ([]string, string, error)
 			gtkLibs = append(gtkLibs, libAdwaita)
 			gtkLibPath = gtkLibPath + ":" + gtkEngineDir
 		} else {
-			log.Printf("sandbox: Failed to find gtk-2.0 libadwaita.so.")
+			Warnf("sandbox: Failed to find gtk-2.0 libadwaita.so.")
 		}
 	}
 
@@ -779,7 +911,7 @@ func (h *hugbox) appendRestrictedGtk2(hasAdwaita bool) ([]string, string, error)
 		gtkLibs = append(gtkLibs, libPrintFile)
 		gtkLibPath = gtkLibPath + ":" + gtkPrintDir
 	} else {
-		log.Printf("sandbox: Failed to find gtk-2.0 libprintbackend-file.so.")
+		Warnf("sandbox: Failed to find gtk-2.0 libprintbackend-file.so.")
 	}
 
 	if setGtkPath {
@@ -819,78 +951,53 @@ func (h *hugbox) appendRestrictedGtk2(hasAdwaita bool) ([]string, string, error)
 	return gtkLibs, gtkLibPath, nil
 }
 
+// appendLdLibraryPathLibs mounts the libraries that were found via
+// LD_LIBRARY_PATH.  These are omitted from the mount set, on the assumption
+// that the directories are mounted, so any that aren't are bound into the
+// restricted library directory, as they would be silently absent otherwise.
+func (h *hugbox) appendLdLibraryPathLibs(libs *dynlib.Libraries) {
+	var aliases []string
+	for alias := range libs.LdLibraryPath {
+		aliases = append(aliases, alias)
+	}
+	sort.Strings(aliases)
+	Debugf("sandbox: LD_LIBRARY_PATH dirs: %v", libs.LdLibraryPathDirs())
+	for _, alias := range aliases {
+		if fn := libs.LdLibraryPath[alias]; !h.isHostPathMounted(fn) {
+			Debugf("sandbox: lib: %v (not mounted via LD_LIBRARY_PATH)", fn)
+			h.roBind(fn, filepath.Join(restrictedLibDir, alias), false)
+		}
+	}
+}
+
 func (h *hugbox) appendLibraries(cache *dynlib.Cache, binaries []string, extraLibs []string, ldLibraryPath string, filterFn dynlib.FilterFunc) error {
 	defer runtime.GC()
 
-	// ld-linux(-x86-64).so needs special handling since it needs to be in
-	// a precise location on the filesystem.
-	ldSoPath, ldSoAlias, err := dynlib.FindLdSo(cache)
-	if err != nil {
-		return err
-	} else {
-		Debugf("sandbox: ld.so appears to be '%v' -> %v.", ldSoAlias, ldSoPath)
-
-		// Normalize.
-		_, ldSoAliasFn := filepath.Split(ldSoAlias)
-		ldSoAlias = filepath.Join("/lib", ldSoAliasFn)
-	}
-
 	// Search the distribution specific directories as well.
-	fallbackLibSearchPath := strings.Join(distributionDependentLibSearchPath, fmt.Sprintf("%c", filepath.ListSeparator))
-	toBindMount, err := cache.ResolveLibraries(binaries, extraLibs, ldLibraryPath, fallbackLibSearchPath, filterFn)
+	fallbackLibSearchPath := strings.Join(dynlib.DistributionLibSearchPath(), fmt.Sprintf("%c", filepath.ListSeparator))
+	mounts, err := cache.MountSet(binaries, extraLibs, ldLibraryPath, fallbackLibSearchPath, filterFn)
 	if err != nil {
 		return err
 	}
+	h.libraries = mounts.Libraries
 
-	// XXX: This needs one more de-dup pass to see if the sandbox expects two
-	// different versions to share an alias.
-
-	// Ensure that bindMounts happen in a consistent order.
-	sortedLibs := []string{}
-	for k, _ := range toBindMount {
-		sortedLibs = append(sortedLibs, k)
+	// Append all the things, in a consistent order.
+	for _, v := range mounts.Binds {
+		Debugf("sandbox: lib: %v", v.Source)
+		h.roBind(v.Source, v.Target, false)
 	}
-	sort.Strings(sortedLibs)
-
-	// Append all the things!
-	for _, realLib := range sortedLibs {
-		if realLib == ldSoPath { // Special handling.
-			h.roBind(realLib, ldSoAlias, false)
-			continue
-		}
-
-		aliases := toBindMount[realLib]
-		Debugf("sandbox: lib: %v", realLib)
-		sort.Strings(aliases) // Likewise, ensure symlink ordering.
-
-		// Avoid leaking information about exact library versions to cursory
-		// inspection by bind mounting libraries in as the first alias, and
-		// then symlinking off that.
-		src := filepath.Join(restrictedLibDir, aliases[0])
-		h.roBind(realLib, src, false)
-		aliases = aliases[1:]
-		if len(aliases) == 0 {
-			continue
-		}
-
-		symlinked := make(map[string]bool) // XXX: Fairly sure this is unneeded.
-		for _, alias := range aliases {
-			dst := filepath.Join(restrictedLibDir, alias)
-			if _, ok := symlinked[dst]; !ok {
-				if dst != src {
-					h.symlink(src, dst)
-					symlinked[dst] = true
-				}
-			}
-		}
+	for _, v := range mounts.Symlinks {
+		h.symlink(v.Source, v.Target)
 	}
 
+	h.appendLdLibraryPathLibs(mounts.Libraries)
+
 	// Some systems are really stubborn about searching for certain things
 	// in the qualified lib directories.  In particular ld-linux.so needs to
 	// be in exactly the right place, and openSUSE seems to really want to
 	// use "/usr/lib64" for certain things.
 	switch runtime.GOARCH {
-	case "amd64":
+	case "amd64", "arm64":
 		h.symlink("/lib", "/lib64")
 		h.symlink(restrictedLibDir, "/usr/lib64")
 	default:
@@ -901,20 +1008,3 @@ func (h *hugbox) appendLibraries(cache *dynlib.Cache, binaries []string, extraLi
 
 	return nil
 }
-
-func init() {
-	searchPaths := []string{
-		"/usr/lib", // Arch Linux.
-	}
-	switch runtime.GOARCH {
-	case "amd64":
-		searchPaths = append([]string{
-			"/usr/lib64",                // Fedora 25
-			"/usr/lib/x86_64-linux-gnu", // Debian
-		}, searchPaths...)
-	default:
-		panic("sandbox: unsupported architecture: " + runtime.GOARCH)
-	}
-
-	distributionDependentLibSearchPath = searchPaths
-}
@@ -0,0 +1,261 @@
+// application_test.go - Tor Browser sandbox tests.
+// Copyright (C) 2016  Yawning Angel.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package sandbox
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"cmd/sandboxed-tor-browser/internal/dynlib"
+	"cmd/sandboxed-tor-browser/internal/ui/config"
+	. "cmd/sandboxed-tor-browser/internal/utils"
+)
+
+// testBrowserExtensions are the extensions that are mounted into the
+// browser profile.
+var testBrowserExtensions = []string{
+	"{73a6fe31-595d-460b-a920-fcc0f8843232}.xpi",
+	"torbutton@torproject.org.xpi",
+	"https-everywhere-eff@eff.org.xpi",
+	"tor-launcher@torproject.org.xpi",
+}
+
+// newTestBundle creates a skeleton installed bundle and profile, and returns
+// a config that points at them.
+func newTestBundle(t *testing.T) *config.Config {
+	dir := t.TempDir()
+	cfg := &config.Config{
+		BundleInstallDir: filepath.Join(dir, "tor-browser"),
+		ProfileDir:       filepath.Join(dir, "profile"),
+	}
+	bundleProfileDir := filepath.Join(cfg.BundleInstallDir, "Browser", profileSubDir)
+	for _, d := range []string{
+		filepath.Join(bundleProfileDir, "preferences"),
+		filepath.Join(bundleProfileDir, "extensions"),
+		cfg.ProfileDir,
+	} {
+		if err := os.MkdirAll(d, DirMode); err != nil {
+			t.Fatalf("failed to create '%v': %v", d, err)
+		}
+	}
+	for _, ext := range testBrowserExtensions {
+		if err := ioutil.WriteFile(filepath.Join(bundleProfileDir, "extensions", ext), nil, FileMode); err != nil {
+			t.Fatalf("failed to create '%v': %v", ext, err)
+		}
+	}
+	if err := ioutil.WriteFile(filepath.Join(cfg.ProfileDir, "prefs.js"), nil, FileMode); err != nil {
+		t.Fatalf("failed to create prefs.js: %v", err)
+	}
+	return cfg
+}
+
+// testMount is a mount in the sandbox's mount plan.
+type testMount struct {
+	op, src string
+}
+
+// mountPlan returns the bind and tmpfs mounts in args, by destination.
+func mountPlan(t *testing.T, args []string) map[string]testMount {
+	plan := make(map[string]testMount)
+	for i := 0; i < len(args); i++ {
+		var m testMount
+		var dest string
+		switch args[i] {
+		case "--bind", "--ro-bind":
+			m, dest = testMount{args[i], args[i+1]}, args[i+2]
+			i += 2
+		case "--tmpfs":
+			m, dest = testMount{args[i], ""}, args[i+1]
+			i++
+		default:
+			continue
+		}
+		if _, ok := plan[dest]; ok {
+			t.Errorf("'%v' is mounted more than once", dest)
+		}
+		plan[dest] = m
+	}
+	return plan
+}
+
+func TestAppendBrowserFilesystem(t *testing.T) {
+	const (
+		homeDir    = "/home/amnesia"
+		bundleDest = homeDir + "/sandboxed-tor-browser/tor-browser"
+		browser    = bundleDest + "/Browser"
+		profile    = browser + "/" + profileSubDir
+	)
+
+	for _, v := range []struct {
+		name           string
+		writableBundle bool
+		amnesiac       bool
+		bundleOp       string
+	}{
+		{"default", false, false, "--ro-bind"},
+		{"amnesiac profile", false, true, "--ro-bind"},
+		{"writable bundle", true, false, "--bind"},
+	} {
+		cfg := newTestBundle(t)
+		cfg.Sandbox.EnableAmnesiacProfileDirectory = v.amnesiac
+		realBrowserHome := filepath.Join(cfg.BundleInstallDir, "Browser")
+		realBundleProfileDir := filepath.Join(realBrowserHome, profileSubDir)
+
+		h := &hugbox{homeDir: homeDir}
+		if err := h.appendBrowserFilesystem(cfg, browser, realBrowserHome, v.writableBundle); err != nil {
+			t.Fatalf("%v: appendBrowserFilesystem() = %v", v.name, err)
+		}
+		if h.chdir != browser {
+			t.Errorf("%v: chdir = %v, expected %v", v.name, h.chdir, browser)
+		}
+
+		expected := map[string]testMount{
+			bundleDest:                   {v.bundleOp, cfg.BundleInstallDir},
+			profile + "/preferences":     {"--ro-bind", filepath.Join(realBundleProfileDir, "preferences")},
+			browser + "/Desktop":         {"--bind", filepath.Join(realBrowserHome, "Desktop")},
+			browser + "/Downloads":       {"--bind", filepath.Join(realBrowserHome, "Downloads")},
+			browser + "/" + cachesSubDir: {"--tmpfs", ""},
+			profile + "/extensions":      {"--tmpfs", ""},
+		}
+		for _, ext := range testBrowserExtensions {
+			expected[profile+"/extensions/"+ext] = testMount{"--ro-bind", filepath.Join(realBundleProfileDir, "extensions", ext)}
+		}
+		if v.amnesiac {
+			// The profile is a tmpfs, with copies of the contents, so
+			// nothing is written back.
+			expected[profile] = testMount{"--tmpfs", ""}
+			if !strings.Contains(strings.Join(h.args, " "), " "+profile+"/prefs.js") {
+				t.Errorf("%v: prefs.js is not copied into the profile", v.name)
+			}
+		} else {
+			expected[profile] = testMount{"--bind", cfg.ProfileDir}
+		}
+
+		plan := mountPlan(t, h.args)
+		for dest, m := range expected {
+			if plan[dest] != m {
+				t.Errorf("%v: '%v' = %+v, expected %+v", v.name, dest, plan[dest], m)
+			}
+		}
+		for dest, m := range plan {
+			if _, ok := expected[dest]; !ok {
+				t.Errorf("%v: unexpected mount '%v' = %+v", v.name, dest, m)
+			}
+		}
+
+		// Nothing from the bundle is writable, other than the directories
+		// that are meant to be.
+		if !v.writableBundle {
+			for dest, m := range plan {
+				if m.op == "--bind" && strings.HasPrefix(m.src, cfg.BundleInstallDir+"/") && !strings.HasSuffix(dest, "/Desktop") && !strings.HasSuffix(dest, "/Downloads") {
+					t.Errorf("%v: '%v' is a writable part of the bundle", v.name, m.src)
+				}
+			}
+		}
+	}
+}
+
+func TestAppendBrowserFilesystemOverrides(t *testing.T) {
+	cfg := newTestBundle(t)
+	desktopDir, downloadsDir, extraDir := t.TempDir(), t.TempDir(), t.TempDir()
+	cfg.Sandbox.DesktopDir = desktopDir
+	cfg.Sandbox.DownloadsDir = downloadsDir
+	cfg.Sandbox.ExtraBindMounts = []config.BindMount{
+		{Source: extraDir, Dest: "/home/amnesia/extra", ReadOnly: true},
+	}
+
+	const browser = "/home/amnesia/sandboxed-tor-browser/tor-browser/Browser"
+	h := &hugbox{homeDir: "/home/amnesia"}
+	if err := h.appendBrowserFilesystem(cfg, browser, filepath.Join(cfg.BundleInstallDir, "Browser"), false); err != nil {
+		t.Fatalf("appendBrowserFilesystem() = %v", err)
+	}
+
+	plan := mountPlan(t, h.args)
+	for dest, m := range map[string]testMount{
+		browser + "/Desktop":   {"--bind", desktopDir},
+		browser + "/Downloads": {"--bind", downloadsDir},
+		"/home/amnesia/extra":  {"--ro-bind", extraDir},
+	} {
+		if plan[dest] != m {
+			t.Errorf("'%v' = %+v, expected %+v", dest, plan[dest], m)
+		}
+	}
+}
+
+func TestIsHostPathMounted(t *testing.T) {
+	h := &hugbox{args: []string{
+		"--ro-bind", "/usr/lib/", "/usr/lib",
+		"--bind", "/opt/foo/libfoo.so.1", "/opt/foo/libfoo.so.1",
+		"--tmpfs", "/opt/bar",
+		"--symlink", "/opt/baz", "/opt/baz/lib",
+	}}
+	for _, v := range []struct {
+		fn       string
+		expected bool
+	}{
+		{"/usr/lib", true},
+		{"/usr/lib/libc.so.6", true},
+		{"/usr/lib/x86_64-linux-gnu/libc.so.6", true},
+		{"/usr/lib64/libc.so.6", false},
+		{"/opt/foo/libfoo.so.1", true},
+		{"/opt/foo/libfoo.so.2", false},
+		{"/opt/bar/libbar.so.1", false},
+		{"/opt/baz/lib/libbaz.so.1", false},
+	} {
+		if mounted := h.isHostPathMounted(v.fn); mounted != v.expected {
+			t.Errorf("isHostPathMounted(%v) = %v, expected %v", v.fn, mounted, v.expected)
+		}
+	}
+}
+
+func TestAppendLdLibraryPathLibs(t *testing.T) {
+	mountedDir, unmountedDir := t.TempDir(), t.TempDir()
+	libs := &dynlib.Libraries{LdLibraryPath: map[string]string{
+		"libfoo.so.1": filepath.Join(mountedDir, "libfoo.so.1"),
+		"libbar.so.2": filepath.Join(unmountedDir, "libbar.so.2"),
+		"libbaz.so.3": filepath.Join(unmountedDir, "libbaz.so.3"),
+	}}
+	for _, fn := range libs.LdLibraryPath {
+		if err := ioutil.WriteFile(fn, nil, FileMode); err != nil {
+			t.Fatalf("failed to create '%v': %v", fn, err)
+		}
+	}
+
+	// Only the libraries in directories that are not mounted are bound,
+	// into the restricted library directory, in a stable order.
+	h := &hugbox{args: []string{"--ro-bind", mountedDir, mountedDir}}
+	h.appendLdLibraryPathLibs(libs)
+	expected := []string{
+		"--ro-bind", mountedDir, mountedDir,
+		"--ro-bind", filepath.Join(unmountedDir, "libbar.so.2"), restrictedLibDir + "/libbar.so.2",
+		"--ro-bind", filepath.Join(unmountedDir, "libbaz.so.3"), restrictedLibDir + "/libbaz.so.3",
+	}
+	if !reflect.DeepEqual(h.args, expected) {
+		t.Errorf("appendLdLibraryPathLibs() args = %q, expected %q", h.args, expected)
+	}
+
+	// Nothing is done without library path libraries.
+	h = &hugbox{}
+	h.appendLdLibraryPathLibs(&dynlib.Libraries{})
+	if len(h.args) != 0 {
+		t.Errorf("appendLdLibraryPathLibs() args = %q, expected none", h.args)
+	}
+}
@@ -0,0 +1,144 @@
+// check.go - Host environment self-test.
+// Copyright (C) 2017  Yawning Angel.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package sandbox
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"cmd/sandboxed-tor-browser/internal/data"
+	"cmd/sandboxed-tor-browser/internal/dynlib"
+	"cmd/sandboxed-tor-browser/internal/ui/config"
+)
+
+// hostCheck is a single host environment check.
+type hostCheck struct {
+	name     string
+	critical bool
+	fn       func() (string, error)
+}
+
+// CheckHost verifies that the host environment is capable of running the
+// sandbox, and writes a pass/fail report to w.  It returns false if any
+// critical check failed.
+func CheckHost(w io.Writer) bool {
+	var bwrapSetuid bool
+
+	checks := []hostCheck{
+		{"embedded assets", true, func() (string, error) {
+			if err := data.Verify(); err != nil {
+				return "", err
+			}
+			return "present", nil
+		}},
+		{"bubblewrap", true, func() (string, error) {
+			h, err := newHugbox()
+			if err != nil {
+				return "", err
+			}
+			bwrapSetuid = h.bwrapSetuid
+			s := fmt.Sprintf("%v (%v)", h.bwrapPath, h.bwrapVersion)
+			if bwrapSetuid {
+				s = s + ", setuid"
+			}
+			for _, f := range h.bwrapVersion.missingFeatures() {
+				s = s + fmt.Sprintf(", no `%v`", f.flag)
+				if f == bwrapAddSeccompFd {
+					s = s + fmt.Sprintf(" (not denying: %v)", strings.Join(unstackableDenied(), ", "))
+				}
+			}
+			return s, nil
+		}},
+		{"user namespaces", false, checkUserNamespaces},
+		{"seccomp", true, checkSeccomp},
+		{"ld.so.cache", true, func() (string, error) {
+			if ok, reason := dynlib.SupportInfo(); !ok {
+				return "", errors.New(reason)
+			}
+			if _, err := dynlib.LoadCache(); err != nil {
+				return "", err
+			}
+			return "parsed", nil
+		}},
+		{"config", true, checkConfig},
+		{"XDG_RUNTIME_DIR", false, func() (string, error) {
+			d := os.Getenv("XDG_RUNTIME_DIR")
+			if d == "" {
+				return "", fmt.Errorf("not set, a directory under %v will be used unless a `runtimeDir` is configured", os.TempDir())
+			}
+			return d, nil
+		}},
+	}
+
+	ok := true
+	for _, c := range checks {
+		s, err := c.fn()
+
+		// User namespaces are only required if bubblewrap isn't setuid.
+		critical := c.critical || (c.name == "user namespaces" && !bwrapSetuid)
+		switch {
+		case err == nil:
+			fmt.Fprintf(w, "[PASS] %v: %v\n", c.name, s)
+		case critical:
+			fmt.Fprintf(w, "[FAIL] %v: %v\n", c.name, err)
+			ok = false
+		default:
+			fmt.Fprintf(w, "[WARN] %v: %v\n", c.name, err)
+		}
+	}
+	return ok
+}
+
+func checkUserNamespaces() (string, error) {
+	if reasons := userNamespaceBlockers(); len(reasons) > 0 {
+		return "", errors.New(strings.Join(reasons, ", "))
+	}
+	return "permitted", nil
+}
+
+func checkSeccomp() (string, error) {
+	if err := seccompFilterSupported(); err != nil {
+		return "", err
+	}
+
+	// Compiling the filters also validates the rule files.
+	for _, name := range SeccompProfiles {
+		if err := ExportProfileBPF(name, ioutil.Discard); err != nil {
+			return "", fmt.Errorf("failed to compile '%v': %v", name, err)
+		}
+	}
+	if err := crossCheckWhitelists(); err != nil {
+		return "", err
+	}
+	return "supported", nil
+}
+
+func checkConfig() (string, error) {
+	// The version is only used to decide if the config needs to be
+	// re-written, which never happens here.
+	if _, err := config.New(""); err != nil {
+		if e, ok := err.(*config.Error); ok {
+			return "", fmt.Errorf("%v (check `%v`)", e, e.Kind)
+		}
+		return "", err
+	}
+	return "valid", nil
+}
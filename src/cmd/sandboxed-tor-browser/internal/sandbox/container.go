@@ -0,0 +1,141 @@
+// container.go - Nested sandbox/container detection.
+// Copyright (C) 2017  Yawning Angel.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package sandbox
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+
+	. "cmd/sandboxed-tor-browser/internal/utils"
+)
+
+const capSysAdmin = 21
+
+// UserNamespaceError is the error returned when the environment disallows
+// the unprivileged user namespaces that a non-setuid bubblewrap requires.
+type UserNamespaceError struct {
+	// Reasons are the signs of why user namespaces are unavailable.
+	Reasons []string
+
+	// Err is the underlying bubblewrap error, if any.
+	Err error
+}
+
+// Error returns the string representation of a UserNamespaceError.
+func (e *UserNamespaceError) Error() string {
+	s := fmt.Sprintf("sandbox: this environment disallows unprivileged user namespaces (%s); run the container with --privileged, or enable the sysctl (kernel.unprivileged_userns_clone = 1, user.max_user_namespaces > 0)", strings.Join(e.Reasons, ", "))
+	if e.Err != nil {
+		s = s + ": " + e.Err.Error()
+	}
+	return s
+}
+
+// CheckUserNamespaces returns a *UserNamespaceError if the environment
+// appears to disallow unprivileged user namespaces, and the installed
+// bubblewrap requires them (ie: it is not setuid).  Problems with bubblewrap
+// itself are left for the launch to report.
+func CheckUserNamespaces() error {
+	h, err := newHugbox()
+	if err != nil || h.bwrapSetuid {
+		return nil
+	}
+	if reasons := userNamespaceBlockers(); len(reasons) > 0 {
+		return &UserNamespaceError{Reasons: reasons}
+	}
+	return nil
+}
+
+// userNamespaceBlockers returns the reasons that unprivileged user namespaces
+// are likely unavailable, if any.
+func userNamespaceBlockers() []string {
+	if _, err := os.Stat("/proc/self/ns/user"); err != nil {
+		return []string{"not supported by the kernel"}
+	}
+
+	var reasons []string
+	for _, v := range []struct {
+		fn, sysctl string
+	}{
+		{"/proc/sys/kernel/unprivileged_userns_clone", "kernel.unprivileged_userns_clone"},
+		{"/proc/sys/user/max_user_namespaces", "user.max_user_namespaces"},
+	} {
+		b, err := ioutil.ReadFile(v.fn)
+		if err != nil {
+			continue
+		}
+		if strings.TrimSpace(string(b)) == "0" {
+			reasons = append(reasons, fmt.Sprintf("disabled (%v = 0)", v.sysctl))
+		}
+	}
+
+	// Flatpak's sandbox always forbids creating nested user namespaces,
+	// while the default Docker/Podman seccomp policy forbids it unless the
+	// container has CAP_SYS_ADMIN (Eg: `--privileged`).
+	switch container := detectContainer(); container {
+	case "":
+	case "Flatpak":
+		reasons = append(reasons, "running inside Flatpak")
+	default:
+		if !hasBoundingCap(capSysAdmin) {
+			reasons = append(reasons, fmt.Sprintf("running in a %v container without CAP_SYS_ADMIN", container))
+		}
+	}
+	return reasons
+}
+
+// detectContainer returns the name of the container runtime that the
+// process appears to be running under, if any.
+func detectContainer() string {
+	for _, v := range []struct {
+		fn, name string
+	}{
+		{"/.flatpak-info", "Flatpak"},
+		{"/.dockerenv", "Docker"},
+		{"/run/.containerenv", "Podman"},
+	} {
+		if FileExists(v.fn) {
+			return v.name
+		}
+	}
+	if v := os.Getenv("container"); v != "" {
+		return v // systemd's convention (Eg: "lxc", "podman").
+	}
+	return ""
+}
+
+// hasBoundingCap returns true if the capability is in the process' bounding
+// set, or if the bounding set can't be determined.
+func hasBoundingCap(capability uint) bool {
+	b, err := ioutil.ReadFile("/proc/self/status")
+	if err != nil {
+		return true
+	}
+	for _, l := range strings.Split(string(b), "\n") {
+		if !strings.HasPrefix(l, "CapBnd:") {
+			continue
+		}
+		v, err := strconv.ParseUint(strings.TrimSpace(strings.TrimPrefix(l, "CapBnd:")), 16, 64)
+		if err != nil {
+			return true
+		}
+		return v&(1<<capability) != 0
+	}
+	return true
+}
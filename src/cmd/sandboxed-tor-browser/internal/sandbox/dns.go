@@ -0,0 +1,63 @@
+// dns.go - Sandbox name resolution.
+// Copyright (C) 2017  Yawning Angel.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package sandbox
+
+import (
+	"fmt"
+	"path/filepath"
+)
+
+const (
+	resolvConfPath = "/etc/resolv.conf"
+
+	// resolvConfBody is the `resolv.conf` provided in sandboxes without
+	// host network access.  All name resolution is meant to happen via tor's
+	// SOCKS port, so the loopback resolver in the sandbox's (empty) network
+	// namespace ensures that anything that tries the libc resolver fails
+	// immediately, instead of timing out.
+	resolvConfBody = "# All name resolution happens via tor.\nnameserver 127.0.0.1\noptions attempts:1 timeout:1\n"
+)
+
+// sanitizeResolvConf provides the sanitized `resolv.conf`.
+func (h *hugbox) sanitizeResolvConf() {
+	h.file(resolvConfPath, []byte(resolvConfBody))
+}
+
+// checkHostResolvConf returns an error if the bubblewrap arguments bind mount
+// the host's `resolv.conf` anywhere, or bind mount over `/etc/resolv.conf`.
+func checkHostResolvConf(args []string) error {
+	hostPath, err := filepath.EvalSymlinks(resolvConfPath)
+	if err != nil {
+		hostPath = resolvConfPath
+	}
+	for i := 0; i+2 < len(args); i++ {
+		switch args[i] {
+		case "--bind", "--ro-bind", "--bind-try", "--ro-bind-try":
+		default:
+			continue
+		}
+		src, dest := filepath.Clean(args[i+1]), filepath.Clean(args[i+2])
+		i += 2
+		if dest == resolvConfPath || dest == "/etc" || dest == "/" {
+			return fmt.Errorf("sandbox: the host's name resolution config would be exposed: %v -> %v", src, dest)
+		}
+		if realSrc, err := filepath.EvalSymlinks(src); err == nil && realSrc == hostPath {
+			return fmt.Errorf("sandbox: the host's name resolution config would be exposed: %v -> %v", src, dest)
+		}
+	}
+	return nil
+}
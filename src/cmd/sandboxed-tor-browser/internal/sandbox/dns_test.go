@@ -0,0 +1,170 @@
+// dns_test.go - Sandbox name resolution config tests.
+// Copyright (C) 2017  Yawning Angel.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package sandbox
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestCheckHostResolvConf(t *testing.T) {
+	hostPath, err := filepath.EvalSymlinks(resolvConfPath)
+	if err != nil {
+		t.Skipf("no host %v: %v", resolvConfPath, err)
+	}
+	link := filepath.Join(t.TempDir(), "resolv.conf")
+	if err = os.Symlink(hostPath, link); err != nil {
+		t.Fatalf("failed to create symlink: %v", err)
+	}
+	other := t.TempDir()
+
+	for _, v := range []struct {
+		name  string
+		args  []string
+		valid bool
+	}{
+		{"none", nil, true},
+		{"unrelated", []string{"--ro-bind", "/usr/lib", "/usr/lib", "--bind", other, "/home/amnesia/other"}, true},
+		{"sanitized file", []string{"--file", "5", resolvConfPath}, true},
+		{"symlink op", []string{"--symlink", "/run/resolv.conf", resolvConfPath}, true},
+		{"host file", []string{"--ro-bind", resolvConfPath, resolvConfPath}, false},
+		{"host file elsewhere", []string{"--ro-bind", resolvConfPath, "/home/amnesia/resolv.conf"}, false},
+		{"host file via symlink", []string{"--bind", link, "/tmp/resolv.conf"}, false},
+		{"host file optional", []string{"--ro-bind-try", hostPath, "/tmp/resolv.conf"}, false},
+		{"over resolv.conf", []string{"--bind", other, resolvConfPath}, false},
+		{"over /etc", []string{"--ro-bind", "/etc", "/etc/"}, false},
+		{"over /", []string{"--bind-try", other, "/"}, false},
+		{"after other mounts", []string{"--tmpfs", "/tmp", "--ro-bind", "/usr/lib", "/usr/lib", "--ro-bind", resolvConfPath, resolvConfPath}, false},
+		{"truncated", []string{"--ro-bind", resolvConfPath}, true},
+	} {
+		if err := checkHostResolvConf(v.args); (err == nil) != v.valid {
+			t.Errorf("%v: checkHostResolvConf(%q) = %v, expected valid: %v", v.name, v.args, err, v.valid)
+		}
+	}
+}
+
+// dryRunArgs runs h as a dry run, and returns the bwrap arguments.
+func dryRunArgs(h *hugbox) ([]string, error) {
+	var buf bytes.Buffer
+	h.dryRun = &buf
+	if _, err := h.run(); err != nil {
+		return nil, err
+	}
+
+	var args []string
+	inArgs := false
+	for _, l := range strings.Split(buf.String(), "\n") {
+		switch {
+		case strings.HasPrefix(l, "# bwrap arguments"):
+			inArgs = true
+		case l == "" || strings.HasPrefix(l, "#"):
+			inArgs = false
+		case inArgs:
+			args = append(args, strings.Fields(l)...)
+		}
+	}
+	return args, nil
+}
+
+// newTestHugbox returns a hugbox like newHugbox, without requiring bwrap.
+func newTestHugbox(net bool) *hugbox {
+	return &hugbox{
+		unshare:      unshareOpts{ipc: true, pid: true, net: net, uts: true, cgroup: true},
+		runtimeDir:   "/run/user/1000",
+		homeDir:      "/home/amnesia",
+		bwrapPath:    "/usr/bin/bwrap",
+		bwrapVersion: &bwrapVersion{},
+	}
+}
+
+func TestSanitizeResolvConf(t *testing.T) {
+	for _, v := range []struct {
+		name      string
+		net       bool
+		allowHost bool
+		hostBind  bool
+		sanitized bool
+		valid     bool
+	}{
+		{"isolated", true, false, false, true, true},
+		{"isolated with host bind", true, false, true, true, false},
+		{"isolated with host bind allowed", true, true, true, true, true},
+		{"host network", false, false, false, false, true},
+		{"host network with host bind", false, false, true, false, true},
+	} {
+		h := newTestHugbox(v.net)
+		h.allowHostResolvConf = v.allowHost
+		if v.hostBind {
+			h.args = append(h.args, "--ro-bind", resolvConfPath, resolvConfPath)
+		}
+
+		args, err := dryRunArgs(h)
+		if (err == nil) != v.valid {
+			t.Errorf("%v: run() = %v, expected valid: %v", v.name, err, v.valid)
+			continue
+		} else if err != nil {
+			continue
+		}
+
+		// The sanitized file is provided via `--file <fd> /etc/resolv.conf`,
+		// with the contents written to the fd.
+		sanitized := false
+		for i := 0; i+2 < len(args); i++ {
+			if args[i] != "--file" || args[i+2] != resolvConfPath {
+				continue
+			}
+			fd, err := strconv.Atoi(args[i+1])
+			if err != nil || fd < 4 || fd-4 >= len(h.fileData) {
+				t.Errorf("%v: invalid --file fd: %v", v.name, args[i+1])
+				continue
+			}
+			if body := string(h.fileData[fd-4]); body != resolvConfBody {
+				t.Errorf("%v: resolv.conf = %q, expected %q", v.name, body, resolvConfBody)
+			}
+			sanitized = true
+		}
+		if sanitized != v.sanitized {
+			t.Errorf("%v: sanitized resolv.conf provided: %v, expected %v", v.name, sanitized, v.sanitized)
+		}
+	}
+}
+
+func TestResolvConfBody(t *testing.T) {
+	// Only the loopback resolver in the sandbox's network namespace, which
+	// fails fast.
+	var nameservers []string
+	for _, l := range strings.Split(resolvConfBody, "\n") {
+		if f := strings.Fields(l); len(f) > 0 {
+			switch f[0] {
+			case "nameserver":
+				nameservers = append(nameservers, f[1:]...)
+			case "search", "domain":
+				t.Errorf("resolv.conf has a '%v' directive", f[0])
+			}
+		}
+	}
+	if len(nameservers) != 1 || nameservers[0] != "127.0.0.1" {
+		t.Errorf("resolv.conf nameservers = %v, expected [127.0.0.1]", nameservers)
+	}
+	if !strings.Contains(resolvConfBody, "attempts:1") || !strings.Contains(resolvConfBody, "timeout:1") {
+		t.Errorf("resolv.conf does not fail fast: %q", resolvConfBody)
+	}
+}
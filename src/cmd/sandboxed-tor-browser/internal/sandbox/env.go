@@ -0,0 +1,99 @@
+// env.go - Sandboxed browser environment.
+// Copyright (C) 2016  Yawning Angel.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package sandbox
+
+import (
+	"sort"
+	"strings"
+
+	"cmd/sandboxed-tor-browser/internal/ui/config"
+)
+
+// sandboxHomeDir is the home directory inside the sandbox.
+const sandboxHomeDir = "/home/amnesia"
+
+// The loopback ports that `tbb_stub.so` redirects to the tor surrogates.
+// These must match `TBB_SOCKS_PORT` and `TBB_CONTROL_PORT` in `tbb_stub.c`,
+// and the proxy prefs set in `mozilla.cfg`.
+const (
+	stubSocksPort   = "9150"
+	stubControlPort = "9151"
+)
+
+// buildEnv returns the base environment of the sandboxed browser, as
+// `KEY=value` strings, followed by the user's `ExtraEnv`.
+//
+// bubblewrap is always started with an empty environment, so no host
+// environment variables reach the sandbox.  The environment is instead
+// built up from this allowlist, `HOME` and `XDG_RUNTIME_DIR` (set for every
+// sandbox), and the values that depend on the rest of the sandbox setup
+// (library paths, X11).
+func buildEnv(cfg *config.Config) []string {
+	env := []string{
+		"XDG_CACHE_HOME=" + sandboxHomeDir + "/.cache",
+		"XDG_CONFIG_HOME=" + sandboxHomeDir + "/.config",
+		"XDG_DATA_HOME=" + sandboxHomeDir + "/.local/share",
+		"LANG=" + localeToLang(cfg.Locale),
+
+		// Set the same env vars that Tor Browser would expect when using a
+		// system tor, since the launcher is responsible for managing the Tor
+		// process, and it will be talking to the surrogates anyway.  The
+		// surrogates forward to the configured tor's SOCKS and control ports,
+		// so these are the same regardless of which tor is used.
+		"TOR_SOCKS_PORT=" + stubSocksPort,
+		"TOR_CONTROL_PORT=" + stubControlPort,
+		"TOR_SKIP_LAUNCH=1",
+		"TOR_NO_DISPLAY_NETWORK_SETTINGS=1",
+		"TOR_HIDE_UPDATE_CHECK_UI=1",
+
+		// Hardware accelerated OpenGL will not work, and never will.
+		"LIBGL_ALWAYS_SOFTWARE=1",
+
+		// Crashdumps regardless of being sanitized or not, not to be trusted.
+		"MOZ_CRASHREPORTER_DISABLE=1",
+	}
+
+	// Apply the user's extra environment, in a deterministic order.  The
+	// keys were validated when the config was loaded.
+	keys := make([]string, 0, len(cfg.Sandbox.ExtraEnv))
+	for k := range cfg.Sandbox.ExtraEnv {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		env = append(env, k+"="+cfg.Sandbox.ExtraEnv[k])
+	}
+
+	return env
+}
+
+// localeToLang converts a Tor Browser locale (Eg: "en-US") to a `LANG` value
+// (Eg: "en_US.UTF-8").  The multi-locale bundle uses the default locale.
+func localeToLang(locale string) string {
+	if locale == "" || locale == "ALL" {
+		locale = "en-US"
+	}
+	return strings.Replace(locale, "-", "_", 1) + ".UTF-8"
+}
+
+func (h *hugbox) setenvs(env []string) {
+	for _, kv := range env {
+		if i := strings.IndexByte(kv, '='); i > 0 {
+			h.setenv(kv[:i], kv[i+1:])
+		}
+	}
+}
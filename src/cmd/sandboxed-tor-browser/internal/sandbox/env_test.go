@@ -0,0 +1,121 @@
+// env_test.go - Sandboxed browser environment tests.
+// Copyright (C) 2016  Yawning Angel.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package sandbox
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"cmd/sandboxed-tor-browser/internal/ui/config"
+)
+
+func envToMap(t *testing.T, env []string) map[string]string {
+	m := make(map[string]string)
+	for _, kv := range env {
+		i := strings.IndexByte(kv, '=')
+		if i <= 0 {
+			t.Fatalf("malformed environment entry: %q", kv)
+		}
+		if _, ok := m[kv[:i]]; ok {
+			t.Errorf("duplicate environment entry: %v", kv[:i])
+		}
+		m[kv[:i]] = kv[i+1:]
+	}
+	return m
+}
+
+func TestBuildEnv(t *testing.T) {
+	// None of the host environment should make it into the sandbox.
+	hostEnv := map[string]string{
+		"SSH_AUTH_SOCK":            "/run/user/1000/ssh-agent.sock",
+		"GPG_AGENT_INFO":           "/run/user/1000/gnupg/S.gpg-agent",
+		"DBUS_SESSION_BUS_ADDRESS": "unix:path=/run/user/1000/bus",
+		"LD_PRELOAD":               "/usr/lib/libevil.so",
+		"PATH":                     "/usr/local/bin:/usr/bin",
+		"LANG":                     "de_DE.UTF-8",
+		"XDG_CONFIG_HOME":          "/home/user/.config",
+		"TOR_SOCKS_PORT":           "9050",
+	}
+	for k, v := range hostEnv {
+		t.Setenv(k, v)
+	}
+
+	cfg := &config.Config{Locale: "pt-BR"}
+	expected := map[string]string{
+		"XDG_CACHE_HOME":                  sandboxHomeDir + "/.cache",
+		"XDG_CONFIG_HOME":                 sandboxHomeDir + "/.config",
+		"XDG_DATA_HOME":                   sandboxHomeDir + "/.local/share",
+		"LANG":                            "pt_BR.UTF-8",
+		"TOR_SOCKS_PORT":                  stubSocksPort,
+		"TOR_CONTROL_PORT":                stubControlPort,
+		"TOR_SKIP_LAUNCH":                 "1",
+		"TOR_NO_DISPLAY_NETWORK_SETTINGS": "1",
+		"TOR_HIDE_UPDATE_CHECK_UI":        "1",
+		"LIBGL_ALWAYS_SOFTWARE":           "1",
+		"MOZ_CRASHREPORTER_DISABLE":       "1",
+	}
+	if env := envToMap(t, buildEnv(cfg)); !reflect.DeepEqual(env, expected) {
+		t.Errorf("buildEnv() = %v, expected %v", env, expected)
+	}
+
+	// The user's extra environment is appended, sorted by name.
+	cfg.Sandbox.ExtraEnv = map[string]string{
+		"MOZ_USE_XINPUT2": "1",
+		"GTK_THEME":       "Adwaita:dark",
+	}
+	env := buildEnv(cfg)
+	if tail := env[len(env)-2:]; !reflect.DeepEqual(tail, []string{"GTK_THEME=Adwaita:dark", "MOZ_USE_XINPUT2=1"}) {
+		t.Errorf("buildEnv() extra environment = %v", tail)
+	}
+	m := envToMap(t, env)
+	for k := range hostEnv {
+		if v, ok := m[k]; ok && v == hostEnv[k] {
+			t.Errorf("buildEnv() passed through host variable %v", k)
+		}
+	}
+}
+
+func TestLocaleToLang(t *testing.T) {
+	for _, v := range []struct {
+		locale   string
+		expected string
+	}{
+		{"en-US", "en_US.UTF-8"},
+		{"ja-JP-mac", "ja_JP-mac.UTF-8"},
+		{"fr", "fr.UTF-8"},
+		{"ALL", "en_US.UTF-8"},
+		{"", "en_US.UTF-8"},
+	} {
+		if lang := localeToLang(v.locale); lang != v.expected {
+			t.Errorf("localeToLang(%v) = %v, expected %v", v.locale, lang, v.expected)
+		}
+	}
+}
+
+func TestHugboxSetenvs(t *testing.T) {
+	h := &hugbox{}
+	h.setenvs([]string{"A=1", "B=x=y", "C=", "=bogus", "bogus"})
+	expected := []string{
+		"--setenv", "A", "1",
+		"--setenv", "B", "x=y",
+		"--setenv", "C", "",
+	}
+	if !reflect.DeepEqual(h.args, expected) {
+		t.Errorf("setenvs() args = %q, expected %q", h.args, expected)
+	}
+}
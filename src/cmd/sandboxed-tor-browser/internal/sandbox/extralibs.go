@@ -0,0 +1,82 @@
+// extralibs.go - Manifest of dlopen()ed libraries.
+// Copyright (C) 2016  Yawning Angel.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package sandbox
+
+import (
+	"encoding/json"
+
+	"cmd/sandboxed-tor-browser/internal/data"
+	"cmd/sandboxed-tor-browser/internal/dynlib"
+	"cmd/sandboxed-tor-browser/internal/ui/config"
+	. "cmd/sandboxed-tor-browser/internal/utils"
+)
+
+// extraLibsManifest is the list of libraries that firefox dlopen()s, and
+// thus never show up when resolving the binaries' dependencies.
+type extraLibsManifest struct {
+	// Required are the libraries that must be present, as firefox will
+	// crash without them.
+	Required []string `json:"required"`
+
+	// Optional are the libraries that are made available if present on the
+	// host.
+	Optional []string `json:"optional"`
+}
+
+// manifestExtraLibs returns the sonames from the embedded extra library
+// manifest and the config that should be resolved in addition to the
+// binaries' dependencies.
+func manifestExtraLibs(cfg *config.Config, cache *dynlib.Cache) ([]string, error) {
+	b, err := data.Load("extralibs.json")
+	if err != nil {
+		return nil, err
+	}
+	var m extraLibsManifest
+	if err = json.Unmarshal(b, &m); err != nil {
+		return nil, err
+	}
+
+	libs := append([]string{}, m.Required...)
+	for _, v := range m.Optional {
+		if cache.GetLibraryPath(v) == "" {
+			Debugf("sandbox: Optional library not present: %v", v)
+			continue
+		}
+		libs = append(libs, v)
+	}
+	for _, v := range cfg.Sandbox.ExtraLibs {
+		if cache.GetLibraryPath(v) == "" {
+			Warnf("sandbox: Configured extra library not present: %v", v)
+			continue
+		}
+		libs = append(libs, v)
+	}
+	return libs, nil
+}
+
+// logManifestLibs logs where each of the extra libraries from the manifest
+// were mounted from.
+func (h *hugbox) logManifestLibs(libs []string) {
+	if h.libraries == nil {
+		return
+	}
+	for _, v := range libs {
+		if fn, ok := h.libraries.Targets[v]; ok {
+			Infof("sandbox: Mounted dlopen()ed library: %v (%v)", v, fn)
+		}
+	}
+}
@@ -28,10 +28,12 @@ import (
 	"runtime"
 	"strconv"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 
 	"cmd/sandboxed-tor-browser/internal/data"
+	"cmd/sandboxed-tor-browser/internal/dynlib"
 	. "cmd/sandboxed-tor-browser/internal/sandbox/process"
 	. "cmd/sandboxed-tor-browser/internal/utils"
 )
@@ -85,16 +87,39 @@ type hugbox struct {
 	stdin     io.Reader
 	stdout    io.Writer
 	stderr    io.Writer
-	seccompFn func(*os.File) error
+	seccompFn func(*os.File) (*ProfileStats, error)
 	pdeathSig syscall.Signal
 
+	// seccompExtraDenied if set, stacks the basic blacklist with these
+	// system calls also denied on top of the seccomp profile, if bubblewrap
+	// supports loading multiple filters.
+	seccompExtraDenied []string
+
+	// allowNoSeccomp if set causes run() to proceed without a seccomp
+	// filter if the kernel does not support seccomp filters.
+	allowNoSeccomp bool
+
+	// allowHostResolvConf if set skips checking that the host's
+	// `resolv.conf` is not bind mounted into a sandbox without network
+	// access.
+	allowHostResolvConf bool
+
 	fakeDbus     bool
 	standardLibs bool
 
+	// dryRun if non-nil causes run() to write the sandbox configuration to
+	// the writer, instead of launching bubblewrap.
+	dryRun io.Writer
+
+	// libraries is the resolved library set, set by appendLibraries(), for
+	// the dry run output.
+	libraries *dynlib.Libraries
+
 	// Internal options, not to be *modified* except via helpers, unless you
 	// know what you are doing.
 	bwrapPath    string
 	bwrapVersion *bwrapVersion
+	bwrapSetuid  bool
 	args         []string
 	fileData     [][]byte
 
@@ -133,6 +158,24 @@ func (h *hugbox) roBind(src, dest string, optional bool) {
 	h.args = append(h.args, "--ro-bind", src, dest)
 }
 
+// isHostPathMounted returns true if the host path fn is bind mounted into the
+// sandbox, either directly or as part of a directory.
+func (h *hugbox) isHostPathMounted(fn string) bool {
+	for i := 0; i+2 < len(h.args); i++ {
+		switch h.args[i] {
+		case "--bind", "--ro-bind":
+		default:
+			continue
+		}
+		src := filepath.Clean(h.args[i+1])
+		i += 2
+		if fn == src || strings.HasPrefix(fn, src+"/") {
+			return true
+		}
+	}
+	return false
+}
+
 func (h *hugbox) file(dest string, data []byte) {
 	h.args = append(h.args, "--file", fmt.Sprintf("%d", 4+len(h.fileData)), dest)
 	h.fileData = append(h.fileData, data)
@@ -152,7 +195,7 @@ func (h *hugbox) setupDbus() {
 }
 
 func (h *hugbox) assetFile(dest, asset string) {
-	b, err := data.Asset(asset)
+	b, err := data.Load(asset)
 	if err != nil {
 		panic(err)
 	}
@@ -229,7 +272,8 @@ func (h *hugbox) shadowDir(dest, src string, exclude []string) {
 }
 
 func (h *hugbox) run() (*Process, error) {
-	// Create the command struct for the sandbox.
+	// Create the command struct for the sandbox.  The host environment is
+	// never passed through, everything is set explicitly via `--setenv`.
 	cmd := &exec.Cmd{
 		Path:   h.bwrapPath,
 		Args:   []string{h.bwrapPath, "--args", "3", h.cmd},
@@ -281,12 +325,20 @@ func (h *hugbox) run() (*Process, error) {
 			"--ro-bind", "/usr/lib", "/usr/lib",
 			"--ro-bind", "/lib", "/lib",
 		}...)
-		if runtime.GOARCH == "amd64" { // 64 bit Linux-ism.
+		switch runtime.GOARCH { // 64 bit Linux-ism.
+		case "amd64":
 			fdArgs = append(fdArgs, "--ro-bind", "/lib64", "/lib64")
 			if FileExists("/usr/lib64") {
 				// openSUSE keeps 64 bit libraries here.
 				fdArgs = append(fdArgs, "--ro-bind", "/usr/lib64", "/usr/lib64")
 			}
+		case "arm64":
+			// Fedora keeps 64 bit libraries here, Debian does not.
+			for _, d := range []string{"/lib64", "/usr/lib64"} {
+				if FileExists(d) {
+					fdArgs = append(fdArgs, "--ro-bind", d, d)
+				}
+			}
 		}
 	}
 	fdArgs = append(fdArgs, h.unshare.toArgs()...) // unshare(2) options.
@@ -323,12 +375,19 @@ func (h *hugbox) run() (*Process, error) {
 	groupBody := fmt.Sprintf("amnesia:x:%d:\n", gid)
 	h.file("/etc/passwd", []byte(passwdBody))
 	h.file("/etc/group", []byte(groupBody))
+	if h.unshare.net {
+		h.sanitizeResolvConf()
+	}
 
-	dieWithParent := h.bwrapVersion.atLeast(0, 1, 8)
-	if dieWithParent {
-		Debugf("sandbox: bubblewrap supports `--die-with-parent`.")
+	if h.bwrapVersion.supports(bwrapDieWithParent) {
 		fdArgs = append(fdArgs, "--die-with-parent")
 	}
+	if h.bwrapVersion.supports(bwrapCapDrop) && !h.bwrapSetuid {
+		// bubblewrap drops all capabilities for non-root users anyway,
+		// but be explicit about it when possible.  The setuid build
+		// restricts the capability options, so leave it be there.
+		fdArgs = append(fdArgs, "--cap-drop", "ALL")
+	}
 
 	if h.fakeDbus {
 		h.setupDbus()
@@ -347,16 +406,31 @@ func (h *hugbox) run() (*Process, error) {
 		fdIdx++
 	}
 
-	// Prep the seccomp pipe if required.
-	var seccompWrFd *os.File
+	// Prep the seccomp pipe if required.  Lack of kernel support is fatal
+	// unless explicitly allowed, while a bad profile always is.
 	if h.seccompFn != nil {
+		if err := seccompFilterSupported(); err != nil {
+			if err != ErrSeccompUnsupported || !h.allowNoSeccomp {
+				return nil, err
+			}
+			Warnf("sandbox: WARNING: %v, running WITHOUT a seccomp filter, as `allowNoSeccomp` is set.", err)
+			h.seccompFn = nil
+		}
+	}
+	seccompFns := h.seccompFilters()
+	seccompFlag := "--seccomp"
+	if len(seccompFns) > 1 {
+		seccompFlag = bwrapAddSeccompFd.flag
+	}
+	var seccompWrFds []*os.File
+	for range seccompFns {
 		r, w, err := os.Pipe()
 		if err != nil {
 			return nil, err
 		}
-		fdArgs = append(fdArgs, "--seccomp", fmt.Sprintf("%d", fdIdx))
+		fdArgs = append(fdArgs, seccompFlag, fmt.Sprintf("%d", fdIdx))
 		cmd.ExtraFiles = append(cmd.ExtraFiles, r)
-		seccompWrFd = w
+		seccompWrFds = append(seccompWrFds, w)
 		fdIdx++
 	}
 
@@ -373,6 +447,11 @@ func (h *hugbox) run() (*Process, error) {
 	// Convert the arg vector to a format fit for bubblewrap, and schedule the
 	// write.
 	fdArgs = append(fdArgs, h.args...) // Finalize args.
+	if h.unshare.net && !h.allowHostResolvConf {
+		if err := checkHostResolvConf(fdArgs); err != nil {
+			return nil, err
+		}
+	}
 	var argsBuf []byte
 	for _, arg := range fdArgs {
 		argsBuf = append(argsBuf, []byte(arg)...)
@@ -383,8 +462,28 @@ func (h *hugbox) run() (*Process, error) {
 
 	Debugf("sandbox: fdArgs: %v", fdArgs)
 
+	if h.dryRun != nil {
+		for _, f := range pendingWriteFds {
+			f.Close()
+		}
+		for _, f := range seccompWrFds {
+			f.Close()
+		}
+		infoRdFd.Close()
+		return nil, h.writeDryRun(cmd.Args, fdArgs)
+	}
+
 	// Fork/exec.
-	cmd.Start()
+	if err := cmd.Start(); err != nil {
+		for _, f := range pendingWriteFds {
+			f.Close()
+		}
+		for _, f := range seccompWrFds {
+			f.Close()
+		}
+		infoRdFd.Close()
+		return nil, err
+	}
 
 	// Do the rest of the setup in a go routine, and monitor completion and
 	// a watchdog timer.
@@ -406,19 +505,24 @@ func (h *hugbox) run() (*Process, error) {
 		}
 
 		// Write the seccomp rules.
-		if h.seccompFn != nil {
-			// This should be the one and only remaining extra file.
-			if len(cmd.ExtraFiles) != 2 {
+		if len(seccompFns) > 0 {
+			// These should be the only remaining extra files, other than
+			// the info fd.
+			if len(cmd.ExtraFiles) != len(seccompFns)+1 {
 				panic("sandbox: unexpected extra files when writing seccomp rules")
-			} else if seccompWrFd == nil {
+			} else if len(seccompWrFds) != len(seccompFns) {
 				panic("sandbox: missing fd when writing seccomp rules")
 			}
-			if err := h.seccompFn(seccompWrFd); err != nil {
-				doneCh <- err
-				return
+			for i, fn := range seccompFns {
+				if stats, err := fn(seccompWrFds[i]); err != nil {
+					doneCh <- err
+					return
+				} else {
+					Infof("sandbox: seccomp: %v", stats)
+				}
+				cmd.ExtraFiles = cmd.ExtraFiles[1:]
 			}
-			cmd.ExtraFiles = cmd.ExtraFiles[1:]
-		} else if seccompWrFd != nil {
+		} else if len(seccompWrFds) > 0 {
 			panic("sandbox: seccomp fd exists when there are no rules to be written")
 		}
 
@@ -458,10 +562,81 @@ timeoutLoop:
 		}
 	}
 
+	// A non-setuid bubblewrap failing to start is almost always due to user
+	// namespaces being unavailable, which the raw error does not make clear.
+	if !h.bwrapSetuid {
+		if reasons := userNamespaceBlockers(); len(reasons) > 0 {
+			err = &UserNamespaceError{Reasons: reasons, Err: err}
+		}
+	}
+
 	process.Kill()
 	return nil, err
 }
 
+func (h *hugbox) writeDryRun(argv, fdArgs []string) error {
+	quote := func(v []string) string {
+		var q []string
+		for _, arg := range v {
+			if arg == "" || strings.ContainsAny(arg, " \t\n\"'\\") {
+				arg = strconv.Quote(arg)
+			}
+			q = append(q, arg)
+		}
+		return strings.Join(q, " ")
+	}
+
+	w := h.dryRun
+	fmt.Fprintf(w, "# bwrap command line:\n%s\n\n", quote(argv))
+
+	// Print each option along with it's arguments on a separate line.
+	fmt.Fprintf(w, "# bwrap arguments (via --args):\n")
+	var opt []string
+	for _, arg := range fdArgs {
+		if strings.HasPrefix(arg, "--") && len(opt) > 0 {
+			fmt.Fprintf(w, "%s\n", quote(opt))
+			opt = nil
+		}
+		opt = append(opt, arg)
+	}
+	if len(opt) > 0 {
+		fmt.Fprintf(w, "%s\n", quote(opt))
+	}
+
+	if h.libraries != nil {
+		fmt.Fprintf(w, "\n# Libraries:\n")
+		for _, lib := range h.libraries.Paths() {
+			fmt.Fprintf(w, "%s -> %s\n", lib, strings.Join(h.libraries.Aliases[lib], ", "))
+		}
+		for _, fn := range h.libraries.Skipped {
+			fmt.Fprintf(w, "# skipped missing binary: %s\n", fn)
+		}
+	}
+
+	fmt.Fprintf(w, "\n# seccomp:\n")
+	seccompFns := h.seccompFilters()
+	if len(seccompFns) == 0 {
+		fmt.Fprintf(w, "disabled\n")
+		return nil
+	}
+
+	// Compile the filters to a temporary file to get the summary.
+	for _, fn := range seccompFns {
+		f, err := ioutil.TempFile("", "seccomp")
+		if err != nil {
+			return err
+		}
+		defer os.Remove(f.Name())
+		stats, err := fn(f)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "%v\n", stats)
+	}
+
+	return nil
+}
+
 type bwrapInfo struct {
 	Pid int `json:"child-pid"`
 }
@@ -506,6 +681,9 @@ func newHugbox() (*hugbox, error) {
 	if h.bwrapPath == "" {
 		return nil, fmt.Errorf("sandbox: unable to find bubblewrap binary")
 	}
+	if fi, err := os.Stat(h.bwrapPath); err == nil {
+		h.bwrapSetuid = fi.Mode()&os.ModeSetuid != 0
+	}
 
 	// Query and cache the bubblewrap version.
 	var err error
@@ -518,18 +696,58 @@ func newHugbox() (*hugbox, error) {
 		// is a really bad idea because I'm a retard, and didn't expect
 		// bubblewrap to be ptrace-able when I contributed support for setting
 		// the hostname.
-		if !h.bwrapVersion.atLeast(0, 1, 3) {
-			return nil, fmt.Errorf("sandbox: bubblewrap appears to be older than 0.1.3, you MUST upgrade.")
+		if !h.bwrapVersion.atLeast(bwrapMinVersion.maj, bwrapMinVersion.min, bwrapMinVersion.pl) {
+			return nil, fmt.Errorf("sandbox: bubblewrap %v is too old, at least %v is required, you MUST upgrade.", h.bwrapVersion, &bwrapMinVersion)
 		}
+		logBwrapFeaturesOnce.Do(func() {
+			for _, f := range h.bwrapVersion.missingFeatures() {
+				Warnf("sandbox: bubblewrap %v does not support `%v` (requires %v), continuing without it.", h.bwrapVersion, f.flag, &f.version)
+			}
+		})
 	}
 
 	return h, nil
 }
 
+// bwrapMinVersion is the oldest bubblewrap release that provides the
+// isolation that the sandbox relies on.
+var bwrapMinVersion = bwrapVersion{0, 1, 3}
+
+// bwrapFeature is an optional bubblewrap command line flag, that is only
+// used if the installed bubblewrap is new enough to support it.
+type bwrapFeature struct {
+	flag    string
+	version bwrapVersion
+}
+
+var (
+	bwrapDieWithParent = bwrapFeature{"--die-with-parent", bwrapVersion{0, 1, 8}}
+	bwrapCapDrop       = bwrapFeature{"--cap-drop", bwrapVersion{0, 2, 0}}
+	bwrapAddSeccompFd  = bwrapFeature{"--add-seccomp-fd", bwrapVersion{0, 5, 0}}
+
+	bwrapFeatures = []bwrapFeature{bwrapDieWithParent, bwrapCapDrop, bwrapAddSeccompFd}
+
+	logBwrapFeaturesOnce sync.Once
+)
+
 type bwrapVersion struct {
 	maj, min, pl int
 }
 
+func (v *bwrapVersion) supports(f bwrapFeature) bool {
+	return v.atLeast(f.version.maj, f.version.min, f.version.pl)
+}
+
+func (v *bwrapVersion) missingFeatures() []bwrapFeature {
+	var missing []bwrapFeature
+	for _, f := range bwrapFeatures {
+		if !v.supports(f) {
+			missing = append(missing, f)
+		}
+	}
+	return missing
+}
+
 func (v *bwrapVersion) atLeast(maj, min, pl int) bool {
 	if v.maj > maj {
 		return true
@@ -563,9 +781,11 @@ func getBwrapVersion(f string) (*bwrapVersion, error) {
 	vStr := strings.TrimPrefix(string(out), "bubblewrap ")
 	vStr = strings.TrimSpace(vStr)
 
-	// Split into major/minor/pl.
+	// Split into major/minor/pl, treating a missing pl as 0.
 	v := strings.Split(vStr, ".")
-	if len(v) < 3 {
+	if len(v) == 2 {
+		v = append(v, "0")
+	} else if len(v) < 3 {
 		return nil, fmt.Errorf("unable to determine bubblewrap version")
 	}
 
@@ -19,69 +19,166 @@
 package process
 
 import (
+	"fmt"
 	"os"
 	"os/exec"
+	"sync"
 	"syscall"
+	"time"
 )
 
+// ExitError is the error returned from Wait when the bwrap instance exits
+// with a non-zero status, or is killed by a signal.
+type ExitError struct {
+	// Code is the exit status, or 128 + the signal number if the instance
+	// was killed by a signal, following the shell convention.
+	Code int
+
+	// Signal is the signal that killed the instance, if any.
+	Signal syscall.Signal
+}
+
+// Error returns the string representation of an ExitError.
+func (e *ExitError) Error() string {
+	if e.Signal != 0 {
+		return fmt.Sprintf("killed by signal: %v", e.Signal)
+	}
+	return fmt.Sprintf("exited with status: %d", e.Code)
+}
+
+// killTimeout is how long Kill waits for the bwrap instance to exit after
+// SIGTERM, before resorting to SIGKILL.
+var killTimeout = 5 * time.Second
+
 // Process is a running bwrap instance.
 type Process struct {
+	sync.Mutex
+
 	init      *os.Process
 	cmd       *exec.Cmd
 	termHooks []func()
+
+	// doneCh is closed once bwrap has exited and been reaped, with the
+	// result in state/err.
+	doneCh chan struct{}
+	state  *os.ProcessState
+	err    error
 }
 
 func (p *Process) onExit() {
-	if p.termHooks != nil {
-		for _, fn := range p.termHooks {
-			fn()
-		}
-		p.termHooks = nil
+	p.Lock()
+	hooks := p.termHooks
+	p.termHooks = nil
+	p.Unlock()
+
+	for _, fn := range hooks {
+		fn()
 	}
 }
 
+// reap waits for bwrap to exit.  This is the only place that bwrap is
+// waited on, so that the exit status is never lost to a concurrent wait.
+func (p *Process) reap() {
+	p.state, p.err = p.cmd.Process.Wait()
+
+	// The init process is gone along with the PID namespace, so make sure
+	// that a subsequent Kill() won't signal a recycled pid.
+	p.Lock()
+	p.init = nil
+	p.Unlock()
+
+	close(p.doneCh)
+}
+
 // AddTermHook adds the hook function fn to be called on process exit.
 func (p *Process) AddTermHook(fn func()) {
+	p.Lock()
+	defer p.Unlock()
 	p.termHooks = append(p.termHooks, fn)
 }
 
-// Kill terminates the bwrap instance and all of it's children.
+// Kill terminates the bwrap instance and all of it's children.  bwrap is
+// started in it's own session, so the entire process group is sent SIGTERM
+// first, and SIGKILL if bwrap is still around after killTimeout.  It is safe
+// to call Kill concurrently with Wait, and on an instance that has already
+// exited.
+//
+// Kill blocks until bwrap has been reaped, which can take up to killTimeout
+// (5 seconds) if anything in the group ignores SIGTERM, so callers on the UI
+// thread should expect a stall.
 func (p *Process) Kill() {
-	if p.init != nil {
-		p.init.Kill()
-		p.init = nil
+	// The process group id can be recycled once bwrap is reaped, so the
+	// group is only ever signaled before then.
+	select {
+	case <-p.doneCh:
+		p.onExit()
+		return
+	default:
 	}
-	if p.cmd != nil {
-		p.cmd.Process.Kill()
-		p.cmd.Process.Wait()
-		p.cmd = nil
+
+	pgid := p.cmd.Process.Pid
+	syscall.Kill(-pgid, syscall.SIGTERM)
+	select {
+	case <-p.doneCh:
+	case <-time.After(killTimeout):
+		p.Lock()
+		init := p.init
+		p.Unlock()
+		if init != nil {
+			init.Kill()
+		}
+		select {
+		case <-p.doneCh:
+		default:
+			syscall.Kill(-pgid, syscall.SIGKILL)
+		}
+		<-p.doneCh
 	}
 	p.onExit()
 }
 
-// Wait waits for the bwrap instance to complete.
+// Wait waits for the bwrap instance to complete.  If the instance exits
+// with a non-zero status or is killed by a signal, an *ExitError is
+// returned.  bwrap propagates the exit status of the sandboxed process, or
+// exits non-zero itself if setting up the sandbox failed.
 func (p *Process) Wait() error {
 	// Can't wait on the init process since it's a grandchild.
-	if p.cmd != nil {
-		p.cmd.Process.Wait()
-		p.cmd = nil
-		p.onExit()
+	<-p.doneCh
+	p.onExit()
+
+	if p.err != nil {
+		return p.err
+	}
+	if ws, ok := p.state.Sys().(syscall.WaitStatus); ok {
+		if ws.Signaled() {
+			return &ExitError{Code: 128 + int(ws.Signal()), Signal: ws.Signal()}
+		} else if ws.ExitStatus() != 0 {
+			return &ExitError{Code: ws.ExitStatus()}
+		}
 	}
 	return nil
 }
 
 // Running returns true if the bwrap instance is running.
 func (p *Process) Running() bool {
-	wpid, err := syscall.Wait4(p.cmd.Process.Pid, nil, syscall.WNOHANG, nil)
-	if err != nil {
+	select {
+	case <-p.doneCh:
 		return false
+	default:
+		return true
 	}
-	return wpid == 0
+}
+
+// Done returns a channel that is closed once the bwrap instance has exited.
+func (p *Process) Done() <-chan struct{} {
+	return p.doneCh
 }
 
 // SetInitPid sets the pid of the bwrap init fork.  This should not be called
 // except from the sandbox creation routine.
 func (p *Process) SetInitPid(pid int) {
+	p.Lock()
+	defer p.Unlock()
 	if p.init != nil {
 		panic("process: SetInitPid called when already set")
 	}
@@ -93,9 +190,12 @@ func (p *Process) SetInitPid(pid int) {
 	p.init = proc
 }
 
-// NewProcess creates a new Process instance from a Cmd.
+// NewProcess creates a new Process instance from a Cmd that has been
+// started.
 func NewProcess(cmd *exec.Cmd) *Process {
 	process := new(Process)
 	process.cmd = cmd
+	process.doneCh = make(chan struct{})
+	go process.reap()
 	return process
 }
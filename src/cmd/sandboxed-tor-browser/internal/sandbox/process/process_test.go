@@ -0,0 +1,137 @@
+// process_test.go - Sandboxed process tests.
+// Copyright (C) 2017  Yawning Angel.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package process
+
+import (
+	"bufio"
+	"errors"
+	"os/exec"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// startGroup starts script under `sh` in it's own session, like bwrap is,
+// and waits for it to write a line to stdout.
+func startGroup(t *testing.T, script string) *Process {
+	cmd := exec.Command("/bin/sh", "-c", script)
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		t.Fatalf("failed to create stdout pipe: %v", err)
+	}
+	if err = cmd.Start(); err != nil {
+		t.Fatalf("failed to start sh: %v", err)
+	}
+	p := NewProcess(cmd)
+	t.Cleanup(func() { syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL) })
+
+	if _, err = bufio.NewReader(stdout).ReadString('\n'); err != nil {
+		t.Fatalf("failed to wait for sh: %v", err)
+	}
+	return p
+}
+
+// waitGroupExited waits for every process in the group to be gone.
+func waitGroupExited(t *testing.T, pgid int) {
+	for deadline := time.Now().Add(5 * time.Second); syscall.Kill(-pgid, 0) != syscall.ESRCH; {
+		if time.Now().After(deadline) {
+			t.Fatalf("process group %v still exists", pgid)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestKill(t *testing.T) {
+	p := startGroup(t, "sleep 60 & echo ready; wait")
+	pgid := p.cmd.Process.Pid
+
+	start := time.Now()
+	p.Kill()
+	if d := time.Since(start); d >= killTimeout {
+		t.Errorf("Kill() took %v, expected SIGTERM to suffice", d)
+	}
+	if p.Running() {
+		t.Errorf("Running() = true after Kill()")
+	}
+	waitGroupExited(t, pgid)
+
+	var exitErr *ExitError
+	if err := p.Wait(); !errors.As(err, &exitErr) || exitErr.Signal != syscall.SIGTERM {
+		t.Errorf("Wait() = %v, expected SIGTERM", err)
+	}
+
+	// Killing an instance that is already gone is harmless.
+	p.Kill()
+}
+
+func TestKillIgnoresSIGTERM(t *testing.T) {
+	oldTimeout := killTimeout
+	defer func() { killTimeout = oldTimeout }()
+	killTimeout = 500 * time.Millisecond
+
+	// Both sh and the backgrounded grandchild ignore SIGTERM.
+	p := startGroup(t, "trap '' TERM; sleep 60 & echo ready; wait")
+	pgid := p.cmd.Process.Pid
+
+	hookCalled := false
+	p.AddTermHook(func() { hookCalled = true })
+
+	start := time.Now()
+	p.Kill()
+	if d := time.Since(start); d < killTimeout {
+		t.Errorf("Kill() took %v, expected it to wait for killTimeout", d)
+	}
+	waitGroupExited(t, pgid)
+	if !hookCalled {
+		t.Errorf("Kill() did not call the termination hooks")
+	}
+
+	var exitErr *ExitError
+	if err := p.Wait(); !errors.As(err, &exitErr) || exitErr.Signal != syscall.SIGKILL || exitErr.Code != 128+int(syscall.SIGKILL) {
+		t.Errorf("Wait() = %v, expected SIGKILL", err)
+	}
+}
+
+func TestKillAfterReaped(t *testing.T) {
+	// sh exits right away, leaving the grandchild behind in the group.
+	p := startGroup(t, "sleep 60 & echo ready")
+	pgid := p.cmd.Process.Pid
+	if err := p.Wait(); err != nil {
+		t.Fatalf("Wait() = %v, expected success", err)
+	}
+
+	// Once bwrap is reaped, the group id is not safe to signal.
+	p.Kill()
+	if err := syscall.Kill(-pgid, 0); err != nil {
+		t.Errorf("Kill() signaled the group after bwrap was reaped: %v", err)
+	}
+}
+
+func TestWaitExitStatus(t *testing.T) {
+	p := startGroup(t, "echo ready; exit 3")
+
+	var exitErr *ExitError
+	if err := p.Wait(); !errors.As(err, &exitErr) || exitErr.Code != 3 || exitErr.Signal != 0 {
+		t.Errorf("Wait() = %v, expected exit status 3", err)
+	}
+	select {
+	case <-p.Done():
+	default:
+		t.Errorf("Done() not closed after Wait()")
+	}
+}
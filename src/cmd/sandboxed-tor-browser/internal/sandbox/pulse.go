@@ -45,8 +45,9 @@ func (h *hugbox) enablePulseAudio() error {
 	if sockPath == "" {
 		hostRuntimeDir := os.Getenv("XDG_RUNTIME_DIR")
 		if hostRuntimeDir == "" {
-			// Should never happen, the app requires/uses XDG_RUNTIME_DIR.
-			return fmt.Errorf("hugbox: BUG: Couldn't determine XDG_RUNTIME_DIR")
+			// The launcher can run without XDG_RUNTIME_DIR, but there is
+			// no way to find the PulseAudio socket.
+			return fmt.Errorf("sandbox: no XDG_RUNTIME_DIR, can't find the PulseAudio socket")
 		}
 		sockPath = filepath.Join(hostRuntimeDir, "pulse", "native")
 	} else if strings.HasPrefix(sockPath, unixPrefix) {
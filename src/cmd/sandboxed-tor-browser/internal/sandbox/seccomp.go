@@ -18,17 +18,77 @@ package sandbox
 
 import (
 	"encoding/binary"
+	"errors"
 	"fmt"
+	"io"
 	"os"
+	"regexp"
 	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
 
 	"github.com/twtiger/gosecco"
+	"github.com/twtiger/gosecco/constants"
 	"github.com/twtiger/gosecco/parser"
+	"github.com/twtiger/gosecco/tree"
 
 	"cmd/sandboxed-tor-browser/internal/data"
+	. "cmd/sandboxed-tor-browser/internal/utils"
 )
 
-func installTorSeccompProfile(fd *os.File, useBridges bool) error {
+// ErrSeccompUnsupported is the error returned when the kernel does not
+// support seccomp filters.
+var ErrSeccompUnsupported = errors.New("sandbox: kernel does not support seccomp filters")
+
+// seccompFilterSupported returns nil if the kernel supports seccomp filters,
+// by attempting to install a NULL filter, which fails with EFAULT if filters
+// are supported, and EINVAL if they are not.
+func seccompFilterSupported() error {
+	const (
+		prSetSeccomp      = 22
+		seccompModeFilter = 2
+	)
+
+	_, _, e := syscall.RawSyscall(syscall.SYS_PRCTL, prSetSeccomp, seccompModeFilter, 0)
+	switch e {
+	case syscall.EFAULT, syscall.EACCES:
+		return nil
+	case syscall.EINVAL:
+		return ErrSeccompUnsupported
+	default:
+		return fmt.Errorf("sandbox: failed to probe for seccomp support: %v", e)
+	}
+}
+
+// ProfileStats is the summary of a compiled seccomp profile.
+type ProfileStats struct {
+	// Sources is the names of the rule sources, including the ones pulled
+	// in via `@include`.
+	Sources []string
+
+	// Rules is the number of system call rules.
+	Rules int
+
+	// Instructions is the size of the compiled filter in bpf instructions.
+	Instructions int
+
+	// Errno is the errno returned by denied system calls, if it is not the
+	// default.
+	Errno string
+}
+
+// String returns the human readable summary of a ProfileStats.
+func (s *ProfileStats) String() string {
+	str := fmt.Sprintf("%d rules from %v, %d bpf instructions", s.Rules, strings.Join(s.Sources, ", "), s.Instructions)
+	if s.Errno != "" {
+		str = str + ", errno " + s.Errno
+	}
+	return str
+}
+
+func installTorSeccompProfile(fd *os.File, useBridges bool) (*ProfileStats, error) {
 	commonAssetFile := "tor-common-" + runtime.GOARCH + ".seccomp"
 
 	assets := []string{commonAssetFile}
@@ -41,16 +101,292 @@ func installTorSeccompProfile(fd *os.File, useBridges bool) error {
 	return installSeccomp(fd, assets)
 }
 
-func installTorBrowserSeccompProfile(fd *os.File) error {
-	assetFile := "torbrowser-" + runtime.GOARCH + ".seccomp"
+// browserRole is the role of a Tor Browser (firefox) sandbox, used to pick
+// the seccomp profile.
+type browserRole string
+
+const (
+	// roleBrowser is the browser itself.
+	roleBrowser browserRole = "browser"
+
+	// roleUpdater is the MAR updater.
+	roleUpdater browserRole = "updater"
+)
+
+// defaultBrowserProfile is the profile used for roles without a profile of
+// their own.
+const defaultBrowserProfile = "torbrowser"
 
-	return installSeccomp(fd, []string{assetFile})
+// browserProfiles is the seccomp profile for each browser role.  A role's
+// profile is used if the asset is embedded, and the default otherwise.
+var browserProfiles = map[browserRole]string{
+	roleBrowser: defaultBrowserProfile,
+	roleUpdater: "torbrowser-updater",
 }
 
-func installSeccomp(fd *os.File, ruleAssets []string) error {
-	defer fd.Close()
+// browserProfileAsset returns the seccomp profile asset for role.
+func browserProfileAsset(role browserRole) string {
+	if name, ok := browserProfiles[role]; ok {
+		asset := name + "-" + runtime.GOARCH + ".seccomp"
+		if _, err := loadSeccompAsset(asset); err == nil {
+			return asset
+		}
+		Debugf("sandbox: No '%v' seccomp profile, using '%v'.", name, defaultBrowserProfile)
+	}
+	return defaultBrowserProfile + "-" + runtime.GOARCH + ".seccomp"
+}
+
+func installTorBrowserSeccompProfile(fd *os.File, role browserRole) (*ProfileStats, error) {
+	return installSeccomp(fd, []string{browserProfileAsset(role)})
+}
+
+// SeccompProfiles is the list of seccomp profile names that can be passed to
+// ExportProfileBPF.
+var SeccompProfiles = []string{"torbrowser", "torbrowser-updater", "tor", "tor-obfs4", "blacklist"}
+
+// ExportProfileBPF compiles the named seccomp profile exactly as is done when
+// launching a sandbox, and writes the raw BPF program to w, for auditing
+// with external tools (eg: `seccomp-tools disasm`).
+func ExportProfileBPF(name string, w io.Writer) error {
+	var fn func(*os.File) (*ProfileStats, error)
+	switch name {
+	case "torbrowser":
+		fn = func(fd *os.File) (*ProfileStats, error) { return installTorBrowserSeccompProfile(fd, roleBrowser) }
+	case "torbrowser-updater":
+		fn = func(fd *os.File) (*ProfileStats, error) { return installTorBrowserSeccompProfile(fd, roleUpdater) }
+	case "tor":
+		fn = func(fd *os.File) (*ProfileStats, error) { return installTorSeccompProfile(fd, false) }
+	case "tor-obfs4":
+		fn = func(fd *os.File) (*ProfileStats, error) { return installTorSeccompProfile(fd, true) }
+	case "blacklist":
+		fn = installBasicBlacklist
+	default:
+		return fmt.Errorf("sandbox: unknown seccomp profile: '%v' (valid: %v)", name, strings.Join(SeccompProfiles, ", "))
+	}
+
+	// The install routines write to (and close) a fd, like they would for
+	// bubblewrap, so give them a pipe.  The write end is closed regardless
+	// of how the install routine fails, so that the copy always sees EOF.
+	r, wrFd, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
 
-	settings := gosecco.SeccompSettings{
+	errCh := make(chan error, 1)
+	go func() {
+		defer wrFd.Close()
+		_, err := fn(wrFd)
+		errCh <- err
+	}()
+	if _, err = io.Copy(w, r); err != nil {
+		// Unblock the install routine if it is still writing.
+		r.Close()
+	}
+	if fnErr := <-errCh; fnErr != nil {
+		return fnErr
+	}
+	return err
+}
+
+var seccompRuleRE = regexp.MustCompile(`^[[:space:]]*([[:word:]]+)[[:space:]]*(\[[^\]]*\])?[[:space:]]*:(.*)$`)
+
+// CrossCheckProfile returns the sorted names of the system calls that the
+// whitelist profile permits (even conditionally), but that the blacklist
+// profile unconditionally denies.  A non-empty result means that the
+// whitelist has been misedited to open a hole that the basic blacklist
+// exists to close.  Includes are not expanded.
+func CrossCheckProfile(whitelist, blacklist []byte) []string {
+	// permitted returns true if a whitelist rule allows the system call
+	// for at least some arguments.
+	permitted := func(action, expr string) bool {
+		if action != "" && !strings.Contains(action, "+allow") {
+			return false
+		}
+		expr = strings.TrimSpace(expr)
+		return expr != "0" && !strings.HasPrefix(expr, "return")
+	}
+
+	denied := make(map[string]bool)
+	for _, l := range strings.Split(string(blacklist), "\n") {
+		if m := seccompRuleRE.FindStringSubmatch(l); m != nil && strings.TrimSpace(m[3]) == "1" {
+			denied[m[1]] = true
+		}
+	}
+
+	var holes []string
+	for _, l := range strings.Split(string(whitelist), "\n") {
+		m := seccompRuleRE.FindStringSubmatch(l)
+		if m == nil || !denied[m[1]] || !permitted(m[2], m[3]) {
+			continue
+		}
+		holes = append(holes, m[1])
+		delete(denied, m[1]) // Only report each system call once.
+	}
+	sort.Strings(holes)
+	return holes
+}
+
+// crossCheckExceptions are the system calls that the shipped whitelists
+// permit on purpose, even though the basic blacklist denies them to the
+// helper processes.
+var crossCheckExceptions = map[string]bool{
+	"name_to_handle_at": true,
+	"unshare":           true,
+}
+
+// crossCheckWhitelists cross checks each of the shipped whitelist profiles
+// against the basic blacklist, and returns an error listing any system calls
+// that are permitted unexpectedly.
+func crossCheckWhitelists() error {
+	blacklist, err := loadSeccompAsset("blacklist-" + runtime.GOARCH + ".seccomp")
+	if err != nil {
+		return err
+	}
+	assets := []string{}
+	for _, prefix := range []string{"tor-common-", "tor-", "tor-obfs4-"} {
+		assets = append(assets, prefix+runtime.GOARCH+".seccomp")
+	}
+	seen := make(map[string]bool)
+	for _, role := range []browserRole{roleBrowser, roleUpdater} {
+		if asset := browserProfileAsset(role); !seen[asset] {
+			assets = append(assets, asset)
+			seen[asset] = true
+		}
+	}
+	for _, asset := range assets {
+		b, err := loadSeccompAsset(asset)
+		if err != nil {
+			return err
+		}
+		whitelist, err := expandSeccompIncludes(asset, string(b), nil, make(map[string]bool))
+		if err != nil {
+			return err
+		}
+		var holes []string
+		for _, name := range CrossCheckProfile([]byte(whitelist), blacklist) {
+			if !crossCheckExceptions[name] {
+				holes = append(holes, name)
+			}
+		}
+		if len(holes) > 0 {
+			return fmt.Errorf("'%v' permits blacklisted system calls: %v", asset, strings.Join(holes, ", "))
+		}
+	}
+	return nil
+}
+
+func installBasicBlacklist(fd *os.File) (*ProfileStats, error) {
+	return installCombinedFilter(fd, nil)
+}
+
+// installCombinedFilter installs the basic blacklist, with the system calls
+// in extraDenied denied in addition to the ones that the blacklist denies.
+//
+// The extra denials are unconditional, and take precedence over the base
+// blacklist (replacing any conditional rule for the same system call), so
+// the resulting filter is always at least as strict as the basic blacklist.
+// Unknown system call names are treated as an error rather than ignored, so
+// that a typo can't silently weaken the filter.
+func installCombinedFilter(fd *os.File, extraDenied []string) (*ProfileStats, error) {
+	asset := "blacklist-" + runtime.GOARCH + ".seccomp"
+	if len(extraDenied) == 0 {
+		return installSeccompSources(fd, []string{asset}, nil, blacklistSettings)
+	}
+
+	denied := make(map[string]bool)
+	for _, name := range extraDenied {
+		if _, ok := constants.GetSyscall(name); !ok {
+			fd.Close()
+			return nil, fmt.Errorf("sandbox: unknown system call to deny: '%v'", name)
+		}
+		denied[name] = true
+	}
+
+	// gosecco rejects multiple differing rules for the same system call, so
+	// strip the base rules that are superseded by an extra denial.
+	base, err := data.Load(asset)
+	if err != nil {
+		fd.Close()
+		return nil, err
+	}
+	var baseRules []string
+	for _, l := range strings.Split(string(base), "\n") {
+		if i := strings.Index(l, ":"); i > 0 && denied[strings.TrimSpace(l[:i])] {
+			continue
+		}
+		baseRules = append(baseRules, l)
+	}
+
+	var rules []string
+	for name := range denied {
+		rules = append(rules, name+": 1")
+	}
+	sort.Strings(rules)
+	sources := []parser.Source{
+		&parser.StringSource{
+			Name:    asset,
+			Content: strings.Join(baseRules, "\n"),
+		},
+		&parser.StringSource{
+			Name:    "extra-denied",
+			Content: strings.Join(rules, "\n") + "\n",
+		},
+	}
+
+	return installSeccompSources(fd, nil, sources, blacklistSettings)
+}
+
+var (
+	// torExtraDenied are the system calls denied on top of the profile for
+	// tor and the pluggable transports, that neither ever has a use for.
+	torExtraDenied = []string{"chroot", "personality"}
+
+	// updaterExtraDenied are the system calls denied on top of the profile
+	// for the updater, which has no business touching the network.
+	updaterExtraDenied = []string{"socket", "connect"}
+)
+
+// unstackableDenied returns every system call that the extra filters deny,
+// which is what goes unenforced if bubblewrap can not stack them.
+func unstackableDenied() []string {
+	var denied []string
+	seen := make(map[string]bool)
+	for _, l := range [][]string{torExtraDenied, updaterExtraDenied} {
+		for _, name := range l {
+			if !seen[name] {
+				seen[name] = true
+				denied = append(denied, name)
+			}
+		}
+	}
+	sort.Strings(denied)
+	return denied
+}
+
+// seccompFilters returns the routines that install the seccomp filters for
+// the hugbox, in the order that they are to be loaded.  The extra denials
+// are a separate filter stacked on top of the profile, as the kernel runs
+// every filter and the most restrictive action wins.  This requires a
+// bubblewrap that can load multiple filters, and is skipped otherwise.
+func (h *hugbox) seccompFilters() []func(*os.File) (*ProfileStats, error) {
+	if h.seccompFn == nil {
+		return nil
+	}
+	fns := []func(*os.File) (*ProfileStats, error){h.seccompFn}
+	if len(h.seccompExtraDenied) == 0 {
+		return fns
+	}
+	if h.bwrapVersion == nil || !h.bwrapVersion.supports(bwrapAddSeccompFd) {
+		Warnf("sandbox: bubblewrap %v can not stack seccomp filters (requires %v), not denying: %v", h.bwrapVersion, &bwrapAddSeccompFd.version, strings.Join(h.seccompExtraDenied, ", "))
+		return fns
+	}
+	extraDenied := h.seccompExtraDenied
+	return append(fns, func(fd *os.File) (*ProfileStats, error) { return installCombinedFilter(fd, extraDenied) })
+}
+
+var (
+	whitelistSettings = gosecco.SeccompSettings{
 		DefaultPositiveAction: "allow",
 		DefaultNegativeAction: "ENOSYS",
 		DefaultPolicyAction:   "ENOSYS",
@@ -58,16 +394,162 @@ func installSeccomp(fd *os.File, ruleAssets []string) error {
 		ActionOnAuditFailure:  "kill",
 	}
 
-	if len(ruleAssets) == 0 {
-		return fmt.Errorf("installSeccomp() called with no rules")
+	blacklistSettings = gosecco.SeccompSettings{
+		DefaultPositiveAction: "ENOSYS",
+		DefaultNegativeAction: "allow",
+		DefaultPolicyAction:   "allow",
+		ActionOnX32:           "kill",
+		ActionOnAuditFailure:  "kill",
+	}
+)
+
+// errnoDirective is the policy directive that sets the errno returned by
+// denied system calls, overriding the default (ENOSYS).  eg: `!errno=EPERM`.
+// Individual rules can use `syscall[+EPERM]: expr`, or `expr; return EPERM`.
+const errnoDirective = "!errno="
+
+var seccompReturnRE = regexp.MustCompile(`(;?[[:space:]]*return[[:space:]]+)([[:word:]]+)[[:space:]]*$`)
+
+// preprocessSeccompSource applies the extensions to the gosecco syntax to
+// the source, and returns the errno set via errnoDirective if any.
+func preprocessSeccompSource(source *parser.StringSource) (string, error) {
+	var errno string
+	lines := strings.Split(source.Content, "\n")
+	for i, l := range lines {
+		trimmed := strings.TrimSpace(l)
+		if strings.HasPrefix(trimmed, errnoDirective) {
+			v := strings.TrimSpace(strings.TrimPrefix(trimmed, errnoDirective))
+			if _, err := errnoValue(v); err != nil {
+				return "", fmt.Errorf("%v:%d: %v", source.Name, i+1, err)
+			} else if errno != "" && errno != v {
+				return "", fmt.Errorf("%v:%d: conflicting %v directive: %v (was %v)", source.Name, i+1, errnoDirective, v, errno)
+			}
+			errno = v
+			lines[i] = "" // gosecco doesn't know about directives.
+			continue
+		}
+
+		// gosecco only accepts numeric values for `return`, so translate
+		// errno names.  A bare `return` without an expression also crashes
+		// the compiler, so turn it into an unconditional match with the
+		// errno as the rule's action.
+		if m := seccompReturnRE.FindStringSubmatchIndex(l); m != nil && !strings.HasPrefix(trimmed, "#") {
+			v, err := errnoValue(l[m[4]:m[5]])
+			if err != nil {
+				return "", fmt.Errorf("%v:%d: %v", source.Name, i+1, err)
+			}
+			if strings.Contains(l[m[2]:m[3]], ";") {
+				lines[i] = l[:m[4]] + strconv.Itoa(int(v))
+			} else {
+				head := strings.TrimSuffix(strings.TrimSpace(l[:m[2]]), ":")
+				if strings.ContainsAny(head, "[]:") {
+					return "", fmt.Errorf("%v:%d: bare `return` with a rule action", source.Name, i+1)
+				}
+				lines[i] = fmt.Sprintf("%s[+%d]: 1", head, v)
+			}
+		}
+	}
+	source.Content = strings.Join(lines, "\n")
+	return errno, nil
+}
+
+// includeDirective is the policy directive that pulls in the rules and
+// constants from another seccomp asset, as if they were part of the policy.
+// eg: `@include pulseaudio-amd64.seccomp`.  Each asset is included at most
+// once across all of a filter's sources, so that fragments shared by several
+// policies do not result in duplicate definitions.
+const includeDirective = "@include"
+
+// loadSeccompAsset loads the named seccomp rule asset.
+var loadSeccompAsset = data.Load
+
+func expandSeccompIncludes(name, content string, stack []string, included map[string]bool) (string, error) {
+	for _, v := range stack {
+		if v == name {
+			return "", fmt.Errorf("seccomp include cycle: %v -> %v", strings.Join(stack, " -> "), name)
+		}
+	}
+	stack = append(stack, name)
+	included[name] = true
+
+	lines := strings.Split(content, "\n")
+	for i, l := range lines {
+		sp := strings.Fields(l)
+		if len(sp) == 0 || sp[0] != includeDirective {
+			continue
+		}
+		if len(sp) != 2 {
+			return "", fmt.Errorf("%v:%d: malformed %v directive", name, i+1, includeDirective)
+		}
+
+		incName := sp[1]
+		if included[incName] {
+			// Already included, check for cycles, but don't duplicate.
+			if _, err := expandSeccompIncludes(incName, "", stack, make(map[string]bool)); err != nil {
+				return "", err
+			}
+			lines[i] = ""
+			continue
+		}
+		b, err := loadSeccompAsset(incName)
+		if err != nil {
+			return "", fmt.Errorf("%v:%d: failed to include '%v': %v", name, i+1, incName, err)
+		}
+		if lines[i], err = expandSeccompIncludes(incName, string(b), stack, included); err != nil {
+			return "", err
+		}
+	}
+	return strings.Join(lines, "\n"), nil
+}
+
+// errnoValue returns the numeric value of an errno name (eg: `EPERM`) or
+// number.
+func errnoValue(s string) (uint32, error) {
+	if v, err := strconv.ParseUint(s, 0, 16); err == nil {
+		return uint32(v), nil
+	}
+	if v, ok := constants.GetError(s); ok {
+		return v, nil
+	}
+	return 0, fmt.Errorf("invalid errno: '%v'", s)
+}
+
+// settingsWithErrno returns a copy of settings with the default actions
+// that deny with an errno replaced by errno.
+func settingsWithErrno(settings gosecco.SeccompSettings, errno string) gosecco.SeccompSettings {
+	isErrno := func(action string) bool {
+		_, err := errnoValue(action)
+		return err == nil
+	}
+	if isErrno(settings.DefaultPositiveAction) {
+		settings.DefaultPositiveAction = errno
+	}
+	if isErrno(settings.DefaultNegativeAction) {
+		settings.DefaultNegativeAction = errno
+	}
+	if isErrno(settings.DefaultPolicyAction) {
+		settings.DefaultPolicyAction = errno
+	}
+	return settings
+}
+
+func installSeccomp(fd *os.File, ruleAssets []string) (*ProfileStats, error) {
+	return installSeccompSources(fd, ruleAssets, nil, whitelistSettings)
+}
+
+func installSeccompSources(fd *os.File, ruleAssets []string, extraSources []parser.Source, settings gosecco.SeccompSettings) (*ProfileStats, error) {
+	defer fd.Close()
+
+	if len(ruleAssets) == 0 && len(extraSources) == 0 {
+		return nil, fmt.Errorf("installSeccomp() called with no rules")
 	}
 
 	// Combine the rules into a single source.
 	var sources []parser.Source
 	for _, asset := range ruleAssets {
-		rules, err := data.Asset(asset)
+		rules, err := loadSeccompAsset(asset)
 		if err != nil {
-			return err
+			return nil, err
 		}
 		source := &parser.StringSource{
 			Name:    asset,
@@ -75,23 +557,73 @@ func installSeccomp(fd *os.File, ruleAssets []string) error {
 		}
 		sources = append(sources, source)
 	}
+	sources = append(sources, extraSources...)
+
+	// Apply the extensions to the gosecco syntax.
+	errno := ""
+	included := make(map[string]bool)
+	for _, source := range sources {
+		ss, ok := source.(*parser.StringSource)
+		if !ok {
+			continue
+		}
+		if included[ss.Name] {
+			ss.Content = "" // Already pulled in by another source.
+			continue
+		}
+		content, err := expandSeccompIncludes(ss.Name, ss.Content, nil, included)
+		if err != nil {
+			return nil, err
+		}
+		ss.Content = content
+		sErrno, err := preprocessSeccompSource(ss)
+		if err != nil {
+			return nil, err
+		}
+		if sErrno == "" {
+			continue
+		} else if errno != "" && errno != sErrno {
+			return nil, fmt.Errorf("%v: conflicting %v directive: %v (was %v)", ss.Name, errnoDirective, sErrno, errno)
+		}
+		errno = sErrno
+	}
+	if errno != "" {
+		settings = settingsWithErrno(settings, errno)
+	}
 
 	// Compile the combined source into bpf bytecode.
 	combined := parser.CombineSources(sources...)
 	bpf, err := gosecco.PrepareSource(combined, settings)
 	if err != nil {
-		return err
+		return nil, err
+	}
+
+	stats := &ProfileStats{
+		Instructions: len(bpf),
+		Errno:        errno,
+	}
+	for name := range included {
+		stats.Sources = append(stats.Sources, name)
+	}
+	sort.Strings(stats.Sources)
+	if raw, err := parser.Parse(combined); err == nil {
+		for _, v := range raw.RuleOrMacros {
+			switch v.(type) {
+			case tree.Rule, *tree.Rule:
+				stats.Rules++
+			}
+		}
 	}
 
 	// Install the bpf bytecode.
 	if size, limit := len(bpf), 0xffff; size > limit {
-		return fmt.Errorf("filter program too big: %d bpf instructions (limit = %d)", size, limit)
+		return nil, fmt.Errorf("filter program too big: %d bpf instructions (limit = %d)", size, limit)
 	}
 	for _, rule := range bpf {
 		if err := binary.Write(fd, binary.LittleEndian, rule); err != nil {
-			return err
+			return nil, err
 		}
 	}
 
-	return nil
+	return stats, nil
 }
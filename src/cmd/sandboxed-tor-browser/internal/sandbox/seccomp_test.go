@@ -0,0 +1,416 @@
+// seccomp_test.go - Sandbox seccomp rule tests.
+// Copyright (C) 2016  Yawning Angel.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package sandbox
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"cmd/sandboxed-tor-browser/internal/data"
+	"github.com/twtiger/gosecco/constants"
+)
+
+// sizeofSockFilter is the size of a `struct sock_filter` instruction.
+const sizeofSockFilter = 8
+
+func TestExportProfileBPF(t *testing.T) {
+	for _, name := range SeccompProfiles {
+		var buf bytes.Buffer
+		if err := ExportProfileBPF(name, &buf); err != nil {
+			t.Errorf("ExportProfileBPF(%v) = %v", name, err)
+			continue
+		}
+		if buf.Len() == 0 || buf.Len()%sizeofSockFilter != 0 {
+			t.Errorf("ExportProfileBPF(%v): invalid program length: %v", name, buf.Len())
+		}
+	}
+
+	if err := ExportProfileBPF("bogus", &bytes.Buffer{}); err == nil {
+		t.Errorf("ExportProfileBPF(bogus) succeeded")
+	}
+}
+
+type failingWriter struct{}
+
+func (w *failingWriter) Write(p []byte) (int, error) {
+	return 0, errors.New("write failed")
+}
+
+func TestExportProfileBPFWriteFailure(t *testing.T) {
+	doneCh := make(chan error, 1)
+	go func() {
+		doneCh <- ExportProfileBPF("torbrowser", &failingWriter{})
+	}()
+
+	select {
+	case err := <-doneCh:
+		if err == nil {
+			t.Fatalf("ExportProfileBPF() succeeded with a failing writer")
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatalf("ExportProfileBPF() deadlocked with a failing writer")
+	}
+}
+
+// bpfJeqK is the opcode for `BPF_JMP | BPF_JEQ | BPF_K`, which is what the
+// compiled filters use to match the system call number.
+const bpfJeqK = 0x15
+
+// compileBPF compiles a seccomp filter with fn, and returns the raw BPF
+// program.
+func compileBPF(t *testing.T, fn func(*os.File) (*ProfileStats, error)) []byte {
+	f, err := ioutil.TempFile("", "seccomp_test")
+	if err != nil {
+		t.Fatalf("failed to create temporary file: %v", err)
+	}
+	defer os.Remove(f.Name())
+	if _, err = fn(f); err != nil {
+		t.Fatalf("failed to compile filter: %v", err)
+	}
+	b, err := ioutil.ReadFile(f.Name())
+	if err != nil {
+		t.Fatalf("failed to read back filter: %v", err)
+	}
+	if len(b) == 0 || len(b)%sizeofSockFilter != 0 {
+		t.Fatalf("invalid program length: %v", len(b))
+	}
+	return b
+}
+
+// compileFilter compiles a seccomp filter with fn, and returns the system
+// call numbers that the program compares against.
+func compileFilter(t *testing.T, fn func(*os.File) (*ProfileStats, error)) map[uint32]bool {
+	return jeqConstants(compileBPF(t, fn))
+}
+
+// jeqConstants returns the constants that a raw BPF program compares
+// against.
+func jeqConstants(b []byte) map[uint32]bool {
+	ks := make(map[uint32]bool)
+	for i := 0; i+sizeofSockFilter <= len(b); i += sizeofSockFilter {
+		if binary.LittleEndian.Uint16(b[i:]) == bpfJeqK {
+			ks[binary.LittleEndian.Uint32(b[i+4:])] = true
+		}
+	}
+	return ks
+}
+
+func TestBlacklistSocketRule(t *testing.T) {
+	var buf bytes.Buffer
+	if err := ExportProfileBPF("blacklist", &buf); err != nil {
+		t.Fatalf("ExportProfileBPF(blacklist) = %v", err)
+	}
+	ks := jeqConstants(buf.Bytes())
+
+	nr, _ := constants.GetSyscall("socket")
+	if !ks[nr] {
+		t.Fatalf("exported blacklist has no socket rule")
+	}
+	for _, family := range []string{"AF_UNIX", "AF_INET", "AF_INET6", "AF_NETLINK"} {
+		v, ok := constants.GetConstant(family)
+		if !ok {
+			t.Fatalf("unknown constant: %v", family)
+		}
+		if !ks[v] {
+			t.Errorf("exported blacklist socket rule does not check for %v", family)
+		}
+	}
+	for _, family := range []string{"AF_PACKET", "AF_BLUETOOTH"} {
+		if _, ok := constants.GetConstant(family); !ok {
+			t.Errorf("constant table is missing %v", family)
+		}
+	}
+}
+
+func TestInstallCombinedFilter(t *testing.T) {
+	// The system calls that the basic blacklist has rules for.
+	asset := "blacklist-" + runtime.GOARCH + ".seccomp"
+	b, err := data.Load(asset)
+	if err != nil {
+		t.Fatalf("failed to load '%v': %v", asset, err)
+	}
+	base := make(map[uint32]string)
+	for _, l := range strings.Split(string(b), "\n") {
+		if i := strings.Index(l, ":"); i > 0 && !strings.HasPrefix(l, "#") {
+			name := strings.TrimSpace(l[:i])
+			if nr, ok := constants.GetSyscall(name); ok {
+				base[nr] = name
+			}
+		}
+	}
+	if len(base) == 0 {
+		t.Fatalf("no rules found in '%v'", asset)
+	}
+
+	for _, extraDenied := range [][]string{torExtraDenied, updaterExtraDenied} {
+		combined := compileFilter(t, func(fd *os.File) (*ProfileStats, error) { return installCombinedFilter(fd, extraDenied) })
+		for _, name := range extraDenied {
+			nr, ok := constants.GetSyscall(name)
+			if !ok {
+				t.Fatalf("unknown system call: %v", name)
+			}
+			if !combined[nr] {
+				t.Errorf("combined filter does not deny '%v'", name)
+			}
+		}
+
+		// Everything the basic blacklist covers must still be covered.
+		for nr, name := range base {
+			if !combined[nr] {
+				t.Errorf("combined filter (%v) lost '%v' from the basic blacklist", extraDenied, name)
+			}
+		}
+	}
+
+	f, err := ioutil.TempFile("", "seccomp_test")
+	if err != nil {
+		t.Fatalf("failed to create temporary file: %v", err)
+	}
+	defer os.Remove(f.Name())
+	if _, err = installCombinedFilter(f, []string{"not_a_syscall"}); err == nil {
+		t.Errorf("installCombinedFilter() accepted an unknown system call")
+	}
+}
+
+func TestSeccompFilters(t *testing.T) {
+	h := &hugbox{
+		seccompFn:          installBasicBlacklist,
+		seccompExtraDenied: torExtraDenied,
+	}
+	for _, v := range []struct {
+		version  *bwrapVersion
+		expected int
+	}{
+		{nil, 1},
+		{&bwrapVersion{0, 2, 0}, 1},
+		{&bwrapVersion{0, 5, 0}, 2},
+		{&bwrapVersion{0, 8, 0}, 2},
+	} {
+		h.bwrapVersion = v.version
+		if n := len(h.seccompFilters()); n != v.expected {
+			t.Errorf("bubblewrap %v: %v filters, expected %v", v.version, n, v.expected)
+		}
+	}
+
+	h.seccompFn = nil
+	if fns := h.seccompFilters(); fns != nil {
+		t.Errorf("seccompFilters() returned filters without a profile")
+	}
+}
+
+func TestUnstackableDenied(t *testing.T) {
+	expected := []string{"chroot", "connect", "personality", "socket"}
+	if denied := unstackableDenied(); !reflect.DeepEqual(denied, expected) {
+		t.Errorf("unstackableDenied() = %v, expected %v", denied, expected)
+	}
+}
+
+// mockSeccompAssets makes the seccomp rule assets in assets available, in
+// addition to the embedded ones, for the duration of the test.
+func mockSeccompAssets(t *testing.T, assets map[string]string) {
+	oldLoad := loadSeccompAsset
+	t.Cleanup(func() { loadSeccompAsset = oldLoad })
+	loadSeccompAsset = func(name string) ([]byte, error) {
+		if s, ok := assets[name]; ok {
+			return []byte(s), nil
+		}
+		return oldLoad(name)
+	}
+}
+
+func TestSeccompIncludes(t *testing.T) {
+	mockSeccompAssets(t, map[string]string{
+		"flat.seccomp":         "TEST_FUTEX_WAIT=0\nTEST_FUTEX_WAKE=1\nfutex: arg1 == TEST_FUTEX_WAIT || arg1 == TEST_FUTEX_WAKE\nread: 1\n",
+		"futex-consts.seccomp": "TEST_FUTEX_WAIT=0\nTEST_FUTEX_WAKE=1\n",
+		"parent.seccomp":       "@include futex-consts.seccomp\nfutex: arg1 == TEST_FUTEX_WAIT || arg1 == TEST_FUTEX_WAKE\nread: 1\n",
+		"sibling.seccomp":      "@include futex-consts.seccomp\nwrite: 1\n",
+		"nested.seccomp":       "@include parent.seccomp\n",
+		"cycle-a.seccomp":      "@include cycle-b.seccomp\nread: 1\n",
+		"cycle-b.seccomp":      "@include cycle-a.seccomp\nwrite: 1\n",
+		"missing.seccomp":      "@include nonexistent.seccomp\nread: 1\n",
+		"malformed.seccomp":    "@include\nread: 1\n",
+		"orphan.seccomp":       "futex: arg1 == TEST_FUTEX_WAIT\n",
+	})
+	compile := func(assets ...string) func(*os.File) (*ProfileStats, error) {
+		return func(fd *os.File) (*ProfileStats, error) { return installSeccomp(fd, assets) }
+	}
+
+	// The fragment's constants are usable by the parent, and the result is
+	// identical to the flat policy.
+	flat := compileBPF(t, compile("flat.seccomp"))
+	for _, name := range []string{"parent.seccomp", "nested.seccomp"} {
+		if b := compileBPF(t, compile(name)); !bytes.Equal(b, flat) {
+			t.Errorf("%v: compiled filter differs from the flat policy", name)
+		}
+	}
+
+	// A fragment pulled in by more than one source is only included once.
+	var stats *ProfileStats
+	compileBPF(t, func(fd *os.File) (*ProfileStats, error) {
+		var err error
+		stats, err = installSeccomp(fd, []string{"parent.seccomp", "sibling.seccomp"})
+		return stats, err
+	})
+	if expected := []string{"futex-consts.seccomp", "parent.seccomp", "sibling.seccomp"}; !reflect.DeepEqual(stats.Sources, expected) {
+		t.Errorf("Sources = %v, expected %v", stats.Sources, expected)
+	}
+
+	for _, name := range []string{"cycle-a.seccomp", "missing.seccomp", "malformed.seccomp", "orphan.seccomp"} {
+		f, err := ioutil.TempFile("", "seccomp_test")
+		if err != nil {
+			t.Fatalf("failed to create temporary file: %v", err)
+		}
+		defer os.Remove(f.Name())
+		if _, err = installSeccomp(f, []string{name}); err == nil {
+			t.Errorf("%v: installSeccomp() succeeded", name)
+		}
+	}
+}
+
+func TestCrossCheckProfile(t *testing.T) {
+	blacklist := []byte("# Comment.\nptrace: 1\nmount: 1\nunshare: 1\nsocket: arg0 == AF_PACKET\n")
+	for _, v := range []struct {
+		name      string
+		whitelist string
+		expected  []string
+	}{
+		{"clean", "read: 1\nwrite: 1\n", nil},
+		{"unconditional", "read: 1\nptrace: 1\nmount: 1\n", []string{"mount", "ptrace"}},
+		{"conditional", "unshare: arg0 == CLONE_NEWUSER\n", []string{"unshare"}},
+		{"allow action", "mount[+allow]: 1\n", []string{"mount"}},
+		{"denied", "ptrace: 0\nmount[+trap]: 1\nunshare: return EPERM\n", nil},
+		{"conditionally blacklisted", "socket: 1\n", nil},
+		{"reported once", "ptrace: arg0 == 0\nptrace: arg0 == 1\n", []string{"ptrace"}},
+	} {
+		if holes := CrossCheckProfile([]byte(v.whitelist), blacklist); !reflect.DeepEqual(holes, v.expected) {
+			t.Errorf("%v: CrossCheckProfile() = %v, expected %v", v.name, holes, v.expected)
+		}
+	}
+}
+
+func TestCrossCheckWhitelists(t *testing.T) {
+	blacklist, err := data.Load("blacklist-" + runtime.GOARCH + ".seccomp")
+	if err != nil {
+		t.Skipf("no blacklist for %v: %v", runtime.GOARCH, err)
+	}
+
+	// Each shipped whitelist only permits the deliberate exceptions, and
+	// every exception is still needed by at least one of them.
+	used := make(map[string]bool)
+	for _, name := range SeccompProfiles {
+		if name == "blacklist" {
+			continue
+		}
+		asset := name + "-" + runtime.GOARCH + ".seccomp"
+		b, err := data.Load(asset)
+		if err != nil {
+			continue // Not every profile is shipped for every architecture.
+		}
+		whitelist, err := expandSeccompIncludes(asset, string(b), nil, make(map[string]bool))
+		if err != nil {
+			t.Fatalf("%v: expandSeccompIncludes() = %v", asset, err)
+		}
+		for _, holeName := range CrossCheckProfile([]byte(whitelist), blacklist) {
+			if !crossCheckExceptions[holeName] {
+				t.Errorf("%v: permits blacklisted system call %v", asset, holeName)
+			}
+			used[holeName] = true
+		}
+	}
+	for name := range crossCheckExceptions {
+		if !used[name] {
+			t.Errorf("crossCheckExceptions: %v is not permitted by any profile", name)
+		}
+	}
+	if err := crossCheckWhitelists(); err != nil {
+		t.Errorf("crossCheckWhitelists() = %v", err)
+	}
+
+	// A misedited profile is caught.
+	asset := browserProfileAsset(roleBrowser)
+	b, err := data.Load(asset)
+	if err != nil {
+		t.Fatalf("failed to load '%v': %v", asset, err)
+	}
+	mockSeccompAssets(t, map[string]string{asset: string(b) + "ptrace: 1\n"})
+	if err := crossCheckWhitelists(); err == nil || !strings.Contains(err.Error(), "ptrace") {
+		t.Errorf("crossCheckWhitelists() misedited = %v, expected ptrace to be reported", err)
+	}
+}
+
+func TestBrowserProfileAsset(t *testing.T) {
+	browserAsset := "torbrowser-" + runtime.GOARCH + ".seccomp"
+	updaterAsset := "torbrowser-updater-" + runtime.GOARCH + ".seccomp"
+	if _, err := data.Load(updaterAsset); err == nil {
+		t.Skipf("'%v' is embedded", updaterAsset)
+	}
+
+	// Roles without an embedded profile fall back to the browser's.
+	for _, v := range []struct {
+		role     browserRole
+		expected string
+	}{
+		{roleBrowser, browserAsset},
+		{roleUpdater, browserAsset},
+		{browserRole("bogus"), browserAsset},
+	} {
+		if asset := browserProfileAsset(v.role); asset != v.expected {
+			t.Errorf("browserProfileAsset(%v) = %v, expected %v", v.role, asset, v.expected)
+		}
+	}
+
+	// A role's own profile is used once there is one, and that is what is
+	// exported and installed for the role.
+	mockSeccompAssets(t, map[string]string{updaterAsset: "read: 1\nwrite: 1\nexit_group: 1\n"})
+	if asset := browserProfileAsset(roleUpdater); asset != updaterAsset {
+		t.Errorf("browserProfileAsset(%v) = %v, expected %v", roleUpdater, asset, updaterAsset)
+	}
+	if asset := browserProfileAsset(roleBrowser); asset != browserAsset {
+		t.Errorf("browserProfileAsset(%v) = %v, expected %v", roleBrowser, asset, browserAsset)
+	}
+	var browserBPF, updaterBPF bytes.Buffer
+	if err := ExportProfileBPF("torbrowser", &browserBPF); err != nil {
+		t.Fatalf("ExportProfileBPF(torbrowser) = %v", err)
+	}
+	if err := ExportProfileBPF("torbrowser-updater", &updaterBPF); err != nil {
+		t.Fatalf("ExportProfileBPF(torbrowser-updater) = %v", err)
+	}
+	if bytes.Equal(browserBPF.Bytes(), updaterBPF.Bytes()) || updaterBPF.Len() >= browserBPF.Len() {
+		t.Errorf("ExportProfileBPF(torbrowser-updater) did not use the updater profile")
+	}
+}
+
+func TestBrowserProfilesExported(t *testing.T) {
+	// Every role's profile can be named for --dump-seccomp.
+	exported := make(map[string]bool)
+	for _, name := range SeccompProfiles {
+		exported[name] = true
+	}
+	for role, name := range browserProfiles {
+		if !exported[name] {
+			t.Errorf("role %v: profile %v is not in SeccompProfiles", role, name)
+		}
+	}
+}
@@ -0,0 +1,258 @@
+// transport.go - Sandboxed pluggable transport.
+// Copyright (C) 2017  Yawning Angel.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package sandbox
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"cmd/sandboxed-tor-browser/internal/dynlib"
+	. "cmd/sandboxed-tor-browser/internal/sandbox/process"
+	"cmd/sandboxed-tor-browser/internal/ui/config"
+	. "cmd/sandboxed-tor-browser/internal/utils"
+)
+
+const ptStartTimeout = 30 * time.Second
+
+// PluggableTransport is a running sandboxed pluggable transport instance.
+type PluggableTransport struct {
+	// Process is the sandboxed transport process.
+	Process *Process
+
+	// Methods is the map of transport names to the address of the SOCKS
+	// server that the transport is listening on.
+	Methods map[string]string
+
+	exitCh  chan struct{}
+	exitErr error
+}
+
+// Exited returns a non-nil error if the transport exited, without blocking.
+func (pt *PluggableTransport) Exited() error {
+	select {
+	case <-pt.exitCh:
+		return pt.exitErr
+	default:
+		return nil
+	}
+}
+
+// RunPluggableTransport launches the bundled pluggable transport (obfs4proxy)
+// in a sandbox as a managed client transport for the transports specified,
+// and waits for it to report the address of each of the SOCKS servers.
+func RunPluggableTransport(cfg *config.Config, manif *config.Manifest, transports []string) (pt *PluggableTransport, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%v", r)
+		}
+	}()
+
+	h, err := newHugbox()
+	if err != nil {
+		return nil, err
+	}
+
+	// The transport reports the listener addresses on stdout.
+	stdoutRd, stdoutWr, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	defer stdoutWr.Close()
+
+	logger := newConsoleLogger("pt")
+	h.stdout = stdoutWr
+	h.stderr = logger
+
+	// obfs4proxy is covered by the same whitelist that tor is, when tor runs
+	// it as a child.
+	h.seccompFn = func(fd *os.File) (*ProfileStats, error) { return installTorSeccompProfile(fd, true) }
+	h.seccompExtraDenied = torExtraDenied
+	h.allowNoSeccomp = cfg.Sandbox.AllowNoSeccomp
+	h.unshare.net = false // The transport needs host network access.
+	h.mountProc = false   // See RunTor().
+
+	realPtDir := filepath.Join(cfg.BundleInstallDir, "Browser", "TorBrowser", "Tor", "PluggableTransports")
+	realPtBin := filepath.Join(realPtDir, "obfs4proxy")
+	realStateDir := filepath.Join(cfg.TorDataDir, "pt_state")
+	ptDir := filepath.Join(h.homeDir, "pt")
+	ptBinDir := filepath.Join(ptDir, "bin")
+	stateDir := filepath.Join(ptDir, "state")
+
+	if err = os.MkdirAll(realStateDir, DirMode); err != nil {
+		return nil, err
+	}
+	h.dir(ptDir)
+	h.roBind(realPtDir, ptBinDir, false)
+	h.bind(realStateDir, stateDir, false)
+
+	if dynlib.IsSupported() {
+		cache, err := loadDynlibCache(cfg, manif)
+		if err != nil {
+			return nil, err
+		}
+		if err := h.appendLibraries(cache, []string{realPtBin}, nil, "", nil); err != nil {
+			return nil, err
+		}
+		h.setenv("LD_LIBRARY_PATH", restrictedLibDir)
+	}
+
+	// Speak the managed proxy configuration protocol (pt-spec.txt).
+	h.setenv("TOR_PT_MANAGED_TRANSPORT_VER", "1")
+	h.setenv("TOR_PT_STATE_LOCATION", stateDir)
+	h.setenv("TOR_PT_CLIENT_TRANSPORTS", strings.Join(transports, ","))
+	if cfg.Tor.UseProxy {
+		// tor can't pass the proxy to a transport that it does not manage.
+		proxy, err := ptProxyURL(cfg)
+		if err != nil {
+			return nil, err
+		}
+		h.setenv("TOR_PT_PROXY", proxy)
+	}
+
+	h.cmd = filepath.Join(ptBinDir, "obfs4proxy")
+
+	process, err := h.run()
+	if err != nil {
+		stdoutRd.Close()
+		return nil, err
+	}
+	stdoutWr.Close()
+
+	pt = &PluggableTransport{
+		Process: process,
+		exitCh:  make(chan struct{}),
+	}
+	go func() {
+		err := process.Wait()
+		if err == nil {
+			err = fmt.Errorf("exited")
+		}
+		pt.exitErr = fmt.Errorf("sandbox: pluggable transport %v", err)
+		close(pt.exitCh)
+	}()
+
+	if pt.Methods, err = readCmethods(stdoutRd, transports, pt.exitCh, logger); err != nil {
+		process.Kill()
+		return nil, err
+	}
+	for k, v := range pt.Methods {
+		Infof("sandbox: pluggable transport: %v listening on %v", k, v)
+	}
+	return pt, nil
+}
+
+// readCmethods reads the transport's stdout until all of the transports are
+// reported as either listening or failed, and returns the listener
+// addresses.  The rest of the output is copied to logger.
+func readCmethods(r io.ReadCloser, transports []string, exitCh <-chan struct{}, logger io.Writer) (map[string]string, error) {
+	type result struct {
+		methods map[string]string
+		err     error
+	}
+	doneCh := make(chan result, 1)
+
+	go func() {
+		defer r.Close()
+
+		methods := make(map[string]string)
+		var err error
+		scanner := bufio.NewScanner(r)
+		for scanner.Scan() {
+			sp := strings.Fields(scanner.Text())
+			if len(sp) == 0 {
+				continue
+			}
+			Debugf("sandbox: pluggable transport: %v", scanner.Text())
+
+			switch sp[0] {
+			case "VERSION":
+				if len(sp) != 2 || sp[1] != "1" {
+					err = fmt.Errorf("unsupported version: %v", scanner.Text())
+				}
+			case "VERSION-ERROR", "ENV-ERROR", "PROXY-ERROR":
+				err = fmt.Errorf("%v", scanner.Text())
+			case "CMETHOD":
+				// CMETHOD <transport> <'socks4','socks5'> <address:port>
+				if len(sp) < 4 || sp[2] != "socks5" {
+					err = fmt.Errorf("unsupported method: %v", scanner.Text())
+				} else if _, _, splitErr := net.SplitHostPort(sp[3]); splitErr != nil {
+					err = fmt.Errorf("invalid method address: %v", scanner.Text())
+				} else {
+					methods[sp[1]] = sp[3]
+				}
+			case "CMETHOD-ERROR":
+				err = fmt.Errorf("%v", scanner.Text())
+			case "CMETHODS":
+				if len(sp) == 2 && sp[1] == "DONE" {
+					if len(methods) != len(transports) {
+						err = fmt.Errorf("only %d of %d transports are available", len(methods), len(transports))
+					}
+					doneCh <- result{methods, err}
+
+					// Drain the rest of the output.
+					io.Copy(logger, r)
+					return
+				}
+			}
+			if err != nil {
+				doneCh <- result{nil, err}
+				io.Copy(logger, r)
+				return
+			}
+		}
+		doneCh <- result{nil, fmt.Errorf("unexpected end of output")}
+	}()
+
+	select {
+	case res := <-doneCh:
+		if res.err != nil {
+			return nil, fmt.Errorf("sandbox: pluggable transport failed to start: %v", res.err)
+		}
+		return res.methods, nil
+	case <-exitCh:
+		return nil, fmt.Errorf("sandbox: pluggable transport exited while starting")
+	case <-time.After(ptStartTimeout):
+		return nil, fmt.Errorf("sandbox: timeout waiting for the pluggable transport to start")
+	}
+}
+
+// ptProxyURL returns the upstream proxy configuration in the `TOR_PT_PROXY`
+// format.
+func ptProxyURL(cfg *config.Config) (string, error) {
+	u := &url.URL{Host: net.JoinHostPort(cfg.Tor.ProxyAddress, cfg.Tor.ProxyPort)}
+	switch cfg.Tor.ProxyType {
+	case "SOCKS 4":
+		u.Scheme = "socks4a"
+	case "SOCKS 5":
+		u.Scheme = "socks5"
+	case "HTTP(S)":
+		u.Scheme = "http"
+	default:
+		return "", fmt.Errorf("sandbox: unsupported proxy type: %v", cfg.Tor.ProxyType)
+	}
+	if u.Scheme != "socks4a" && cfg.Tor.ProxyUsername != "" && cfg.Tor.ProxyPassword != "" {
+		u.User = url.UserPassword(cfg.Tor.ProxyUsername, cfg.Tor.ProxyPassword)
+	}
+	return u.String(), nil
+}
@@ -47,7 +47,6 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
-	"log"
 	"net"
 	"os"
 	"sync"
@@ -358,7 +357,7 @@ func (c *surrogateInstance) consumeClientRequest() error {
 			// Check to see if the extension is allowed.
 			_, extAllowed := extensionOpFwdMap[opCode]
 			if !extAllowed {
-				log.Printf("sandbox: X11: WARNING: Rejecting prohibited request: %d", opCode)
+				Warnf("sandbox: X11: WARNING: Rejecting prohibited request: %d", opCode)
 
 				if err := c.injectRequestError(opCode); err != nil {
 					return err
@@ -0,0 +1,149 @@
+// auth.go - Tor control port authentication.
+// Copyright (C) 2015, 2016  Yawning Angel.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package tor
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"git.schwanenlied.me/yawning/bulb.git"
+
+	"cmd/sandboxed-tor-browser/internal/ui/config"
+)
+
+// protocolAuthMethods maps the configurable authentication methods to the
+// names used in the PROTOCOLINFO response.
+var protocolAuthMethods = map[string]string{
+	config.ControlAuthNull:       "NULL",
+	config.ControlAuthPassword:   "HASHEDPASSWORD",
+	config.ControlAuthCookie:     "COOKIE",
+	config.ControlAuthSafeCookie: "SAFECOOKIE",
+}
+
+// authenticate authenticates with the control port using the specified
+// method, failing if the method is not offered.  The "auto" method lets bulb
+// pick the best method that is offered instead.
+func authenticate(ctrl *bulb.Conn, method, password string) error {
+	if method == "" || method == config.ControlAuthAuto {
+		return ctrl.Authenticate(password)
+	}
+
+	pi, err := ctrl.ProtocolInfo()
+	if err != nil {
+		return err
+	}
+	if !pi.AuthMethods[protocolAuthMethods[method]] {
+		return fmt.Errorf("'%v' authentication is not offered by the control port", method)
+	}
+
+	switch method {
+	case config.ControlAuthNull:
+		_, err = ctrl.Request("AUTHENTICATE")
+	case config.ControlAuthPassword:
+		if password == "" {
+			return fmt.Errorf("'%v' authentication requires a password", method)
+		}
+		_, err = ctrl.Request("AUTHENTICATE %s", hex.EncodeToString([]byte(password)))
+	case config.ControlAuthCookie:
+		var cookie []byte
+		if cookie, err = readAuthCookie(pi.CookieFile); err != nil {
+			return err
+		}
+		_, err = ctrl.Request("AUTHENTICATE %s", hex.EncodeToString(cookie))
+	case config.ControlAuthSafeCookie:
+		err = safeCookieAuthenticate(ctrl, pi.CookieFile)
+	default:
+		err = fmt.Errorf("unsupported authentication method: '%v'", method)
+	}
+	return err
+}
+
+func readAuthCookie(path string) ([]byte, error) {
+	const authCookieLength = 32
+
+	if path == "" {
+		return nil, fmt.Errorf("no cookie file advertised")
+	}
+	cookie, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the cookie file: %v", err)
+	}
+	if len(cookie) != authCookieLength {
+		return nil, fmt.Errorf("invalid cookie file length: %d", len(cookie))
+	}
+	return cookie, nil
+}
+
+// safeCookieAuthenticate does "SAFECOOKIE" authentication, which unlike
+// "COOKIE" authentication also proves that the control port can read the
+// cookie, before the cookie is used.
+func safeCookieAuthenticate(ctrl *bulb.Conn, cookieFile string) error {
+	const (
+		authNonceLength = 32
+
+		authServerHashKey = "Tor safe cookie authentication server-to-controller hash"
+		authClientHashKey = "Tor safe cookie authentication controller-to-server hash"
+	)
+
+	cookie, err := readAuthCookie(cookieFile)
+	if err != nil {
+		return err
+	}
+
+	var clientNonce [authNonceLength]byte
+	if _, err := rand.Read(clientNonce[:]); err != nil {
+		return err
+	}
+	resp, err := ctrl.Request("AUTHCHALLENGE SAFECOOKIE %s", hex.EncodeToString(clientNonce[:]))
+	if err != nil {
+		return err
+	}
+
+	// 250 AUTHCHALLENGE SERVERHASH=... SERVERNONCE=...
+	var serverHash, serverNonce []byte
+	for _, v := range strings.Split(resp.Reply, " ") {
+		if s := strings.TrimPrefix(v, "SERVERHASH="); s != v {
+			serverHash, err = hex.DecodeString(s)
+		} else if s = strings.TrimPrefix(v, "SERVERNONCE="); s != v {
+			serverNonce, err = hex.DecodeString(s)
+		}
+		if err != nil {
+			return fmt.Errorf("invalid AUTHCHALLENGE response: %v", err)
+		}
+	}
+	if len(serverHash) != sha256.Size || len(serverNonce) != authNonceLength {
+		return fmt.Errorf("invalid AUTHCHALLENGE response")
+	}
+
+	mac := func(key string) []byte {
+		m := hmac.New(sha256.New, []byte(key))
+		m.Write(cookie)
+		m.Write(clientNonce[:])
+		m.Write(serverNonce)
+		return m.Sum(nil)
+	}
+	if !hmac.Equal(serverHash, mac(authServerHashKey)) {
+		return fmt.Errorf("invalid AUTHCHALLENGE server hash")
+	}
+	_, err = ctrl.Request("AUTHENTICATE %s", hex.EncodeToString(mac(authClientHashKey)))
+	return err
+}
@@ -0,0 +1,125 @@
+// auth_test.go - Tor control port authentication tests.
+// Copyright (C) 2017  Yawning Angel.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package tor
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"cmd/sandboxed-tor-browser/internal/ui/config"
+)
+
+// newFakeCookieControlPort returns a fake AF_LOCAL control port that only
+// advertises cookie authentication, and a cookie file containing fileCookie.
+func newFakeCookieControlPort(t *testing.T, fileCookie []byte) (*fakeControlPort, *config.Config) {
+	f, cfg := newFakeControlPort(t, false, "version=0.4.8.9")
+
+	f.cookie = make([]byte, 32)
+	if _, err := rand.Read(f.cookie); err != nil {
+		t.Fatalf("failed to generate cookie: %v", err)
+	}
+	if fileCookie == nil {
+		fileCookie = f.cookie
+	}
+	f.cookieFile = filepath.Join(t.TempDir(), "control_auth_cookie")
+	if err := ioutil.WriteFile(f.cookieFile, fileCookie, 0600); err != nil {
+		t.Fatalf("failed to write cookie: %v", err)
+	}
+	cfg.SystemTorControlAuthMethod = ""
+
+	return f, cfg
+}
+
+func TestSafeCookieAuthentication(t *testing.T) {
+	for _, method := range []string{"", config.ControlAuthAuto, config.ControlAuthSafeCookie} {
+		_, cfg := newFakeCookieControlPort(t, nil)
+		cfg.SystemTorControlAuthMethod = method
+		if err := CheckControlPort(cfg); err != nil {
+			t.Errorf("method '%v': CheckControlPort() = %v", method, err)
+		}
+	}
+}
+
+func TestSafeCookieAuthenticationFailures(t *testing.T) {
+	t.Run("wrong cookie", func(t *testing.T) {
+		_, cfg := newFakeCookieControlPort(t, bytes.Repeat([]byte{0x23}, 32))
+		cfg.SystemTorControlAuthMethod = config.ControlAuthSafeCookie
+		if err := CheckControlPort(cfg); err == nil {
+			t.Fatalf("CheckControlPort() succeeded with the wrong cookie")
+		}
+	})
+
+	t.Run("truncated cookie", func(t *testing.T) {
+		_, cfg := newFakeCookieControlPort(t, []byte("short"))
+		cfg.SystemTorControlAuthMethod = config.ControlAuthSafeCookie
+		if err := CheckControlPort(cfg); err == nil {
+			t.Fatalf("CheckControlPort() succeeded with a truncated cookie")
+		}
+	})
+
+	t.Run("method not offered", func(t *testing.T) {
+		_, cfg := newFakeCookieControlPort(t, nil)
+		cfg.SystemTorControlAuthMethod = config.ControlAuthNull
+		if err := CheckControlPort(cfg); err == nil {
+			t.Fatalf("CheckControlPort() succeeded with an unoffered method")
+		}
+	})
+}
+
+func TestControlAuthMethods(t *testing.T) {
+	nullPort := func(t *testing.T) *config.Config {
+		_, cfg := newFakeControlPort(t, true, "version=0.4.8.9")
+		return cfg
+	}
+	cookiePort := func(t *testing.T) *config.Config {
+		_, cfg := newFakeCookieControlPort(t, nil)
+		return cfg
+	}
+
+	for _, v := range []struct {
+		name       string
+		port       func(*testing.T) *config.Config
+		method     string
+		notOffered bool
+	}{
+		{"null auto", nullPort, config.ControlAuthAuto, false},
+		{"null", nullPort, config.ControlAuthNull, false},
+		{"null port cookie", nullPort, config.ControlAuthCookie, true},
+		{"null port safecookie", nullPort, config.ControlAuthSafeCookie, true},
+		{"null port password", nullPort, config.ControlAuthPassword, true},
+		{"cookie", cookiePort, config.ControlAuthCookie, false},
+		{"cookie port null", cookiePort, config.ControlAuthNull, true},
+		{"cookie port password", cookiePort, config.ControlAuthPassword, true},
+	} {
+		t.Run(v.name, func(t *testing.T) {
+			cfg := v.port(t)
+			cfg.SystemTorControlAuthMethod = v.method
+			err := CheckControlPort(cfg)
+			if v.notOffered {
+				if err == nil || !strings.Contains(err.Error(), "is not offered") {
+					t.Errorf("CheckControlPort() = %v, expected '%v' to be rejected", err, v.method)
+				}
+			} else if err != nil {
+				t.Errorf("CheckControlPort() = %v", err)
+			}
+		})
+	}
+}
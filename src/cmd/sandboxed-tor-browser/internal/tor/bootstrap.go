@@ -0,0 +1,121 @@
+// bootstrap.go - Tor bootstrap status events.
+// Copyright (C) 2015, 2016  Yawning Angel.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package tor
+
+import (
+	"context"
+	"strconv"
+	"strings"
+)
+
+// BootstrapStatus is a tor bootstrap progress status.
+type BootstrapStatus struct {
+	// Progress is the bootstrap progress percentage.
+	Progress int
+
+	// Tag is the bootstrap phase keyword (Eg: "conn_dir").
+	Tag string
+
+	// Summary is the human readable bootstrap phase description.
+	Summary string
+}
+
+// Done returns true if the bootstrap is complete.
+func (st *BootstrapStatus) Done() bool {
+	return st.Progress >= 100
+}
+
+// SubscribeBootstrap registers for the `STATUS_CLIENT` events, and returns
+// a channel that the bootstrap progress is sent to.  The channel is closed
+// once bootstrap completes, the context is done, or the control port
+// connection is lost.  The events are consumed from the event queue shared
+// with the circuit display, so the two must not be used at the same time.
+func (t *Tor) SubscribeBootstrap(ctx context.Context) (<-chan BootstrapStatus, error) {
+	const evPrefix = "STATUS_CLIENT "
+
+	if err := t.setevents("STATUS_CLIENT"); err != nil {
+		return nil, err
+	}
+
+	ch := make(chan BootstrapStatus)
+	go func() {
+		defer close(ch)
+		for {
+			select {
+			case ev, ok := <-t.ctrlEvents:
+				if !ok {
+					return
+				}
+				if !strings.HasPrefix(ev.Reply, evPrefix) {
+					continue
+				}
+				st := parseBootstrapStatus(strings.TrimPrefix(ev.Reply, evPrefix))
+				if st == nil {
+					continue
+				}
+				select {
+				case ch <- *st:
+				case <-ctx.Done():
+					return
+				}
+				if st.Done() {
+					return
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return ch, nil
+}
+
+// parseBootstrapStatus parses a `STATUS_CLIENT` event or `status/bootstrap-phase`
+// value, and returns nil if it is not bootstrap progress.
+func parseBootstrapStatus(s string) *BootstrapStatus {
+	const bootstrapPrefix = "NOTICE BOOTSTRAP "
+	if !strings.HasPrefix(s, bootstrapPrefix) {
+		return nil
+	}
+
+	st := new(BootstrapStatus)
+	hasProgress := false
+	for _, v := range splitQuoted(strings.TrimPrefix(s, bootstrapPrefix)) {
+		const (
+			progressPrefix = "PROGRESS="
+			tagPrefix      = "TAG="
+			summaryPrefix  = "SUMMARY="
+		)
+
+		switch {
+		case strings.HasPrefix(v, progressPrefix):
+			pct, err := strconv.Atoi(strings.TrimPrefix(v, progressPrefix))
+			if err != nil {
+				return nil
+			}
+			st.Progress = pct
+			hasProgress = true
+		case strings.HasPrefix(v, tagPrefix):
+			st.Tag = strings.TrimPrefix(v, tagPrefix)
+		case strings.HasPrefix(v, summaryPrefix):
+			st.Summary = strings.Trim(strings.TrimPrefix(v, summaryPrefix), "\"")
+		}
+	}
+	if !hasProgress {
+		return nil
+	}
+	return st
+}
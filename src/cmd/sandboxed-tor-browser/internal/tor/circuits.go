@@ -188,7 +188,7 @@ func initCircuitMonitor(p *ctrlProxy) (*circuitMonitor, error) {
 	m.p = p
 	m.conns = list.New()
 
-	if _, err := m.p.tor.ctrl.Request("SETEVENTS %s", eventStream); err != nil {
+	if err := m.p.tor.setevents(eventStream); err != nil {
 		return nil, fmt.Errorf("circuitMon: failed to register for circuit/stream events: %v", err)
 	}
 	go m.handleEvents()
@@ -0,0 +1,124 @@
+// reconfigure.go - Runtime tor reconfiguration.
+// Copyright (C) 2015, 2016  Yawning Angel.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package tor
+
+import (
+	"fmt"
+	"strings"
+
+	"cmd/sandboxed-tor-browser/internal/ui/config"
+)
+
+// reconfigurableOptions are the torrc options that Reconfigure manages, in
+// addition to the extra options.  Any that the new config does not set are
+// reset to the defaults.
+var reconfigurableOptions = []string{
+	"Bridge",
+	"ClientTransportPlugin",
+	"HTTPSProxy",
+	"HTTPSProxyAuthenticator",
+	"Socks4Proxy",
+	"Socks5Proxy",
+	"Socks5ProxyPassword",
+	"Socks5ProxyUsername",
+	"UseBridges",
+}
+
+// Reconfigure applies the bridge, proxy, and extra options from cfg to a
+// running sandboxed tor instance via `SETCONF`, without restarting it.  The
+// oldExtraOptions that are no longer set are reset to the defaults, and
+// ptMethods are the methods of the pluggable transport that was launched
+// with the instance, if any.
+func (t *Tor) Reconfigure(cfg *config.Config, oldExtraOptions map[string]string, bridges map[string][]string, ptMethods map[string]string) error {
+	if t.isSystem {
+		return fmt.Errorf("tor: can not reconfigure a system tor")
+	}
+	if cfg.Tor.UseBridges && ptMethods == nil {
+		// The pluggable transport is only launched if bridges were enabled
+		// when tor was launched.
+		return fmt.Errorf("tor: enabling bridges requires restarting tor")
+	}
+
+	var lines []string
+	bridgeLines, err := torrcBridgeLines(cfg, bridges, ptMethods)
+	if err != nil {
+		return err
+	}
+	proxyLines, err := torrcProxyLines(cfg)
+	if err != nil {
+		return err
+	}
+	for _, l := range append(append(bridgeLines, proxyLines...), torrcExtraLines(cfg)...) {
+		lines = append(lines, strings.Split(l, "\n")...)
+	}
+
+	// Build the SETCONF arguments, with repeated options (Eg: `Bridge`)
+	// grouped together as tor requires.
+	var keys []string
+	values := make(map[string][]string)
+	for _, l := range lines {
+		l = strings.TrimSpace(l)
+		if l == "" || strings.HasPrefix(l, "#") {
+			continue
+		}
+		kv := strings.SplitN(l, " ", 2)
+		k, v := kv[0], ""
+		if len(kv) == 2 {
+			v = strings.TrimSpace(kv[1])
+		}
+		if values[k] == nil {
+			keys = append(keys, k)
+		}
+		values[k] = append(values[k], v)
+	}
+	resetKeys := append([]string{}, reconfigurableOptions...)
+	for k := range oldExtraOptions {
+		resetKeys = append(resetKeys, k)
+	}
+	for _, k := range resetKeys {
+		if values[k] == nil {
+			keys = append(keys, k)
+			values[k] = []string{}
+		}
+	}
+
+	var args []string
+	for _, k := range keys {
+		if len(values[k]) == 0 {
+			args = append(args, k) // Reset to the default.
+			continue
+		}
+		for _, v := range values[k] {
+			args = append(args, k+"="+quoteConfValue(v))
+		}
+	}
+
+	t.Lock()
+	defer t.Unlock()
+
+	if t.ctrl == nil {
+		return ErrTorNotRunning
+	}
+	_, err = t.ctrl.Request("%s", "SETCONF "+strings.Join(args, " "))
+	return err
+}
+
+func quoteConfValue(v string) string {
+	v = strings.Replace(v, `\`, `\\`, -1)
+	v = strings.Replace(v, `"`, `\"`, -1)
+	return `"` + v + `"`
+}
@@ -25,7 +25,6 @@ import (
 	"errors"
 	"fmt"
 	"io"
-	"log"
 	"net"
 	"os"
 	"path/filepath"
@@ -35,6 +34,7 @@ import (
 
 	"cmd/sandboxed-tor-browser/internal/socks5"
 	"cmd/sandboxed-tor-browser/internal/ui/config"
+	. "cmd/sandboxed-tor-browser/internal/utils"
 )
 
 const (
@@ -174,7 +174,7 @@ func (p *socksProxy) acceptLoop() {
 			if e, ok := err.(net.Error); ok && e.Temporary() {
 				continue
 			}
-			log.Printf("failed to accept SOCKS conn: %v", err)
+			Warnf("failed to accept SOCKS conn: %v", err)
 			return
 		}
 		go p.handleConn(conn)
@@ -500,7 +500,7 @@ func (c *ctrlProxyConn) handle() {
 
 	var err error
 	if err = c.processPreAuth(); err != nil {
-		log.Printf("control port pre-auth error: %v", err)
+		Warnf("control port pre-auth error: %v", err)
 		return
 	}
 
@@ -532,7 +532,7 @@ func (p *ctrlProxy) acceptLoop() {
 			if e, ok := err.(net.Error); ok && e.Temporary() {
 				continue
 			}
-			log.Printf("failed to accept control conn: %v", err)
+			Warnf("failed to accept control conn: %v", err)
 			return
 		}
 		p.handleConn(conn)
@@ -573,7 +573,7 @@ func launchCtrlProxy(cfg *config.Config, tor *Tor) (*ctrlProxy, error) {
 	if cfg.Sandbox.EnableCircuitDisplay {
 		p.circuitMonitor, err = initCircuitMonitor(p)
 		if err != nil {
-			log.Printf("tor: failed to launch circuit display helper: %v", err)
+			Warnf("tor: failed to launch circuit display helper: %v", err)
 		}
 	}
 	p.circuitMonitorEnabled = p.circuitMonitor != nil && err == nil
@@ -19,15 +19,15 @@ package tor
 
 import (
 	"bytes"
-	"crypto/rand"
-	"encoding/hex"
+	"context"
 	"errors"
 	"fmt"
 	"io/ioutil"
-	"log"
 	mrand "math/rand"
+	"net"
 	"os"
 	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -35,7 +35,6 @@ import (
 	"unicode"
 
 	"git.schwanenlied.me/yawning/bulb.git"
-	"golang.org/x/crypto/openpgp/s2k"
 	"golang.org/x/net/proxy"
 
 	"cmd/sandboxed-tor-browser/internal/data"
@@ -55,9 +54,10 @@ type Tor struct {
 	isSystem       bool
 	isBootstrapped bool
 
-	process    *process.Process
-	ctrl       *bulb.Conn
-	ctrlEvents chan *bulb.Response
+	process       *process.Process
+	ctrl          *bulb.Conn
+	ctrlEvents    chan *bulb.Response
+	ctrlSetEvents string
 
 	socksNet  string
 	socksAddr string
@@ -133,6 +133,60 @@ func (t *Tor) getinfo(arg string) (*bulb.Response, error) {
 	return t.ctrl.Request("GETINFO %s", arg)
 }
 
+// CheckControlPort checks that the control port connection is usable by
+// issuing a `GETINFO version`, and returns a descriptive error on failure.
+func (t *Tor) CheckControlPort() error {
+	t.Lock()
+	defer t.Unlock()
+
+	if t.ctrl == nil {
+		return fmt.Errorf("tor: control port health check failed: %v", ErrTorNotRunning)
+	}
+	return checkControlVersion(t.ctrl)
+}
+
+// CheckControlPort checks that the configured system tor control port is
+// reachable and that authentication succeeds, by dialing it afresh and
+// issuing a `GETINFO version`.  A descriptive error is returned on failure.
+func CheckControlPort(cfg *config.Config) error {
+	ctrl, err := dialSystemTor(cfg)
+	if err != nil {
+		return fmt.Errorf("tor: control port health check failed: %v", err)
+	}
+	defer ctrl.Close()
+
+	return checkControlVersion(ctrl)
+}
+
+func checkControlVersion(ctrl *bulb.Conn) error {
+	const versionPrefix = "version="
+
+	resp, err := ctrl.Request("GETINFO version")
+	if err != nil {
+		return fmt.Errorf("tor: control port health check failed: %v", err)
+	}
+	if len(resp.Data) != 1 || !strings.HasPrefix(resp.Data[0], versionPrefix) {
+		return fmt.Errorf("tor: control port health check failed: unexpected response: %v", resp.RawLines)
+	}
+	Debugf("tor: control port health check ok, version: %v", strings.TrimPrefix(resp.Data[0], versionPrefix))
+
+	return nil
+}
+
+func (t *Tor) setevents(events string) error {
+	t.Lock()
+	defer t.Unlock()
+
+	if t.ctrl == nil {
+		return ErrTorNotRunning
+	}
+	if _, err := t.ctrl.Request("%s", strings.TrimSpace("SETEVENTS "+events)); err != nil {
+		return err
+	}
+	t.ctrlSetEvents = events // Re-registered on reconnect.
+	return nil
+}
+
 func (t *Tor) getconf(arg string) (*bulb.Response, error) {
 	t.Lock()
 	defer t.Unlock()
@@ -230,60 +284,202 @@ func (t *Tor) launchSurrogates(cfg *config.Config) error {
 	}
 
 	if !t.IsSystem() {
-		const passthroughAddr = "127.0.0.1:9150"
+		pNet, pAddr, err := cfg.Tor.SocksPortAddr()
+		if err != nil {
+			Warnf("tor: Invalid SOCKS passthrough address: %v", err)
+			return nil
+		}
 
 		tNet, tAddr, _ := t.SocksPort()
-		t.socksPassthrough, err = launchPassthroughProxy("tcp", passthroughAddr, tNet, tAddr)
+		t.socksPassthrough, err = launchPassthroughProxy(pNet, pAddr, tNet, tAddr)
 		if err != nil {
-			log.Printf("tor: Failed to open SOCKS passthrough listener: %v", err)
+			Warnf("tor: Failed to open SOCKS passthrough listener: %v", err)
 		} else {
-			log.Printf("tor: Opened SOCKS passthrough listener: %v", passthroughAddr)
+			Infof("tor: Opened SOCKS passthrough listener: %v", pAddr)
+			if pNet == "unix" {
+				t.unlinkOnExit = append(t.unlinkOnExit, pAddr)
+			}
 		}
 	}
 
 	return nil
 }
 
-func (t *Tor) eventReader() {
+// eventReader forwards control port events to the event channel.  If redial
+// is non-nil, the control port connection will be re-established if it is
+// lost for any reason other than Shutdown().
+func (t *Tor) eventReader(redial func() (*bulb.Conn, error)) {
+	t.Lock()
 	ctrl := t.ctrl
-	for {
-		resp, err := ctrl.NextEvent()
-		if err != nil {
+	t.Unlock()
+
+	for ctrl != nil {
+		for {
+			resp, err := ctrl.NextEvent()
+			if err != nil {
+				break
+			}
+			t.ctrlEvents <- resp
+		}
+		if redial == nil {
 			break
 		}
-		t.ctrlEvents <- resp
+		ctrl = t.reconnect(ctrl, redial)
 	}
 	close(t.ctrlEvents)
 }
 
-// NewSystemTor creates a Tor struct around a system tor instance.
+// reconnect replaces the dropped control port connection oldCtrl with a new
+// one, retrying with backoff until it succeeds, or the instance is shutdown.
+func (t *Tor) reconnect(oldCtrl *bulb.Conn, redial func() (*bulb.Conn, error)) *bulb.Conn {
+	const (
+		minBackoff = 1 * time.Second
+		maxBackoff = 30 * time.Second
+	)
+
+	isCurrent := func() bool {
+		t.Lock()
+		defer t.Unlock()
+		return t.ctrl == oldCtrl
+	}
+
+	backoff := minBackoff
+	for attempt := 1; isCurrent(); attempt++ {
+		Warnf("tor: Control port connection lost, reconnecting (attempt %d).", attempt)
+		ctrl, err := redial()
+		if err != nil {
+			Warnf("tor: Failed to reconnect to the control port: %v", err)
+			time.Sleep(backoff)
+			if backoff *= 2; backoff > maxBackoff {
+				backoff = maxBackoff
+			}
+			continue
+		}
+
+		t.Lock()
+		defer t.Unlock()
+		if t.ctrl != oldCtrl {
+			// Shutdown() was called while reconnecting.
+			ctrl.Close()
+			return nil
+		}
+		if t.ctrlSetEvents != "" {
+			if _, err = ctrl.Request("SETEVENTS %s", t.ctrlSetEvents); err != nil {
+				Warnf("tor: Failed to re-register for events: %v", err)
+			}
+		}
+		oldCtrl.Close()
+		t.ctrl = ctrl
+		Infof("tor: Reconnected to the control port.")
+		return ctrl
+	}
+	return nil
+}
+
+// dialSystemTor connects and authenticates to the system tor control port.
+func dialSystemTor(cfg *config.Config) (*bulb.Conn, error) {
+	conn, err := dialSystemTorControlPort(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return authSystemTor(cfg, conn)
+}
+
+// DialControlPortContext connects and authenticates to the system tor control
+// port like dialSystemTor, but retries connecting with exponential backoff
+// until it succeeds or ctx is done, for when the system tor may still be
+// starting.  On timeout, the last error is returned.  Authentication
+// failures are not retried.
+func DialControlPortContext(ctx context.Context, cfg *config.Config) (*bulb.Conn, error) {
+	conn, err := dialWithBackoff(ctx, func() (net.Conn, error) { return dialSystemTorControlPort(cfg) })
+	if err != nil {
+		return nil, err
+	}
+	return authSystemTor(cfg, conn)
+}
+
+func dialSystemTorControlPort(cfg *config.Config) (net.Conn, error) {
+	const keepAlive = 30 * time.Second
+
+	network := cfg.SystemTorControlNet
+	addr := cfg.SystemTorControlAddr
+
+	// Dial the control port, with TCP keepalives enabled (ignored for
+	// AF_LOCAL), so that a dead connection is eventually noticed.
+	d := &net.Dialer{KeepAlive: keepAlive}
+	conn, err := d.Dial(network, addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to the system tor control port (%v:%v): %v", network, addr, err)
+	}
+	return conn, nil
+}
+
+func authSystemTor(cfg *config.Config, conn net.Conn) (*bulb.Conn, error) {
+	ctrl := bulb.NewConn(conn)
+
+	// Authenticate with the control port.  Unless a method is configured,
+	// this will use the "best" method that the system tor supports, so "NULL"
+	// or "SAFECOOKIE" authentication via the cookie path advertised in the
+	// PROTOCOLINFO response, falling back to "HASHEDPASSWORD" if a password
+	// is configured.  The cookie file must be readable by the current user,
+	// which is typically done via group membership.
+	if err := authenticate(ctrl, cfg.SystemTorControlAuthMethod, cfg.SystemTorControlPassword); err != nil {
+		ctrl.Close()
+		return nil, fmt.Errorf("failed to authenticate with the system tor control port: %v", err)
+	}
+
+	ctrl.StartAsyncReader()
+	return ctrl, nil
+}
+
+func dialWithBackoff(ctx context.Context, dial func() (net.Conn, error)) (net.Conn, error) {
+	const (
+		minBackoff = 100 * time.Millisecond
+		maxBackoff = 5 * time.Second
+	)
+
+	backoff := minBackoff
+	for {
+		conn, err := dial()
+		if err == nil {
+			return conn, nil
+		}
+		Debugf("tor: Failed to connect to the control port, retrying in %v: %v", backoff, err)
+
+		select {
+		case <-ctx.Done():
+			return nil, err
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+}
+
+// NewSystemTor creates a Tor struct around a system tor instance.  The
+// control port connection is automatically re-established if it is lost
+// (Eg: the system tor is restarted).
 func NewSystemTor(cfg *config.Config) (*Tor, error) {
+	const dialTimeout = 15 * time.Second
+
 	t := new(Tor)
 	t.isSystem = true
 	t.ctrlEvents = make(chan *bulb.Response, 16)
 	t.isBootstrapped = true
 
-	net := cfg.SystemTorControlNet
-	addr := cfg.SystemTorControlAddr
+	ctx, cancel := context.WithTimeout(context.Background(), dialTimeout)
+	defer cancel()
 
-	// Dial the control port.
 	var err error
-	if t.ctrl, err = bulb.Dial(net, addr); err != nil {
-		return nil, err
-	}
-
-	// Authenticate with the control port.
-	if err = t.ctrl.Authenticate(""); err != nil {
-		t.ctrl.Close()
+	if t.ctrl, err = DialControlPortContext(ctx, cfg); err != nil {
 		return nil, err
 	}
-
-	t.ctrl.StartAsyncReader()
-	go t.eventReader()
+	go t.eventReader(func() (*bulb.Conn, error) { return dialSystemTor(cfg) })
 
 	// Launch the surrogates.
 	if err = t.launchSurrogates(cfg); err != nil {
-		t.ctrl.Close()
+		t.Shutdown()
 		return nil, err
 	}
 
@@ -307,6 +503,8 @@ func NewSandboxedTor(cfg *config.Config, process *process.Process) *Tor {
 // DoBootstrap will bootstrap a tor instance, if it is one that is lauched
 // by us.
 func (t *Tor) DoBootstrap(cfg *config.Config, async *Async) (err error) {
+	const ctrlDialTimeout = 10 * time.Second
+
 	if t.isBootstrapped {
 		return nil
 	}
@@ -338,11 +536,16 @@ func (t *Tor) DoBootstrap(cfg *config.Config, async *Async) (err error) {
 
 	Debugf("tor: control port is: %v", string(ctrlPortAddr))
 
-	// Dial the control port.
+	// Dial the control port.  tor writes the `control_port` file before it
+	// is necessarily accepting connections, so retry for a bit.
 	async.UpdateProgress("Connecting to the Tor Control Port.")
-	if t.ctrl, err = bulb.Dial("unix", t.ctrlAddr); err != nil {
+	ctx, cancel := context.WithTimeout(context.Background(), ctrlDialTimeout)
+	defer cancel()
+	conn, err := dialWithBackoff(ctx, func() (net.Conn, error) { return net.Dial("unix", t.ctrlAddr) })
+	if err != nil {
 		return err
 	}
+	t.ctrl = bulb.NewConn(conn)
 	ctrl := t.ctrl // Shadow, so that we fail gracefully on close.
 
 	// Authenticate with the control port.
@@ -354,17 +557,20 @@ func (t *Tor) DoBootstrap(cfg *config.Config, async *Async) (err error) {
 	// when the control port connection gets closed.  Past this point, tor
 	// shouldn't leave a turd process lying around, though I've seen it on
 	// occaision. :(
-	log.Printf("tor: Taking ownership of the tor process")
+	Infof("tor: Taking ownership of the tor process")
 	if _, err = ctrl.Request("TAKEOWNERSHIP"); err != nil {
 		return err
 	}
 
 	// Start the event async reader.
 	ctrl.StartAsyncReader()
-	go t.eventReader()
+	go t.eventReader(nil)
 
-	// Register the `STATUS_CLIENT` event handler.
-	if _, err = ctrl.Request("SETEVENTS STATUS_CLIENT"); err != nil {
+	// Register for the bootstrap status events.
+	subCtx, subCancel := context.WithCancel(context.Background())
+	defer subCancel()
+	statusCh, err := t.SubscribeBootstrap(subCtx)
+	if err != nil {
 		return err
 	}
 
@@ -380,15 +586,11 @@ func (t *Tor) DoBootstrap(cfg *config.Config, async *Async) (err error) {
 	for nTicks := 0; nTicks < 300 && !bootstrapFinished; { // 300 sec timeout (bootstrap).
 		newPct := 0
 		select {
-		case ev := <-t.ctrlEvents:
-			const evPrefix = "STATUS_CLIENT "
-			if ev == nil {
+		case st, ok := <-statusCh:
+			if !ok {
 				return ErrCanceled
 			}
-			if !strings.HasPrefix(ev.Reply, evPrefix) {
-				continue
-			}
-			bootstrapFinished, newPct = handleBootstrapEvent(async, strings.TrimPrefix(ev.Reply, evPrefix))
+			bootstrapFinished, newPct = handleBootstrapEvent(async, &st)
 		case <-async.Cancel:
 			return ErrCanceled
 		case <-hz.C:
@@ -411,7 +613,7 @@ func (t *Tor) DoBootstrap(cfg *config.Config, async *Async) (err error) {
 			if err != nil {
 				return err
 			}
-			bootstrapFinished, newPct = handleBootstrapEvent(async, strings.TrimPrefix(resp.Data[0], statusPrefix))
+			bootstrapFinished, newPct = handleBootstrapEvent(async, parseBootstrapStatus(strings.TrimPrefix(resp.Data[0], statusPrefix)))
 		}
 		// As long as forward progress is being made, reset the timer.
 		if newPct > pct {
@@ -424,7 +626,8 @@ func (t *Tor) DoBootstrap(cfg *config.Config, async *Async) (err error) {
 	}
 
 	// Squelch the events, and drain the event queue.
-	if _, err = ctrl.Request("SETEVENTS"); err != nil {
+	subCancel()
+	if err = t.setevents(""); err != nil {
 		return err
 	}
 	for len(t.ctrlEvents) > 0 {
@@ -442,137 +645,180 @@ func (t *Tor) DoBootstrap(cfg *config.Config, async *Async) (err error) {
 }
 
 // CfgToSandboxTorrc converts the `ui/config/Config` to a sandboxed tor ready
-// torrc.
-func CfgToSandboxTorrc(cfg *config.Config, bridges map[string][]string) ([]byte, error) {
-	torrc, err := data.Asset("torrc")
+// torrc.  If ptMethods is non-nil, the pluggable transports are used via the
+// SOCKS servers at the addresses in ptMethods, instead of being launched by
+// tor.
+func CfgToSandboxTorrc(cfg *config.Config, bridges map[string][]string, ptMethods map[string]string) ([]byte, error) {
+	torrc, err := data.Load("torrc")
 	if err != nil {
 		return nil, err
 	}
 
-	// Apply proxy/bridge config.
-	if cfg.Tor.UseBridges {
-		torrcBridges, err := data.Asset("torrc-bridges")
-		if err != nil {
-			return nil, err
-		}
-		bridgeArgs := []string{string(torrcBridges)}
-		if !cfg.Tor.UseCustomBridges {
-			// No seed was set. Generate one with math.Rand, since this is
-			// purely for load balancing and doesn't require high grade
-			// entropy.
-			if cfg.Tor.InternalBridgeSeed == 0 {
-				seed := mrand.Int63()
-				cfg.Tor.SetInternalBridgeSeed(seed)
-				if err = cfg.Sync(); err != nil {
-					return nil, err
-				}
-			}
-
-			// Initialize the deterministic random bit generator, using
-			// the persisted seed.
-			drbgSrc := mrand.NewSource(cfg.Tor.InternalBridgeSeed)
-			drbg := mrand.New(drbgSrc)
-
-			shuf := drbg.Perm(len(bridges[cfg.Tor.InternalBridgeType]))
-			for _, i := range shuf {
-				bridgeArgs = append(bridgeArgs, bridges[cfg.Tor.InternalBridgeType][i])
-			}
-		} else {
-			// The caller is responsible for making sure that this is indeed
-			// bridge lines, and not random other bullshit.
-			bridgeArgs = append(bridgeArgs, cfg.Tor.CustomBridges)
+	// Apply the extra stream isolation flags to the SocksPort.  Tor Browser
+	// already uses distinct SOCKS credentials per first party domain, which
+	// is handled by `IsolateSOCKSAuth` (enabled by default).
+	if cfg.Tor.StreamIsolation {
+		const isolateAuth = "KeepAliveIsolateSOCKSAuth"
+		if !bytes.Contains(torrc, []byte(isolateAuth)) {
+			return nil, fmt.Errorf("tor: torrc missing `%v`", isolateAuth)
 		}
+		torrc = bytes.Replace(torrc, []byte(isolateAuth), []byte(isolateAuth+" IsolateDestAddr IsolateDestPort"), 1)
+	}
 
+	// Apply proxy/bridge config.
+	bridgeArgs, err := torrcBridgeLines(cfg, bridges, ptMethods)
+	if err != nil {
+		return nil, err
+	}
+	if bridgeArgs != nil {
 		s := "\n" + strings.Join(bridgeArgs, "\n") + "\n"
 		torrc = append(torrc, []byte(s)...)
 	}
-
-	if cfg.Tor.UseProxy {
-		proxyArgs := []string{}
-		proxyAddr := cfg.Tor.ProxyAddress + ":" + cfg.Tor.ProxyPort
-		proxyUser := cfg.Tor.ProxyUsername
-		proxyPasswd := cfg.Tor.ProxyPassword
-
-		switch cfg.Tor.ProxyType {
-		case "SOCKS 4":
-			proxyArgs = append(proxyArgs, "Socks4Proxy "+proxyAddr)
-		case "SOCKS 5":
-			proxyArgs = append(proxyArgs, "Socks5Proxy "+proxyAddr)
-			if proxyUser != "" && proxyPasswd != "" {
-				proxyArgs = append(proxyArgs, "Socks5ProxyUsername "+proxyUser)
-				proxyArgs = append(proxyArgs, "Socks5ProxyPassword "+proxyPasswd)
-			}
-		case "HTTP(S)":
-			proxyArgs = append(proxyArgs, "HTTPSProxy "+proxyAddr)
-			if proxyUser != "" && proxyPasswd != "" {
-				proxyArgs = append(proxyArgs, "HTTPSProxyAuthenticator "+proxyUser+":"+proxyPasswd)
-			}
-		default:
-			return nil, fmt.Errorf("tor: Unsupported proxy type: %v", cfg.Tor.ProxyType)
-		}
-
+	proxyArgs, err := torrcProxyLines(cfg)
+	if err != nil {
+		return nil, err
+	}
+	if proxyArgs != nil {
 		s := "\n" + strings.Join(proxyArgs, "\n") + "\n"
 		torrc = append(torrc, []byte(s)...)
 	}
 
-	// Generate a random control port password.
-	var entropy [16]byte
-	if _, err := rand.Read(entropy[:]); err != nil {
-		return nil, fmt.Errorf("tor: Failed to generate a password: %v", err)
-	}
-	cfg.Tor.CtrlPassword = hex.EncodeToString(entropy[:])
-
-	// Convert it to the RFC2440 S2K variant that Tor understands and expects.
-	// (SHA1, with the first 2 bytes of the descriptor that specify
-	// iterated/salted, and the hash omitted).
-	b := &bytes.Buffer{}
-	key := make([]byte, 20)
-	if err := s2k.Serialize(b, key, rand.Reader, []byte(cfg.Tor.CtrlPassword), nil); err != nil {
-		return nil, fmt.Errorf("tor: Failed to hash password: %v", err)
+	// Generate a random control port password.  Only the hash ends up in
+	// the torrc, and the plaintext is only ever held in memory.
+	passwd, hashedPasswd, err := config.GenerateControlPassword()
+	if err != nil {
+		return nil, fmt.Errorf("tor: %v", err)
 	}
-	b.Write(key)
-	hashedPasswd := "16:" + hex.EncodeToString(b.Bytes()[2:])
+	cfg.Tor.CtrlPassword = passwd
 
 	torrc = append(torrc, []byte("\nHashedControlPassword ")...)
 	torrc = append(torrc, []byte(hashedPasswd)...)
 
+	// Append the user specified options last.  The options that the sandbox
+	// depends on are rejected by config.Validate().
+	if extraArgs := torrcExtraLines(cfg); extraArgs != nil {
+		s := "\n\n" + strings.Join(extraArgs, "\n")
+		torrc = append(torrc, []byte(s)...)
+	}
+
 	return torrc, nil
 }
 
-func handleBootstrapEvent(async *Async, s string) (bool, int) {
-	const bootstrapPrefix = "NOTICE BOOTSTRAP "
-	if !strings.HasPrefix(s, bootstrapPrefix) {
-		return false, 0
+// torrcBridgeLines returns the torrc lines for the bridge config, or nil if
+// bridges are not in use.
+func torrcBridgeLines(cfg *config.Config, bridges map[string][]string, ptMethods map[string]string) ([]string, error) {
+	if !cfg.Tor.UseBridges {
+		return nil, nil
 	}
 
-	split := splitQuoted(strings.TrimPrefix(s, bootstrapPrefix))
+	torrcBridges, err := data.Load("torrc-bridges")
+	if err != nil {
+		return nil, err
+	}
+	bridgeArgs := []string{string(torrcBridges)}
+	if ptMethods != nil {
+		bridgeArgs = nil
+		for _, l := range strings.Split(string(torrcBridges), "\n") {
+			if !strings.HasPrefix(l, "ClientTransportPlugin ") {
+				bridgeArgs = append(bridgeArgs, l)
+			}
+		}
+		var transports []string
+		for k := range ptMethods {
+			transports = append(transports, k)
+		}
+		sort.Strings(transports)
+		for _, k := range transports {
+			bridgeArgs = append(bridgeArgs, "ClientTransportPlugin "+k+" socks5 "+ptMethods[k])
+		}
+	}
+	if !cfg.Tor.UseCustomBridges {
+		// No seed was set. Generate one with math.Rand, since this is
+		// purely for load balancing and doesn't require high grade
+		// entropy.
+		if cfg.Tor.InternalBridgeSeed == 0 {
+			seed := mrand.Int63()
+			cfg.Tor.SetInternalBridgeSeed(seed)
+			if err = cfg.Sync(); err != nil {
+				return nil, err
+			}
+		}
 
-	var progress, summary string
-	for _, v := range split {
-		const (
-			progressPrefix = "PROGRESS="
-			summaryPrefix  = "SUMMARY="
-		)
+		// Initialize the deterministic random bit generator, using
+		// the persisted seed.
+		drbgSrc := mrand.NewSource(cfg.Tor.InternalBridgeSeed)
+		drbg := mrand.New(drbgSrc)
 
-		if strings.HasPrefix(v, progressPrefix) {
-			progress = strings.TrimPrefix(v, progressPrefix)
-		} else if strings.HasPrefix(v, summaryPrefix) {
-			summary = strings.TrimPrefix(v, summaryPrefix)
-			summary = strings.Trim(summary, "\"")
+		shuf := drbg.Perm(len(bridges[cfg.Tor.InternalBridgeType]))
+		for _, i := range shuf {
+			bridgeArgs = append(bridgeArgs, bridges[cfg.Tor.InternalBridgeType][i])
 		}
+	} else {
+		// The bridge lines are validated by config.ValidateBridgeLines()
+		// when they are set, and when the config is loaded.
+		bridgeArgs = append(bridgeArgs, cfg.Tor.CustomBridges)
 	}
-	progressPct, err := strconv.Atoi(progress)
-	if err != nil {
-		progressPct = 0
-	}
+	return bridgeArgs, nil
+}
 
-	if progress != "" && summary != "" {
-		async.UpdateProgress(fmt.Sprintf("Bootstrap: %s", summary))
-		if progress == "100" {
-			return true, progressPct
+// torrcProxyLines returns the torrc lines for the proxy config, or nil if a
+// proxy is not in use.
+func torrcProxyLines(cfg *config.Config) ([]string, error) {
+	if !cfg.Tor.UseProxy {
+		return nil, nil
+	}
+
+	proxyArgs := []string{}
+	proxyAddr := cfg.Tor.ProxyAddress + ":" + cfg.Tor.ProxyPort
+	proxyUser := cfg.Tor.ProxyUsername
+	proxyPasswd := cfg.Tor.ProxyPassword
+
+	switch cfg.Tor.ProxyType {
+	case "SOCKS 4":
+		proxyArgs = append(proxyArgs, "Socks4Proxy "+proxyAddr)
+	case "SOCKS 5":
+		proxyArgs = append(proxyArgs, "Socks5Proxy "+proxyAddr)
+		if proxyUser != "" && proxyPasswd != "" {
+			proxyArgs = append(proxyArgs, "Socks5ProxyUsername "+proxyUser)
+			proxyArgs = append(proxyArgs, "Socks5ProxyPassword "+proxyPasswd)
 		}
+	case "HTTP(S)":
+		proxyArgs = append(proxyArgs, "HTTPSProxy "+proxyAddr)
+		if proxyUser != "" && proxyPasswd != "" {
+			proxyArgs = append(proxyArgs, "HTTPSProxyAuthenticator "+proxyUser+":"+proxyPasswd)
+		}
+	default:
+		return nil, fmt.Errorf("tor: Unsupported proxy type: %v", cfg.Tor.ProxyType)
+	}
+	return proxyArgs, nil
+}
+
+// torrcExtraLines returns the torrc lines for the user specified extra
+// options in a consistent order, or nil if there are none.
+func torrcExtraLines(cfg *config.Config) []string {
+	var keys, lines []string
+	for k := range cfg.Tor.ExtraOptions {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		lines = append(lines, k+" "+cfg.Tor.ExtraOptions[k])
+	}
+	return lines
+}
+
+func handleBootstrapEvent(async *Async, st *BootstrapStatus) (bool, int) {
+	if st == nil {
+		return false, 0
+	}
+	if async.BootstrapProgress != nil {
+		async.BootstrapProgress(st.Progress)
+	}
+	if st.Summary != "" {
+		async.UpdateProgress(fmt.Sprintf("Bootstrap: %s", st.Summary))
+		return st.Done(), st.Progress
 	}
-	return false, progressPct
+	return false, st.Progress
 }
 
 // Random quoted split function stolen and modified from the intertubes.
@@ -0,0 +1,178 @@
+// tor_test.go - Tor daemon interface tests.
+// Copyright (C) 2016  Yawning Angel.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package tor
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"cmd/sandboxed-tor-browser/internal/ui/config"
+)
+
+// fakeControlPort is a minimal tor control port that speaks just enough of
+// the protocol for NULL, COOKIE or SAFECOOKIE authentication and `GETINFO version`.
+type fakeControlPort struct {
+	l           net.Listener
+	authOk      bool
+	versionLine string
+
+	// cookie and cookieFile if set, switch to SAFECOOKIE authentication.
+	cookie     []byte
+	cookieFile string
+}
+
+func (f *fakeControlPort) serve() {
+	for {
+		conn, err := f.l.Accept()
+		if err != nil {
+			return
+		}
+		go f.handle(conn)
+	}
+}
+
+func (f *fakeControlPort) handle(conn net.Conn) {
+	defer conn.Close()
+
+	var clientHash []byte
+	r := bufio.NewReader(conn)
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		var resp string
+		switch cmd := strings.TrimSpace(line); {
+		case strings.HasPrefix(cmd, "PROTOCOLINFO"):
+			authLine := "AUTH METHODS=NULL"
+			if f.cookie != nil {
+				authLine = fmt.Sprintf("AUTH METHODS=COOKIE,SAFECOOKIE COOKIEFILE=%q", f.cookieFile)
+			}
+			resp = "250-PROTOCOLINFO 1\r\n250-" + authLine + "\r\n250-VERSION Tor=\"0.4.8.9\"\r\n250 OK\r\n"
+		case strings.HasPrefix(cmd, "AUTHCHALLENGE SAFECOOKIE "):
+			clientNonce, err := hex.DecodeString(strings.TrimPrefix(cmd, "AUTHCHALLENGE SAFECOOKIE "))
+			if err != nil || f.cookie == nil {
+				resp = "513 Invalid AUTHCHALLENGE\r\n"
+				break
+			}
+			serverNonce := make([]byte, 32)
+			rand.Read(serverNonce)
+			mac := func(key string) []byte {
+				m := hmac.New(sha256.New, []byte(key))
+				m.Write(f.cookie)
+				m.Write(clientNonce)
+				m.Write(serverNonce)
+				return m.Sum(nil)
+			}
+			clientHash = mac("Tor safe cookie authentication controller-to-server hash")
+			resp = fmt.Sprintf("250 AUTHCHALLENGE SERVERHASH=%X SERVERNONCE=%X\r\n", mac("Tor safe cookie authentication server-to-controller hash"), serverNonce)
+		case strings.HasPrefix(cmd, "AUTHENTICATE"):
+			authOk := f.authOk
+			if f.cookie != nil {
+				// Without an AUTHCHALLENGE, this is COOKIE authentication.
+				expected := f.cookie
+				if clientHash != nil {
+					expected = clientHash
+				}
+				b, err := hex.DecodeString(strings.TrimSpace(strings.TrimPrefix(cmd, "AUTHENTICATE")))
+				authOk = err == nil && hmac.Equal(b, expected)
+			}
+			if !authOk {
+				conn.Write([]byte("515 Authentication failed\r\n"))
+				return
+			}
+			resp = "250 OK\r\n"
+		case cmd == "GETINFO version":
+			resp = "250-" + f.versionLine + "\r\n250 OK\r\n"
+		case cmd == "QUIT":
+			conn.Write([]byte("250 closing connection\r\n"))
+			return
+		default:
+			resp = "510 Unrecognized command\r\n"
+		}
+		if _, err := conn.Write([]byte(resp)); err != nil {
+			return
+		}
+	}
+}
+
+func newFakeControlPort(t *testing.T, authOk bool, versionLine string) (*fakeControlPort, *config.Config) {
+	path := filepath.Join(t.TempDir(), "control")
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	f := &fakeControlPort{l: l, authOk: authOk, versionLine: versionLine}
+	go f.serve()
+
+	cfg := &config.Config{
+		SystemTorControlNet:        "unix",
+		SystemTorControlAddr:       path,
+		SystemTorControlAuthMethod: config.ControlAuthNull,
+	}
+	return f, cfg
+}
+
+func TestCheckControlPort(t *testing.T) {
+	_, cfg := newFakeControlPort(t, true, "version=0.4.8.9")
+	if err := CheckControlPort(cfg); err != nil {
+		t.Fatalf("CheckControlPort() = %v", err)
+	}
+}
+
+func TestCheckControlPortFailures(t *testing.T) {
+	t.Run("unreachable", func(t *testing.T) {
+		cfg := &config.Config{
+			SystemTorControlNet:  "unix",
+			SystemTorControlAddr: filepath.Join(t.TempDir(), "nonexistent"),
+		}
+		if err := CheckControlPort(cfg); err == nil || !strings.Contains(err.Error(), "failed to connect") {
+			t.Fatalf("CheckControlPort() = %v, expected a connect failure", err)
+		}
+	})
+
+	t.Run("auth", func(t *testing.T) {
+		_, cfg := newFakeControlPort(t, false, "version=0.4.8.9")
+		if err := CheckControlPort(cfg); err == nil || !strings.Contains(err.Error(), "failed to authenticate") {
+			t.Fatalf("CheckControlPort() = %v, expected an authentication failure", err)
+		}
+	})
+
+	t.Run("response", func(t *testing.T) {
+		_, cfg := newFakeControlPort(t, true, "bogus=1")
+		if err := CheckControlPort(cfg); err == nil || !strings.Contains(err.Error(), "unexpected response") {
+			t.Fatalf("CheckControlPort() = %v, expected an unexpected response failure", err)
+		}
+	})
+}
+
+func TestTorCheckControlPortNotRunning(t *testing.T) {
+	tor := &Tor{}
+	if err := tor.CheckControlPort(); err == nil {
+		t.Fatalf("CheckControlPort() succeeded without a control connection")
+	}
+}
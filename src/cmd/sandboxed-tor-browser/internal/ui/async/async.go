@@ -22,10 +22,15 @@ import (
 	"bytes"
 	"errors"
 	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
 	"runtime"
 	"time"
 
 	"git.schwanenlied.me/yawning/grab.git"
+
+	. "cmd/sandboxed-tor-browser/internal/utils"
 )
 
 // ErrCanceled is the error set when an async operation was canceled.
@@ -49,6 +54,22 @@ type Async struct {
 	// UpdateProgress is the function called to give progress feedback to
 	// the UI.
 	UpdateProgress func(string)
+
+	// TransferProgress if non-nil is called periodically during downloads
+	// with the number of bytes transferred, and the expected total (0 if
+	// unknown).
+	TransferProgress func(done, total uint64)
+
+	// BootstrapProgress if non-nil is called with the tor bootstrap
+	// percentage on each bootstrap status event.
+	BootstrapProgress func(int)
+
+	// Deadline if non-zero is the maximum duration of each transfer.
+	Deadline time.Duration
+
+	// StallTimeout if non-zero is the maximum duration that a transfer may
+	// go without making forward progress.
+	StallTimeout time.Duration
 }
 
 // Grab asynchronously downloads the provided URL using the provided grab
@@ -59,39 +80,120 @@ func (async *Async) Grab(client *grab.Client, url string, hzFn func(string)) []b
 		return nil
 	} else {
 		req.Buffer = &bytes.Buffer{}
-		var resp *grab.Response
+		if async.doGrab(client, req, hzFn) == nil {
+			return nil
+		}
+		return req.Buffer.Bytes()
+	}
+}
+
+// GrabFile asynchronously downloads the provided URL using the provided grab
+// client to the file at path, periodically invoking the hzFn on forward
+// progress, and returns the contents of the file.  If the file exists from
+// a previous incomplete download, the transfer is resumed with a HTTP Range
+// request if the server supports it.  It is up to the caller to remove the
+// file once it is no longer needed.
+func (async *Async) GrabFile(client *grab.Client, url, path string, hzFn func(string)) []byte {
+	for {
+		req, err := grab.NewRequest(url)
+		if err != nil {
+			async.Err = err
+			return nil
+		}
+		req.Filename = path
+		_, err = os.Stat(path)
+		hadPartial := err == nil
+
+		resp := async.doGrab(client, req, hzFn)
+		if async.Err == ErrCanceled {
+			return nil
+		}
+
+		// If the server didn't honor the range request, or the partial file
+		// doesn't match the remote file, restart from scratch.
+		restart := false
+		if resp == nil {
+			restart = grab.IsContentLengthMismatch(async.Err)
+		} else if resp.DidResume && resp.HTTPResponse.Request.Method != "HEAD" {
+			restart = resp.HTTPResponse.StatusCode != http.StatusPartialContent
+		}
+		if restart && hadPartial {
+			Warnf("async: Failed to resume download, restarting: %v", url)
+			os.Remove(path)
+			async.Err = nil
+			continue
+		}
+		if resp == nil {
+			return nil
+		}
+
+		var b []byte
+		if b, async.Err = ioutil.ReadFile(path); async.Err != nil {
+			return nil
+		}
+		return b
+	}
+}
+
+func (async *Async) doGrab(client *grab.Client, req *grab.Request, hzFn func(string)) *grab.Response {
+	var resp *grab.Response
 
-		ch := client.DoAsync(req)
+	var deadlineCh <-chan time.Time
+	if async.Deadline > 0 {
+		deadline := time.NewTimer(async.Deadline)
+		defer deadline.Stop()
+		deadlineCh = deadline.C
+	}
+
+	ch := client.DoAsync(req)
+	select {
+	case resp = <-ch:
+	case <-async.Cancel:
+		client.CancelRequest(req)
+		async.Err = ErrCanceled
+		return nil
+	case <-deadlineCh:
+		client.CancelRequest(req)
+		async.Err = fmt.Errorf("async: timed out after %v: %v", async.Deadline, req.HTTPRequest.URL)
+		return nil
+	}
+
+	// Wait for the transfer to complete.
+	t := time.NewTicker(1000 * time.Millisecond)
+	defer t.Stop()
+	lastBytes, lastProgress := uint64(0), time.Now()
+	for {
 		select {
-		case resp = <-ch:
 		case <-async.Cancel:
 			client.CancelRequest(req)
 			async.Err = ErrCanceled
 			return nil
-		}
-
-		// Wait for the transfer to complete.
-		t := time.NewTicker(1000 * time.Millisecond)
-		defer t.Stop()
-		for {
-			select {
-			case <-async.Cancel:
+		case <-deadlineCh:
+			client.CancelRequest(req)
+			async.Err = fmt.Errorf("async: timed out after %v: %v", async.Deadline, req.HTTPRequest.URL)
+			return nil
+		case now := <-t.C:
+			if n := resp.BytesTransferred(); n != lastBytes {
+				lastBytes, lastProgress = n, now
+			} else if async.StallTimeout > 0 && now.Sub(lastProgress) > async.StallTimeout && !resp.IsComplete() {
 				client.CancelRequest(req)
-				async.Err = ErrCanceled
+				async.Err = fmt.Errorf("async: stalled for %v: %v", async.StallTimeout, req.HTTPRequest.URL)
 				return nil
-			case <-t.C:
-				if resp.IsComplete() {
-					if resp.Error != nil {
-						async.Err = resp.Error
-						return nil
-					}
-					return req.Buffer.Bytes()
-				} else if hzFn != nil {
-					remaining := resp.ETA().Sub(time.Now()).Seconds()
-					hzFn(fmt.Sprintf("%vs remaining", int(remaining)))
+			}
+			if async.TransferProgress != nil {
+				async.TransferProgress(resp.BytesTransferred(), resp.Size)
+			}
+			if resp.IsComplete() {
+				if resp.Error != nil {
+					async.Err = resp.Error
+					return nil
 				}
-				runtime.Gosched()
+				return resp
+			} else if hzFn != nil {
+				remaining := resp.ETA().Sub(time.Now()).Seconds()
+				hzFn(fmt.Sprintf("%vs remaining", int(remaining)))
 			}
+			runtime.Gosched()
 		}
 	}
 }
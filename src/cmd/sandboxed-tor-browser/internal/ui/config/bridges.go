@@ -0,0 +1,124 @@
+// bridges.go - Bridge line validation.
+// Copyright (C) 2017  Yawning Angel.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package config
+
+import (
+	"encoding/hex"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"cmd/sandboxed-tor-browser/internal/data"
+)
+
+// TorTransports is the list of pluggable transports that the sandboxed tor
+// instance has a `ClientTransportPlugin` for.
+var TorTransports []string
+
+func isSupportedTransport(transport string) bool {
+	for _, v := range TorTransports {
+		if v == transport {
+			return true
+		}
+	}
+	return false
+}
+
+// ValidateBridgeLines validates and sanitizes bridge lines.  Each line must be
+// of the form `[Bridge] [transport] IP:Port [Fingerprint] [k=v ...]`, and the
+// transport if any must be one that the sandboxed tor instance can use.
+func ValidateBridgeLines(ls string) (string, error) {
+	var ret []string
+
+	for _, l := range strings.Split(ls, "\n") {
+		sp := strings.Fields(l)
+		if len(sp) > 0 && strings.ToLower(sp[0]) == "bridge" {
+			sp = sp[1:]
+		}
+		if len(sp) == 0 {
+			continue
+		}
+		l = strings.Join(sp, " ")
+
+		// XXX: This obliterates the user's changes if there's an error,
+		// which is probably likely somewhat obnoxious.
+
+		// The optional transport.
+		hasTransport := false
+		if _, _, err := net.SplitHostPort(sp[0]); err != nil {
+			if net.ParseIP(sp[0]) != nil {
+				return "", fmt.Errorf("invalid Bridge: '%v', missing port", l)
+			}
+			if !isSupportedTransport(sp[0]) {
+				return "", fmt.Errorf("invalid Bridge: '%v', unknown transport: %v", l, sp[0])
+			}
+			if len(sp) < 2 {
+				return "", fmt.Errorf("invalid Bridge: '%v', missing IP", l)
+			}
+			hasTransport = true
+			sp = sp[1:]
+		}
+
+		// The IP:Port.
+		if ip, port, err := net.SplitHostPort(sp[0]); err != nil {
+			return "", fmt.Errorf("invalid Bridge: '%v', bad IP/port", l)
+		} else if net.ParseIP(ip) == nil {
+			return "", fmt.Errorf("invalid Bridge IP/port: %v", sp[0])
+		} else if p, err := strconv.ParseUint(port, 10, 16); err != nil || p == 0 {
+			return "", fmt.Errorf("invalid Bridge IP/port: %v", sp[0])
+		}
+		sp = sp[1:]
+
+		// The optional fingerprint.
+		if len(sp) > 0 && !strings.Contains(sp[0], "=") {
+			if b, err := hex.DecodeString(sp[0]); err != nil || len(b) != 20 {
+				return "", fmt.Errorf("invalid Bridge: '%v', bad fingerprint: %v", l, sp[0])
+			}
+			sp = sp[1:]
+		}
+
+		// The transport arguments.
+		for _, arg := range sp {
+			if !hasTransport {
+				return "", fmt.Errorf("invalid Bridge: '%v', arguments without a transport", l)
+			}
+			if !strings.Contains(arg, "=") {
+				return "", fmt.Errorf("invalid Bridge: '%v', bad argument: %v", l, arg)
+			}
+		}
+
+		// BridgeDB entries lack the "Bridge".
+		ret = append(ret, "Bridge "+l)
+	}
+
+	return strings.Join(ret, "\n"), nil
+}
+
+func init() {
+	d, err := data.Load("torrc-bridges")
+	if err != nil {
+		panic(err)
+	}
+	for _, l := range strings.Split(string(d), "\n") {
+		sp := strings.Fields(l)
+		if len(sp) < 2 || sp[0] != "ClientTransportPlugin" {
+			continue
+		}
+		TorTransports = append(TorTransports, strings.Split(sp[1], ",")...)
+	}
+}
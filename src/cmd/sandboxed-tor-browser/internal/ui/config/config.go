@@ -22,14 +22,19 @@ import (
 	"fmt"
 	"io/ioutil"
 	gonet "net"
+	"net/url"
 	"os"
 	"path/filepath"
+	"regexp"
 	"runtime"
+	"strings"
+	"syscall"
 	"time"
 
 	butils "git.schwanenlied.me/yawning/bulb.git/utils"
 	xdg "github.com/cep21/xdgbasedir"
 
+	"cmd/sandboxed-tor-browser/internal/data"
 	"cmd/sandboxed-tor-browser/internal/utils"
 )
 
@@ -37,16 +42,53 @@ const (
 	configFile   = "sandboxed-tor-browser.json"
 	manifestFile = "manifest.json"
 
-	defaultChannel = "release"
-	defaultLocale  = "en-US"
-	archLinux32    = "linux32"
-	archLinux64    = "linux64"
+	defaultChannel   = "release"
+	defaultLocale    = "en-US"
+	nightlyChannel   = "nightly"
+	nightlyLocale    = "ALL"
+	defaultSocksPort = "tcp://127.0.0.1:9150"
+	archLinux32      = "linux32"
+	archLinux64      = "linux64"
+	archLinuxAArch64 = "linux-aarch64"
+
+	defaultUpdateInterval  = 2 * time.Hour // TBB behavior.
+	defaultDownloadTimeout = 1 * time.Hour
 
 	appDir           = "sandboxed-tor-browser"
 	bundleInstallDir = "tor-browser"
 	torDataDir       = "tor"
+	profileDir       = "profile"
+	namedProfilesDir = "profiles"
+)
+
+// profileNameRe is the valid instance profile names (See NewWithProfile).
+var profileNameRe = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]{0,63}$`)
+
+// Channels is the list of Tor Browser channels that are recognized.  The
+// `hardened` channel is discontinued, and is only accepted so that existing
+// installs can be migrated.
+var Channels = []string{"release", "alpha", "hardened", nightlyChannel}
+
+// The system tor control port authentication methods.
+const (
+	ControlAuthAuto       = "auto"
+	ControlAuthNull       = "null"
+	ControlAuthPassword   = "password"
+	ControlAuthCookie     = "cookie"
+	ControlAuthSafeCookie = "safecookie"
 )
 
+// ControlAuthMethods is the list of system tor control port authentication
+// methods that may be configured.
+var ControlAuthMethods = []string{ControlAuthAuto, ControlAuthNull, ControlAuthPassword, ControlAuthCookie, ControlAuthSafeCookie}
+
+// localeRe matches well formed locale names (Eg: "en-US", "de", "zh-CN").
+var localeRe = regexp.MustCompile(`^[a-zA-Z]{2,3}(-[a-zA-Z0-9]+)*$`)
+
+// pinnedVersionRe matches the bundle versions that may be pinned (Eg: "7.0.6",
+// "7.5a5").
+var pinnedVersionRe = regexp.MustCompile(`^[0-9]+\.[0-9]+(\.[0-9]+|a[0-9]+)?(-hardened)?$`)
+
 // TorProxyTypes are the proxy protocols supported by tor.
 var TorProxyTypes = []string{"SOCKS 4", "SOCKS 5", "HTTP(S)"}
 
@@ -91,6 +133,73 @@ type Tor struct {
 
 	// CustomBridges is the user provided bridge lines.
 	CustomBridges string `json:"customBridges"`
+
+	// StreamIsolation enables isolating streams by destination address and
+	// port, in addition to the per-domain isolation done by Tor Browser.
+	// This only applies to the sandboxed tor instance, and is ignored when
+	// using a system tor daemon.
+	StreamIsolation bool `json:"streamIsolation"`
+
+	// SocksPort is the host side SOCKS port passthrough listener to the
+	// sandboxed tor instance ("tcp://127.0.0.1:9150", "unix:///path", "9150").
+	SocksPort string `json:"socksPort,omitempty"`
+
+	// ExtraOptions are additional torrc options for the sandboxed tor
+	// instance (Eg: "ExitNodes"), that are appended after the ones that the
+	// launcher generates.  The options that the sandbox depends on may not
+	// be set, and this is ignored when using a system tor daemon.
+	ExtraOptions map[string]string `json:"extraOptions,omitempty"`
+}
+
+// reservedTorOptions are the torrc options that are managed by the launcher,
+// and may not be set via `ExtraOptions`.
+var reservedTorOptions = []string{
+	"ClientTransportPlugin",
+	"ControlPort",
+	"ControlPortWriteToFile",
+	"ControlSocket",
+	"CookieAuthentication",
+	"DataDirectory",
+	"DisableNetwork",
+	"GeoIPFile",
+	"GeoIPv6File",
+	"HashedControlPassword",
+	"RunAsDaemon",
+	"SocksPort",
+}
+
+var torOptionRe = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9]*$`)
+
+func validateTorOptions(opts map[string]string) error {
+	for k, v := range opts {
+		if !torOptionRe.MatchString(k) {
+			return fmt.Errorf("invalid option: %q", k)
+		}
+		if strings.ContainsAny(v, "\r\n\x00") {
+			return fmt.Errorf("invalid value for '%v'", k)
+		}
+		for _, r := range reservedTorOptions {
+			if strings.EqualFold(k, r) {
+				return fmt.Errorf("'%v' is reserved", k)
+			}
+		}
+	}
+	return nil
+}
+
+// SetStreamIsolation sets if streams should be isolated by destination and
+// marks the config dirty.
+func (t *Tor) SetStreamIsolation(b bool) {
+	if t.StreamIsolation != b {
+		t.StreamIsolation = b
+		t.cfg.isDirty = true
+	}
+}
+
+// SocksPortAddr returns the network and address of the host side SOCKS port
+// passthrough listener.
+func (t *Tor) SocksPortAddr() (net, addr string, err error) {
+	return parsePortString(t.SocksPort)
 }
 
 // SetUseProxy sets if the Tor network should be reached via a local proxy and
@@ -214,6 +323,15 @@ type Sandbox struct {
 	// EnableAmnesiacProfileDirectory enables amnesiac profile directories.
 	EnableAmnesiacProfileDirectory bool `json:"enableAmnesiacProfileDirectory"`
 
+	// AllowNoSeccomp allows launching without the seccomp filters if the
+	// kernel does not support them, instead of failing.
+	AllowNoSeccomp bool `json:"allowNoSeccomp,omitempty"`
+
+	// AllowHostResolvConf allows launching even if the host's `resolv.conf`
+	// would be bind mounted into the browser sandbox, instead of failing.
+	// This should never be needed.
+	AllowHostResolvConf bool `json:"allowHostResolvConf,omitempty"`
+
 	// DesktopDir is the directory to be bind mounted instead of the default
 	// bundle Desktop directory.
 	DesktopDir string `json:"desktopDir,omitEmpty"`
@@ -221,6 +339,96 @@ type Sandbox struct {
 	// DownloadsDir is the directory to be bind mounted instead of the default
 	// bundle Downloads directory.
 	DownloadsDir string `json:"downloadsDir,omitEmpty"`
+
+	// ExtraBindMounts are additional host paths to be bind mounted into the
+	// browser sandbox.
+	ExtraBindMounts []BindMount `json:"extraBindMounts,omitempty"`
+
+	// ExtraEnv is additional environment variables to set in the browser
+	// sandbox.  The variables that the sandbox itself depends on may not be
+	// overridden.
+	ExtraEnv map[string]string `json:"extraEnv,omitempty"`
+
+	// ExtraLibs are the sonames of additional host libraries to be made
+	// available in the browser sandbox, for things that firefox dlopen()s
+	// (Eg: PKCS#11 modules).  Libraries that are not present on the host
+	// are skipped.
+	ExtraLibs []string `json:"extraLibs,omitempty"`
+}
+
+// BindMount is a host path that is bind mounted into the sandbox.
+type BindMount struct {
+	// Source is the absolute path of the file or directory on the host.
+	Source string `json:"source"`
+
+	// Dest is the absolute path that Source is mounted at in the sandbox.
+	Dest string `json:"dest"`
+
+	// ReadOnly mounts Source read-only.
+	ReadOnly bool `json:"readOnly,omitempty"`
+}
+
+// reservedSandboxDirs are the directories in the sandbox that extra bind
+// mounts may not overlap, as the sandbox itself depends on their contents.
+var reservedSandboxDirs = []string{
+	"/dev",
+	"/etc",
+	"/home/amnesia/sandboxed-tor-browser", // The bundle.
+	"/lib",
+	"/lib64",
+	"/proc",
+	"/run",
+	"/sys",
+	"/usr",
+}
+
+// reservedEnvVars are the environment variables that are managed by the
+// launcher, and may not be set via `ExtraEnv`, in addition to the `LD_` and
+// `TOR_` prefixed ones.
+var reservedEnvVars = []string{
+	"DISPLAY",
+	"HOME",
+	"XAUTHORITY",
+	"XDG_RUNTIME_DIR",
+}
+
+func validateExtraEnv(env map[string]string) error {
+	for k, v := range env {
+		if k == "" || strings.ContainsAny(k, "=\x00") || strings.ContainsRune(v, 0) {
+			return fmt.Errorf("invalid variable: %q", k)
+		}
+		if strings.HasPrefix(k, "TOR_") || strings.HasPrefix(k, "LD_") {
+			return fmt.Errorf("'%v' is reserved", k)
+		}
+		for _, r := range reservedEnvVars {
+			if k == r {
+				return fmt.Errorf("'%v' is reserved", k)
+			}
+		}
+	}
+	return nil
+}
+
+func (m *BindMount) validate() error {
+	if !filepath.IsAbs(m.Source) {
+		return fmt.Errorf("source is not absolute: %v", m.Source)
+	}
+	if !utils.FileExists(m.Source) {
+		return fmt.Errorf("source does not exist: %v", m.Source)
+	}
+	if !filepath.IsAbs(m.Dest) {
+		return fmt.Errorf("destination is not absolute: %v", m.Dest)
+	}
+	dest := filepath.Clean(m.Dest)
+	if dest == "/" {
+		return fmt.Errorf("destination is the root directory")
+	}
+	for _, d := range reservedSandboxDirs {
+		if dest == d || strings.HasPrefix(dest, d+"/") || strings.HasPrefix(d, dest+"/") {
+			return fmt.Errorf("destination '%v' overlaps '%v', which is reserved", m.Dest, d)
+		}
+	}
+	return nil
 }
 
 // SetDisplay sets the sandbox `DISPLAY` override and marks the config dirty.
@@ -291,16 +499,52 @@ type Config struct {
 	// "linux64").
 	Architecture string `json:"-"`
 
-	// Channel is the Tor Browser channel to install ("release", "alpha")
+	// Channel is the Tor Browser channel to install ("release", "alpha",
+	// "nightly").
 	Channel string `json:"channel,omitempty"`
 
 	// Locale is the Tor Browser locale to install ("en-US", "ja").
 	Locale string `json:"locale,omitempty"`
 
+	// Mirrors is the list of base URLs of Tor Browser download mirrors to
+	// try in order when installing.  If empty, the canonical download server
+	// is used.
+	Mirrors []string `json:"mirrors,omitempty"`
+
+	// PinnedVersion is the Tor Browser version to install for the configured
+	// architecture and channel.  If set, the bundle is kept at exactly this
+	// version, and newer versions are only reported.
+	PinnedVersion string `json:"pinnedVersion,omitempty"`
+
+	// DisableUpdate disables all update checks and updates, for when the
+	// bundle is kept up to date by other means (Eg: the system package
+	// manager).  The bundle is still installed if it is missing.
+	DisableUpdate bool `json:"disableUpdate,omitempty"`
+
+	// DownloadProxy is the URL of the HTTP(S) proxy used to download the
+	// bundle when Tor is not available yet (Eg: the initial install).  If
+	// unset, the `HTTPS_PROXY`/`HTTP_PROXY` environment variables are used.
+	DownloadProxy string `json:"downloadProxy,omitempty"`
+
 	// LastUpdateCheck is the UNIX time when the last update check was
 	// sucessfully completed.
 	LastUpdateCheck int64 `json:"lastUpdateCheck,omitEmpty"`
 
+	// UpdateCheckInterval is the interval between background update checks
+	// while the browser is running (Eg: "24h"), or "0" to disable them.  If
+	// unset, the Tor Browser default of 2 hours is used.
+	UpdateCheckInterval string `json:"updateCheckInterval,omitempty"`
+
+	// DownloadTimeout is the deadline for each individual download (Eg:
+	// "30m"), after which it is aborted, and the next mirror is tried.  If
+	// unset, 1 hour is used.  "0" disables the deadline, though downloads
+	// that stall completely are still aborted.
+	DownloadTimeout string `json:"downloadTimeout,omitempty"`
+
+	// LogLevel is the minimum level of the log messages that are logged
+	// ("debug", "info", "warn", or "error").  If unset, "info" is used.
+	LogLevel string `json:"logLevel,omitempty"`
+
 	// ForceUpdate is set if the installed bundle is known to be obsolete.
 	ForceUpdate bool `json:"forceUpdate"`
 
@@ -329,9 +573,34 @@ type Config struct {
 	// SystemTorControlAddr is the system tor daemon control port address.
 	SystemTorControlAddr string `json:"-"`
 
+	// SystemTorControlPassword is the system tor daemon control port
+	// password, if any.
+	SystemTorControlPassword string `json:"-"`
+
+	// SystemTorControlPasswordFile if set, is the path to a file containing
+	// the system tor daemon control port password.  The `TOR_CONTROL_PASSWD`
+	// enviornment variable takes precedence.
+	SystemTorControlPasswordFile string `json:"systemTorControlPasswordFile,omitempty"`
+
+	// SystemTorControlAuthMethod is the system tor daemon control port
+	// authentication method to use ("auto", "null", "password", "cookie",
+	// "safecookie").  Unless it is "auto" (the default, which picks the best
+	// method offered), connecting fails if the method is not offered.
+	SystemTorControlAuthMethod string `json:"systemTorControlAuthMethod,omitempty"`
+
+	// RuntimeDirOverride if set, is used as the RuntimeDir.
+	RuntimeDirOverride string `json:"runtimeDir,omitempty"`
+
+	// DataDirOverride if set, is used as the UserDataDir.
+	DataDirOverride string `json:"dataDir,omitempty"`
+
 	// RumtineDir is `$XDG_RUNTIME_DIR/appDir`.
 	RuntimeDir string `json:"-"`
 
+	// RuntimeDirIsFallback indicates that `XDG_RUNTIME_DIR` was not set, and
+	// RuntimeDir is a private directory under the system temporary directory.
+	RuntimeDirIsFallback bool `json:"-"`
+
 	// UserDataDir is `$XDG_USER_DATA_DIR/appDir`.
 	UserDataDir string `json:"-"`
 
@@ -341,16 +610,29 @@ type Config struct {
 	// TorDataDir is `UserDataDir/torDataDir`.
 	TorDataDir string `json:"-"`
 
+	// ProfileDir is `UserDataDir/profileDir`, the browser profile that is
+	// kept outside of the bundle so that it survives reinstalls.
+	ProfileDir string `json:"-"`
+
 	// ConfigDir is `XDG_CONFIG_HOME/appDir`.
 	ConfigDir string `json:"-"`
 
+	// ProfileName is the name of the instance profile, or "" for the
+	// default instance (See NewWithProfile).
+	ProfileName string `json:"-"`
+
 	// ConfigVersionChanged indicates that the config file was from an old
 	// version.
 	ConfigVersionChanged bool `json:"-"`
 
-	isDirty      bool
-	path         string
-	manifestPath string
+	isDirty          bool
+	explicitLocale   bool
+	envOverrides     []appliedEnvOverride
+	path             string
+	manifestPath     string
+	downloadProxyURL *url.URL
+	updateInterval   time.Duration
+	downloadTimeout  time.Duration
 }
 
 // SetLocale sets the configured locale, and marks the config dirty.
@@ -369,6 +651,34 @@ func (cfg *Config) SetChannel(c string) {
 	}
 }
 
+// SetPinnedVersion sets the pinned bundle version, and marks the config
+// dirty.
+func (cfg *Config) SetPinnedVersion(v string) {
+	if v != cfg.PinnedVersion {
+		cfg.isDirty = true
+		cfg.PinnedVersion = v
+	}
+}
+
+// DownloadProxyURL returns the URL of the HTTP(S) proxy to use for downloads
+// that are not done over Tor, or nil if a proxy should not be used.
+func (cfg *Config) DownloadProxyURL() *url.URL {
+	return cfg.downloadProxyURL
+}
+
+// IsPastPinnedVersion returns true if a bundle version is pinned, and the
+// specified version is newer than the pinned version.
+func (cfg *Config) IsPastPinnedVersion(vStr string) bool {
+	if cfg.PinnedVersion == "" {
+		return false
+	}
+	cmp, err := bundleVersionCompare(vStr, cfg.PinnedVersion)
+	if err != nil {
+		return true
+	}
+	return cmp > 0
+}
+
 // SetFirstLaunch sets the first launch flag and marks the config dirty.
 func (cfg *Config) SetFirstLaunch(b bool) {
 	if cfg.FirstLaunch != b {
@@ -377,12 +687,31 @@ func (cfg *Config) SetFirstLaunch(b bool) {
 	}
 }
 
+// DownloadDeadline returns the deadline for each individual download, or 0
+// if there is none.
+func (cfg *Config) DownloadDeadline() time.Duration {
+	return cfg.downloadTimeout
+}
+
+// UpdateInterval returns the interval between background update checks, or 0
+// if background update checks are disabled.
+func (cfg *Config) UpdateInterval() time.Duration {
+	if cfg.DisableUpdate {
+		return 0
+	}
+	return cfg.updateInterval
+}
+
 // NeedsUpdateCheck returns true if the bundle needs to be checked for updates,
-// and possibly updated.
+// and possibly updated.  Update checks are never needed if the update check
+// interval is 0.
 func (cfg *Config) NeedsUpdateCheck() bool {
-	const updateInterval = 60 * 60 * 2 // 2 hours, TBB behavior.
-	now := time.Now().Unix()
-	return (now > cfg.LastUpdateCheck+updateInterval) || cfg.LastUpdateCheck > now
+	interval := cfg.UpdateInterval()
+	if interval == 0 {
+		return false
+	}
+	now, last := time.Now(), time.Unix(cfg.LastUpdateCheck, 0)
+	return now.Sub(last) > interval || last.After(now)
 }
 
 // SetLastUpdateCheck sets the last update check time and marks the config
@@ -426,7 +755,7 @@ func (cfg *Config) Sanitize() {
 func (cfg *Config) Sync() error {
 	if cfg.isDirty {
 		// Encode to JSON and write to disk.
-		if b, err := json.Marshal(&cfg); err != nil {
+		if b, err := json.Marshal(cfg.fileConfig()); err != nil {
 			return err
 		} else if err = ioutil.WriteFile(cfg.path, b, utils.FileMode); err != nil {
 			return err
@@ -444,80 +773,396 @@ func (cfg *Config) ResetDirty() {
 	cfg.isDirty = false
 }
 
+func isValidChannel(channel string) bool {
+	for _, v := range Channels {
+		if v == channel {
+			return true
+		}
+	}
+	return false
+}
+
+// validLocales returns the set of Tor Browser locales offered for a given
+// channel, or nil if the channel is not one that is currently offered (eg:
+// the discontinued `hardened` channel, which is handled by forcing a
+// reinstall).
+func validLocales(channel string) (map[string]bool, error) {
+	var bundleLocales map[string][]string
+	if d, err := data.Load("ui/locales.json"); err != nil {
+		return nil, err
+	} else if err = json.Unmarshal(d, &bundleLocales); err != nil {
+		return nil, err
+	}
+
+	l, ok := bundleLocales[channel]
+	if !ok {
+		return nil, nil
+	}
+	m := make(map[string]bool)
+	for _, v := range l {
+		m[v] = true
+	}
+	return m, nil
+}
+
+// hostArchitecture returns the Tor Browser architecture that matches the
+// architecture the launcher was built for.
+func hostArchitecture() (string, error) {
+	switch runtime.GOARCH {
+	case "amd64":
+		return archLinux64, nil
+	case "arm64":
+		// Tor Browser does not provide arm64 bundles, so this is only
+		// useful with a bundle that is installed by other means.
+		return archLinuxAArch64, nil
+	default:
+		return "", newError(KindHost, "unsupported Arch: %v", runtime.GOARCH)
+	}
+}
+
+// CheckHostArchitecture returns an error if the configured architecture does
+// not match the host, as the sandbox only resolves the bundle's libraries
+// from the host's native library path.
+func (cfg *Config) CheckHostArchitecture() error {
+	arch, err := hostArchitecture()
+	if err != nil {
+		return err
+	}
+	if cfg.Architecture != arch {
+		return newError(KindHost, "configured Architecture %q does not match the host (%q), the bundle's libraries will not resolve (override with --cross-arch if multilib is installed)", cfg.Architecture, arch)
+	}
+	return nil
+}
+
+// LocaleFallbacks returns the list of locales to try, in order of preference,
+// when installing the bundle: the configured locale, the base language, and
+// then the default locale.  Channels that only offer a single bundle, or that
+// are discontinued, get no fallbacks.
+func (cfg *Config) LocaleFallbacks() []string {
+	l := []string{cfg.Locale}
+	if cfg.Channel == nightlyChannel || cfg.Channel == "hardened" {
+		return l
+	}
+	if lang := localeLanguage(cfg.Locale); lang != cfg.Locale {
+		l = append(l, lang)
+	}
+	if cfg.Locale != defaultLocale {
+		l = append(l, defaultLocale)
+	}
+	return l
+}
+
+// hasOfferedLocale returns true if the configured locale, or a locale for
+// the same language in the fallback chain, is in the set of offered locales.
+// The default locale is the last resort of every chain, so only counting
+// fallbacks for the same language still rejects unknown locales.
+func (cfg *Config) hasOfferedLocale(locales map[string]bool) bool {
+	lang := localeLanguage(cfg.Locale)
+	for _, l := range cfg.LocaleFallbacks() {
+		if locales[l] && localeLanguage(l) == lang {
+			return true
+		}
+	}
+	return false
+}
+
+// localeLanguage returns the base language of a locale (Eg: "en" for
+// "en-US").
+func localeLanguage(l string) string {
+	if i := strings.Index(l, "-"); i > 0 {
+		return l[:i]
+	}
+	return l
+}
+
+// parseDownloadProxy parses the download proxy URL, falling back to the
+// standard proxy environment variables if s is empty.
+func parseDownloadProxy(s string) (*url.URL, error) {
+	if s == "" {
+		for _, env := range []string{"HTTPS_PROXY", "https_proxy", "HTTP_PROXY", "http_proxy"} {
+			if s = os.Getenv(env); s != "" {
+				break
+			}
+		}
+		if s == "" {
+			return nil, nil
+		}
+	}
+
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, err
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("not a HTTP(S) proxy URL")
+	}
+	return u, nil
+}
+
+// parsePortString parses a control/SOCKS port string, and refuses TCP
+// addresses that are not on the loopback interface.
+func parsePortString(s string) (net, addr string, err error) {
+	if net, addr, err = butils.ParseControlPortString(s); err != nil {
+		return "", "", err
+	}
+	if err = validateControlPort(net, addr); err != nil {
+		return "", "", err
+	}
+	return
+}
+
+// validateControlPort checks that a system tor control port is either a
+// loopback TCP address or a UNIX domain socket.
+func validateControlPort(net, addr string) error {
+	switch net {
+	case "tcp":
+		host, _, err := gonet.SplitHostPort(addr)
+		if err != nil {
+			return err
+		}
+		if !gonet.ParseIP(host).IsLoopback() {
+			return fmt.Errorf("non-loopback address: %v", host)
+		}
+	case "unix":
+		if !filepath.IsAbs(addr) {
+			return fmt.Errorf("socket path is not absolute: %v", addr)
+		}
+	default:
+		return fmt.Errorf("unsupported network: '%v'", net)
+	}
+	return nil
+}
+
+// HasNamedProfiles returns true if the runtime or data directory dir of the
+// default instance also contains named instance profiles.
+func HasNamedProfiles(dir string) bool {
+	return utils.FileExists(filepath.Join(dir, namedProfilesDir))
+}
+
+// fallbackRuntimeDir returns a private per-user directory under the system
+// temporary directory, for use when `XDG_RUNTIME_DIR` is not set, creating
+// it if needed.  As anyone can create entries there, an existing directory
+// is only used if it is owned by the user and inaccessible to others.
+func fallbackRuntimeDir() (string, error) {
+	d := filepath.Join(os.TempDir(), fmt.Sprintf("%s-%d", appDir, os.Getuid()))
+	if err := os.Mkdir(d, utils.DirMode); err != nil && !os.IsExist(err) {
+		return "", err
+	}
+
+	fi, err := os.Lstat(d)
+	if err != nil {
+		return "", err
+	}
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !fi.IsDir() || !ok || int(st.Uid) != os.Getuid() {
+		return "", fmt.Errorf("'%v' is not a directory owned by the user", d)
+	}
+	if fi.Mode().Perm() != utils.DirMode.Perm() {
+		return "", fmt.Errorf("'%v' has insecure permissions: %v", d, fi.Mode().Perm())
+	}
+	return d, nil
+}
+
+// ApplyDefaults sets the options that are unset to their default values,
+// and marks the config dirty if any were changed.
+func (cfg *Config) ApplyDefaults() {
+	if cfg.Channel == "" {
+		cfg.SetChannel(defaultChannel)
+	}
+	if cfg.Locale == "" {
+		if cfg.Channel == nightlyChannel {
+			// Nightly builds are only available as multi-locale bundles.
+			cfg.SetLocale(nightlyLocale)
+		} else {
+			cfg.SetLocale(defaultLocale)
+		}
+	}
+	if cfg.Tor.SocksPort == "" {
+		cfg.Tor.SocksPort = defaultSocksPort
+		cfg.isDirty = true
+	}
+	cfg.Tor.cfg = cfg
+	cfg.Sandbox.cfg = cfg
+}
+
+// Validate checks that the options are valid, and derives the internal
+// values that depend on them.  Unset options are rejected, so ApplyDefaults
+// should be called first.
+func (cfg *Config) Validate() error {
+	if cfg.UseSystemTor {
+		if err := validateControlPort(cfg.SystemTorControlNet, cfg.SystemTorControlAddr); err != nil {
+			return newError(KindControlPort, "invalid control port: %v", err)
+		}
+	}
+	if m := cfg.SystemTorControlAuthMethod; m != "" {
+		valid := false
+		for _, v := range ControlAuthMethods {
+			valid = valid || m == v
+		}
+		if !valid {
+			return newError(KindControlAuth, "invalid control port auth method %q (valid: %s)", m, strings.Join(ControlAuthMethods, ", "))
+		}
+		if m == ControlAuthPassword && cfg.UseSystemTor && cfg.SystemTorControlPassword == "" {
+			return newError(KindControlAuth, "control port auth method %q requires a password", m)
+		}
+	}
+	if !isValidChannel(cfg.Channel) {
+		return newError(KindChannel, "invalid Channel %q (valid: %s)", cfg.Channel, strings.Join(Channels, ", "))
+	}
+	if locales, err := validLocales(cfg.Channel); err != nil {
+		return &Error{Kind: KindLocale, Err: err}
+	} else if cfg.Channel == nightlyChannel && cfg.explicitLocale && cfg.Locale != nightlyLocale {
+		// Rather than silently discarding the user's choice of locale.
+		return newError(KindLocale, "explicitly configured Locale %q conflicts with channel %q, which is only available as Locale %q", cfg.Locale, cfg.Channel, nightlyLocale)
+	} else if locales != nil && (!localeRe.MatchString(cfg.Locale) || !cfg.hasOfferedLocale(locales)) {
+		// Locales that aren't offered are allowed if the installer will
+		// fall back to an offered locale for the same language.
+		return newError(KindLocale, "invalid Locale %q for channel %q", cfg.Locale, cfg.Channel)
+	}
+	for _, v := range cfg.Mirrors {
+		if u, err := url.Parse(v); err != nil {
+			return newError(KindMirror, "invalid mirror: %v", err)
+		} else if (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+			return newError(KindMirror, "invalid mirror: '%v'", v)
+		}
+	}
+	if cfg.DownloadTimeout == "" {
+		cfg.downloadTimeout = defaultDownloadTimeout
+	} else if d, err := time.ParseDuration(cfg.DownloadTimeout); err != nil {
+		return newError(KindDownloadTimeout, "invalid download timeout: %v", err)
+	} else if d < 0 {
+		return newError(KindDownloadTimeout, "invalid download timeout: '%v' is negative", cfg.DownloadTimeout)
+	} else {
+		cfg.downloadTimeout = d
+	}
+	if cfg.UpdateCheckInterval == "" {
+		cfg.updateInterval = defaultUpdateInterval
+	} else if d, err := time.ParseDuration(cfg.UpdateCheckInterval); err != nil {
+		return newError(KindUpdateCheckInterval, "invalid update check interval: %v", err)
+	} else if d < 0 {
+		return newError(KindUpdateCheckInterval, "invalid update check interval: '%v' is negative", cfg.UpdateCheckInterval)
+	} else {
+		cfg.updateInterval = d
+	}
+	if u, err := parseDownloadProxy(cfg.DownloadProxy); err != nil {
+		return newError(KindDownloadProxy, "invalid download proxy: %v", err)
+	} else {
+		cfg.downloadProxyURL = u
+	}
+	if cfg.LogLevel != "" {
+		if _, err := utils.ParseLogLevel(cfg.LogLevel); err != nil {
+			return &Error{Kind: KindLogLevel, Err: err}
+		}
+	}
+	if cfg.PinnedVersion != "" && !pinnedVersionRe.MatchString(cfg.PinnedVersion) {
+		return newError(KindPinnedVersion, "invalid pinned version: '%v'", cfg.PinnedVersion)
+	}
+	if cfg.DisableUpdate && cfg.PinnedVersion != "" {
+		return newError(KindPinnedVersion, "`disableUpdate` and `pinnedVersion` are mutually exclusive")
+	}
+	if _, _, err := cfg.Tor.SocksPortAddr(); err != nil {
+		return newError(KindSocksPort, "invalid SOCKS port: %v", err)
+	}
+
+	for _, m := range cfg.Sandbox.ExtraBindMounts {
+		if err := m.validate(); err != nil {
+			return newError(KindExtraBindMounts, "invalid extra bind mount: %v", err)
+		}
+	}
+	if err := validateTorOptions(cfg.Tor.ExtraOptions); err != nil {
+		return newError(KindExtraTorOptions, "invalid extra tor options: %v", err)
+	}
+	if err := validateExtraEnv(cfg.Sandbox.ExtraEnv); err != nil {
+		return newError(KindExtraEnv, "invalid extra environment: %v", err)
+	}
+	for _, v := range cfg.Sandbox.ExtraLibs {
+		if v == "" || strings.ContainsAny(v, "/\x00") {
+			return newError(KindExtraLibs, "invalid extra library: %q", v)
+		}
+	}
+
+	// Reject bridge lines that the sandboxed tor instance can't use, rather
+	// than failing obscurely when tor is launched.
+	if cfg.Tor.UseBridges && cfg.Tor.UseCustomBridges {
+		if _, err := ValidateBridgeLines(cfg.Tor.CustomBridges); err != nil {
+			return newError(KindBridges, "invalid custom bridges: %v", err)
+		}
+	}
+
+	return nil
+}
+
 // New creates a new config object and populates it with the configuration
 // from disk if available, default values otherwise.
 func New(version string) (*Config, error) {
+	return NewWithProfile(version, "")
+}
+
+// NewWithProfile creates a new config object like New, for the named instance
+// profile.  Each named profile gets a `profiles/<name>` subdirectory of the
+// runtime and data directories, so that instances with different names have
+// their own bundle, browser profile, tor state and lock, while sharing the
+// config file.  The default instance ("") uses the directories as is.
+func NewWithProfile(version, profileName string) (*Config, error) {
 	const (
-		envControlPort = "TOR_CONTROL_PORT"
-		envRuntimeDir  = "XDG_RUNTIME_DIR"
+		envControlPort   = "TOR_CONTROL_PORT"
+		envControlPasswd = "TOR_CONTROL_PASSWD"
+		envRuntimeDir    = "XDG_RUNTIME_DIR"
 	)
 
 	cfg := new(Config)
 
 	// Populate the internal only fields that are not serialized.
+	if profileName != "" && !profileNameRe.MatchString(profileName) {
+		return nil, newError(KindProfileName, "invalid profile name: %q", profileName)
+	}
+	cfg.ProfileName = profileName
 	if runtime.GOOS != "linux" {
-		return nil, fmt.Errorf("unsupported OS: %v", runtime.GOOS)
+		return nil, newError(KindHost, "unsupported OS: %v", runtime.GOOS)
 	}
-	switch runtime.GOARCH {
-	case "amd64":
-		cfg.Architecture = archLinux64
-	default:
-		return nil, fmt.Errorf("unsupported Arch: %v", runtime.GOARCH)
+	if arch, err := hostArchitecture(); err != nil {
+		return nil, err
+	} else {
+		cfg.Architecture = arch
 	}
 	if env := os.Getenv(envControlPort); env != "" {
-		if net, addr, err := butils.ParseControlPortString(env); err != nil {
-			return nil, fmt.Errorf("invalid control port: %v", err)
+		if net, addr, err := parsePortString(env); err != nil {
+			return nil, newError(KindControlPort, "invalid control port: %v", err)
 		} else {
-			// Refuse to use TCP control ports not on the loopback interface.
-			if net == "tcp" {
-				host, _, _ := gonet.SplitHostPort(addr)
-				if !gonet.ParseIP(host).IsLoopback() {
-					return nil, fmt.Errorf("non-loopback control port: %v", host)
-				}
-			}
 			cfg.UseSystemTor = true
 			cfg.SystemTorControlNet = net
 			cfg.SystemTorControlAddr = addr
 		}
 	}
 
-	// Initialize the directories that have files in them.  The paths are not
-	// serialized but part of the config struct.
-	if d := os.Getenv(envRuntimeDir); d == "" {
-		return nil, fmt.Errorf("no `%s` set in the enviornment", envRuntimeDir)
-	} else {
-		cfg.RuntimeDir = filepath.Join(d, appDir)
-	}
-	if d, err := xdg.DataHomeDirectory(); err != nil {
-		return nil, err
-	} else {
-		cfg.UserDataDir = filepath.Join(d, appDir)
-		cfg.BundleInstallDir = filepath.Join(cfg.UserDataDir, bundleInstallDir)
-		cfg.TorDataDir = filepath.Join(cfg.UserDataDir, torDataDir)
-		cfg.manifestPath = filepath.Join(cfg.UserDataDir, manifestFile)
-	}
-
 	// Ensure the path used to store the config file exits.
 	if d, err := xdg.ConfigHomeDirectory(); err != nil {
-		return nil, err
+		return nil, &Error{Kind: KindConfigFile, Err: err}
 	} else {
 		d = filepath.Join(d, appDir)
-		if err := os.MkdirAll(d, utils.DirMode); err != nil {
-			return nil, err
+		if err := utils.MkdirAllPrivate(d); err != nil {
+			return nil, &Error{Kind: KindConfigFile, Err: err}
 		}
 		cfg.ConfigDir = d
 		cfg.path = filepath.Join(cfg.ConfigDir, configFile)
 	}
 
-	// Load the config file.
+	// Load the config file.  The fields that have defaults that depend on
+	// other fields are also decoded separately, so that values that were
+	// explicitly set can be told apart from ones that were not.
+	var explicit struct {
+		Locale *string `json:"locale"`
+	}
 	cfg.isDirty = true
 	if b, err := ioutil.ReadFile(cfg.path); err != nil {
 		// File not found, or failed to read.
 		if !os.IsNotExist(err) {
-			return nil, err
+			return nil, &Error{Kind: KindConfigFile, Err: err}
 		}
 	} else if err = json.Unmarshal(b, &cfg); err != nil {
-		return nil, err
+		return nil, &Error{Kind: KindSyntax, Err: err}
+	} else if err = json.Unmarshal(b, &explicit); err != nil {
+		return nil, &Error{Kind: KindSyntax, Err: err}
 	} else if cfg.LastVersion != version {
 		// The version changed, we want to re-Sync().
 		cfg.LastVersion = version
@@ -525,16 +1170,64 @@ func New(version string) (*Config, error) {
 	} else {
 		cfg.isDirty = false
 	}
+	if err := cfg.applyEnvOverrides(); err != nil {
+		return nil, err
+	}
 
-	// Apply sensible defaults for unset items.
-	if cfg.Channel == "" {
-		cfg.SetChannel(defaultChannel)
+	// Load the system tor control port password, without ever logging it.
+	if cfg.UseSystemTor {
+		if env := os.Getenv(envControlPasswd); env != "" {
+			cfg.SystemTorControlPassword = env
+		} else if fn := cfg.SystemTorControlPasswordFile; fn != "" {
+			b, err := ioutil.ReadFile(fn)
+			if err != nil {
+				return nil, newError(KindControlPassword, "failed to read the control port password file: %v", err)
+			}
+			cfg.SystemTorControlPassword = strings.TrimRight(string(b), "\r\n")
+		}
 	}
-	if cfg.Locale == "" {
-		cfg.SetLocale(defaultLocale)
+
+	// Initialize the directories that have files in them.  The paths are not
+	// serialized but part of the config struct, and are derived from the
+	// XDG base directories unless explicitly overridden.
+	if d := cfg.RuntimeDirOverride; d != "" {
+		if !filepath.IsAbs(d) {
+			return nil, newError(KindRuntimeDir, "runtime directory override is not absolute: %v", d)
+		}
+		cfg.RuntimeDir = filepath.Clean(d)
+	} else if d = os.Getenv(envRuntimeDir); d != "" {
+		cfg.RuntimeDir = filepath.Join(d, appDir)
+	} else if d, err := fallbackRuntimeDir(); err != nil {
+		return nil, newError(KindRuntimeDir, "no `%s` set in the enviornment, and no `runtimeDir` configured: %v", envRuntimeDir, err)
+	} else {
+		cfg.RuntimeDir = d
+		cfg.RuntimeDirIsFallback = true
+	}
+	if d := cfg.DataDirOverride; d != "" {
+		if !filepath.IsAbs(d) {
+			return nil, newError(KindDataDir, "data directory override is not absolute: %v", d)
+		}
+		cfg.UserDataDir = filepath.Clean(d)
+	} else if d, err := xdg.DataHomeDirectory(); err != nil {
+		return nil, newError(KindDataDir, "failed to determine the data directory, and no `dataDir` configured: %v", err)
+	} else {
+		cfg.UserDataDir = filepath.Join(d, appDir)
+	}
+	if cfg.ProfileName != "" {
+		cfg.RuntimeDir = filepath.Join(cfg.RuntimeDir, namedProfilesDir, cfg.ProfileName)
+		cfg.UserDataDir = filepath.Join(cfg.UserDataDir, namedProfilesDir, cfg.ProfileName)
+	}
+	cfg.BundleInstallDir = filepath.Join(cfg.UserDataDir, bundleInstallDir)
+	cfg.TorDataDir = filepath.Join(cfg.UserDataDir, torDataDir)
+	cfg.ProfileDir = filepath.Join(cfg.UserDataDir, profileDir)
+	cfg.manifestPath = filepath.Join(cfg.UserDataDir, manifestFile)
+
+	// Apply sensible defaults for unset items, and validate the result.
+	cfg.explicitLocale = explicit.Locale != nil && *explicit.Locale != "" || cfg.isEnvOverridden("STB_LOCALE")
+	cfg.ApplyDefaults()
+	if err := cfg.Validate(); err != nil {
+		return nil, err
 	}
-	cfg.Tor.cfg = cfg
-	cfg.Sandbox.cfg = cfg
 
 	return cfg, nil
 }
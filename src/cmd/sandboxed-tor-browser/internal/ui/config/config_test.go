@@ -0,0 +1,115 @@
+// config_test.go - Configuration tests.
+// Copyright (C) 2016  Yawning Angel.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package config
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestLocaleFallbacks(t *testing.T) {
+	for _, v := range []struct {
+		channel, locale string
+		expected        []string
+	}{
+		{"release", "en-US", []string{"en-US", "en"}},
+		{"release", "en-GB", []string{"en-GB", "en", "en-US"}},
+		{"release", "de", []string{"de", "en-US"}},
+		{"alpha", "pt-BR", []string{"pt-BR", "pt", "en-US"}},
+		{nightlyChannel, "ALL", []string{"ALL"}},
+	} {
+		cfg := &Config{Channel: v.channel, Locale: v.locale}
+		if l := cfg.LocaleFallbacks(); !reflect.DeepEqual(l, v.expected) {
+			t.Errorf("%v/%v: LocaleFallbacks() = %v, expected %v", v.channel, v.locale, l, v.expected)
+		}
+	}
+}
+
+func TestHasOfferedLocale(t *testing.T) {
+	locales, err := validLocales("release")
+	if err != nil {
+		t.Fatalf("validLocales() = %v", err)
+	}
+
+	for _, v := range []struct {
+		locale   string
+		expected bool
+	}{
+		{"en-US", true},
+		{"de", true},
+		{"de-AT", true}, // Falls back to "de".
+		{"en-GB", true}, // Falls back to "en-US", the same language.
+		{"es-MX", false},
+		{"xx-YY", false},
+		{"xx", false},
+	} {
+		cfg := &Config{Channel: "release", Locale: v.locale}
+		if ok := cfg.hasOfferedLocale(locales); ok != v.expected {
+			t.Errorf("%v: hasOfferedLocale() = %v, expected %v", v.locale, ok, v.expected)
+		}
+	}
+}
+
+func TestNeedsUpdateCheck(t *testing.T) {
+	now := time.Now().Unix()
+	for _, v := range []struct {
+		name      string
+		interval  time.Duration
+		disable   bool
+		lastCheck int64
+		expected  bool
+	}{
+		{"never checked", 2 * time.Hour, false, 0, true},
+		{"recently checked", 2 * time.Hour, false, now - 60, false},
+		{"interval elapsed", 2 * time.Hour, false, now - 3*60*60, true},
+		{"short interval elapsed", 30 * time.Minute, false, now - 60*60, true},
+		{"long interval pending", 24 * time.Hour, false, now - 3*60*60, false},
+		{"clock skew", 2 * time.Hour, false, now + 60*60, true},
+		{"interval disabled", 0, false, 0, false},
+		{"updates disabled", 2 * time.Hour, true, 0, false},
+	} {
+		cfg := &Config{updateInterval: v.interval, DisableUpdate: v.disable, LastUpdateCheck: v.lastCheck}
+		if ok := cfg.NeedsUpdateCheck(); ok != v.expected {
+			t.Errorf("%v: NeedsUpdateCheck() = %v, expected %v", v.name, ok, v.expected)
+		}
+	}
+}
+
+func TestValidateExtraEnv(t *testing.T) {
+	for _, v := range []struct {
+		env map[string]string
+		ok  bool
+	}{
+		{nil, true},
+		{map[string]string{"GTK_THEME": "Adwaita:dark", "MOZ_USE_XINPUT2": "1"}, true},
+		{map[string]string{"EMPTY": ""}, true},
+		{map[string]string{"": "1"}, false},
+		{map[string]string{"A=B": "1"}, false},
+		{map[string]string{"NUL": "a\x00b"}, false},
+		{map[string]string{"LD_PRELOAD": "/tmp/libfoo.so"}, false},
+		{map[string]string{"TOR_SOCKS_PORT": "9050"}, false},
+		{map[string]string{"DISPLAY": ":0"}, false},
+		{map[string]string{"HOME": "/root"}, false},
+		{map[string]string{"XAUTHORITY": "/tmp/xauth"}, false},
+		{map[string]string{"XDG_RUNTIME_DIR": "/run/user/0"}, false},
+	} {
+		if err := validateExtraEnv(v.env); (err == nil) != v.ok {
+			t.Errorf("validateExtraEnv(%q) = %v, expected ok: %v", v.env, err, v.ok)
+		}
+	}
+}
@@ -0,0 +1,85 @@
+// diff.go - Config comparison.
+// Copyright (C) 2017  Yawning Angel.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package config
+
+import (
+	"reflect"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// diffIgnored is the set of fields that are runtime only state, and are
+// never considered by Diff.
+var diffIgnored = map[string]bool{
+	"tor.ctrlPassword":     true,
+	"configVersionChanged": true,
+}
+
+// Equal returns true iff cfg and other have the same options, ignoring
+// runtime only state.
+func (cfg *Config) Equal(other *Config) bool {
+	return len(cfg.Diff(other)) == 0
+}
+
+// Diff returns the names of the options that differ between cfg and other,
+// as they appear in the config file (Eg: "tor.extraOptions").  Options that
+// are never serialized use the field name with the first letter lowercased.
+// Empty and unset lists and maps are considered equal.
+func (cfg *Config) Diff(other *Config) []string {
+	var diff []string
+	diffStruct(&diff, "", reflect.ValueOf(cfg).Elem(), reflect.ValueOf(other).Elem())
+	return diff
+}
+
+func diffStruct(diff *[]string, prefix string, a, b reflect.Value) {
+	t := a.Type()
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath != "" {
+			// Unexported, either derived, or a back-pointer.
+			continue
+		}
+		name := prefix + diffFieldName(f)
+		if diffIgnored[name] {
+			continue
+		}
+
+		va, vb := a.Field(i), b.Field(i)
+		switch {
+		case f.Type.Kind() == reflect.Struct:
+			diffStruct(diff, name+".", va, vb)
+		case f.Type.Kind() == reflect.Slice || f.Type.Kind() == reflect.Map:
+			if va.Len() == 0 && vb.Len() == 0 {
+				continue
+			}
+			if !reflect.DeepEqual(va.Interface(), vb.Interface()) {
+				*diff = append(*diff, name)
+			}
+		case va.Interface() != vb.Interface():
+			*diff = append(*diff, name)
+		}
+	}
+}
+
+func diffFieldName(f reflect.StructField) string {
+	if tag := strings.Split(f.Tag.Get("json"), ",")[0]; tag != "" && tag != "-" {
+		return tag
+	}
+	r, n := utf8.DecodeRuneInString(f.Name)
+	return string(unicode.ToLower(r)) + f.Name[n:]
+}
@@ -0,0 +1,122 @@
+// diff_test.go - Config comparison tests.
+// Copyright (C) 2017  Yawning Angel.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package config
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestDiff(t *testing.T) {
+	for _, v := range []struct {
+		name     string
+		fn       func(*Config)
+		expected []string
+	}{
+		{"unchanged", func(cfg *Config) {}, nil},
+		{"scalar", func(cfg *Config) { cfg.Channel = "alpha" }, []string{"channel"}},
+		{"unserialized", func(cfg *Config) { cfg.UseSystemTor = true }, []string{"useSystemTor"}},
+		{"nested scalar", func(cfg *Config) { cfg.Tor.UseBridges = true }, []string{"tor.useBridges"}},
+		{"custom bridges", func(cfg *Config) { cfg.Tor.CustomBridges = "obfs4 192.0.2.1:443" }, []string{"tor.customBridges"}},
+		{"tor options", func(cfg *Config) {
+			cfg.Tor.ExtraOptions = map[string]string{"ConnectionPadding": "1"}
+		}, []string{"tor.extraOptions"}},
+		{"empty tor options", func(cfg *Config) { cfg.Tor.ExtraOptions = map[string]string{} }, nil},
+		{"bind mounts", func(cfg *Config) {
+			cfg.Sandbox.ExtraBindMounts = []BindMount{{Source: "/srv/a", Dest: "/home/amnesia/a"}}
+		}, []string{"sandbox.extraBindMounts"}},
+		{"empty bind mounts", func(cfg *Config) { cfg.Sandbox.ExtraBindMounts = []BindMount{} }, nil},
+		{"mirrors", func(cfg *Config) { cfg.Mirrors = []string{"https://mirror.example.com/"} }, []string{"mirrors"}},
+		{"multiple", func(cfg *Config) {
+			cfg.LogLevel = "debug"
+			cfg.Sandbox.ExtraEnv = map[string]string{"GTK_THEME": "Adwaita"}
+			cfg.Tor.StreamIsolation = true
+		}, []string{"logLevel", "tor.streamIsolation", "sandbox.extraEnv"}},
+		{"runtime only", func(cfg *Config) {
+			cfg.Tor.CtrlPassword = "hunter2"
+			cfg.ConfigVersionChanged = true
+			cfg.isDirty = true
+		}, nil},
+	} {
+		a, b := newTestConfig(), newTestConfig()
+		v.fn(b)
+		if diff := a.Diff(b); !reflect.DeepEqual(diff, v.expected) {
+			t.Errorf("%v: Diff() = %v, expected %v", v.name, diff, v.expected)
+		}
+		if diff := b.Diff(a); !reflect.DeepEqual(diff, v.expected) {
+			t.Errorf("%v: reversed Diff() = %v, expected %v", v.name, diff, v.expected)
+		}
+		if eq := a.Equal(b); eq != (len(v.expected) == 0) {
+			t.Errorf("%v: Equal() = %v", v.name, eq)
+		}
+	}
+}
+
+func TestDiffCollections(t *testing.T) {
+	// Lists and maps are compared by content, not by identity, and order
+	// matters for lists.
+	a, b := newTestConfig(), newTestConfig()
+	a.Mirrors = []string{"https://a.example.com/", "https://b.example.com/"}
+	b.Mirrors = append([]string{}, a.Mirrors...)
+	a.Tor.ExtraOptions = map[string]string{"ConnectionPadding": "1", "ReducedConnectionPadding": "1"}
+	b.Tor.ExtraOptions = map[string]string{"ReducedConnectionPadding": "1", "ConnectionPadding": "1"}
+	a.Sandbox.ExtraBindMounts = []BindMount{{Source: "/srv/a", Dest: "/home/amnesia/a", ReadOnly: true}}
+	b.Sandbox.ExtraBindMounts = []BindMount{{Source: "/srv/a", Dest: "/home/amnesia/a", ReadOnly: true}}
+	if !a.Equal(b) {
+		t.Errorf("Equal() = false, diff %v", a.Diff(b))
+	}
+
+	b.Mirrors = []string{a.Mirrors[1], a.Mirrors[0]}
+	b.Tor.ExtraOptions = map[string]string{"ConnectionPadding": "0", "ReducedConnectionPadding": "1"}
+	b.Sandbox.ExtraBindMounts[0].ReadOnly = false
+	expected := []string{"mirrors", "tor.extraOptions", "sandbox.extraBindMounts"}
+	if diff := a.Diff(b); !reflect.DeepEqual(diff, expected) {
+		t.Errorf("Diff() = %v, expected %v", diff, expected)
+	}
+}
+
+func TestReloadTor(t *testing.T) {
+	cfg := newTestConfig()
+	cfg.Tor.CtrlPassword = "hunter2"
+
+	// Changes outside of the tor section are not applied.
+	newCfg := newTestConfig()
+	newCfg.LogLevel = "debug"
+	if changed, err := cfg.ReloadTor(newCfg); err != nil || changed {
+		t.Errorf("ReloadTor(logLevel) = %v, %v, expected no change", changed, err)
+	}
+
+	// Changes to the tor section are, keeping the runtime state.
+	newCfg = newTestConfig()
+	newCfg.Tor.ExtraOptions = map[string]string{"ConnectionPadding": "1"}
+	if changed, err := cfg.ReloadTor(newCfg); err != nil || !changed {
+		t.Errorf("ReloadTor(tor.extraOptions) = %v, %v, expected a change", changed, err)
+	}
+	if !reflect.DeepEqual(cfg.Tor.ExtraOptions, newCfg.Tor.ExtraOptions) {
+		t.Errorf("ReloadTor() tor.extraOptions = %v", cfg.Tor.ExtraOptions)
+	}
+	if cfg.Tor.CtrlPassword != "hunter2" || cfg.Tor.cfg != cfg {
+		t.Errorf("ReloadTor() clobbered the runtime state")
+	}
+
+	// Things that require a restart are rejected.
+	newCfg = newTestConfig()
+	newCfg.UseSystemTor = true
+	if _, err := cfg.ReloadTor(newCfg); err == nil {
+		t.Errorf("ReloadTor(useSystemTor) succeeded")
+	}
+}
@@ -0,0 +1,141 @@
+// env.go - Environment variable config overrides.
+// Copyright (C) 2017  Yawning Angel.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package config
+
+import (
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// envOverride is an environment variable that overrides a config field.
+type envOverride struct {
+	env   string
+	field func(cfg *Config) interface{}
+}
+
+// envOverrides is the list of environment variables that override the
+// config file, for use in containers and CI.  The precedence is environment,
+// then the config file, then the defaults.  Overridden values are never
+// written back to the config file.
+//
+// In addition to these, `TOR_CONTROL_PORT` and `TOR_CONTROL_PASSWD` select
+// a system tor daemon, and `XDG_RUNTIME_DIR`, `XDG_CONFIG_HOME` and
+// `XDG_DATA_HOME` are used to derive the directories.
+//
+// Lists are comma separated, and booleans are parsed by strconv.ParseBool.
+var envOverrides = []envOverride{
+	{"STB_ARCHITECTURE", func(cfg *Config) interface{} { return &cfg.Architecture }},
+	{"STB_CHANNEL", func(cfg *Config) interface{} { return &cfg.Channel }},
+	{"STB_LOCALE", func(cfg *Config) interface{} { return &cfg.Locale }},
+	{"STB_MIRRORS", func(cfg *Config) interface{} { return &cfg.Mirrors }},
+	{"STB_PINNED_VERSION", func(cfg *Config) interface{} { return &cfg.PinnedVersion }},
+	{"STB_DISABLE_UPDATE", func(cfg *Config) interface{} { return &cfg.DisableUpdate }},
+	{"STB_DOWNLOAD_PROXY", func(cfg *Config) interface{} { return &cfg.DownloadProxy }},
+	{"STB_UPDATE_CHECK_INTERVAL", func(cfg *Config) interface{} { return &cfg.UpdateCheckInterval }},
+	{"STB_DOWNLOAD_TIMEOUT", func(cfg *Config) interface{} { return &cfg.DownloadTimeout }},
+	{"STB_LOG_LEVEL", func(cfg *Config) interface{} { return &cfg.LogLevel }},
+	{"STB_RUNTIME_DIR", func(cfg *Config) interface{} { return &cfg.RuntimeDirOverride }},
+	{"STB_DATA_DIR", func(cfg *Config) interface{} { return &cfg.DataDirOverride }},
+	{"STB_CONTROL_PASSWORD_FILE", func(cfg *Config) interface{} { return &cfg.SystemTorControlPasswordFile }},
+	{"STB_CONTROL_AUTH_METHOD", func(cfg *Config) interface{} { return &cfg.SystemTorControlAuthMethod }},
+	{"STB_USE_BRIDGES", func(cfg *Config) interface{} { return &cfg.Tor.UseBridges }},
+	{"STB_STREAM_ISOLATION", func(cfg *Config) interface{} { return &cfg.Tor.StreamIsolation }},
+}
+
+// appliedEnvOverride is an override that was applied, with the values from
+// the environment and the config file, so that the latter can be restored
+// when serializing.
+type appliedEnvOverride struct {
+	envOverride
+	envValue  interface{}
+	fileValue interface{}
+}
+
+// applyEnvOverrides applies the environment variable overrides to the
+// config.
+func (cfg *Config) applyEnvOverrides() error {
+	for _, o := range envOverrides {
+		v, ok := os.LookupEnv(o.env)
+		if !ok {
+			continue
+		}
+
+		field := reflect.ValueOf(o.field(cfg)).Elem()
+		fileValue := field.Interface()
+		switch field.Kind() {
+		case reflect.String:
+			field.SetString(v)
+		case reflect.Bool:
+			b, err := strconv.ParseBool(v)
+			if err != nil {
+				return newError(KindEnvOverride, "invalid `%v`: %v", o.env, err)
+			}
+			field.SetBool(b)
+		case reflect.Slice:
+			var l []string
+			for _, s := range strings.Split(v, ",") {
+				if s = strings.TrimSpace(s); s != "" {
+					l = append(l, s)
+				}
+			}
+			field.Set(reflect.ValueOf(l))
+		default:
+			panic("config: unsupported environment override type: " + field.Kind().String())
+		}
+		cfg.envOverrides = append(cfg.envOverrides, appliedEnvOverride{o, field.Interface(), fileValue})
+	}
+
+	switch cfg.Architecture {
+	case archLinux32, archLinux64, archLinuxAArch64:
+	default:
+		return newError(KindEnvOverride, "invalid `STB_ARCHITECTURE`: %v", cfg.Architecture)
+	}
+	return nil
+}
+
+// isEnvOverridden returns true if the environment variable env overrides the
+// config.
+func (cfg *Config) isEnvOverridden(env string) bool {
+	for _, o := range cfg.envOverrides {
+		if o.env == env {
+			return true
+		}
+	}
+	return false
+}
+
+// fileConfig returns a copy of the config suitable for writing to the
+// config file, with the overridden fields that were not changed since
+// restored to their config file values.
+func (cfg *Config) fileConfig() *Config {
+	if len(cfg.envOverrides) == 0 {
+		return cfg
+	}
+
+	c := *cfg
+	for _, o := range cfg.envOverrides {
+		field := reflect.ValueOf(o.field(&c)).Elem()
+		if !reflect.DeepEqual(field.Interface(), o.envValue) {
+			// Changed after the override was applied (Eg: via the UI).
+			continue
+		}
+		field.Set(reflect.ValueOf(o.fileValue))
+	}
+	return &c
+}
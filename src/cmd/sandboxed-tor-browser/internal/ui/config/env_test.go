@@ -0,0 +1,210 @@
+// env_test.go - Environment variable config override tests.
+// Copyright (C) 2017  Yawning Angel.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+const testVersion = "0.0.17"
+
+// unsetenv unsets the environment variable env for the duration of the test.
+func unsetenv(t *testing.T, env string) {
+	t.Setenv(env, "") // Restores the old value on cleanup.
+	os.Unsetenv(env)
+}
+
+// isolateConfigEnv points the XDG base directories at a temporary directory,
+// and clears every other environment variable that New consults, so that the
+// host's environment does not leak into the test.  The path of the config
+// file is returned.
+func isolateConfigEnv(t *testing.T) string {
+	for _, o := range envOverrides {
+		unsetenv(t, o.env)
+	}
+	for _, env := range []string{"TOR_CONTROL_PORT", "TOR_CONTROL_PASSWD", "HTTPS_PROXY", "https_proxy", "HTTP_PROXY", "http_proxy"} {
+		unsetenv(t, env)
+	}
+
+	dir := t.TempDir()
+	t.Setenv("XDG_CONFIG_HOME", filepath.Join(dir, "config"))
+	t.Setenv("XDG_DATA_HOME", filepath.Join(dir, "data"))
+	t.Setenv("XDG_RUNTIME_DIR", filepath.Join(dir, "run"))
+	return filepath.Join(dir, "config", appDir, configFile)
+}
+
+func writeTestConfig(t *testing.T, fn, s string) {
+	if err := os.MkdirAll(filepath.Dir(fn), 0700); err != nil {
+		t.Fatalf("failed to create the config directory: %v", err)
+	}
+	if err := ioutil.WriteFile(fn, []byte(s), 0600); err != nil {
+		t.Fatalf("failed to write the config file: %v", err)
+	}
+}
+
+func TestEnvOverrides(t *testing.T) {
+	tested := make(map[string]bool)
+	for _, v := range []struct {
+		env      string
+		value    string
+		field    func(*Config) interface{}
+		expected interface{}
+	}{
+		{"STB_ARCHITECTURE", archLinux32, func(cfg *Config) interface{} { return cfg.Architecture }, archLinux32},
+		{"STB_CHANNEL", "hardened", func(cfg *Config) interface{} { return cfg.Channel }, "hardened"},
+		{"STB_LOCALE", "de", func(cfg *Config) interface{} { return cfg.Locale }, "de"},
+		{"STB_MIRRORS", "https://a.example.com/, https://b.example.com/,", func(cfg *Config) interface{} { return cfg.Mirrors }, []string{"https://a.example.com/", "https://b.example.com/"}},
+		{"STB_PINNED_VERSION", "7.0.1", func(cfg *Config) interface{} { return cfg.PinnedVersion }, "7.0.1"},
+		{"STB_DISABLE_UPDATE", "true", func(cfg *Config) interface{} { return cfg.DisableUpdate }, true},
+		{"STB_DOWNLOAD_PROXY", "http://127.0.0.1:8118", func(cfg *Config) interface{} { return cfg.DownloadProxy }, "http://127.0.0.1:8118"},
+		{"STB_UPDATE_CHECK_INTERVAL", "6h", func(cfg *Config) interface{} { return cfg.UpdateCheckInterval }, "6h"},
+		{"STB_DOWNLOAD_TIMEOUT", "10m", func(cfg *Config) interface{} { return cfg.DownloadTimeout }, "10m"},
+		{"STB_LOG_LEVEL", "debug", func(cfg *Config) interface{} { return cfg.LogLevel }, "debug"},
+		{"STB_RUNTIME_DIR", "/tmp/stb-run", func(cfg *Config) interface{} { return cfg.RuntimeDir }, "/tmp/stb-run"},
+		{"STB_DATA_DIR", "/tmp/stb-data", func(cfg *Config) interface{} { return cfg.UserDataDir }, "/tmp/stb-data"},
+		{"STB_CONTROL_PASSWORD_FILE", "/tmp/stb-passwd", func(cfg *Config) interface{} { return cfg.SystemTorControlPasswordFile }, "/tmp/stb-passwd"},
+		{"STB_CONTROL_AUTH_METHOD", ControlAuthSafeCookie, func(cfg *Config) interface{} { return cfg.SystemTorControlAuthMethod }, ControlAuthSafeCookie},
+		{"STB_USE_BRIDGES", "1", func(cfg *Config) interface{} { return cfg.Tor.UseBridges }, true},
+		{"STB_STREAM_ISOLATION", "true", func(cfg *Config) interface{} { return cfg.Tor.StreamIsolation }, true},
+	} {
+		fn := isolateConfigEnv(t)
+		writeTestConfig(t, fn, `{"channel":"alpha","locale":"fr","lastVersion":"`+testVersion+`"}`)
+		os.Setenv(v.env, v.value)
+
+		cfg, err := New(testVersion)
+		if err != nil {
+			t.Errorf("%v: New() = %v", v.env, err)
+		} else if f := v.field(cfg); !reflect.DeepEqual(f, v.expected) {
+			t.Errorf("%v: New() field = %v, expected %v", v.env, f, v.expected)
+		} else if !cfg.isEnvOverridden(v.env) {
+			t.Errorf("%v: isEnvOverridden() = false", v.env)
+		}
+		tested[v.env] = true
+	}
+
+	for _, o := range envOverrides {
+		if !tested[o.env] {
+			t.Errorf("%v: not tested", o.env)
+		}
+	}
+}
+
+func TestEnvOverridePrecedence(t *testing.T) {
+	fn := isolateConfigEnv(t)
+
+	// Default.
+	cfg, err := New(testVersion)
+	if err != nil {
+		t.Fatalf("New() = %v", err)
+	}
+	if cfg.Channel != defaultChannel {
+		t.Errorf("default: Channel = %v, expected %v", cfg.Channel, defaultChannel)
+	}
+
+	// Config file over the default.
+	writeTestConfig(t, fn, `{"channel":"alpha","locale":"fr","lastVersion":"`+testVersion+`"}`)
+	if cfg, err = New(testVersion); err != nil {
+		t.Fatalf("New() = %v", err)
+	}
+	if cfg.Channel != "alpha" {
+		t.Errorf("file: Channel = %v, expected alpha", cfg.Channel)
+	}
+
+	// Environment over the config file.
+	os.Setenv("STB_CHANNEL", "hardened")
+	if cfg, err = New(testVersion); err != nil {
+		t.Fatalf("New() = %v", err)
+	}
+	if cfg.Channel != "hardened" {
+		t.Errorf("env: Channel = %v, expected hardened", cfg.Channel)
+	}
+
+	// The override is not written back to the config file, but other
+	// changes are.
+	cfg.SetLocale("de")
+	if err = cfg.Sync(); err != nil {
+		t.Fatalf("Sync() = %v", err)
+	}
+	var onDisk struct {
+		Channel string `json:"channel"`
+		Locale  string `json:"locale"`
+	}
+	if b, err := ioutil.ReadFile(fn); err != nil {
+		t.Fatalf("failed to read the config file: %v", err)
+	} else if err = json.Unmarshal(b, &onDisk); err != nil {
+		t.Fatalf("failed to decode the config file: %v", err)
+	}
+	if onDisk.Channel != "alpha" || onDisk.Locale != "de" {
+		t.Errorf("Sync() wrote channel %v, locale %v, expected alpha, de", onDisk.Channel, onDisk.Locale)
+	}
+
+	// Unless the overridden field itself was changed after startup.
+	cfg.SetChannel("release")
+	if err = cfg.Sync(); err != nil {
+		t.Fatalf("Sync() = %v", err)
+	}
+	if b, err := ioutil.ReadFile(fn); err != nil {
+		t.Fatalf("failed to read the config file: %v", err)
+	} else if err = json.Unmarshal(b, &onDisk); err != nil {
+		t.Fatalf("failed to decode the config file: %v", err)
+	}
+	if onDisk.Channel != "release" {
+		t.Errorf("Sync() wrote channel %v, expected release", onDisk.Channel)
+	}
+}
+
+func TestEnvOverrideErrors(t *testing.T) {
+	for _, v := range []struct {
+		env      string
+		value    string
+		expected ErrorKind
+	}{
+		{"STB_DISABLE_UPDATE", "maybe", KindEnvOverride},
+		{"STB_ARCHITECTURE", "sparc", KindEnvOverride},
+		{"STB_CHANNEL", "bogus", KindChannel},
+		{"STB_MIRRORS", "ftp://mirror.example.com/", KindMirror},
+		{"STB_RUNTIME_DIR", "relative/run", KindRuntimeDir},
+		{"STB_LOCALE", "xx-YY", KindLocale},
+	} {
+		isolateConfigEnv(t)
+		os.Setenv(v.env, v.value)
+
+		_, err := New(testVersion)
+		var cfgErr *Error
+		if !errors.As(err, &cfgErr) {
+			t.Errorf("%v=%v: New() = %v, expected a config error", v.env, v.value, err)
+		} else if cfgErr.Kind != v.expected {
+			t.Errorf("%v=%v: New() kind = %v, expected %v (%v)", v.env, v.value, cfgErr.Kind, v.expected, err)
+		}
+	}
+
+	// STB_LOCALE is an explicitly set locale, so it conflicts with the
+	// nightly channel rather than being silently replaced.
+	isolateConfigEnv(t)
+	os.Setenv("STB_CHANNEL", nightlyChannel)
+	os.Setenv("STB_LOCALE", "de")
+	var cfgErr *Error
+	if _, err := New(testVersion); !errors.As(err, &cfgErr) || cfgErr.Kind != KindLocale {
+		t.Errorf("nightly STB_LOCALE: New() = %v, expected a locale error", err)
+	}
+}
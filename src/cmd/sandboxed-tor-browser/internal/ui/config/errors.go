@@ -0,0 +1,143 @@
+// errors.go - Typed config errors.
+// Copyright (C) 2017  Yawning Angel.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package config
+
+import "fmt"
+
+// ErrorKind is the kind of a config Error, identifying the option or the
+// part of the environment that is at fault.
+type ErrorKind int
+
+const (
+	// KindSyntax is the kind of error returned when the config file can not
+	// be decoded.
+	KindSyntax ErrorKind = iota
+
+	// KindHost is the kind of error returned when the host OS or
+	// architecture is unsupported, or does not match the config.
+	KindHost
+
+	// KindEnvOverride is the kind of error returned when an `STB_*`
+	// environment override is invalid.
+	KindEnvOverride
+
+	// KindConfigFile is the kind of error returned when the config file, or
+	// the directory that holds it can not be accessed.
+	KindConfigFile
+
+	// KindControlPort is the kind of error returned when the system tor
+	// control port address (`TOR_CONTROL_PORT`) is invalid.
+	KindControlPort
+
+	// KindControlAuth is the kind of error returned when the system tor
+	// control port authentication method is invalid, or can not be used.
+	KindControlAuth
+
+	// KindControlPassword is the kind of error returned when the system tor
+	// control port password file can not be read.
+	KindControlPassword
+
+	// KindRuntimeDir is the kind of error returned when the runtime
+	// directory is invalid or can not be determined.
+	KindRuntimeDir
+
+	// KindDataDir is the kind of error returned when the data directory is
+	// invalid or can not be determined.
+	KindDataDir
+
+	// KindProfileName is the kind of error returned when the instance
+	// profile name is invalid.
+	KindProfileName
+
+	// The remaining kinds are returned when the option of the same name is
+	// invalid.
+	KindChannel
+	KindLocale
+	KindLogLevel
+	KindMirror
+	KindDownloadTimeout
+	KindUpdateCheckInterval
+	KindDownloadProxy
+	KindPinnedVersion
+	KindSocksPort
+	KindExtraBindMounts
+	KindExtraTorOptions
+	KindExtraEnv
+	KindExtraLibs
+	KindBridges
+)
+
+var errorKindOptions = map[ErrorKind]string{
+	KindSyntax:              "config file",
+	KindHost:                "architecture",
+	KindEnvOverride:         "environment",
+	KindConfigFile:          "config file",
+	KindControlPort:         "TOR_CONTROL_PORT",
+	KindControlAuth:         "systemTorControlAuthMethod",
+	KindControlPassword:     "systemTorControlPasswordFile",
+	KindRuntimeDir:          "runtimeDir",
+	KindDataDir:             "dataDir",
+	KindProfileName:         "--profile-name",
+	KindChannel:             "channel",
+	KindLocale:              "locale",
+	KindLogLevel:            "logLevel",
+	KindMirror:              "mirrors",
+	KindDownloadTimeout:     "downloadTimeout",
+	KindUpdateCheckInterval: "updateCheckInterval",
+	KindDownloadProxy:       "downloadProxy",
+	KindPinnedVersion:       "pinnedVersion",
+	KindSocksPort:           "tor.socksPort",
+	KindExtraBindMounts:     "sandbox.extraBindMounts",
+	KindExtraTorOptions:     "tor.extraOptions",
+	KindExtraEnv:            "sandbox.extraEnv",
+	KindExtraLibs:           "sandbox.extraLibs",
+	KindBridges:             "tor.customBridges",
+}
+
+// String returns the name of the option (or the part of the environment)
+// that an ErrorKind refers to.
+func (k ErrorKind) String() string {
+	if s, ok := errorKindOptions[k]; ok {
+		return s
+	}
+	return fmt.Sprintf("ErrorKind(%d)", int(k))
+}
+
+// Error is the error returned when the config can not be loaded, or fails
+// validation.  Front-ends should switch on the Kind rather than match the
+// message.
+type Error struct {
+	// Kind is the kind of error.
+	Kind ErrorKind
+
+	// Err is the underlying error.
+	Err error
+}
+
+// Error returns the string representation of an Error.
+func (e *Error) Error() string {
+	return e.Err.Error()
+}
+
+// Unwrap returns the underlying error.
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+func newError(kind ErrorKind, format string, a ...interface{}) error {
+	return &Error{Kind: kind, Err: fmt.Errorf(format, a...)}
+}
@@ -0,0 +1,99 @@
+// errors_test.go - Configuration error tests.
+// Copyright (C) 2016  Yawning Angel.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package config
+
+import (
+	"errors"
+	"os"
+	"testing"
+)
+
+func newTestConfig() *Config {
+	cfg := new(Config)
+	cfg.ApplyDefaults()
+	return cfg
+}
+
+func TestValidateDefaults(t *testing.T) {
+	if err := newTestConfig().Validate(); err != nil {
+		t.Fatalf("Validate() = %v", err)
+	}
+}
+
+func TestValidateErrorKind(t *testing.T) {
+	for _, v := range []struct {
+		name     string
+		fn       func(*Config)
+		expected ErrorKind
+	}{
+		{"control port", func(cfg *Config) {
+			cfg.UseSystemTor = true
+			cfg.SystemTorControlNet, cfg.SystemTorControlAddr = "tcp", "192.0.2.1:9051"
+		}, KindControlPort},
+		{"control auth method", func(cfg *Config) { cfg.SystemTorControlAuthMethod = "bogus" }, KindControlAuth},
+		{"control auth password", func(cfg *Config) {
+			cfg.UseSystemTor = true
+			cfg.SystemTorControlNet, cfg.SystemTorControlAddr = "tcp", "127.0.0.1:9051"
+			cfg.SystemTorControlAuthMethod = ControlAuthPassword
+		}, KindControlAuth},
+		{"channel", func(cfg *Config) { cfg.Channel = "bogus" }, KindChannel},
+		{"locale", func(cfg *Config) { cfg.Locale = "xx-YY" }, KindLocale},
+		{"log level", func(cfg *Config) { cfg.LogLevel = "bogus" }, KindLogLevel},
+		{"mirror", func(cfg *Config) { cfg.Mirrors = []string{"ftp://mirror.example.com/"} }, KindMirror},
+		{"download timeout", func(cfg *Config) { cfg.DownloadTimeout = "-1s" }, KindDownloadTimeout},
+		{"update check interval", func(cfg *Config) { cfg.UpdateCheckInterval = "soon" }, KindUpdateCheckInterval},
+		{"download proxy", func(cfg *Config) { cfg.DownloadProxy = "socks5://127.0.0.1:9050" }, KindDownloadProxy},
+		{"pinned version", func(cfg *Config) { cfg.PinnedVersion = "latest" }, KindPinnedVersion},
+		{"extra libs", func(cfg *Config) { cfg.Sandbox.ExtraLibs = []string{"../libfoo.so"} }, KindExtraLibs},
+		{"extra env", func(cfg *Config) { cfg.Sandbox.ExtraEnv = map[string]string{"LD_PRELOAD": "/tmp/libfoo.so"} }, KindExtraEnv},
+	} {
+		cfg := newTestConfig()
+		v.fn(cfg)
+		err := cfg.Validate()
+
+		var cfgErr *Error
+		if !errors.As(err, &cfgErr) {
+			t.Errorf("%v: Validate() = %v, expected a config error", v.name, err)
+		} else if cfgErr.Kind != v.expected {
+			t.Errorf("%v: Validate() kind = %v, expected %v (%v)", v.name, cfgErr.Kind, v.expected, err)
+		}
+	}
+}
+
+func TestErrorKindString(t *testing.T) {
+	for _, v := range []struct {
+		kind     ErrorKind
+		expected string
+	}{
+		{KindControlPort, "TOR_CONTROL_PORT"},
+		{KindControlAuth, "systemTorControlAuthMethod"},
+		{KindControlPassword, "systemTorControlPasswordFile"},
+		{KindLogLevel, "logLevel"},
+		{ErrorKind(-1), "ErrorKind(-1)"},
+	} {
+		if s := v.kind.String(); s != v.expected {
+			t.Errorf("ErrorKind(%d).String() = %v, expected %v", int(v.kind), s, v.expected)
+		}
+	}
+}
+
+func TestErrorUnwrap(t *testing.T) {
+	var err error = &Error{Kind: KindConfigFile, Err: os.ErrPermission}
+	if !errors.Is(err, os.ErrPermission) {
+		t.Errorf("errors.Is() failed to find the underlying error")
+	}
+}
@@ -24,10 +24,13 @@ import (
 	"path/filepath"
 	"strconv"
 	"strings"
+	"time"
 
 	"cmd/sandboxed-tor-browser/internal/utils"
 )
 
+const manifestBackupSuffix = ".bak"
+
 // Manifest contains the installed Tor Browser information.
 type Manifest struct {
 	// Version is the installed version.
@@ -39,21 +42,75 @@ type Manifest struct {
 	// Channel is the installed Tor Browser channel.
 	Channel string `json:"channel,omitEmpty"`
 
-	// Locale is the installed Tor Browser locale.
+	// Locale is the configured Tor Browser locale.
 	Locale string `json:"locale,omitEmpty"`
 
+	// ResolvedLocale is the installed Tor Browser locale, if the configured
+	// locale was not available and a fallback was used instead.
+	ResolvedLocale string `json:"resolvedLocale,omitempty"`
+
+	// InstallTime is the UNIX time when the bundle was installed.
+	InstallTime int64 `json:"installTime,omitempty"`
+
+	// BundleSHA256 is the hex encoded SHA256 digest of the verified bundle
+	// archive that was installed.  It is cleared once the bundle is updated.
+	BundleSHA256 string `json:"bundleSHA256,omitempty"`
+
 	isDirty bool
 	path    string
 }
 
-// SetVersion sets the manifest version and marks the config dirty.
+// SetVersion sets the manifest version and marks the config dirty.  As the
+// bundle no longer matches the archive that was installed, the archive
+// digest is cleared.
 func (m *Manifest) SetVersion(v string) {
 	if m.Version != v {
 		m.isDirty = true
 		m.Version = v
+		m.BundleSHA256 = ""
 	}
 }
 
+// SetInstalled sets the install time and the installed bundle archive digest,
+// and marks the manifest dirty.
+func (m *Manifest) SetInstalled(t time.Time, digest string) {
+	m.InstallTime = t.Unix()
+	m.BundleSHA256 = digest
+	m.isDirty = true
+}
+
+// SetResolvedLocale sets the installed bundle locale, and marks the manifest
+// dirty.
+func (m *Manifest) SetResolvedLocale(l string) {
+	if l == m.Locale {
+		l = ""
+	}
+	if m.ResolvedLocale != l {
+		m.isDirty = true
+		m.ResolvedLocale = l
+	}
+}
+
+// BundleLocale returns the locale of the installed bundle.
+func (m *Manifest) BundleLocale() string {
+	if m.ResolvedLocale != "" {
+		return m.ResolvedLocale
+	}
+	return m.Locale
+}
+
+// String returns a human readable summary of the manifest.
+func (m *Manifest) String() string {
+	s := fmt.Sprintf("Tor Browser %v (%v, %v, %v)", m.Version, m.Channel, m.Architecture, m.BundleLocale())
+	if m.InstallTime != 0 {
+		s += fmt.Sprintf(", installed %v", time.Unix(m.InstallTime, 0).Format(time.RFC3339))
+	}
+	if m.BundleSHA256 != "" {
+		s += fmt.Sprintf(", sha256 %v", m.BundleSHA256)
+	}
+	return s
+}
+
 // Sync flushes the manifest to disk, if the manifest is dirty.
 func (m *Manifest) Sync() error {
 	if m.isDirty {
@@ -154,6 +211,41 @@ func bundleVersionCompare(a, b string) (int, error) {
 	return 0, nil // One is probably hardened, the other isn't.
 }
 
+// Backup saves a copy of the on-disk manifest, for the purpose of rolling back
+// an installation.
+func (m *Manifest) Backup() error {
+	b, err := ioutil.ReadFile(m.path)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(m.path+manifestBackupSuffix, b, utils.FileMode)
+}
+
+// ManifestPaths returns the paths of the manifest and the manifest backup.
+func ManifestPaths(cfg *Config) []string {
+	return []string{cfg.manifestPath, cfg.manifestPath + manifestBackupSuffix}
+}
+
+// HasManifestBackup returns true if a manifest backup is present.
+func HasManifestBackup(cfg *Config) bool {
+	_, err := os.Stat(cfg.manifestPath + manifestBackupSuffix)
+	return err == nil
+}
+
+// RestoreManifestBackup replaces the manifest with the backup, and returns the
+// restored manifest.
+func RestoreManifestBackup(cfg *Config) (*Manifest, error) {
+	if err := os.Rename(cfg.manifestPath+manifestBackupSuffix, cfg.manifestPath); err != nil {
+		return nil, err
+	}
+	return LoadManifest(cfg)
+}
+
+// RemoveManifestBackup removes the manifest backup if any.
+func RemoveManifestBackup(cfg *Config) {
+	os.Remove(cfg.manifestPath + manifestBackupSuffix)
+}
+
 // Purge deletes the manifest.
 func (m *Manifest) Purge() {
 	os.Remove(m.path)
@@ -0,0 +1,50 @@
+// password.go - Control port password generation.
+// Copyright (C) 2017  Yawning Angel.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package config
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+
+	"golang.org/x/crypto/openpgp/s2k"
+)
+
+// GenerateControlPassword generates a random control port password, and
+// returns it along with the hashed form suitable for tor's
+// `HashedControlPassword` option.
+func GenerateControlPassword() (plaintext, hashed string, err error) {
+	var entropy [16]byte
+	if _, err = rand.Read(entropy[:]); err != nil {
+		return "", "", fmt.Errorf("failed to generate a password: %v", err)
+	}
+	plaintext = hex.EncodeToString(entropy[:])
+
+	// Convert it to the RFC2440 S2K variant that Tor understands and expects.
+	// (SHA1, with the first 2 bytes of the descriptor that specify
+	// iterated/salted, and the hash omitted).
+	b := &bytes.Buffer{}
+	key := make([]byte, 20)
+	if err = s2k.Serialize(b, key, rand.Reader, []byte(plaintext), nil); err != nil {
+		return "", "", fmt.Errorf("failed to hash password: %v", err)
+	}
+	b.Write(key)
+	hashed = "16:" + hex.EncodeToString(b.Bytes()[2:])
+
+	return plaintext, hashed, nil
+}
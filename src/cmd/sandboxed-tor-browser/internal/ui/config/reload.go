@@ -0,0 +1,51 @@
+// reload.go - Runtime config reloading.
+// Copyright (C) 2017  Yawning Angel.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package config
+
+import (
+	"fmt"
+	"strings"
+)
+
+// ReloadTor replaces the `tor` section of cfg with the one from newCfg (Eg: a
+// freshly loaded config), keeping the runtime only state, and returns true if
+// anything changed.  An error is returned, and nothing is changed if newCfg
+// differs in anything that can't be changed while running.
+func (cfg *Config) ReloadTor(newCfg *Config) (bool, error) {
+	switch {
+	case newCfg.Architecture != cfg.Architecture:
+		return false, fmt.Errorf("the architecture can not be changed while running")
+	case newCfg.UseSystemTor != cfg.UseSystemTor:
+		return false, fmt.Errorf("switching to or from a system tor requires a restart")
+	case newCfg.RuntimeDir != cfg.RuntimeDir || newCfg.UserDataDir != cfg.UserDataDir:
+		return false, fmt.Errorf("the runtime and data directories can not be changed while running")
+	}
+
+	changed := false
+	for _, f := range cfg.Diff(newCfg) {
+		changed = changed || strings.HasPrefix(f, "tor.")
+	}
+	if !changed {
+		return false, nil
+	}
+
+	t := newCfg.Tor
+	t.cfg = cfg
+	t.CtrlPassword = cfg.Tor.CtrlPassword
+	cfg.Tor = t
+	return true, nil
+}
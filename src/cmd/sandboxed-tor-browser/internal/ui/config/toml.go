@@ -0,0 +1,197 @@
+// toml.go - Effective config TOML output.
+// Copyright (C) 2017  Yawning Angel.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+const redacted = "[redacted]"
+
+// WriteTOML writes the effective config, including the values that were
+// derived from the defaults and the environment, to w as TOML.  Passwords
+// are redacted.
+func (cfg *Config) WriteTOML(w io.Writer) error {
+	// Round trip through JSON so that the keys match the config file.
+	b, err := json.Marshal(cfg)
+	if err != nil {
+		return err
+	}
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	var m map[string]interface{}
+	if err = dec.Decode(&m); err != nil {
+		return err
+	}
+
+	// Add the values that are never serialized to the config file.
+	m["architecture"] = cfg.Architecture
+	m["runtimeDir"] = cfg.RuntimeDir
+	m["userDataDir"] = cfg.UserDataDir
+	m["bundleInstallDir"] = cfg.BundleInstallDir
+	m["torDataDir"] = cfg.TorDataDir
+	m["profileDir"] = cfg.ProfileDir
+	m["configDir"] = cfg.ConfigDir
+	if cfg.ProfileName != "" {
+		m["profileName"] = cfg.ProfileName
+	}
+	m["useSystemTor"] = cfg.UseSystemTor
+	if cfg.UseSystemTor {
+		m["systemTorControlNet"] = cfg.SystemTorControlNet
+		m["systemTorControlAddr"] = cfg.SystemTorControlAddr
+		if cfg.SystemTorControlPassword != "" {
+			m["systemTorControlPassword"] = redacted
+		}
+	}
+	if u := cfg.downloadProxyURL; u != nil {
+		s := u.Scheme + "://" + u.Host
+		if u.User != nil {
+			s = u.Scheme + "://" + u.User.Username() + ":" + redacted + "@" + u.Host
+		}
+		m["downloadProxy"] = s
+	}
+	if t, ok := m["tor"].(map[string]interface{}); ok {
+		if cfg.Tor.ProxyPassword != "" {
+			t["proxyPassword"] = redacted
+		}
+	}
+
+	var buf bytes.Buffer
+	if err = writeTOMLTable(&buf, "", m); err != nil {
+		return err
+	}
+	_, err = w.Write(buf.Bytes())
+	return err
+}
+
+func writeTOMLTable(w *bytes.Buffer, prefix string, m map[string]interface{}) error {
+	var keys, tables []string
+	for k, v := range m {
+		if _, ok := v.(map[string]interface{}); ok {
+			tables = append(tables, k)
+		} else if v != nil {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	sort.Strings(tables)
+
+	// Keys must be written before any sub-tables.
+	for _, k := range keys {
+		s, err := tomlValue(m[k])
+		if err != nil {
+			return fmt.Errorf("config: failed to encode '%v': %v", prefix+k, err)
+		}
+		fmt.Fprintf(w, "%s = %s\n", tomlKey(k), s)
+	}
+	for _, k := range tables {
+		name := prefix + tomlKey(k)
+		fmt.Fprintf(w, "\n[%s]\n", name)
+		if err := writeTOMLTable(w, name+".", m[k].(map[string]interface{})); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func tomlKey(k string) string {
+	for _, r := range k {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '_' || r == '-') {
+			return tomlString(k)
+		}
+	}
+	if k == "" {
+		return `""`
+	}
+	return k
+}
+
+func tomlValue(v interface{}) (string, error) {
+	switch t := v.(type) {
+	case string:
+		return tomlString(t), nil
+	case bool:
+		return fmt.Sprintf("%v", t), nil
+	case json.Number:
+		return t.String(), nil
+	case []interface{}:
+		var vals []string
+		for _, e := range t {
+			s, err := tomlValue(e)
+			if err != nil {
+				return "", err
+			}
+			vals = append(vals, s)
+		}
+		return "[" + strings.Join(vals, ", ") + "]", nil
+	case map[string]interface{}:
+		var keys, vals []string
+		for k := range t {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			if t[k] == nil {
+				continue
+			}
+			s, err := tomlValue(t[k])
+			if err != nil {
+				return "", err
+			}
+			vals = append(vals, tomlKey(k)+" = "+s)
+		}
+		return "{ " + strings.Join(vals, ", ") + " }", nil
+	default:
+		return "", fmt.Errorf("unsupported type: %T", v)
+	}
+}
+
+func tomlString(s string) string {
+	var b bytes.Buffer
+	b.WriteByte('"')
+	for _, r := range s {
+		switch r {
+		case '"':
+			b.WriteString(`\"`)
+		case '\\':
+			b.WriteString(`\\`)
+		case '\b':
+			b.WriteString(`\b`)
+		case '\t':
+			b.WriteString(`\t`)
+		case '\n':
+			b.WriteString(`\n`)
+		case '\f':
+			b.WriteString(`\f`)
+		case '\r':
+			b.WriteString(`\r`)
+		default:
+			if r < 0x20 || r == 0x7f {
+				fmt.Fprintf(&b, `\u%04X`, r)
+			} else {
+				b.WriteRune(r)
+			}
+		}
+	}
+	b.WriteByte('"')
+	return b.String()
+}
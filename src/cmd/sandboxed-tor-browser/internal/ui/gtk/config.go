@@ -190,7 +190,7 @@ func (d *configDialog) onOk() error {
 	end := d.torBridgeCustomEntryBuf.GetEndIter()
 	if s, err := d.torBridgeCustomEntryBuf.GetText(start, end, false); err != nil {
 		return err
-	} else if s, err = sbui.ValidateBridgeLines(s); err != nil {
+	} else if s, err = config.ValidateBridgeLines(s); err != nil {
 		return err
 	} else {
 		d.ui.Cfg.Tor.SetCustomBridges(s)
@@ -18,7 +18,6 @@
 package gtk
 
 import (
-	"log"
 	"path/filepath"
 	"strings"
 	"time"
@@ -53,32 +52,46 @@ type gtkUI struct {
 
 func (ui *gtkUI) Run() error {
 	const (
-		updateMinInterval   = 30 * time.Second
-		updateCheckInterval = 2 * time.Hour
-		updateNagInterval   = 15 * time.Minute
-		gtkPumpInterval     = 1 * time.Second
+		updateMinInterval = 30 * time.Second
+		updateNagInterval = 15 * time.Minute
+		gtkPumpInterval   = 1 * time.Second
 	)
+	updateCheckInterval := ui.Cfg.UpdateInterval()
 
 	if err := ui.Common.Run(); err != nil {
 		ui.bitch("Failed to run common UI: %v", err)
 		return err
 	}
-	if ui.PrintVersion {
+	if ui.PrintVersion || ui.DryRun || ui.DumpSeccomp != "" || ui.ShowConfig || ui.ListVersions || ui.ListLocales || ui.Uninstall {
 		return nil
 	}
 	if ui.updateNotification == nil {
-		log.Printf("ui: libnotify wasn't found, no desktop notifications possible")
+		Warnf("ui: libnotify wasn't found, no desktop notifications possible")
 	}
 
 	if ui.WasHardened {
-		log.Printf("ui: Previous `hardened` bundle detected")
+		Infof("ui: Previous `hardened` bundle detected")
 
 		ok := ui.ask("The hardened bundle has been discontinued, and the installation of a supported bundle is required.\n\nWARNING: The install process will delete the existing bundle, including bookmarks and downloads.  Backup all data you wish to preserve before continuing.")
 		if !ok {
-			log.Printf("ui: User denied `hardened` bundle overwrite")
+			Infof("ui: User denied `hardened` bundle overwrite")
 			return nil
 		}
-		log.Printf("ui: User confirmed `hardened` bundle overwrite")
+		Infof("ui: User confirmed `hardened` bundle overwrite")
+	}
+
+	if ui.Reinstall {
+		if !ui.AssumeYes {
+			ok := ui.ask("The installed bundle in '%v' will be deleted, and a fresh copy downloaded.\n\nThe browser profile in '%v' will be preserved.", ui.Cfg.BundleInstallDir, ui.Cfg.ProfileDir)
+			if !ok {
+				Infof("ui: User denied reinstall")
+				return nil
+			}
+		}
+		if err := ui.RemoveBundle(); err != nil {
+			ui.bitch("Failed to remove the installed bundle: %v", err)
+			return err
+		}
 	}
 
 	if ui.NeedsInstall() || ui.ForceInstall {
@@ -146,6 +159,10 @@ func (ui *gtkUI) Run() error {
 
 		updateTimer := time.NewTimer(initialUpdateInterval)
 		defer updateTimer.Stop()
+		if updateCheckInterval == 0 {
+			Infof("update: Background update checks are disabled.")
+			updateTimer.Stop()
+		}
 
 		gtkPumpTicker := time.NewTicker(gtkPumpInterval)
 		defer gtkPumpTicker.Stop()
@@ -161,9 +178,33 @@ func (ui *gtkUI) Run() error {
 				// to work.
 				gtk3.MainIterationDo(false)
 				continue
+			case <-ui.ReloadCh:
+				ui.ReloadConfig()
+
+				// Reschedule the background update checks if the interval
+				// was changed, unless the user is being nagged to restart.
+				if interval := ui.Cfg.UpdateInterval(); interval != updateCheckInterval {
+					updateCheckInterval = interval
+					if ui.Cfg.ForceUpdate {
+						continue
+					}
+					if !updateTimer.Stop() {
+						select {
+						case <-updateTimer.C:
+						default:
+						}
+					}
+					if updateCheckInterval == 0 {
+						Infof("update: Background update checks are disabled.")
+					} else {
+						Infof("update: Next scheduled update check: %v", updateCheckInterval)
+						updateTimer.Reset(updateCheckInterval)
+					}
+				}
+				continue
 			case action := <-ui.updateNotificationCh:
 				// Notification action was triggered, probably a restart.
-				log.Printf("update: Received notification action: %v", action)
+				Infof("update: Received notification action: %v", action)
 				if action == actionRestart {
 					break browserRunningLoop
 				}
@@ -178,7 +219,7 @@ func (ui *gtkUI) Run() error {
 			// do it as part of doUpdate() after the restart if it has
 			// aged too much.
 			if !ui.Cfg.ForceUpdate {
-				log.Printf("update: Starting scheduled update check.")
+				Infof("update: Starting scheduled update check.")
 
 				// Check for an update in the background.
 				async := async.NewAsync()
@@ -197,21 +238,21 @@ func (ui *gtkUI) Run() error {
 				}
 
 				if async.Err != nil {
-					log.Printf("update: Failed background update check: %v", async.Err)
+					Warnf("update: Failed background update check: %v", async.Err)
 				}
 
 				if update != nil {
-					log.Printf("update: An update is available: %v", update.DisplayVersion)
+					Infof("update: An update is available: %v", update.DisplayVersion)
 				} else {
-					log.Printf("update: The bundle is up to date")
+					Infof("update: The bundle is up to date")
 				}
 			}
 
 			if ui.Cfg.ForceUpdate {
-				log.Printf("update: Displaying notification.")
+				Infof("update: Displaying notification.")
 				ui.notifyUpdate(update)
 				updateTimer.Reset(updateNagInterval)
-			} else {
+			} else if updateCheckInterval > 0 {
 				updateTimer.Reset(updateCheckInterval)
 			}
 		}
@@ -276,7 +317,7 @@ func Init() (sbui.UI, error) {
 	// Load the UI.
 	if b, err := gtk3.BuilderNew(); err != nil {
 		return nil, err
-	} else if d, err := data.Asset("ui/gtkui.ui"); err != nil {
+	} else if d, err := data.Load("ui/gtkui.ui"); err != nil {
 		return nil, err
 	} else if err = b.AddFromString(string(d)); err != nil {
 		return nil, err
@@ -316,7 +357,7 @@ func (ui *gtkUI) onDestroy() {
 
 func (ui *gtkUI) launch() error {
 	// If we don't need to update, and would just launch, quash the UI.
-	checkUpdate := ui.Cfg.ForceUpdate || ui.Cfg.NeedsUpdateCheck()
+	checkUpdate := !ui.Cfg.DisableUpdate && (ui.Cfg.ForceUpdate || ui.Cfg.NeedsUpdateCheck())
 	squelchUI := !checkUpdate && ui.Cfg.UseSystemTor
 
 	async := async.NewAsync()
@@ -351,18 +392,22 @@ func (ui *gtkUI) ask(format string, a ...interface{}) bool {
 }
 
 func (ui *gtkUI) notifyUpdate(update *installer.UpdateEntry) {
-	if update == nil {
-		panic("ui: notifyUpdate called with no update metadata")
+	if ui.updateNotification == nil {
+		return
 	}
 
-	if ui.updateNotification != nil {
-		ui.updateNotification.Update("A Tor Browser update is available.", "Please restart to update to version "+update.DisplayVersion+".", ui.iconPixbuf)
-		ui.updateNotification.Show()
+	// The bundle may have been marked as stale by a previous run (eg: with
+	// update checks disabled since), so the metadata is not always at hand.
+	body := "Please restart to update."
+	if update != nil {
+		body = "Please restart to update to version " + update.DisplayVersion + "."
 	}
+	ui.updateNotification.Update("A Tor Browser update is available.", body, ui.iconPixbuf)
+	ui.updateNotification.Show()
 }
 
 func (ui *gtkUI) pixbufFromAsset(asset string) (*gdk.Pixbuf, error) {
-	d, err := data.Asset(asset)
+	d, err := data.Load(asset)
 	if err != nil {
 		return nil, err
 	}
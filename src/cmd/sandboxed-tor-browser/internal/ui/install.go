@@ -17,11 +17,14 @@
 package ui
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"io/ioutil"
-	"log"
 	"net"
+	"net/url"
 	"os"
+	"path"
 	"path/filepath"
 	"runtime"
 	"time"
@@ -31,106 +34,279 @@ import (
 	"cmd/sandboxed-tor-browser/internal/tor"
 	. "cmd/sandboxed-tor-browser/internal/ui/async"
 	"cmd/sandboxed-tor-browser/internal/ui/config"
+	"cmd/sandboxed-tor-browser/internal/ui/status"
 	"cmd/sandboxed-tor-browser/internal/utils"
 )
 
+// RemoveBundle removes the installed bundle and the manifest, so that the
+// next install is a fresh download, and logs what was removed.  The browser
+// profile directory is preserved.
+func (c *Common) RemoveBundle() error {
+	utils.Infof("reinstall: Removing the installed bundle.")
+	removed, err := installer.RemoveBundle(c.Cfg)
+	for _, d := range removed {
+		utils.Infof("reinstall: Removed: %v", d)
+	}
+	if err != nil {
+		return err
+	}
+	if c.Manif != nil {
+		utils.Infof("reinstall: Removed the manifest for version: %v", c.Manif.Version)
+		c.Manif.Purge()
+		c.Manif = nil
+	}
+	utils.Infof("reinstall: Preserved the profile: %v", c.Cfg.ProfileDir)
+	return nil
+}
+
 // DoInstall executes the install step based on the configured parameters.
 // This is blocking and should be run from a go routine, with the appropriate
 // Async structure used to communicate.
 func (c *Common) DoInstall(async *Async) {
+	c.DoInstallWithProgress(async, nil)
+}
+
+// DoInstallWithProgress executes the install step like DoInstall, invoking
+// fn (if non-nil) with the install phase, and the byte level progress of the
+// bundle download and extraction.
+func (c *Common) DoInstallWithProgress(async *Async, fn installer.ProgressFunc) {
+	report := func(p installer.Progress) {
+		if fn != nil {
+			fn(p)
+		}
+	}
+
 	var err error
 	async.Err = nil
 	defer func() {
+		async.TransferProgress = nil
 		if len(async.Cancel) > 0 {
 			<-async.Cancel
 		}
 		if async.Err != nil {
-			log.Printf("install: Failing with error: %v", async.Err)
+			utils.Errorf("install: Failing with error: %v", async.Err)
+			c.status.SetFailed(async.Err)
 		} else {
-			log.Printf("install: Complete.")
+			utils.Infof("install: Complete.")
+			if c.Manif != nil {
+				c.status.SetVersion(c.Manif.Version)
+			}
 		}
 		runtime.GC()
 		async.Done <- true
 	}()
 
-	log.Printf("install: Starting.")
+	utils.Infof("install: Starting.")
+	c.status.SetState(status.StateInstalling)
 
 	if c.tor != nil {
-		log.Printf("install: Shutting down old tor.")
+		utils.Infof("install: Shutting down old tor.")
 		c.tor.Shutdown()
 		c.tor = nil
 	}
 
-	// Get the Dial() routine used to reach the external network.
+	// Get the Dial() routine used to reach the external network.  If there
+	// is an existing usable bundle (eg: on reinstall), the tor from it is
+	// used so that the download happens over Tor.  Otherwise, the system
+	// tor is used if configured, and a direct connection as a last resort.
 	var dialFn dialFunc
-	if err := c.launchTor(async, true); err != nil {
-		async.Err = err
-		return
+	canLaunchTor := c.Manif != nil && !c.WasHardened && c.Manif.Architecture == c.Cfg.Architecture && utils.DirExists(c.Cfg.BundleInstallDir)
+	if err := c.launchTor(async, !canLaunchTor); err != nil {
+		if !canLaunchTor || err == ErrCanceled {
+			async.Err = err
+			return
+		}
+		utils.Warnf("install: Failed to launch the installed tor: %v", err)
+		async.Err = nil
+		if err = c.launchTor(async, true); err != nil {
+			async.Err = err
+			return
+		}
 	}
 	if dialFn, err = c.getTorDialFunc(); err == tor.ErrTorNotRunning {
-		dialFn = net.Dial
+		if proxy := c.Cfg.DownloadProxyURL(); proxy != nil {
+			utils.Infof("install: Using the HTTP(S) proxy: %v://%v", proxy.Scheme, proxy.Host)
+			dialFn = newProxyDialFunc(proxy)
+		} else {
+			dialFn = net.Dial
+		}
 	} else if err != nil {
 		async.Err = err
 		return
 	}
 
+	c.status.SetState(status.StateInstalling) // Launching tor changes it.
+
 	// Create the async HTTP client.
 	client := newHPKPGrabClient(dialFn)
+	c.setDownloadTimeouts(async)
 
 	// Download the JSON file showing where the bundle files are.
-	log.Printf("install: Checking available downloads.")
+	utils.Infof("install: Checking available downloads.")
 	async.UpdateProgress("Checking available downloads.")
 
-	var version string
+	var version, locale string
 	var downloads *installer.DownloadsEntry
 	if url := installer.DownloadsURL(c.Cfg, (c.tor != nil)); url == "" {
-		async.Err = fmt.Errorf("unable to find downloads URL")
+		async.Err = fmt.Errorf("unable to find downloads URL for channel: %v", c.Cfg.Channel)
 		return
 	} else {
-		log.Printf("install: Metadata URL: %v", url)
+		utils.Infof("install: Metadata URL: %v", url)
+		report(installer.Progress{Phase: installer.PhaseCheck, Filename: path.Base(url)})
 		if b := async.Grab(client, url, nil); async.Err != nil {
 			return
-		} else if version, downloads, async.Err = installer.GetDownloadsEntry(c.Cfg, b); async.Err != nil {
+		} else if version, locale, downloads, async.Err = installer.GetDownloadsEntry(c.Cfg, b); async.Err != nil {
 			return
 		}
 	}
 	checkAt := time.Now().Unix()
 
-	log.Printf("install: Version: %v Downloads: %v", version, downloads)
+	if pinned := c.Cfg.PinnedVersion; pinned != "" && pinned != version {
+		utils.Infof("install: Current version is %v, but the bundle is pinned to %v.", version, pinned)
+		if downloads, async.Err = installer.PinnedDownloadsEntry(downloads, version, pinned); async.Err != nil {
+			return
+		}
+		version = pinned
+	}
 
-	// Download the bundle.
-	log.Printf("install: Downloading %v", downloads.Binary)
-	async.UpdateProgress("Downloading Tor Browser.")
+	utils.Infof("install: Version: %v Locale: %v Downloads: %v", version, locale, downloads)
 
-	var bundleTarXz []byte
-	if bundleTarXz = async.Grab(client, downloads.Binary, func(s string) { async.UpdateProgress(fmt.Sprintf("Downloading Tor Browser: %s", s)) }); async.Err != nil {
+	// The bundle is downloaded to a file so that interrupted downloads can
+	// be resumed.  It is only removed once the download is known to be
+	// either good or corrupted.
+	var partialPath string
+	if u, err := url.Parse(downloads.Binary); err != nil {
+		async.Err = err
 		return
+	} else {
+		partialPath = filepath.Join(c.Cfg.UserDataDir, path.Base(u.Path)+".partial")
 	}
 
-	// Download the signature.
-	log.Printf("install: Downloading %v", downloads.Sig)
-	async.UpdateProgress("Downloading Tor Browser PGP Signature.")
-
-	var bundleSig []byte
-	if bundleSig = async.Grab(client, downloads.Sig, nil); async.Err != nil {
-		return
+	// Download and verify the bundle, trying each mirror in turn.  A bundle
+	// that fails verification is discarded, so that the next mirror starts
+	// from scratch instead of resuming the bad download.
+	mirrors := c.Cfg.Mirrors
+	if len(mirrors) == 0 {
+		mirrors = []string{installer.CanonicalMirror}
 	}
+	var bundleTarXz []byte
+	for _, mirror := range mirrors {
+		var entry *installer.DownloadsEntry
+		if entry, async.Err = installer.MirrorDownloadsEntry(downloads, mirror); async.Err != nil {
+			utils.Infof("install: Skipping mirror '%v': %v", mirror, async.Err)
+			continue
+		}
 
-	// Check the signature.
-	log.Printf("install: Validating Tor Browser PGP Signature.")
-	async.UpdateProgress("Validating Tor Browser PGP Signature.")
+		// Download the bundle.
+		utils.Infof("install: Downloading %v", entry.Binary)
+		async.UpdateProgress("Downloading Tor Browser.")
+		if fn != nil {
+			bundleName := path.Base(entry.Binary)
+			async.TransferProgress = func(done, total uint64) {
+				fn(installer.Progress{Phase: installer.PhaseDownload, BytesDone: done, BytesTotal: total, Filename: bundleName})
+			}
+		}
+
+		if bundleTarXz = async.GrabFile(client, entry.Binary, partialPath, func(s string) { async.UpdateProgress(fmt.Sprintf("Downloading Tor Browser: %s", s)) }); async.Err == ErrCanceled {
+			return
+		} else if async.Err != nil {
+			utils.Warnf("install: Failed to download bundle from '%v': %v", mirror, async.Err)
+			continue
+		}
+
+		async.TransferProgress = nil
+
+		// Download the signature.
+		utils.Infof("install: Downloading %v", entry.Sig)
+		async.UpdateProgress("Downloading Tor Browser PGP Signature.")
+
+		var bundleSig []byte
+		if bundleSig = async.Grab(client, entry.Sig, nil); async.Err == ErrCanceled {
+			return
+		} else if async.Err != nil {
+			utils.Warnf("install: Failed to download signature from '%v': %v", mirror, async.Err)
+			continue
+		}
+
+		// Check the signature.
+		utils.Infof("install: Validating Tor Browser PGP Signature (%v).", installer.TorBrowserSigningKeyFingerprint)
+		async.UpdateProgress("Validating Tor Browser PGP Signature.")
+		report(installer.Progress{Phase: installer.PhaseVerify, Filename: path.Base(entry.Sig)})
+
+		if async.Err = installer.ValidatePGPSignature(bundleTarXz, bundleSig); async.Err != nil {
+			utils.Warnf("install: Invalid bundle signature from '%v': %v", mirror, async.Err)
+			os.Remove(partialPath)
+			continue
+		}
 
-	if async.Err = installer.ValidatePGPSignature(bundleTarXz, bundleSig); async.Err != nil {
+		// Download the SHA256 sums file and its signature, from the same
+		// mirror as the bundle.
+		var sumsURL string
+		if sumsURL, async.Err = installer.SHA256SumsURL(entry.Binary); async.Err != nil {
+			return
+		}
+		sumsSigURL := installer.SHA256SumsSigURL(sumsURL)
+		utils.Infof("install: Downloading %v", sumsURL)
+		async.UpdateProgress("Downloading Tor Browser SHA256 sums.")
+
+		var sums, sumsSig []byte
+		if sums = async.Grab(client, sumsURL, nil); async.Err == ErrCanceled {
+			return
+		} else if async.Err != nil {
+			utils.Warnf("install: Failed to download SHA256 sums from '%v': %v", mirror, async.Err)
+			continue
+		}
+		utils.Infof("install: Downloading %v", sumsSigURL)
+		if sumsSig = async.Grab(client, sumsSigURL, nil); async.Err == ErrCanceled {
+			return
+		} else if async.Err != nil {
+			utils.Warnf("install: Failed to download SHA256 sums signature from '%v': %v", mirror, async.Err)
+			continue
+		}
+
+		// Check the SHA256 sums file signature, and the bundle digest.
+		utils.Infof("install: Validating Tor Browser SHA256 sums PGP Signature.")
+		async.UpdateProgress("Validating Tor Browser SHA256 sums.")
+		report(installer.Progress{Phase: installer.PhaseVerify, Filename: path.Base(sumsURL)})
+		if async.Err = installer.ValidateSHA256SumsSignature(sums, sumsSig); async.Err != nil {
+			utils.Warnf("install: Invalid SHA256 sums from '%v': %v", mirror, async.Err)
+			continue
+		}
+
+		utils.Infof("install: Validating Tor Browser SHA256 digest.")
+		async.UpdateProgress("Validating Tor Browser SHA256 digest.")
+		if async.Err = installer.ValidateSHA256Sum(sums, entry.Binary, bundleTarXz); async.Err != nil {
+			utils.Warnf("install: Invalid bundle digest from '%v': %v", mirror, async.Err)
+			os.Remove(partialPath)
+			continue
+		}
+
+		utils.Infof("install: Bundle served by mirror: %v", mirror)
+		break
+	}
+	if async.Err != nil {
+		if len(mirrors) > 1 {
+			async.Err = fmt.Errorf("failed to download from all mirrors, last error: %v", async.Err)
+		}
 		return
 	}
+	os.Remove(partialPath)
+	bundleDigest := sha256.Sum256(bundleTarXz)
 
 	// Install the bundle.
-	log.Printf("install: Installing Tor Browser.")
+	utils.Infof("install: Installing Tor Browser.")
 	async.UpdateProgress("Installing Tor Browser.")
 
+	// The tor from the old bundle can't be running while the bundle is being
+	// replaced.
+	if c.tor != nil && !c.tor.IsSystem() {
+		utils.Infof("install: Shutting down old tor.")
+		c.tor.Shutdown()
+		c.tor = nil
+	}
 	os.RemoveAll(c.Cfg.TorDataDir) // Remove the tor directory.
 
-	if err := installer.ExtractBundle(c.Cfg.BundleInstallDir, bundleTarXz, async.Cancel); err != nil {
+	if err := installer.ExtractBundleWithProgress(c.Cfg.BundleInstallDir, bundleTarXz, async.Cancel, fn); err != nil {
 		async.Err = err
 		if async.Err == installer.ErrExtractionCanceled {
 			async.Err = ErrCanceled
@@ -146,8 +322,17 @@ func (c *Common) DoInstall(async *Async) {
 		return
 	}
 
-	// Set the manifest.
+	// Set the manifest, keeping the old one around in case a rollback is
+	// required.
+	config.RemoveManifestBackup(c.Cfg)
+	if c.Manif != nil {
+		if err := c.Manif.Backup(); err != nil {
+			utils.Warnf("install: Failed to backup the old manifest: %v", err)
+		}
+	}
 	c.Manif = config.NewManifest(c.Cfg, version)
+	c.Manif.SetResolvedLocale(locale)
+	c.Manif.SetInstalled(time.Now(), hex.EncodeToString(bundleDigest[:]))
 	if async.Err = c.Manif.Sync(); async.Err != nil {
 		return
 	}
@@ -163,14 +348,14 @@ func (c *Common) DoInstall(async *Async) {
 
 func writeAutoconfig(cfg *config.Config) error {
 	autoconfigFile := filepath.Join(cfg.BundleInstallDir, "Browser", "defaults", "pref", "autoconfig.js")
-	if b, err := data.Asset("installer/autoconfig.js"); err != nil {
+	if b, err := data.Load("installer/autoconfig.js"); err != nil {
 		return err
 	} else if err = ioutil.WriteFile(autoconfigFile, b, utils.FileMode); err != nil {
 		return err
 	}
 
 	mozillacfgFile := filepath.Join(cfg.BundleInstallDir, "Browser", "mozilla.cfg")
-	if b, err := data.Asset("installer/mozilla.cfg"); err != nil {
+	if b, err := data.Load("installer/mozilla.cfg"); err != nil {
 		return err
 	} else if err = ioutil.WriteFile(mozillacfgFile, b, utils.FileMode); err != nil {
 		return err
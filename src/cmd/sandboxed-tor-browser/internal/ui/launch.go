@@ -18,11 +18,15 @@ package ui
 
 import (
 	"fmt"
-	"log"
+	"io"
 	"runtime"
 
+	"cmd/sandboxed-tor-browser/internal/installer"
 	"cmd/sandboxed-tor-browser/internal/sandbox"
+	"cmd/sandboxed-tor-browser/internal/tor"
 	. "cmd/sandboxed-tor-browser/internal/ui/async"
+	"cmd/sandboxed-tor-browser/internal/ui/status"
+	"cmd/sandboxed-tor-browser/internal/utils"
 )
 
 // DoLaunch executes the launch step based on the configured parameters.
@@ -35,19 +39,21 @@ func (c *Common) DoLaunch(async *Async, checkUpdates bool) {
 			<-async.Cancel
 		}
 		if async.Err != nil {
-			log.Printf("launch: Failing with error: %v", async.Err)
+			utils.Errorf("launch: Failing with error: %v", async.Err)
+			c.status.SetFailed(async.Err)
 			if c.tor != nil {
 				c.tor.Shutdown()
 				c.tor = nil
 			}
 		} else {
-			log.Printf("launch: Complete.")
+			utils.Infof("launch: Complete.")
+			c.status.SetState(status.StateRunning)
 		}
 		runtime.GC()
 		async.Done <- true
 	}()
 
-	log.Printf("launch: Starting.")
+	utils.Infof("launch: Starting.")
 
 	// Ensure that we actually can launch.
 	if c.NeedsInstall() {
@@ -56,23 +62,90 @@ func (c *Common) DoLaunch(async *Async, checkUpdates bool) {
 	}
 
 	// Start tor if required.
-	log.Printf("launch: Connecting to the Tor network.")
+	utils.Infof("launch: Connecting to the Tor network.")
 	async.UpdateProgress("Connecting to the Tor network.")
 	if async.Err = c.launchTor(async, false); async.Err != nil {
 		return
 	}
 
 	// If an update check is needed, check for updates.
-	if checkUpdates {
-		c.doUpdate(async)
+	if checkUpdates && !c.Cfg.DisableUpdate {
+		bundleIntact := c.doUpdate(async)
+		if async.Err != nil {
+			if !c.canLaunchAfterFailedUpdate(async.Err, bundleIntact) {
+				return
+			}
+			utils.Warnf("launch: Update check failed, using the installed bundle: %v", async.Err)
+			async.Err = nil
+		}
+	}
+
+	// A successful update shuts down the old tor, and only relaunches a
+	// sandboxed one, so reconnect to the system tor if needed.
+	if c.tor == nil {
+		utils.Infof("launch: Reconnecting to the Tor network.")
+		async.UpdateProgress("Reconnecting to the Tor network.")
+		if async.Err = c.launchTor(async, false); async.Err != nil {
+			return
+		}
+	}
+
+	// Ensure that the control port is usable, since the browser will hang
+	// trying to bootstrap otherwise.  A system tor is re-dialed so that
+	// both connectivity and authentication are checked.
+	if !c.SkipTorCheck {
+		if c.Cfg.UseSystemTor {
+			async.Err = tor.CheckControlPort(c.Cfg)
+		} else {
+			async.Err = c.tor.CheckControlPort()
+		}
 		if async.Err != nil {
 			return
 		}
 	}
 
 	// Launch the sandboxed Tor Browser.
-	log.Printf("launch: Starting Tor Browser.")
+	utils.Infof("launch: Starting Tor Browser.")
 	async.UpdateProgress("Starting Tor Browser.")
 
-	c.Sandbox, async.Err = sandbox.RunTorBrowser(c.Cfg, c.Manif, c.tor)
+	c.Sandbox, async.Err = sandbox.RunTorBrowserWithOptions(c.Cfg, c.Manif, c.tor, &sandbox.RunOptions{WritableBundle: c.WritableBundle})
+	if c.Cfg.FirstLaunch {
+		if async.Err == nil {
+			// The new install works, the old one is no longer needed.
+			installer.DiscardRollback(c.Cfg)
+		} else if installer.CanRollback(c.Cfg) {
+			// The freshly installed bundle failed to start, so go back to
+			// the previous bundle.
+			utils.Warnf("launch: Failed to start new install: %v", async.Err)
+			if manif, err := installer.Rollback(c.Cfg); err != nil {
+				utils.Warnf("launch: Failed to roll back install: %v", err)
+			} else {
+				utils.Infof("launch: Rolled back to version: %v", manif.Version)
+				c.Manif = manif
+				async.Err = fmt.Errorf("failed to start Tor Browser, rolled back to %v: %v", manif.Version, async.Err)
+			}
+		}
+	}
+}
+
+// canLaunchAfterFailedUpdate returns true iff the installed bundle may still
+// be launched after updating failed with err.  This is only the case when
+// the update check itself failed, and the bundle wasn't touched, so the
+// update will be re-attempted by the periodic checks while the browser is
+// running.  If an update is known to be available, the installed bundle is
+// obsolete, and the failure is fatal.
+func (c *Common) canLaunchAfterFailedUpdate(err error, bundleIntact bool) bool {
+	return err != ErrCanceled && bundleIntact && !c.Cfg.ForceUpdate
+}
+
+// DoDryRun does the sandbox setup for launching Tor Browser, and writes the
+// resulting bwrap arguments, libraries, and seccomp profile summary to w,
+// without launching anything.
+func (c *Common) DoDryRun(w io.Writer) error {
+	if c.NeedsInstall() {
+		return fmt.Errorf("dry run failed, installation required")
+	}
+
+	_, err := sandbox.RunTorBrowserWithOptions(c.Cfg, c.Manif, nil, &sandbox.RunOptions{DryRun: w, WritableBundle: c.WritableBundle})
+	return err
 }
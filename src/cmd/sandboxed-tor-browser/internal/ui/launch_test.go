@@ -0,0 +1,46 @@
+// launch_test.go - Launcher tests.
+// Copyright (C) 2016  Yawning Angel.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package ui
+
+import (
+	"errors"
+	"testing"
+
+	. "cmd/sandboxed-tor-browser/internal/ui/async"
+	"cmd/sandboxed-tor-browser/internal/ui/config"
+)
+
+func TestCanLaunchAfterFailedUpdate(t *testing.T) {
+	errFailed := errors.New("failed to download update metadata")
+	for _, v := range []struct {
+		name         string
+		err          error
+		bundleIntact bool
+		forceUpdate  bool
+		expected     bool
+	}{
+		{"metadata fetch failed", errFailed, true, false, true},
+		{"update available, fetch failed", errFailed, true, true, false},
+		{"update failed to apply", errFailed, false, true, false},
+		{"canceled", ErrCanceled, true, false, false},
+	} {
+		c := &Common{Cfg: &config.Config{ForceUpdate: v.forceUpdate}}
+		if ok := c.canLaunchAfterFailedUpdate(v.err, v.bundleIntact); ok != v.expected {
+			t.Errorf("%v: canLaunchAfterFailedUpdate() = %v, expected %v", v.name, ok, v.expected)
+		}
+	}
+}
@@ -0,0 +1,85 @@
+// list.go - Available version/locale listing.
+// Copyright (C) 2017  Yawning Angel.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package ui
+
+import (
+	"fmt"
+	"io"
+	"net"
+
+	"cmd/sandboxed-tor-browser/internal/installer"
+	"cmd/sandboxed-tor-browser/internal/tor"
+	. "cmd/sandboxed-tor-browser/internal/ui/async"
+)
+
+// DoListAvailable queries the download server, and writes either the
+// versions offered for the configured channel, or the locales offered for
+// the pinned (or latest) version to w.  The system tor is used if configured,
+// the download proxy otherwise, and a direct connection as a last resort.
+func (c *Common) DoListAvailable(w io.Writer, listLocales bool) error {
+	var dialFn dialFunc = net.Dial
+	if c.Cfg.UseSystemTor {
+		t, err := tor.NewSystemTor(c.Cfg)
+		if err != nil {
+			return err
+		}
+		defer t.Shutdown()
+		dialer, err := t.Dialer()
+		if err != nil {
+			return err
+		}
+		dialFn = dialer.Dial
+	} else if proxy := c.Cfg.DownloadProxyURL(); proxy != nil {
+		dialFn = newProxyDialFunc(proxy)
+	}
+	client := newHPKPGrabClient(dialFn)
+	async := NewAsync()
+	c.setDownloadTimeouts(async)
+
+	version := c.Cfg.PinnedVersion
+	if !listLocales || version == "" {
+		b := async.Grab(client, installer.IndexURL(""), nil)
+		if async.Err != nil {
+			return async.Err
+		}
+		versions, err := installer.AvailableVersions(c.Cfg, b)
+		if err != nil {
+			return err
+		}
+		if !listLocales {
+			for _, v := range versions {
+				fmt.Fprintln(w, v)
+			}
+			return nil
+		}
+		version = versions[len(versions)-1]
+	}
+
+	b := async.Grab(client, installer.IndexURL(version), nil)
+	if async.Err != nil {
+		return async.Err
+	}
+	locales, err := installer.AvailableLocales(c.Cfg, version, b)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "# %v (%v)\n", version, c.Cfg.Architecture)
+	for _, l := range locales {
+		fmt.Fprintln(w, l)
+	}
+	return nil
+}
@@ -0,0 +1,90 @@
+// proxy.go - HTTP(S) proxy dialer.
+// Copyright (C) 2017  Yawning Angel.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package ui
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+)
+
+// newProxyDialFunc returns a dialFunc that tunnels connections through the
+// HTTP(S) proxy with `CONNECT`.  The tunnel is used instead of
+// `http.Transport.Proxy` so that the TLS connection to the destination is
+// still made (and HPKP validated) by the caller.
+func newProxyDialFunc(proxy *url.URL) dialFunc {
+	proxyAddr := proxy.Host
+	if proxy.Port() == "" {
+		if proxy.Scheme == "https" {
+			proxyAddr = net.JoinHostPort(proxy.Hostname(), "443")
+		} else {
+			proxyAddr = net.JoinHostPort(proxy.Hostname(), "80")
+		}
+	}
+
+	return func(network, addr string) (net.Conn, error) {
+		conn, err := net.Dial(network, proxyAddr)
+		if err != nil {
+			return nil, err
+		}
+		if proxy.Scheme == "https" {
+			tlsConn := tls.Client(conn, &tls.Config{ServerName: proxy.Hostname()})
+			if err = tlsConn.Handshake(); err != nil {
+				conn.Close()
+				return nil, err
+			}
+			conn = tlsConn
+		}
+
+		req := &http.Request{
+			Method: "CONNECT",
+			URL:    &url.URL{Opaque: addr},
+			Host:   addr,
+			Header: make(http.Header),
+		}
+		if u := proxy.User; u != nil {
+			p, _ := u.Password()
+			auth := base64.StdEncoding.EncodeToString([]byte(u.Username() + ":" + p))
+			req.Header.Set("Proxy-Authorization", "Basic "+auth)
+		}
+		if err = req.Write(conn); err != nil {
+			conn.Close()
+			return nil, err
+		}
+
+		br := bufio.NewReader(conn)
+		resp, err := http.ReadResponse(br, req)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			conn.Close()
+			return nil, fmt.Errorf("proxy CONNECT failed: %v", resp.Status)
+		}
+		if br.Buffered() > 0 {
+			conn.Close()
+			return nil, fmt.Errorf("proxy sent data before the tunnel was established")
+		}
+		return conn, nil
+	}
+}
@@ -0,0 +1,62 @@
+// reload.go - SIGHUP config reloading.
+// Copyright (C) 2017  Yawning Angel.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package ui
+
+import (
+	"cmd/sandboxed-tor-browser/internal/ui/config"
+	"cmd/sandboxed-tor-browser/internal/utils"
+)
+
+// ReloadConfig re-loads the config, and applies any changes to the `tor`
+// section to the running sandboxed tor instance, without restarting it or the
+// browser.  This is triggered by SIGHUP, and does nothing when using a system
+// tor.
+func (c *Common) ReloadConfig() {
+	utils.Infof("reload: Reloading config.")
+	if c.Cfg.UseSystemTor {
+		utils.Infof("reload: Ignoring, a system tor is in use.")
+		return
+	}
+
+	newCfg, err := config.NewWithProfile(Version+"-"+Revision, c.Cfg.ProfileName)
+	if err != nil {
+		utils.Warnf("reload: Failed to load config: %v", err)
+		return
+	}
+	utils.Debugf("reload: Changed options: %v", c.Cfg.Diff(newCfg))
+	oldTor := c.Cfg.Tor
+	if changed, err := c.Cfg.ReloadTor(newCfg); err != nil {
+		utils.Warnf("reload: Rejecting config: %v", err)
+		return
+	} else if !changed {
+		utils.Infof("reload: The tor config is unchanged.")
+		return
+	}
+	if oldTor.SocksPort != c.Cfg.Tor.SocksPort || oldTor.StreamIsolation != c.Cfg.Tor.StreamIsolation {
+		utils.Warnf("reload: SOCKS port changes take effect when tor is next launched.")
+	}
+
+	if c.tor == nil {
+		utils.Infof("reload: tor is not running, the new config will be used at launch.")
+		return
+	}
+	if err = c.tor.Reconfigure(c.Cfg, oldTor.ExtraOptions, Bridges, c.ptMethods); err != nil {
+		utils.Warnf("reload: Failed to reconfigure tor, the new config will be used when tor is next launched: %v", err)
+		return
+	}
+	utils.Infof("reload: Applied the new tor config.")
+}
@@ -0,0 +1,185 @@
+// status.go - Runtime status file.
+// Copyright (C) 2017  Yawning Angel.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package status provides a machine readable status file that is updated as
+// the launcher runs, for external monitoring.
+package status
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	. "cmd/sandboxed-tor-browser/internal/utils"
+)
+
+// FileName is the name of the status file in the runtime directory.
+const FileName = "status.json"
+
+// State is the current state of the launcher.
+type State string
+
+const (
+	// StateStarting is the state prior to anything else happening.
+	StateStarting State = "starting"
+
+	// StateInstalling is the state while the bundle is being installed.
+	StateInstalling State = "installing"
+
+	// StateUpdating is the state while the bundle is being updated.
+	StateUpdating State = "updating"
+
+	// StateBootstrapping is the state while tor is being launched and
+	// bootstrapped.
+	StateBootstrapping State = "bootstrapping"
+
+	// StateRunning is the state while Tor Browser is running.
+	StateRunning State = "running"
+
+	// StateFailed is the state after an install or launch failed.
+	StateFailed State = "failed"
+)
+
+// Status is the contents of the status file.
+type Status struct {
+	// State is the current state.
+	State State `json:"state"`
+
+	// Version is the installed bundle version, if any.
+	Version string `json:"version,omitempty"`
+
+	// BootstrapProgress is the tor bootstrap percentage.
+	BootstrapProgress int `json:"bootstrapProgress"`
+
+	// PID is the process ID of the launcher.
+	PID int `json:"pid"`
+
+	// Error is the error that caused StateFailed.
+	Error string `json:"error,omitempty"`
+
+	// Updated is the time of the last change, in seconds since the epoch.
+	Updated int64 `json:"updated"`
+}
+
+// Writer is a status file writer.  All of the methods are safe to call
+// concurrently, and on a nil Writer.
+type Writer struct {
+	sync.Mutex
+
+	path   string
+	status Status
+}
+
+// SetState sets the current state, and updates the status file.
+func (w *Writer) SetState(s State) {
+	if w == nil {
+		return
+	}
+	w.Lock()
+	defer w.Unlock()
+	w.status.State = s
+	w.status.Error = ""
+	w.write()
+}
+
+// SetFailed sets the current state to StateFailed with the error, and
+// updates the status file.
+func (w *Writer) SetFailed(err error) {
+	if w == nil {
+		return
+	}
+	w.Lock()
+	defer w.Unlock()
+	w.status.State = StateFailed
+	w.status.Error = err.Error()
+	w.write()
+}
+
+// SetVersion sets the installed bundle version, and updates the status file.
+func (w *Writer) SetVersion(v string) {
+	if w == nil {
+		return
+	}
+	w.Lock()
+	defer w.Unlock()
+	w.status.Version = v
+	w.write()
+}
+
+// SetBootstrapProgress sets the tor bootstrap percentage, and updates the
+// status file.
+func (w *Writer) SetBootstrapProgress(p int) {
+	if w == nil {
+		return
+	}
+	w.Lock()
+	defer w.Unlock()
+	if w.status.BootstrapProgress == p {
+		return
+	}
+	w.status.BootstrapProgress = p
+	w.write()
+}
+
+// Remove removes the status file.
+func (w *Writer) Remove() {
+	if w == nil {
+		return
+	}
+	w.Lock()
+	defer w.Unlock()
+	os.Remove(w.path)
+}
+
+func (w *Writer) write() {
+	w.status.Updated = time.Now().Unix()
+	b, err := json.Marshal(&w.status)
+	if err != nil {
+		Warnf("status: Failed to serialize status: %v", err)
+		return
+	}
+
+	// Write to a temporary file and rename it over the old one, so that
+	// readers never see a partially written file.
+	tmpPath := w.path + ".tmp"
+	if err = ioutil.WriteFile(tmpPath, b, FileMode); err == nil {
+		err = os.Rename(tmpPath, w.path)
+	}
+	if err != nil {
+		Warnf("status: Failed to write status file: %v", err)
+		os.Remove(tmpPath)
+	}
+}
+
+// New creates a new status Writer for the status file in the directory dir,
+// and writes the initial status.
+func New(dir, version string) *Writer {
+	w := &Writer{
+		path: filepath.Join(dir, FileName),
+		status: Status{
+			State:   StateStarting,
+			Version: version,
+			PID:     os.Getpid(),
+		},
+	}
+	w.Lock()
+	defer w.Unlock()
+	w.write()
+	return w
+}
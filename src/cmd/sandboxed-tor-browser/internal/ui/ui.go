@@ -28,9 +28,12 @@ import (
 	"net"
 	"net/http"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"syscall"
+	"time"
 
 	"git.schwanenlied.me/yawning/grab.git"
 	"git.schwanenlied.me/yawning/hpkp.git"
@@ -42,6 +45,7 @@ import (
 	"cmd/sandboxed-tor-browser/internal/tor"
 	. "cmd/sandboxed-tor-browser/internal/ui/async"
 	"cmd/sandboxed-tor-browser/internal/ui/config"
+	"cmd/sandboxed-tor-browser/internal/ui/status"
 	"cmd/sandboxed-tor-browser/internal/utils"
 )
 
@@ -68,13 +72,70 @@ const (
 	DefaultBridgeTransport = "obfs4"
 
 	chanHardened = "hardened"
+
+	logFileName  = "sandboxed-tor-browser.log"
+	lockFileName = "lock"
 )
 
+// hiddenFlags is the set of command line flags that are omitted from the
+// usage output, as they are only useful for debugging/auditing.
+var hiddenFlags = map[string]bool{
+	"dump-seccomp":       true,
+	"i-really-want-root": true,
+}
+
+// PreParseFlag returns the value of the command line flag name, and if it
+// was set.  This is for the few flags that must be examined before the flags
+// are parsed, and parses a scratch copy of every flag, so that the argument
+// following a flag that takes a value is never mistaken for a flag, and
+// parsing stops at the first non-flag argument.  Nothing is returned if the
+// command line fails to parse, as flag.Parse() will reject it later.
+func PreParseFlag(name string) (string, bool) {
+	return preParseFlag(os.Args[1:], name)
+}
+
+func preParseFlag(args []string, name string) (string, bool) {
+	fs := flag.NewFlagSet("", flag.ContinueOnError)
+	fs.SetOutput(ioutil.Discard)
+	new(Common).registerFlags(fs)
+	flag.VisitAll(func(f *flag.Flag) {
+		if fs.Lookup(f.Name) != nil {
+			return
+		}
+		if bf, ok := f.Value.(interface {
+			IsBoolFlag() bool
+		}); ok && bf.IsBoolFlag() {
+			fs.Bool(f.Name, false, f.Usage)
+		} else {
+			fs.String(f.Name, "", f.Usage)
+		}
+	})
+	if err := fs.Parse(args); err != nil {
+		return "", false
+	}
+
+	var v string
+	var isSet bool
+	fs.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			v, isSet = f.Value.String(), true
+		}
+	})
+	return v, isSet
+}
+
 func usage() {
 	_, file := filepath.Split(os.Args[0])
 	fmt.Fprintf(os.Stderr, "Usage: %s [OPTION]... [COMMAND]\n", file)
 	fmt.Fprintf(os.Stderr, "\n Options:\n\n")
-	flag.PrintDefaults()
+	visible := flag.NewFlagSet(file, flag.ContinueOnError)
+	visible.SetOutput(os.Stderr)
+	flag.VisitAll(func(f *flag.Flag) {
+		if !hiddenFlags[f.Name] {
+			visible.Var(f.Value, f.Name, f.Usage)
+		}
+	})
+	visible.PrintDefaults()
 	fmt.Fprintf(os.Stderr, "\n")
 	fmt.Fprintf(os.Stderr, "\n Commands:\n\n")
 	fmt.Fprintf(os.Stderr, "   install\tForce (re)installation.\n")
@@ -99,18 +160,41 @@ type Common struct {
 	Sandbox *process.Process
 	tor     *tor.Tor
 	lock    *lockFile
+	status  *status.Writer
+
+	// ptMethods are the methods of the pluggable transport launched with
+	// the sandboxed tor, if any.
+	ptMethods map[string]string
+
+	// ReloadCh receives SIGHUP, which triggers ReloadConfig.
+	ReloadCh chan os.Signal
 
-	logQuiet bool
-	logPath  string
-	logFile  *os.File
+	logQuiet   bool
+	logPath    string
+	logLevel   string
+	logFile    *os.File
+	printUsage bool
 
 	PendingUpdate *installer.UpdateEntry
 
 	ForceInstall   bool
+	Reinstall      bool
+	AssumeYes      bool
 	ForceConfig    bool
 	NoKillTor      bool
 	AdvancedConfig bool
 	PrintVersion   bool
+	DryRun         bool
+	DumpSeccomp    string
+	ShowConfig     bool
+	ListVersions   bool
+	ListLocales    bool
+	WritableBundle bool
+	CrossArch      bool
+	Uninstall      bool
+	Purge          bool
+	ProfileName    string
+	SkipTorCheck   bool
 	WasHardened    bool
 }
 
@@ -120,13 +204,11 @@ func (c *Common) Init() error {
 
 	// Register the common command line flags.
 	flag.Usage = usage
-	flag.BoolVar(&c.AdvancedConfig, "advanced", false, "Show advanced config options.")
-	flag.BoolVar(&c.PrintVersion, "version", false, "Print the version and exit.")
-	flag.BoolVar(&c.logQuiet, "q", false, "Suppress logging to console.")
-	flag.StringVar(&c.logPath, "l", "", "Specify a log file.")
+	c.registerFlags(flag.CommandLine)
 
 	// Initialize/load the config file.
-	if c.Cfg, err = config.New(Version + "-" + Revision); err != nil {
+	c.ProfileName, _ = PreParseFlag("profile-name")
+	if c.Cfg, err = config.NewWithProfile(Version+"-"+Revision, c.ProfileName); err != nil {
 		return err
 	}
 	if c.Manif, err = config.LoadManifest(c.Cfg); err != nil {
@@ -156,6 +238,30 @@ func (c *Common) Init() error {
 	return c.Cfg.Sync()
 }
 
+// registerFlags registers the common command line flags with fs.
+func (c *Common) registerFlags(fs *flag.FlagSet) {
+	fs.BoolVar(&c.AdvancedConfig, "advanced", false, "Show advanced config options.")
+	fs.BoolVar(&c.PrintVersion, "version", false, "Print the version and exit.")
+	fs.BoolVar(&c.DryRun, "dry-run", false, "Print the sandbox configuration and exit, without launching.")
+	fs.BoolVar(&c.SkipTorCheck, "skip-tor-check", false, "Skip the tor control port check before launching.")
+	fs.BoolVar(&c.CrossArch, "cross-arch", false, "Allow a configured architecture that does not match the host.")
+	fs.BoolVar(&c.WritableBundle, "writable-bundle", false, "Mount the installed bundle read-write in the sandbox (NOT RECOMMENDED).")
+	fs.BoolVar(&c.Reinstall, "reinstall", false, "Remove the installed bundle, and download a fresh copy.")
+	fs.BoolVar(&c.AssumeYes, "yes", false, "Do not ask for confirmation before removing the installed bundle.")
+	fs.BoolVar(&c.Uninstall, "uninstall", false, "Remove the installed bundle and the launcher state, and exit.")
+	fs.BoolVar(&c.Purge, "purge", false, "With `--uninstall`, also remove the browser profile and the config.")
+	fs.BoolVar(&c.ShowConfig, "show-config", false, "Print the effective configuration and exit.")
+	fs.BoolVar(&c.ListVersions, "list-versions", false, "List the versions offered for the configured channel and exit.")
+	fs.BoolVar(&c.ListLocales, "list-locales", false, "List the locales offered for the pinned (or latest) version and exit.")
+	fs.StringVar(&c.DumpSeccomp, "dump-seccomp", "", "Write the named compiled seccomp profile to stdout and exit.")
+	fs.StringVar(&c.ProfileName, "profile-name", "", "Use a separate, named instance with its own bundle, browser profile, and tor state.")
+	fs.BoolVar(&c.logQuiet, "q", false, "Suppress logging to console.")
+	fs.StringVar(&c.logPath, "l", "", "Specify a log file.")
+	fs.StringVar(&c.logPath, "log-file", "", "Specify a log file (default: sandboxed-tor-browser.log in the runtime directory).")
+	fs.StringVar(&c.logLevel, "log-level", "", "Set the log level (debug, info, warn, error).")
+	fs.BoolVar(&c.printUsage, "h", false, "Print usage and esit.")
+}
+
 // Run handles initiailzing the at-runtime state.
 func (c *Common) Run() error {
 	const (
@@ -164,9 +270,8 @@ func (c *Common) Run() error {
 	)
 
 	// Parse the command line flags.
-	halp := flag.Bool("h", false, "Print usage and esit.")
 	flag.Parse()
-	if *halp {
+	if c.printUsage {
 		flag.Usage()
 	}
 	for _, v := range flag.Args() {
@@ -179,10 +284,50 @@ func (c *Common) Run() error {
 			flag.Usage()
 		}
 	}
+	if c.Reinstall {
+		c.ForceInstall = true
+	}
 	if c.PrintVersion {
 		fmt.Printf("sandboxed-tor-browser %s (%s)\n", Version, Revision)
+		if m, err := installer.InstalledManifest(c.Cfg); err != nil {
+			fmt.Printf("%v\n", err)
+		} else {
+			fmt.Printf("%v\n", m)
+		}
 		return nil // Skip the lock, because we will exit.
 	}
+	if c.DumpSeccomp != "" {
+		return sandbox.ExportProfileBPF(c.DumpSeccomp, os.Stdout)
+	}
+	if c.ShowConfig {
+		return c.Cfg.WriteTOML(os.Stdout)
+	}
+	if c.ListVersions || c.ListLocales {
+		return c.DoListAvailable(os.Stdout, c.ListLocales)
+	}
+	if c.Uninstall {
+		return c.DoUninstall(os.Stdout, c.Purge)
+	}
+	if c.CrossArch {
+		utils.Warnf("ui: Skipping the host architecture check, as requested.")
+	} else if err := c.Cfg.CheckHostArchitecture(); err != nil {
+		return err
+	}
+
+	// Acquire the lock file before anything else is touched, so that
+	// concurrent launches do not race creating the directories, or the
+	// default log file, which belongs to the running instance if any.
+	var err error
+	if c.lock, err = newLockFile(c); err != nil {
+		return err
+	}
+	var installedVersion string
+	if c.Manif != nil {
+		installedVersion = c.Manif.Version
+	}
+	c.status = status.New(c.Cfg.RuntimeDir, installedVersion)
+	c.ReloadCh = make(chan os.Signal, 1)
+	signal.Notify(c.ReloadCh, syscall.SIGHUP)
 
 	// Create the directories required.
 	if !utils.DirExists(c.Cfg.UserDataDir) {
@@ -191,30 +336,41 @@ func (c *Common) Run() error {
 			c.Manif.Purge()
 			c.Manif = nil
 		}
-		if err := os.MkdirAll(c.Cfg.UserDataDir, utils.DirMode); err != nil {
+		if err = utils.MkdirAllPrivate(c.Cfg.UserDataDir); err != nil {
 			return err
 		}
 	}
-	if !utils.DirExists(c.Cfg.RuntimeDir) {
-		if err := os.MkdirAll(c.Cfg.RuntimeDir, utils.DirMode); err != nil {
-			return err
-		}
+	if err = installer.InitProfileDir(c.Cfg); err != nil {
+		return err
 	}
 
-	// Setup logging.
-	var err error
+	// Setup logging.  Unless a log file is specified, each launch logs to a
+	// fresh file in the runtime directory, with the previous one kept.
 	logWriters := []io.Writer{}
-	if c.logPath != "" {
-		flags := os.O_CREATE | os.O_APPEND | os.O_WRONLY
-		c.logFile, err = os.OpenFile(c.logPath, flags, utils.FileMode)
-		if err != nil {
-			fmt.Printf("Failed to open log file '%v': %v", c.logPath, err)
-		}
+	flags := os.O_CREATE | os.O_APPEND | os.O_WRONLY
+	if c.logPath == "" {
+		c.logPath = filepath.Join(c.Cfg.RuntimeDir, logFileName)
+		os.Rename(c.logPath, c.logPath+".1")
+		flags |= os.O_TRUNC
+	}
+	if c.logFile, err = os.OpenFile(c.logPath, flags, utils.FileMode); err != nil {
+		fmt.Printf("Failed to open log file '%v': %v\n", c.logPath, err)
+	} else {
 		logWriters = append(logWriters, c.logFile)
 	}
 	if !c.logQuiet {
 		logWriters = append(logWriters, os.Stdout)
 	}
+	if c.logLevel == "" {
+		c.logLevel = c.Cfg.LogLevel
+	}
+	if c.logLevel != "" {
+		l, err := utils.ParseLogLevel(c.logLevel)
+		if err != nil {
+			return err
+		}
+		utils.SetLogLevel(l)
+	}
 	if len(logWriters) == 0 {
 		log.SetOutput(ioutil.Discard)
 	} else {
@@ -222,14 +378,20 @@ func (c *Common) Run() error {
 		log.SetOutput(w)
 	}
 
+	if c.Cfg.RuntimeDirIsFallback {
+		utils.Warnf("ui: XDG_RUNTIME_DIR is not set, using: %v", c.Cfg.RuntimeDir)
+	}
+	if c.Cfg.DisableUpdate {
+		utils.Infof("ui: Auto-update disabled, the bundle will only be installed if missing.")
+	}
+
 	// Set sensible rlimits.
 	if err = sandbox.SetSensibleRlimits(); err != nil {
 		return err
 	}
 
-	// Acquire the lock file.
-	if c.lock, err = newLockFile(c); err != nil {
-		return err
+	if c.DryRun {
+		return c.DoDryRun(os.Stdout)
 	}
 
 	return nil
@@ -242,11 +404,26 @@ func (c *Common) Term() {
 		c.Cfg.Sync()
 	}
 
+	// Ensure that the browser is gone, if we are terminating early.
+	if c.Sandbox != nil {
+		c.Sandbox.Kill()
+		c.Sandbox = nil
+	}
+
 	if c.tor != nil {
 		c.tor.Shutdown()
 		c.tor = nil
 	}
 
+	if c.ReloadCh != nil {
+		signal.Stop(c.ReloadCh)
+	}
+
+	if c.status != nil {
+		c.status.Remove()
+		c.status = nil
+	}
+
 	if c.lock != nil {
 		c.lock.unlock()
 		c.lock = nil
@@ -258,6 +435,10 @@ func (c *Common) NeedsInstall() bool {
 	if c.Manif == nil {
 		return true
 	}
+	if c.Cfg.DisableUpdate {
+		// Whatever is installed is what the user wants.
+		return false
+	}
 	if c.Manif.Architecture != c.Cfg.Architecture {
 		return true
 	}
@@ -267,6 +448,9 @@ func (c *Common) NeedsInstall() bool {
 	if c.Manif.Locale != c.Cfg.Locale {
 		return true
 	}
+	if c.Cfg.PinnedVersion != "" && c.Manif.Version != c.Cfg.PinnedVersion {
+		return true
+	}
 	return false
 }
 
@@ -293,25 +477,50 @@ func (c *Common) launchTor(async *Async, onlySystem bool) error {
 		}
 	}()
 
+	c.status.SetState(status.StateBootstrapping)
+	async.BootstrapProgress = c.status.SetBootstrapProgress
+	defer func() {
+		async.BootstrapProgress = nil
+	}()
+
 	if c.tor != nil && !c.NoKillTor {
-		log.Printf("launch: Shutting down old tor.")
+		utils.Infof("launch: Shutting down old tor.")
 		c.tor.Shutdown()
 		c.tor = nil
 	}
 
 	if c.tor != nil && c.NoKillTor {
 		// Only the first re-launch should be skipped.
-		log.Printf("launch: Reusing old tor.")
+		utils.Infof("launch: Reusing old tor.")
 		c.NoKillTor = false
 	} else if c.Cfg.UseSystemTor {
+		if c.Cfg.Tor.StreamIsolation {
+			utils.Infof("launch: Stream isolation is ignored with a system tor.")
+		}
 		if c.tor, err = tor.NewSystemTor(c.Cfg); err != nil {
 			async.Err = err
 			return err
 		}
 	} else if !onlySystem {
+		// Launch the pluggable transport in it's own sandbox, if required.
+		var pt *sandbox.PluggableTransport
+		var ptMethods map[string]string
+		if c.Cfg.Tor.UseBridges {
+			async.UpdateProgress("Launching pluggable transport.")
+			if pt, err = sandbox.RunPluggableTransport(c.Cfg, c.Manif, config.TorTransports); err != nil {
+				async.Err = err
+				return err
+			}
+			ptMethods = pt.Methods
+		}
+		c.ptMethods = ptMethods
+
 		// Build the torrc.
-		torrc, err := tor.CfgToSandboxTorrc(c.Cfg, Bridges)
+		torrc, err := tor.CfgToSandboxTorrc(c.Cfg, Bridges, ptMethods)
 		if err != nil {
+			if pt != nil {
+				pt.Process.Kill()
+			}
 			async.Err = err
 			return err
 		}
@@ -321,13 +530,25 @@ func (c *Common) launchTor(async *Async, onlySystem bool) error {
 		async.UpdateProgress("Launching Tor executable.")
 		process, err := sandbox.RunTor(c.Cfg, c.Manif, torrc)
 		if err != nil {
+			if pt != nil {
+				pt.Process.Kill()
+			}
 			async.Err = err
 			return err
 		}
+		if pt != nil {
+			// The transport is only used by tor, so it goes away with tor.
+			process.AddTermHook(pt.Process.Kill)
+		}
 
 		async.UpdateProgress("Waiting on Tor bootstrap.")
 		c.tor = tor.NewSandboxedTor(c.Cfg, process)
 		if err = c.tor.DoBootstrap(c.Cfg, async); err != nil {
+			if pt != nil {
+				if ptErr := pt.Exited(); ptErr != nil {
+					err = ptErr
+				}
+			}
 			async.Err = err
 			return err
 		}
@@ -354,74 +575,93 @@ func (l *lockFile) unlock() {
 	defer l.f.Close()
 }
 
+// newLockFile acquires the instance lock, and records the PID of the current
+// process in the lock file.  The lock is a flock(2) lock, so it is released by
+// the kernel if the process terminates uncleanly, and a leftover lock file
+// from a crashed instance will simply be reused.  The runtime directory that
+// holds the lock file is created if needed.
 func newLockFile(c *Common) (*lockFile, error) {
-	const lockFileName = "lock"
+	// MkdirAll succeeds if a concurrent launch created the directory first,
+	// and whichever instance loses the race for the lock fails on the
+	// flock(2) below, so there is only one way to fail.
+	if err := utils.MkdirAllPrivate(c.Cfg.RuntimeDir); err != nil {
+		return nil, err
+	}
 
 	l := new(lockFile)
 	p := filepath.Join(c.Cfg.RuntimeDir, lockFileName)
 
 	var err error
-	if l.f, err = os.OpenFile(p, os.O_CREATE, utils.FileMode); err != nil {
+	if l.f, err = os.OpenFile(p, os.O_CREATE|os.O_RDWR|syscall.O_NOFOLLOW|syscall.O_CLOEXEC, utils.FileMode); err != nil {
 		return nil, err
 	}
 
 	fd := int(l.f.Fd())
 	if err = syscall.Flock(fd, syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		defer l.f.Close()
 		if err == syscall.EWOULDBLOCK {
+			if b, err := ioutil.ReadAll(l.f); err == nil {
+				if pid, err := strconv.Atoi(strings.TrimSpace(string(b))); err == nil && pid > 0 {
+					return nil, fmt.Errorf("`sandboxed-tor-browser` is already running (pid %d)", pid)
+				}
+			}
 			return nil, fmt.Errorf("`sandboxed-tor-browser` is already running")
 		}
 		return nil, err
 	}
 
+	// Record the PID of the lock holder.
+	if err = l.f.Truncate(0); err == nil {
+		_, err = fmt.Fprintf(l.f, "%d\n", os.Getpid())
+	}
+	if err != nil {
+		l.f.Close()
+		return nil, err
+	}
+
 	return l, nil
 }
 
-// ValidateBridgeLines validates and sanitizes bridge lines.
-func ValidateBridgeLines(ls string) (string, error) {
-	var ret []string
-
-	for _, l := range strings.Split(ls, "\n") {
-		l = strings.TrimSpace(l)
-		if len(l) == 0 {
-			continue
-		}
-		sp := strings.Split(l, " ")
-		if len(sp) == 0 {
-			continue
-		}
-		if strings.ToLower(sp[0]) == "bridge" { // Assume well formed...
-			ret = append(ret, l)
-			continue
-		}
+const (
+	httpDialTimeout           = 60 * time.Second
+	httpResponseHeaderTimeout = 60 * time.Second
+	httpStallTimeout          = 2 * time.Minute
+)
 
-		// XXX: This obliterates the user's changes if there's an error,
-		// which is probably likely somewhat obnoxious.
+// withDialTimeout wraps dialFn such that it fails if a connection (including
+// the TLS handshake, if any) is not established within timeout.  Not all of
+// the dialers support deadlines (Eg: the tor SOCKS dialer), so the dial is
+// abandoned rather than canceled, and late connections are closed.
+func withDialTimeout(dialFn dialFunc, timeout time.Duration) dialFunc {
+	if dialFn == nil {
+		return nil
+	}
 
-		// Validate that there is at least either:
-		if ip, _, err := net.SplitHostPort(sp[0]); err != nil {
-			if net.ParseIP(sp[0]) != nil {
-				return "", fmt.Errorf("invalid Bridge: '%v', missing port", l)
-			}
-			if Bridges[sp[0]] == nil {
-				return "", fmt.Errorf("invalid Bridge: '%v', unknown transport: %v", l, sp[0])
-			}
-			if len(sp) < 2 {
-				return "", fmt.Errorf("invalid Bridge: '%v', missing IP", l)
-			}
-			if ip, _, err = net.SplitHostPort(sp[1]); err != nil {
-				return "", fmt.Errorf("invalid Bridge: '%v', bad IP/port", l)
-			} else if net.ParseIP(ip) == nil {
-				return "", fmt.Errorf("invalid Bridge: '%v'", l)
-			}
-		} else if net.ParseIP(ip) == nil { // Or a host:port.
-			return "", fmt.Errorf("invalid Bridge IP/port: %v", sp[0])
+	type dialResult struct {
+		conn net.Conn
+		err  error
+	}
+	return func(network, addr string) (net.Conn, error) {
+		ch := make(chan dialResult, 1)
+		go func() {
+			conn, err := dialFn(network, addr)
+			ch <- dialResult{conn, err}
+		}()
+
+		t := time.NewTimer(timeout)
+		defer t.Stop()
+		select {
+		case r := <-ch:
+			return r.conn, r.err
+		case <-t.C:
+			go func() {
+				if r := <-ch; r.conn != nil {
+					r.conn.Close()
+				}
+			}()
+			return nil, fmt.Errorf("dial %v %v: timed out after %v", network, addr, timeout)
 		}
-
-		// BridgeDB entries lack the "Bridge".
-		ret = append(ret, "Bridge "+l)
 	}
-
-	return strings.Join(ret, "\n"), nil
 }
 
 func newGrabClient(dialFn dialFunc, dialTLSFn dialFunc) *grab.Client {
@@ -429,13 +669,23 @@ func newGrabClient(dialFn dialFunc, dialTLSFn dialFunc) *grab.Client {
 	client := grab.NewClient()
 	client.UserAgent = ""
 	client.HTTPClient.Transport = &http.Transport{
-		Proxy:   nil,
-		Dial:    dialFn,
-		DialTLS: dialTLSFn,
+		Proxy:                 nil,
+		Dial:                  withDialTimeout(dialFn, httpDialTimeout),
+		DialTLS:               withDialTimeout(dialTLSFn, httpDialTimeout),
+		TLSHandshakeTimeout:   httpDialTimeout,
+		ResponseHeaderTimeout: httpResponseHeaderTimeout,
 	}
 	return client
 }
 
+// setDownloadTimeouts applies the configured per-transfer deadline and the
+// stall timeout to async.  A transfer that times out fails with a regular
+// error, so that the next mirror (if any) is tried.
+func (c *Common) setDownloadTimeouts(async *Async) {
+	async.Deadline = c.Cfg.DownloadDeadline()
+	async.StallTimeout = httpStallTimeout
+}
+
 func newHPKPGrabClient(dialFn dialFunc) *grab.Client {
 	dialConf := &hpkp.DialerConfig{
 		Storage:   installer.StaticHPKPPins,
@@ -448,33 +698,33 @@ func newHPKPGrabClient(dialFn dialFunc) *grab.Client {
 
 func init() {
 	BundleChannels = make(map[string][]string)
-	if d, err := data.Asset("ui/channels.json"); err != nil {
+	if d, err := data.Load("ui/channels.json"); err != nil {
 		panic(err)
 	} else if err = json.Unmarshal(d, &BundleChannels); err != nil {
 		panic(err)
 	}
 
 	BundleLocales = make(map[string][]string)
-	if d, err := data.Asset("ui/locales.json"); err != nil {
+	if d, err := data.Load("ui/locales.json"); err != nil {
 		panic(err)
 	} else if err = json.Unmarshal(d, &BundleLocales); err != nil {
 		panic(err)
 	}
 
 	Bridges = make(map[string][]string)
-	if d, err := data.Asset("bridges.json"); err != nil {
+	if d, err := data.Load("bridges.json"); err != nil {
 		panic(err)
 	} else if err = json.Unmarshal(d, &Bridges); err != nil {
 		panic(err)
 	}
 
-	if d, err := data.Asset("version"); err != nil {
+	if d, err := data.Load("version"); err != nil {
 		panic(err)
 	} else {
 		Version = strings.TrimSpace(string(d))
 	}
 
-	if d, err := data.Asset("revision"); err != nil {
+	if d, err := data.Load("revision"); err != nil {
 		panic(err)
 	} else {
 		Revision = strings.TrimSpace(string(d))
@@ -0,0 +1,49 @@
+// ui_test.go - Common user interface tests.
+// Copyright (C) 2016  Yawning Angel.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package ui
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestPreParseFlag(t *testing.T) {
+	for _, v := range []struct {
+		args     string
+		name     string
+		expected string
+		isSet    bool
+	}{
+		{"--profile-name foo", "profile-name", "foo", true},
+		{"-profile-name=foo --dry-run", "profile-name", "foo", true},
+		{"--profile-name foo --dry-run", "dry-run", "true", true},
+		{"--dry-run=false", "dry-run", "false", true},
+		{"--debug --dry-run", "dry-run", "true", true},
+		{"", "profile-name", "", false},
+		{"--log-file dry-run", "dry-run", "", false},
+		{"--log-file --profile-name foo", "profile-name", "", false},
+		{"-q -l --dry-run", "dry-run", "", false},
+		{"--profile-name dry-run", "dry-run", "", false},
+		{"install --dry-run", "dry-run", "", false},
+		{"-- --dry-run", "dry-run", "", false},
+		{"--not-a-flag --dry-run", "dry-run", "", false},
+	} {
+		if s, ok := preParseFlag(strings.Fields(v.args), v.name); s != v.expected || ok != v.isSet {
+			t.Errorf("%q: preParseFlag(%v) = %q, %v, expected %q, %v", v.args, v.name, s, ok, v.expected, v.isSet)
+		}
+	}
+}
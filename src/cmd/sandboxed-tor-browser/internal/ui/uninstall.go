@@ -0,0 +1,132 @@
+// uninstall.go - Launcher uninstallation.
+// Copyright (C) 2017  Yawning Angel.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package ui
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"cmd/sandboxed-tor-browser/internal/installer"
+	"cmd/sandboxed-tor-browser/internal/ui/config"
+)
+
+// DoUninstall removes the installed bundle (and any backup or staging copy
+// of it), the manifest, and the runtime directory (including the lock file),
+// and writes what was removed to w.
+// If purge is set, the rest of the user data (the browser profile and the
+// tor state) and the config are removed as well, though the config is kept
+// if it is shared with other instance profiles.  It fails if another
+// instance is running.
+func (c *Common) DoUninstall(w io.Writer, purge bool) error {
+	// The lock is held for the duration, so that an instance can't be
+	// launched while things are being removed out from under it.
+	lock, err := newLockFile(c)
+	if err != nil {
+		return err
+	}
+	defer lock.unlock()
+
+	nrRemoved := 0
+	remove := func(p string) error {
+		if _, err := os.Lstat(p); err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if err := os.RemoveAll(p); err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "Removed: %v\n", p)
+		nrRemoved++
+		return nil
+	}
+
+	// Directories that the user explicitly configured may contain things
+	// that were not created by the launcher, and the default instance's
+	// directories may contain the named instance profiles, so those are
+	// only removed if they are empty once everything known is gone.
+	removeDir := func(d string, isOverride bool, known []string) error {
+		if !isOverride && !(c.Cfg.ProfileName == "" && config.HasNamedProfiles(d)) {
+			return remove(d)
+		}
+		for _, v := range known {
+			if err := remove(v); err != nil {
+				return err
+			}
+		}
+		if err := os.Remove(d); err == nil {
+			fmt.Fprintf(w, "Removed: %v\n", d)
+			nrRemoved++
+		} else if !os.IsNotExist(err) {
+			fmt.Fprintf(w, "Kept non-empty directory: %v\n", d)
+		}
+		return nil
+	}
+
+	for _, v := range config.ManifestPaths(c.Cfg) {
+		if err = remove(v); err != nil {
+			return err
+		}
+	}
+	c.Manif = nil
+
+	// This includes the previous install kept for rollback, and any partial
+	// extraction left over from an interrupted install.
+	removed, err := installer.RemoveBundle(c.Cfg)
+	for _, v := range removed {
+		fmt.Fprintf(w, "Removed: %v\n", v)
+		nrRemoved++
+	}
+	if err != nil {
+		return err
+	}
+
+	runtimeKnown := []string{
+		filepath.Join(c.Cfg.RuntimeDir, lockFileName),
+		filepath.Join(c.Cfg.RuntimeDir, logFileName),
+		filepath.Join(c.Cfg.RuntimeDir, logFileName+".1"),
+	}
+	if err = removeDir(c.Cfg.RuntimeDir, c.Cfg.RuntimeDirOverride != "", runtimeKnown); err != nil {
+		return err
+	}
+
+	if purge {
+		dataKnown := []string{c.Cfg.TorDataDir, c.Cfg.ProfileDir}
+		if err = removeDir(c.Cfg.UserDataDir, c.Cfg.DataDirOverride != "", dataKnown); err != nil {
+			return err
+		}
+		if c.Cfg.ProfileName != "" || config.HasNamedProfiles(c.Cfg.UserDataDir) {
+			// The config is shared by all of the instance profiles.
+			fmt.Fprintf(w, "Kept the config, as it is shared with other instance profiles.\n")
+		} else if err = remove(c.Cfg.ConfigDir); err != nil {
+			return err
+		} else {
+			// Don't re-create the config file on termination.
+			c.Cfg.ResetDirty()
+		}
+	} else {
+		fmt.Fprintf(w, "Kept the browser profile and the config, use `--purge` to remove them as well.\n")
+	}
+
+	if nrRemoved == 0 {
+		fmt.Fprintf(w, "Nothing to remove.\n")
+	}
+	return nil
+}
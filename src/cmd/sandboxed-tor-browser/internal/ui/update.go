@@ -21,20 +21,21 @@ import (
 	"crypto/sha512"
 	"encoding/hex"
 	"fmt"
-	"log"
 	"time"
 
 	"cmd/sandboxed-tor-browser/internal/installer"
 	"cmd/sandboxed-tor-browser/internal/sandbox"
 	"cmd/sandboxed-tor-browser/internal/tor"
 	. "cmd/sandboxed-tor-browser/internal/ui/async"
+	"cmd/sandboxed-tor-browser/internal/ui/status"
+	"cmd/sandboxed-tor-browser/internal/utils"
 )
 
 // CheckUpdate queries the update server to see if an update for the current
 // bundle is available.
 func (c *Common) CheckUpdate(async *Async) *installer.UpdateEntry {
 	// Check for updates.
-	log.Printf("update: Checking for updates.")
+	utils.Infof("update: Checking for updates.")
 	async.UpdateProgress("Checking for updates.")
 
 	// Create the async HTTP client.
@@ -49,18 +50,19 @@ func (c *Common) CheckUpdate(async *Async) *installer.UpdateEntry {
 	}
 
 	client := newHPKPGrabClient(dialFn)
+	c.setDownloadTimeouts(async)
 
 	// Determine where the update metadata should be fetched from.
 	updateURLs := []string{}
 	for _, b := range []bool{true, false} { // Prioritize .onions.
 		if url, err := installer.UpdateURL(c.Manif, b); err != nil {
-			log.Printf("update: Failed to get update URL (onion: %v): %v", b, err)
+			utils.Warnf("update: Failed to get update URL (onion: %v): %v", b, err)
 		} else {
 			updateURLs = append(updateURLs, url)
 		}
 	}
 	if len(updateURLs) == 0 {
-		log.Printf("update: Failed to find any update URLs")
+		utils.Warnf("update: Failed to find any update URLs")
 		async.Err = fmt.Errorf("failed to find any update URLs")
 		return nil
 	}
@@ -69,15 +71,15 @@ func (c *Common) CheckUpdate(async *Async) *installer.UpdateEntry {
 	var update *installer.UpdateEntry
 	fetchOk := false
 	for _, url := range updateURLs {
-		log.Printf("update: Metadata URL: %v", url)
+		utils.Infof("update: Metadata URL: %v", url)
 		async.Err = nil // Clear errors per fetch.
 		if b := async.Grab(client, url, nil); async.Err == ErrCanceled {
 			return nil
 		} else if async.Err != nil {
-			log.Printf("update: Metadata download failed: %v", async.Err)
+			utils.Warnf("update: Metadata download failed: %v", async.Err)
 			continue
 		} else if update, async.Err = installer.GetUpdateEntry(b); async.Err != nil {
-			log.Printf("update: Metadata parse failed: %v", async.Err)
+			utils.Warnf("update: Metadata parse failed: %v", async.Err)
 			continue
 		}
 		fetchOk = true
@@ -95,14 +97,18 @@ func (c *Common) CheckUpdate(async *Async) *installer.UpdateEntry {
 
 	// If there is an update, tag the installed bundle as stale...
 	if update == nil {
-		log.Printf("update: Installed bundle is current.")
+		utils.Infof("update: Installed bundle is current.")
 		c.Cfg.SetForceUpdate(false)
 	} else if !c.Manif.BundleUpdateVersionValid(update.AppVersion) {
-		log.Printf("update: Update server provided a downgrade: '%v'", update.AppVersion)
+		utils.Infof("update: Update server provided a downgrade: '%v'", update.AppVersion)
 		async.Err = fmt.Errorf("update server provided a downgrade: '%v'", update.AppVersion)
 		return nil
+	} else if c.Cfg.IsPastPinnedVersion(update.AppVersion) {
+		utils.Infof("update: Version %v is available, but the bundle is pinned to %v.", update.DisplayVersion, c.Cfg.PinnedVersion)
+		c.Cfg.SetForceUpdate(false)
+		update = nil
 	} else {
-		log.Printf("update: Installed bundle needs updating.")
+		utils.Infof("update: Installed bundle needs updating.")
 		c.Cfg.SetForceUpdate(true)
 	}
 	c.Cfg.SetLastUpdateCheck(checkAt)
@@ -133,16 +139,17 @@ func (c *Common) FetchUpdate(async *Async, patch *installer.Patch) []byte {
 	}
 
 	// Download the MAR file.
-	log.Printf("update: Downloading %v", patch.Url)
+	utils.Infof("update: Downloading %v", patch.Url)
 	async.UpdateProgress("Downloading Tor Browser Update.")
 
 	var mar []byte
 	client := newHPKPGrabClient(dialFn)
+	c.setDownloadTimeouts(async)
 	if mar = async.Grab(client, patch.Url, func(s string) { async.UpdateProgress(fmt.Sprintf("Downloading Tor Browser Update: %s", s)) }); async.Err != nil {
 		return nil
 	}
 
-	log.Printf("update: Validating Tor Browser Update.")
+	utils.Infof("update: Validating Tor Browser Update.")
 	async.UpdateProgress("Validating Tor Browser Update.")
 
 	// Validate the size against that listed in the XML file.
@@ -177,7 +184,10 @@ func (c *Common) FetchUpdate(async *Async, patch *installer.Patch) []byte {
 	return mar
 }
 
-func (c *Common) doUpdate(async *Async) {
+// doUpdate checks for, and applies updates as needed.  On failure, the
+// return value indicates if the installed bundle was left untouched, and thus
+// can still be used.
+func (c *Common) doUpdate(async *Async) (bundleIntact bool) {
 	// This attempts to follow the process that Firefox uses to check for
 	// updates.  https://wiki.mozilla.org/Software_Update:Checking_For_Updates
 
@@ -197,18 +207,20 @@ func (c *Common) doUpdate(async *Async) {
 			// Something either broke, or the bundle is up to date.  The caller
 			// needs to check async.Err, and either way there's nothing more that
 			// can be done.
-			return
+			return true
 		}
 		c.PendingUpdate = nil
 	}
 
+	c.status.SetState(status.StateUpdating)
+
 	// Figure out the best MAR to download.
 	patches := make(map[string]*installer.Patch)
 	for i := 0; i < len(update.Patch); i++ {
 		v := &update.Patch[i]
 		if patches[v.Type] != nil {
 			async.Err = fmt.Errorf("duplicate patch entry for kind: '%v'", v.Type)
-			return
+			return true
 		}
 		patches[v.Type] = v
 	}
@@ -220,6 +232,7 @@ func (c *Common) doUpdate(async *Async) {
 	patchTypes = append(patchTypes, patchComplete)
 
 	// Cycle through the patch types, and apply the "best" one.
+	bundleIntact = true
 	nrAttempts := 0
 	for _, patchType := range patchTypes {
 		async.Err = nil
@@ -232,9 +245,9 @@ func (c *Common) doUpdate(async *Async) {
 		nrAttempts++
 		mar := c.FetchUpdate(async, patch)
 		if async.Err == ErrCanceled {
-			return
+			return bundleIntact
 		} else if async.Err != nil {
-			log.Printf("update: Failed to fetch update: %v", async.Err)
+			utils.Warnf("update: Failed to fetch update: %v", async.Err)
 			continue
 		}
 		if mar == nil {
@@ -243,23 +256,25 @@ func (c *Common) doUpdate(async *Async) {
 
 		// Shutdown the old tor now.
 		if c.tor != nil {
-			log.Printf("update: Shutting down old tor.")
+			utils.Infof("update: Shutting down old tor.")
 			c.tor.Shutdown()
 			c.tor = nil
 		}
 
 		// Apply the update.
-		log.Printf("update: Updating Tor Browser.")
+		utils.Infof("update: Updating Tor Browser.")
 		async.UpdateProgress("Updating Tor Browser.")
 
 		async.ToUI <- false //  Lock out canceling.
 
+		// A failed update may leave the bundle in an indeterminate state.
+		bundleIntact = false
 		if async.Err = sandbox.RunUpdate(c.Cfg, mar); async.Err != nil {
-			log.Printf("update: Failed to apply update: %v", async.Err)
+			utils.Warnf("update: Failed to apply update: %v", async.Err)
 			if patchType == patchPartial {
 				c.Cfg.SetSkipPartialUpdate(true)
 				if async.Err = c.Cfg.Sync(); async.Err != nil {
-					return
+					return false
 				}
 			}
 			async.ToUI <- true // Unlock canceling.
@@ -271,30 +286,32 @@ func (c *Common) doUpdate(async *Async) {
 
 		// Reinstall the autoconfig stuff.
 		if async.Err = writeAutoconfig(c.Cfg); async.Err != nil {
-			return
+			return false
 		}
 
 		// Update the maniftest and config.
 		c.Manif.SetVersion(update.AppVersion)
 		if async.Err = c.Manif.Sync(); async.Err != nil {
-			return
+			return false
 		}
+		c.status.SetVersion(update.AppVersion)
 		c.Cfg.SetForceUpdate(false)
 		c.Cfg.SetSkipPartialUpdate(false)
 		if async.Err = c.Cfg.Sync(); async.Err != nil {
-			return
+			return false
 		}
 
 		async.ToUI <- true // Unlock canceling.
 
 		// Restart tor if we launched it.
 		if !c.Cfg.UseSystemTor {
-			log.Printf("launch: Reconnecting to the Tor network.")
+			utils.Infof("launch: Reconnecting to the Tor network.")
 			async.UpdateProgress("Reconnecting to the Tor network.")
 			async.Err = c.launchTor(async, false)
 		}
 
-		return
+		// The bundle is updated, any failure relaunching tor is unrelated.
+		return true
 	}
 
 	if nrAttempts == 0 {
@@ -302,5 +319,5 @@ func (c *Common) doUpdate(async *Async) {
 	} else if async.Err != ErrCanceled {
 		async.Err = fmt.Errorf("failed to apply all possible MAR files")
 	}
-	return
+	return bundleIntact
 }
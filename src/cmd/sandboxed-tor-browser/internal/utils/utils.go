@@ -19,8 +19,11 @@ package utils
 
 import (
 	"flag"
+	"fmt"
 	"log"
 	"os"
+	"path/filepath"
+	"strings"
 )
 
 const (
@@ -56,13 +59,103 @@ func FileExists(f string) bool {
 	return true
 }
 
-// Debugf logs at the debug level.
-func Debugf(format string, v ...interface{}) {
-	if enableDebugSpew {
+// MkdirAllPrivate creates the directory d (and any missing parents) like
+// os.MkdirAll, and then forces the permissions of d to DirMode, as the mode
+// passed to os.MkdirAll is subject to the umask, and does not apply to an
+// existing directory.  Missing parents are created the same way, as a
+// restrictive umask (Eg: 0277) would otherwise leave them unwritable.
+// Failing to enforce the permissions is logged, but is not treated as an
+// error.
+func MkdirAllPrivate(d string) error {
+	if parent := filepath.Dir(d); parent != d {
+		if _, err := os.Stat(parent); os.IsNotExist(err) {
+			if err = MkdirAllPrivate(parent); err != nil {
+				return err
+			}
+		}
+	}
+	if err := os.MkdirAll(d, DirMode); err != nil {
+		return err
+	}
+	if err := os.Chmod(d, DirMode.Perm()); err != nil {
+		Warnf("utils: Failed to set the permissions of '%v': %v", d, err)
+		return nil
+	}
+	if fi, err := os.Stat(d); err != nil {
+		Warnf("utils: Failed to verify the permissions of '%v': %v", d, err)
+	} else if mode := fi.Mode().Perm(); mode != DirMode.Perm() {
+		Warnf("utils: '%v' has permissions %v, instead of %v", d, mode, DirMode.Perm())
+	}
+	return nil
+}
+
+// LogLevel is a logging level.
+type LogLevel int
+
+const (
+	// LogLevelDebug is the debug logging level.
+	LogLevelDebug LogLevel = iota
+
+	// LogLevelInfo is the informational logging level.
+	LogLevelInfo
+
+	// LogLevelWarn is the warning logging level.
+	LogLevelWarn
+
+	// LogLevelError is the error logging level.
+	LogLevelError
+)
+
+var logLevel = LogLevelInfo
+
+// ParseLogLevel returns the LogLevel corresponding to a string.
+func ParseLogLevel(s string) (LogLevel, error) {
+	switch strings.ToLower(s) {
+	case "debug":
+		return LogLevelDebug, nil
+	case "info":
+		return LogLevelInfo, nil
+	case "warn", "warning":
+		return LogLevelWarn, nil
+	case "error":
+		return LogLevelError, nil
+	default:
+		return LogLevelInfo, fmt.Errorf("invalid log level: '%v' (valid: debug, info, warn, error)", s)
+	}
+}
+
+// SetLogLevel sets the minimum level of the messages that are logged.  The
+// `--debug` flag always enables debug logging.
+func SetLogLevel(l LogLevel) {
+	logLevel = l
+}
+
+func logf(l LogLevel, format string, v ...interface{}) {
+	if l >= logLevel || (l == LogLevelDebug && enableDebugSpew) {
 		log.Printf(format, v...)
 	}
 }
 
+// Debugf logs at the debug level.
+func Debugf(format string, v ...interface{}) {
+	logf(LogLevelDebug, format, v...)
+}
+
+// Infof logs at the info level.
+func Infof(format string, v ...interface{}) {
+	logf(LogLevelInfo, format, v...)
+}
+
+// Warnf logs at the warning level.
+func Warnf(format string, v ...interface{}) {
+	logf(LogLevelWarn, format, v...)
+}
+
+// Errorf logs at the error level.
+func Errorf(format string, v ...interface{}) {
+	logf(LogLevelError, format, v...)
+}
+
 func init() {
 	flag.BoolVar(&enableDebugSpew, "debug", false, "Enable debug logging.")
 }
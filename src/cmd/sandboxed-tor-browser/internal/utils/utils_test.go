@@ -0,0 +1,91 @@
+// utils_test.go - Misc utility routine tests.
+// Copyright (C) 2016  Yawning Angel.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package utils
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func TestMkdirAllPrivate(t *testing.T) {
+	for _, v := range []struct {
+		name     string
+		umask    int
+		existing os.FileMode
+	}{
+		{"permissive umask", 0, 0},
+		{"default umask", 022, 0},
+		{"restrictive umask", 0277, 0},
+		{"existing world readable", 022, 0777},
+		{"existing unwritable", 022, 0500},
+	} {
+		base := t.TempDir()
+		d := filepath.Join(base, "a", "b")
+		if v.existing != 0 {
+			if err := os.MkdirAll(d, DirMode); err != nil {
+				t.Fatalf("%v: failed to create the directory: %v", v.name, err)
+			}
+			if err := os.Chmod(d, v.existing); err != nil {
+				t.Fatalf("%v: failed to set the permissions: %v", v.name, err)
+			}
+		}
+
+		oldMask := syscall.Umask(v.umask)
+		err := MkdirAllPrivate(d)
+		syscall.Umask(oldMask)
+		if err != nil {
+			t.Errorf("%v: MkdirAllPrivate() = %v", v.name, err)
+			continue
+		}
+
+		fi, err := os.Stat(d)
+		if err != nil {
+			t.Errorf("%v: failed to stat the directory: %v", v.name, err)
+		} else if !fi.IsDir() || fi.Mode().Perm() != DirMode.Perm() {
+			t.Errorf("%v: MkdirAllPrivate() mode = %v, expected %v", v.name, fi.Mode(), DirMode)
+		}
+		if v.existing == 0 {
+			// Created parents are private too, rather than left to the umask.
+			if fi, err = os.Stat(filepath.Dir(d)); err != nil {
+				t.Errorf("%v: failed to stat the parent: %v", v.name, err)
+			} else if fi.Mode().Perm() != DirMode.Perm() {
+				t.Errorf("%v: MkdirAllPrivate() parent mode = %v, expected %v", v.name, fi.Mode(), DirMode)
+			}
+		}
+
+		// Let t.TempDir() clean up directories the umask made unwritable.
+		filepath.Walk(base, func(path string, info os.FileInfo, err error) error {
+			if err == nil && info.IsDir() {
+				os.Chmod(path, 0700)
+			}
+			return nil
+		})
+	}
+}
+
+func TestMkdirAllPrivateNotDir(t *testing.T) {
+	fn := filepath.Join(t.TempDir(), "file")
+	if err := ioutil.WriteFile(fn, nil, FileMode); err != nil {
+		t.Fatalf("failed to create the file: %v", err)
+	}
+	if err := MkdirAllPrivate(fn); err == nil {
+		t.Errorf("MkdirAllPrivate(file) succeeded")
+	}
+}
@@ -17,15 +17,57 @@
 package main
 
 import (
+	"flag"
 	"log"
 	"os"
 	"os/signal"
 	"syscall"
 
+	"cmd/sandboxed-tor-browser/internal/sandbox"
+	"cmd/sandboxed-tor-browser/internal/sandbox/process"
+	sbui "cmd/sandboxed-tor-browser/internal/ui"
 	"cmd/sandboxed-tor-browser/internal/ui/gtk"
 )
 
+// allowRootFlag is the command line flag that allows running as root, which
+// is intentionally awkward to type.
+const allowRootFlag = "i-really-want-root"
+
+// checkFlag is the command line flag that runs the host environment
+// self-test.
+const checkFlag = "check"
+
+// hasFlag returns true if the boolean command line flag is set.  This is done
+// ahead of time since the flags are parsed long after the check is required.
+func hasFlag(name string) bool {
+	v, ok := sbui.PreParseFlag(name)
+	return ok && v == "true"
+}
+
 func main() {
+	// Refuse to run as root, since the sandbox is set up by this process,
+	// and an escape would have full control over the system.
+	flag.Bool(allowRootFlag, false, "Allow running as root (NOT RECOMMENDED).")
+	if os.Geteuid() == 0 && !hasFlag(allowRootFlag) {
+		log.Fatalf("refusing to run as root, as a sandbox escape would compromise the entire system (override with --%s)", allowRootFlag)
+	}
+
+	// The self-test is run before the UI is initialized, since the UI
+	// requires a working environment.
+	flag.Bool(checkFlag, false, "Check the host environment and exit.")
+	if hasFlag(checkFlag) {
+		if !sandbox.CheckHost(os.Stdout) {
+			os.Exit(1)
+		}
+		return
+	}
+
+	// Running in a container that breaks user namespaces is a common
+	// source of confusing bubblewrap failures, so say so up front.
+	if err := sandbox.CheckUserNamespaces(); err != nil {
+		log.Printf("warning: %v", err)
+	}
+
 	// Disable dumping core and ptrace().
 	if ret, _, err := syscall.Syscall6(syscall.SYS_PRCTL, syscall.PR_SET_DUMPABLE, 0, 0, 0, 0, 0); ret != 0 {
 		log.Fatalf("failed to disable core dumps: %v", err)
@@ -34,7 +76,7 @@ func main() {
 
 	// Install the signal handlers before initializing the UI.
 	sigCh := make(chan os.Signal, 1)
-	signal.Notify(sigCh, os.Interrupt, os.Kill, syscall.SIGTERM)
+	signal.Notify(sigCh, os.Interrupt, syscall.SIGTERM)
 
 	// Initialize the UI.
 	ui, err := gtk.Init()
@@ -44,20 +86,34 @@ func main() {
 	defer ui.Term()
 
 	// Launch the UI in a go routine so that clean up happens.
-	doneCh := make(chan interface{})
+	doneCh := make(chan error)
 	go func() {
-		defer func() { doneCh <- true }()
-		if err := ui.Run(); err != nil {
-			log.Printf("fatal error in the user interface: %v", err)
-		}
+		doneCh <- ui.Run()
 	}()
 
 	// Wait for the actual work to finish, or a fatal signal to be received.
+	exitCode := 0
 	select {
-	case _ = <-doneCh:
+	case err := <-doneCh:
 		// Goroutine terminated.
+		if ee, ok := err.(*process.ExitError); ok {
+			// Propagate the browser's exit status, so that scripts can
+			// detect crashes and sandbox setup failures.
+			log.Printf("tor browser %v", ee)
+			exitCode = ee.Code
+		} else if err != nil {
+			log.Printf("fatal error in the user interface: %v", err)
+			exitCode = 1
+		}
 	case sig := <-sigCh:
-		// Caught a signal handler.
+		// Caught a signal handler, clean up and exit.
 		log.Printf("exiting on signal: %v", sig)
+		exitCode = 1
+	}
+
+	// The deferred cleanup will not run on os.Exit().
+	if exitCode != 0 {
+		ui.Term()
+		os.Exit(exitCode)
 	}
 }